@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"time"
 
 	"github.com/jerbe/jim/log"
 
@@ -9,11 +10,16 @@ import (
 )
 
 type Config struct {
-	Main    Main    `yaml:"main"`
-	Http    Http    `yaml:"http"`
-	Redis   Redis   `yaml:"redis"`
-	MySQL   MySQL   `yaml:"mysql"`
-	MongoDB MongoDB `yaml:"mongodb"`
+	Main      Main      `yaml:"main"`
+	Http      Http      `yaml:"http"`
+	Redis     Redis     `yaml:"redis"`
+	MySQL     MySQL     `yaml:"mysql"`
+	MongoDB   MongoDB   `yaml:"mongodb"`
+	Websocket Websocket `yaml:"websocket"`
+	Chat      Chat      `yaml:"chat"`
+	Storage   Storage   `yaml:"storage"`
+	Media     Media     `yaml:"media"`
+	Search    Search    `yaml:"search"`
 }
 
 type Main struct {
@@ -56,6 +62,156 @@ type MongoDB struct {
 
 	// MainDB 主数据库名
 	MainDB string `yaml:"main_db"`
+
+	// DisableTransaction 不使用事务写入聊天消息
+	// 默认在副本集或分片集群上使用事务,单节点部署时自动不使用
+	DisableTransaction bool `yaml:"disable_transaction"`
+}
+
+type Websocket struct {
+	// SendQueueSize 每个连接的发送队列长度
+	SendQueueSize int `yaml:"send_queue_size"`
+
+	// OverflowPolicy 发送队列已满时的处理策略
+	// 支持:drop_oldest,disconnect,block
+	OverflowPolicy string `yaml:"overflow_policy"`
+
+	// BlockTimeout block策略下等待队列空位的最长时间
+	BlockTimeout time.Duration `yaml:"block_timeout"`
+
+	// WriteTimeout 单条消息写入连接的超时时间
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+
+	// PingInterval 服务端发送ping控制帧的间隔
+	PingInterval time.Duration `yaml:"ping_interval"`
+
+	// PongWait 等待客户端数据(包括pong)的最长时间,必须大于 PingInterval
+	PongWait time.Duration `yaml:"pong_wait"`
+
+	// MaxMessageSize 客户端单条消息的最大字节数
+	MaxMessageSize int64 `yaml:"max_message_size"`
+
+	// IdleTimeout 没有收到任何业务消息时的空闲超时时间,为0时不限制
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+type Chat struct {
+	// RollbackWindow 发送人可以撤回自己消息的时间窗口
+	RollbackWindow time.Duration `yaml:"rollback_window"`
+
+	// AdminRollbackWindow 群主跟管理员可以撤回群成员消息的时间窗口,为0时不限制
+	AdminRollbackWindow time.Duration `yaml:"admin_rollback_window"`
+
+	// EditWindow 发送人可以编辑自己文本消息的时间窗口
+	EditWindow time.Duration `yaml:"edit_window"`
+
+	// MaxTextLength 文本消息的最大字符数
+	MaxTextLength int `yaml:"max_text_length"`
+
+	// MediaHosts 媒体消息Src允许使用的域名,包含其子域名,为空时不限制
+	MediaHosts []string `yaml:"media_hosts"`
+
+	// MaxScheduleDelay 定时消息最多可以延后发送的时间
+	MaxScheduleDelay time.Duration `yaml:"max_schedule_delay"`
+
+	// MaxTTL 阅后即焚消息的最长有效期
+	MaxTTL time.Duration `yaml:"max_ttl"`
+
+	// ScheduleInterval 检查到期的定时消息跟阅后即焚消息的间隔
+	ScheduleInterval time.Duration `yaml:"schedule_interval"`
+
+	// ActionIDWindow 相同发送人使用相同ActionID重复发送时直接返回第一次发送结果的时间窗口
+	ActionIDWindow time.Duration `yaml:"action_id_window"`
+
+	// OutboxInterval 检查推送失败的消息并重新推送的间隔
+	OutboxInterval time.Duration `yaml:"outbox_interval"`
+
+	// RepairInterval 检查并修复房间跟消息不一致的间隔
+	RepairInterval time.Duration `yaml:"repair_interval"`
+
+	// ReactionEmojis 允许用于表情回应的表情,为空时允许所有标准emoji
+	ReactionEmojis []string `yaml:"reaction_emojis"`
+
+	// MaxReactions 每条消息最多可以有多少种不同的表情回应
+	MaxReactions int `yaml:"max_reactions"`
+}
+
+type Storage struct {
+	// Driver 存储驱动
+	// 支持:local,s3
+	Driver string `yaml:"driver"`
+
+	// Local 本地文件系统存储配置
+	Local LocalStorage `yaml:"local"`
+
+	// S3 兼容S3协议的对象存储配置
+	S3 S3Storage `yaml:"s3"`
+}
+
+type LocalStorage struct {
+	// Root 文件保存的根目录
+	Root string `yaml:"root"`
+}
+
+type S3Storage struct {
+	// Endpoint 服务地址; example: https://s3.ap-east-1.amazonaws.com
+	Endpoint string `yaml:"endpoint"`
+
+	// Region 区域
+	Region string `yaml:"region"`
+
+	// Bucket 存储桶
+	Bucket string `yaml:"bucket"`
+
+	// AccessKeyID 访问密钥ID
+	AccessKeyID string `yaml:"access_key_id"`
+
+	// SecretAccessKey 访问密钥
+	SecretAccessKey string `yaml:"secret_access_key"`
+
+	// PathStyle 是否使用路径风格的地址,MinIO等自建服务一般需要开启
+	PathStyle bool `yaml:"path_style"`
+}
+
+type Media struct {
+	// MaxSize 单个文件的最大字节数
+	MaxSize int64 `yaml:"max_size"`
+
+	// ChunkSize 分片上传时每个分片的字节数
+	ChunkSize int64 `yaml:"chunk_size"`
+
+	// AllowedTypes 允许上传的文件类型,按嗅探出的Content-Type前缀匹配
+	// 为空时只允许图片、音频、视频、PDF、ZIP跟纯文本
+	AllowedTypes []string `yaml:"allowed_types"`
+
+	// UploadExpire 分片上传会话的有效期
+	UploadExpire time.Duration `yaml:"upload_expire"`
+
+	// URLExpire 下载地址的有效期
+	URLExpire time.Duration `yaml:"url_expire"`
+
+	// SignKey 下载地址的签名密钥,为空时使用 main.jwt_signing_key
+	SignKey string `yaml:"sign_key"`
+
+	// BaseURL 生成下载地址使用的服务地址; example: https://im.example.com
+	BaseURL string `yaml:"base_url"`
+	// ThumbnailSizes 图片缩略图的最长边像素,会生成多个尺寸
+	ThumbnailSizes []int `yaml:"thumbnail_sizes"`
+
+	// MaxPixels 提取元数据时允许解码的图片最大像素数,防止解压炸弹
+	MaxPixels int64 `yaml:"max_pixels"`
+
+	// FFmpegPath 提取视频封面使用的ffmpeg路径,为空时从PATH中查找,找不到时只提取时长
+	FFmpegPath string `yaml:"ffmpeg_path"`
+
+	// Workers 提取元数据的后台任务数量
+	Workers int `yaml:"workers"`
+}
+
+type Search struct {
+	// Driver 搜索驱动
+	// 支持:mongo
+	Driver string `yaml:"driver"`
 }
 
 var _cfg Config
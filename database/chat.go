@@ -1,8 +1,10 @@
 package database
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/jerbe/jim/errors"
@@ -37,7 +39,7 @@ const (
 )
 
 const (
-	// 消息类型: 1-纯文本,2-图片,3-语音,4-视频, 5-位置
+	// 消息类型: 1-纯文本,2-图片,3-语音,4-视频, 5-位置,6-文件,7-表情贴纸,8-卡片,9-系统通知,10-自定义
 
 	// ChatMessageTypePlainText 文本类型
 	ChatMessageTypePlainText = 1
@@ -53,6 +55,79 @@ const (
 
 	// ChatMessageTypeLocation 位置类型
 	ChatMessageTypeLocation = 5
+
+	// ChatMessageTypeFile 文件类型
+	ChatMessageTypeFile = 6
+
+	// ChatMessageTypeSticker 表情贴纸类型
+	ChatMessageTypeSticker = 7
+
+	// ChatMessageTypeCard 卡片类型,链接卡片或者用户/群名片
+	ChatMessageTypeCard = 8
+
+	// ChatMessageTypeSystem 系统通知类型,只能由服务端生成
+	ChatMessageTypeSystem = 9
+
+	// ChatMessageTypeCustom 自定义类型,消息主体为应用自己定义的JSON数据
+	ChatMessageTypeCustom = 10
+
+	// ChatMessageTypeMerged 合并转发类型,消息主体中保存被转发消息的快照,只能通过转发接口生成
+	ChatMessageTypeMerged = 11
+)
+
+const (
+	// ChatMessageCardTypeLink 链接卡片
+	ChatMessageCardTypeLink = "link"
+
+	// ChatMessageCardTypeUser 用户名片
+	ChatMessageCardTypeUser = "user"
+
+	// ChatMessageCardTypeGroup 群名片
+	ChatMessageCardTypeGroup = "group"
+)
+
+const (
+	// ChatMessageSystemEventMemberJoined 群成员加入
+	ChatMessageSystemEventMemberJoined = "member_joined"
+
+	// ChatMessageSystemEventGroupRenamed 群名称修改
+	ChatMessageSystemEventGroupRenamed = "group_renamed"
+
+	// ChatMessageSystemEventAnnouncementUpdated 群公告更新
+	ChatMessageSystemEventAnnouncementUpdated = "announcement_updated"
+)
+
+const (
+	// ChatMessageReadStatusUnread 未读
+	ChatMessageReadStatusUnread = 0
+
+	// ChatMessageReadStatusRead 已读
+	ChatMessageReadStatusRead = 1
+)
+
+const (
+	// ChatMessageSendStatusSent 已发送
+	ChatMessageSendStatusSent = 1
+
+	// ChatMessageSendStatusUndelivered 未抵达
+	ChatMessageSendStatusUndelivered = 2
+
+	// ChatMessageSendStatusDelivered 已抵达
+	ChatMessageSendStatusDelivered = 3
+)
+
+const (
+	// ChatMessageStatusNormal 正常
+	ChatMessageStatusNormal = 1
+
+	// ChatMessageStatusDeleted 已删除
+	ChatMessageStatusDeleted = 2
+
+	// ChatMessageStatusRollback 已撤回
+	ChatMessageStatusRollback = 3
+
+	// ChatMessageStatusExpired 已过期,阅后即焚的消息到期后主体会被清空
+	ChatMessageStatusExpired = 4
 )
 
 const (
@@ -62,6 +137,9 @@ const (
 	// ChatMessageBodyFormatJPEG JPEG类型
 	ChatMessageBodyFormatJPEG = "jpeg"
 
+	// ChatMessageBodyFormatPNG PNG类型
+	ChatMessageBodyFormatPNG = "png"
+
 	// ChatMessageBodyFormatWEBP GIF类型
 	ChatMessageBodyFormatWEBP = "webp"
 
@@ -147,6 +225,48 @@ type ChatMessage struct {
 	// 消息主体
 	Body ChatMessageBody `bson:"body" json:"body"`
 
+	// ReplyTo 回复的消息快照
+	ReplyTo *ChatMessageQuote `bson:"reply_to,omitempty" json:"reply_to,omitempty"`
+
+	// ThreadID 所属话题的根消息ID,为0时表示不在话题中
+	ThreadID int64 `bson:"thread_id,omitempty" json:"thread_id,omitempty"`
+
+	// ThreadReplyCount 以该消息为根的话题回复数量
+	ThreadReplyCount int64 `bson:"thread_reply_count,omitempty" json:"thread_reply_count,omitempty"`
+
+	// ThreadRepliedAt 以该消息为根的话题最后回复时间
+	ThreadRepliedAt int64 `bson:"thread_replied_at,omitempty" json:"thread_replied_at,omitempty"`
+
+	// Mentions 被@的用户ID列表,只有群聊有效
+	Mentions []int64 `bson:"mentions,omitempty" json:"mentions,omitempty"`
+
+	// MentionAll 是否@所有人,只有群主跟管理员可以使用
+	MentionAll bool `bson:"mention_all,omitempty" json:"mention_all,omitempty"`
+
+	// Reactions 表情回应, key 为表情, value 为回应了该表情的用户ID列表
+	Reactions map[string][]int64 `bson:"reactions,omitempty" json:"reactions,omitempty"`
+
+	// EditedAt 最后编辑时间,为0时表示没有编辑过
+	EditedAt int64 `bson:"edited_at,omitempty" json:"edited_at,omitempty"`
+
+	// Revisions 编辑前的历史版本,按时间正序排列
+	Revisions []ChatMessageRevision `bson:"revisions,omitempty" json:"revisions,omitempty"`
+
+	// DeletedBy 删除了该消息的用户ID列表,只对这些用户隐藏
+	DeletedBy []int64 `bson:"deleted_by,omitempty" json:"deleted_by,omitempty"`
+
+	// ExpireAt 过期时间(毫秒),大于0时到期后对所有人清空消息主体
+	ExpireAt int64 `bson:"expire_at,omitempty" json:"expire_at,omitempty"`
+
+	// ScheduleID 定时消息的任务ID,有唯一索引,防止多个实例重复发送
+	ScheduleID string `bson:"schedule_id,omitempty" json:"schedule_id,omitempty"`
+
+	// ForwardFromID 逐条转发时原消息的发送人ID,不是转发的消息为0
+	ForwardFromID int64 `bson:"forward_from_id,omitempty" json:"forward_from_id,omitempty"`
+
+	// Outbox 待推送标记,推送成功后删除
+	Outbox *ChatMessageOutbox `bson:"outbox,omitempty" json:"-"`
+
 	// 消息发送时间, 要用时间戳?
 	CreatedAt int64 `bson:"created_at" json:"created_at"` // 消息时间
 
@@ -166,17 +286,83 @@ func (m *ChatMessage) UnmarshalBinary(data []byte) error {
 
 // ChatMessageBody 消息主体
 type ChatMessageBody struct {
-	// 文本信息。适用消息类型: 1
+	// 文本信息。适用消息类型: 1,9
 	Text string `bson:"text,omitempty" json:"text,omitempty"`
 
-	// 来源地址。通用字段，适用消息类型: 2,3,4
+	// 来源地址。通用字段，适用消息类型: 2,3,4,6,7
 	Src string `bson:"src,omitempty" json:"src,omitempty"`
 
-	// 文件格式。适用消息类型: 2,3,4
+	// 文件格式。适用消息类型: 2,3,4,7
 	Format string `bson:"format,omitempty" json:"format,omitempty"`
 
-	// 文件大小。适用消息类型: 2,3,4
-	Size string `bson:"size,omitempty" json:"size,omitempty"`
+	// 文件大小,单位字节。适用消息类型: 2,3,4,6
+	Size ChatMessageBodySize `bson:"size,omitempty" json:"size,omitempty"`
+
+	// 媒体文件ID,来源地址是本服务上传的文件时由服务端填写。适用消息类型: 2,3,4,6
+	MediaID string `bson:"media_id,omitempty" json:"media_id,omitempty"`
+
+	// 宽度,单位像素,由服务端提取。适用消息类型: 2,4
+	Width int `bson:"width,omitempty" json:"width,omitempty"`
+
+	// 高度,单位像素,由服务端提取。适用消息类型: 2,4
+	Height int `bson:"height,omitempty" json:"height,omitempty"`
+
+	// 模糊占位图的blurhash,由服务端提取。适用消息类型: 2,4
+	Blurhash string `bson:"blurhash,omitempty" json:"blurhash,omitempty"`
+
+	// 缩略图,按尺寸从小到大排列,由服务端生成。适用消息类型: 2
+	Thumbnails []ChatMessageThumbnail `bson:"thumbnails,omitempty" json:"thumbnails,omitempty"`
+
+	// 视频封面地址,旧数据中保存的是带签名的地址,现在读取时按 PosterVariant 签名。适用消息类型: 4
+	Poster string `bson:"poster,omitempty" json:"poster,omitempty"`
+
+	// 视频封面的标识,由服务端生成。适用消息类型: 4
+	PosterVariant string `bson:"poster_variant,omitempty" json:"poster_variant,omitempty"`
+
+	// 时长,单位毫秒,由服务端提取。适用消息类型: 4
+	Duration int64 `bson:"duration,omitempty" json:"duration,omitempty"`
+
+	// 文件名称。适用消息类型: 6
+	Name string `bson:"name,omitempty" json:"name,omitempty"`
+
+	// 文件MIME类型。适用消息类型: 6
+	Mime string `bson:"mime,omitempty" json:"mime,omitempty"`
+
+	// 表情贴纸ID。适用消息类型: 7
+	StickerID string `bson:"sticker_id,omitempty" json:"sticker_id,omitempty"`
+
+	// 表情贴纸所属的表情包ID。适用消息类型: 7
+	PackID string `bson:"pack_id,omitempty" json:"pack_id,omitempty"`
+
+	// 卡片类型, link-链接,user-用户名片,group-群名片。适用消息类型: 8
+	CardType string `bson:"card_type,omitempty" json:"card_type,omitempty"`
+
+	// 卡片标题。适用消息类型: 8
+	Title string `bson:"title,omitempty" json:"title,omitempty"`
+
+	// 卡片描述。适用消息类型: 8
+	Description string `bson:"description,omitempty" json:"description,omitempty"`
+
+	// 链接地址。适用消息类型: 8
+	URL string `bson:"url,omitempty" json:"url,omitempty"`
+
+	// 名片对应的用户ID或者群ID。适用消息类型: 8
+	TargetID int64 `bson:"target_id,omitempty" json:"target_id,omitempty"`
+
+	// 系统通知事件。适用消息类型: 9
+	Event string `bson:"event,omitempty" json:"event,omitempty"`
+
+	// 触发系统通知的用户ID。适用消息类型: 9
+	OperatorID int64 `bson:"operator_id,omitempty" json:"operator_id,omitempty"`
+
+	// 系统通知涉及的用户ID列表。适用消息类型: 9
+	UserIDs []int64 `bson:"user_ids,omitempty" json:"user_ids,omitempty"`
+
+	// 自定义消息的应用类型标识。适用消息类型: 10
+	CustomType string `bson:"custom_type,omitempty" json:"custom_type,omitempty"`
+
+	// 自定义消息的JSON数据,服务端不解析。适用消息类型: 10
+	Data string `bson:"data,omitempty" json:"data,omitempty"`
 
 	// 位置信息-经度。 适用消息类型: 5
 	Longitude string `bson:"longitude,omitempty" json:"longitude,omitempty"`
@@ -189,6 +375,61 @@ type ChatMessageBody struct {
 
 	// 位置信息标签。适用消息类型: 5
 	LocationLabel string `bson:"location_label,omitempty" json:"location_label,omitempty"`
+
+	// 合并转发的消息快照,按原消息的发送时间正序排列。适用消息类型: 11
+	Items []ChatMessageForwardItem `bson:"items,omitempty" json:"items,omitempty"`
+}
+
+// ChatMessageForwardItem 合并转发中的一条消息快照,保留原消息的发送人跟发送时间
+type ChatMessageForwardItem struct {
+	// SenderID 原消息的发送人ID
+	SenderID int64 `bson:"sender_id" json:"sender_id"`
+
+	// Type 原消息的类型
+	Type int `bson:"type" json:"type"`
+
+	// Body 原消息的主体
+	Body ChatMessageBody `bson:"body" json:"body"`
+
+	// CreatedAt 原消息的发送时间
+	CreatedAt int64 `bson:"created_at" json:"created_at"`
+}
+
+// ChatMessageThumbnail 图片消息的缩略图
+type ChatMessageThumbnail struct {
+	// Src 缩略图地址,旧数据中保存的是带签名的地址,现在读取时按 Variant 签名
+	Src string `bson:"src,omitempty" json:"src,omitempty"`
+
+	// Variant 缩略图的标识
+	Variant string `bson:"variant,omitempty" json:"variant,omitempty"`
+
+	// Width 宽度,单位像素
+	Width int `bson:"width" json:"width"`
+
+	// Height 高度,单位像素
+	Height int `bson:"height" json:"height"`
+}
+
+// ChatMessageQuote 被回复消息的快照
+// 保存发送时被回复消息的内容,被回复的消息之后再被修改也不影响快照
+type ChatMessageQuote struct {
+	// RoomID 被回复消息所在的房间号
+	RoomID string `bson:"room_id" json:"room_id"`
+
+	// MessageID 被回复的消息ID
+	MessageID int64 `bson:"message_id" json:"message_id"`
+
+	// SenderID 被回复消息的发送人ID
+	SenderID int64 `bson:"sender_id" json:"sender_id"`
+
+	// Type 被回复消息的类型
+	Type int `bson:"type" json:"type"`
+
+	// Body 被回复消息的主体,文本会被截断
+	Body ChatMessageBody `bson:"body" json:"body"`
+
+	// CreatedAt 被回复消息的发送时间
+	CreatedAt int64 `bson:"created_at" json:"created_at"`
 }
 
 // ChatRoom 聊天室房间数据
@@ -216,13 +457,47 @@ type ChatRoom struct {
 }
 
 // AddChatMessage 添加一条聊天消息
+// MongoDB 支持事务时使用事务写入;否则依次写入,中途失败留下的不一致由 RepairChatRoom 修复
 func AddChatMessage(msg *ChatMessage) error {
-	now := msg.CreatedAt
-	// mongo客户端
+	if MongoTransactionEnabled() {
+		return AddChatMessageTx(msg)
+	}
 
-	db := GlobDB.Mongo.Database(DatabaseMongodbIM)
+	err := addChatMessage(GlobCtx, GlobDB.Mongo.Database(DatabaseMongodbIM), msg)
+	if err != nil {
+		return err
+	}
+
+	pushLastChatMessageListCache(msg)
+	return nil
+}
+
+// AddChatMessageTx 使用事务添加一条聊天消息
+// 递增消息ID,保存消息跟更新最后一条消息要么全部成功,要么全部失败,不会留下空缺的消息ID
+func AddChatMessageTx(msg *ChatMessage) error {
+	txOpts := options.Transaction().SetWriteConcern(writeconcern.Majority()).SetReadConcern(readconcern.Snapshot())
+	err := GlobDB.Mongo.UseSession(GlobCtx, func(sessionCtx mongo.SessionContext) error {
+		// 遇到写冲突等临时错误时会重新执行整个事务
+		_, err := sessionCtx.WithTransaction(sessionCtx, func(txCtx mongo.SessionContext) (interface{}, error) {
+			return nil, addChatMessage(txCtx, txCtx.Client().Database(DatabaseMongodbIM), msg)
+		}, txOpts)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	// 缓存在事务提交后再更新,避免事务重试或回滚时缓存中留下不存在的消息
+	pushLastChatMessageListCache(msg)
+	return nil
+}
+
+// addChatMessage 递增房间的消息ID,保存消息并更新房间的最后一条消息
+// 在事务中调用时 ctx 为事务的 mongo.SessionContext
+func addChatMessage(ctx context.Context, db *mongo.Database, msg *ChatMessage) error {
+	now := msg.CreatedAt
 	srs := db.Collection(CollectionRoom).
-		FindOneAndUpdate(GlobCtx, bson.M{
+		FindOneAndUpdate(ctx, bson.M{
 			"room_id": msg.RoomID,
 		}, bson.M{
 			"$inc": bson.M{"last_message_id": 1},
@@ -245,16 +520,19 @@ func AddChatMessage(msg *ChatMessage) error {
 	msg.MessageID = room.LastMessageID
 
 	// 递增房间号的消息排列索引
-	rs, err := db.Collection(CollectionMessage).InsertOne(GlobCtx, msg)
+	rs, err := db.Collection(CollectionMessage).InsertOne(ctx, msg)
 	if err != nil {
-		// @TODO 推送到重试管道,进行重试插入
+		if msg.ScheduleID != "" && mongo.IsDuplicateKeyError(err) {
+			return errors.Wrap(ErrChatScheduleDelivered)
+		}
+		// 插入失败时直接返回错误,客户端使用相同的ActionID重试不会产生重复消息
 		return errors.Wrap(err)
 	}
 	msg.ID = rs.InsertedID.(primitive.ObjectID)
 
 	// 更新聊天室的最后一条消息
 	_, err = db.Collection(CollectionRoom).
-		UpdateOne(GlobCtx, bson.M{
+		UpdateOne(ctx, bson.M{
 			"room_id": msg.RoomID,
 			"$and": bson.A{
 				bson.M{
@@ -271,13 +549,13 @@ func AddChatMessage(msg *ChatMessage) error {
 				"last_message": msg,
 			},
 		})
-	if err != nil {
-		return errors.Wrap(err)
-	}
+	return errors.Wrap(err)
+}
 
-	// 将聊天数据推送到缓存定长队列中去
+// pushLastChatMessageListCache 将聊天数据推送到缓存定长队列中去
+func pushLastChatMessageListCache(msg *ChatMessage) {
 	cacheKey := cacheKeyFormatLastMessageList(msg.RoomID, msg.SessionType)
-	err = GlobCache.ZAdd(GlobCtx, cacheKey, driver.Z{Member: msg, Score: float64(msg.MessageID)}).Err()
+	err := GlobCache.ZAdd(GlobCtx, cacheKey, driver.Z{Member: msg, Score: float64(msg.MessageID)}).Err()
 	// 如果报错的话,直接删除缓存,因为有可能设置成empty模式
 	if err != nil {
 		GlobCache.Del(GlobCtx, cacheKey)
@@ -286,107 +564,88 @@ func AddChatMessage(msg *ChatMessage) error {
 	if err == nil {
 		GlobCache.Expire(GlobCtx, cacheKey, jcache.RandomExpirationDuration())
 	}
-
-	return nil
 }
 
-// AddChatMessageTx 使用事务添加一条聊天消息
-func AddChatMessageTx(msg *ChatMessage) error {
-	now := msg.CreatedAt
-	err := GlobDB.Mongo.UseSession(GlobCtx, func(sessionCtx mongo.SessionContext) error {
-		//
-		//t := time.Second
-		_, err := sessionCtx.WithTransaction(sessionCtx, func(ctxb mongo.SessionContext) (interface{}, error) {
-			// mongo客户端
-			db := ctxb.Client().Database(DatabaseMongodbIM)
-			srs := db.Collection(CollectionRoom).
-				FindOneAndUpdate(ctxb, bson.M{
-					"room_id": msg.RoomID,
-				}, bson.M{
-					"$inc": bson.M{"last_message_id": 1},
-					"$set": bson.M{
-						"updated_at": now,
-					},
-					"$setOnInsert": bson.M{
-						"session_type": msg.SessionType,
-						"created_at":   now,
-					},
-				}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After))
-			room := new(ChatRoom)
-			err := srs.Decode(room)
-			if err != nil {
-				return nil, errors.Wrap(err)
-			}
-
-			// 设置消息ID为递增的ID
-			msg.MessageID = room.LastMessageID
-
-			// 递增房间号的消息排列索引
-			rs, err := db.Collection(CollectionMessage).InsertOne(ctxb, msg)
-			if err != nil {
-				return nil, errors.Wrap(err)
-			}
-			msg.ID = rs.InsertedID.(primitive.ObjectID)
-
-			// 更新聊天室的最后一条消息
-			_, err = db.Collection(CollectionRoom).
-				UpdateOne(ctxb, bson.M{
-					"room_id": msg.RoomID,
-				}, bson.M{
-					"$set": bson.M{
-						"last_message": msg,
-					},
-				})
-			if err != nil {
-				return nil, errors.Wrap(err)
-			}
-
-			// 将聊天数据推送到缓存定长队列中去
-			cacheKey := cacheKeyFormatLastMessageList(msg.RoomID, msg.SessionType)
-			err = GlobCache.ZAdd(GlobCtx, cacheKey, driver.Z{Member: msg, Score: float64(msg.MessageID)}).Err()
-			// 如果报错的话,直接删除缓存,因为有可能设置成empty模式
-			if err != nil {
-				GlobCache.Del(GlobCtx, cacheKey)
-				log.Error().Err(err).Msgf("推送消息到缓存列表失败:\n %+v", err)
-			}
-			if err == nil {
-				GlobCache.Expire(GlobCtx, cacheKey, jcache.RandomExpirationDuration())
-			}
-
-			return nil, nil
-		}, options.Transaction().SetWriteConcern(writeconcern.Majority()).SetReadConcern(readconcern.Snapshot()))
-		if err != nil {
-			return errors.Wrap(err)
-		}
+// RollbackChatMessageFilter 撤回消息过滤器
+type RollbackChatMessageFilter struct {
+	// RoomID 房间ID
+	RoomID string
 
-		return nil
-	})
-	return errors.Wrap(err)
+	// SessionType 会话类型
+	SessionType int
+
+	// MessageID 消息ID
+	MessageID int64
+
+	// SenderID 大于0时只能撤回该发送人的消息
+	SenderID int64
+
+	// CreatedAfter 大于0时只能撤回该时间(毫秒)之后发送的消息
+	CreatedAfter int64
 }
 
-// RollbackChatMessage 撤回一条消息
-func RollbackChatMessage(roomID string, sessionType int, senderID, msgID int64) (bool, error) {
-	now := time.Now()
-	rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
-		Collection(CollectionMessage).
+// RollbackChatMessage 撤回一条消息,返回撤回后的消息
+// 没有符合条件的消息时返回 errors.NoRecords
+func RollbackChatMessage(filter *RollbackChatMessageFilter) (*ChatMessage, error) {
+	query := bson.M{
+		"room_id":      filter.RoomID,
+		"session_type": filter.SessionType,
+		"message_id":   filter.MessageID,
+		"status":       bson.M{"$nin": bson.A{ChatMessageStatusRollback, ChatMessageStatusExpired}},
+	}
+	if filter.SenderID > 0 {
+		query["sender_id"] = filter.SenderID
+	}
+	if filter.CreatedAfter > 0 {
+		query["created_at"] = bson.M{"$gt": filter.CreatedAfter}
+	}
+
+	now := time.Now().UnixMilli()
+	db := GlobDB.Mongo.Database(DatabaseMongodbIM)
+	msg := new(ChatMessage)
+	err := db.Collection(CollectionMessage).
+		FindOneAndUpdate(GlobCtx, query, bson.M{
+			"$set": bson.M{
+				"status":     ChatMessageStatusRollback,
+				"body":       ChatMessageBody{},
+				"updated_at": now,
+			},
+			"$unset": bson.M{"revisions": "", "reactions": ""},
+		}, options.FindOneAndUpdate().SetReturnDocument(options.After)).
+		Decode(msg)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	// 如果撤回的是房间的最后一条消息,同步更新房间中的副本,其他消息中的回复快照也要一起清空
+	_, err = db.Collection(CollectionRoom).
 		UpdateOne(GlobCtx, bson.M{
-			"room_id":      roomID,
-			"session_type": sessionType,
-			"message_id":   msgID,
-			"sender_id":    senderID,
-			"status":       bson.M{"$ne": 3},
-			"created_at":   bson.M{"$gt": now.Add(-2 * time.Minute).UnixMilli()}, // 2分钟内禁止撤回
+			"room_id":                 msg.RoomID,
+			"last_message.message_id": msg.MessageID,
 		}, bson.M{
 			"$set": bson.M{
-				"status":     3,
-				"updated_at": now.UnixMilli(),
+				"last_message.status":     ChatMessageStatusRollback,
+				"last_message.body":       ChatMessageBody{},
+				"last_message.updated_at": now,
 			},
 		})
 	if err != nil {
-		return false, errors.Wrap(err)
+		return nil, errors.Wrap(err)
 	}
 
-	return rs.ModifiedCount > 0, nil
+	_, err = db.Collection(CollectionMessage).
+		UpdateMany(GlobCtx, bson.M{
+			"reply_to.room_id":    msg.RoomID,
+			"reply_to.message_id": msg.MessageID,
+		}, bson.M{
+			"$set": bson.M{"reply_to.body": ChatMessageBody{}},
+		})
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	updateLastChatMessageListCache(msg)
+	return msg, nil
 }
 
 type GetChatMessageListOptions struct {
@@ -399,6 +658,14 @@ type GetChatMessageListOptions struct {
 	Limit int64
 }
 
+var (
+	// ChatMessageSortAsc 按消息ID正序排列
+	ChatMessageSortAsc = bson.M{"message_id": 1}
+
+	// ChatMessageSortDesc 按消息ID倒序排列
+	ChatMessageSortDesc = bson.M{"message_id": -1}
+)
+
 const (
 	defaultLimit     = 20
 	defaultLastLimit = 20
@@ -434,6 +701,30 @@ type GetChatMessageListFilter struct {
 	Sort          any    `bson:"sort"`
 	LastMessageID *int64 `bson:"last_message_id"`
 	Limit         *int   `bson:"limit"`
+
+	// UserID 查看消息的用户ID,设置后会排除该用户删除过的消息
+	UserID *int64 `bson:"user_id"`
+
+	// BeforeMessageID 只获取消息ID小于该值的消息
+	BeforeMessageID *int64 `bson:"before_message_id"`
+
+	// AfterMessageID 只获取消息ID大于该值的消息
+	AfterMessageID *int64 `bson:"after_message_id"`
+}
+
+func (f *GetChatMessageListFilter) SetBeforeMessageID(val int64) *GetChatMessageListFilter {
+	f.BeforeMessageID = &val
+	return f
+}
+
+func (f *GetChatMessageListFilter) SetAfterMessageID(val int64) *GetChatMessageListFilter {
+	f.AfterMessageID = &val
+	return f
+}
+
+func (f *GetChatMessageListFilter) SetUserID(val int64) *GetChatMessageListFilter {
+	f.UserID = &val
+	return f
 }
 
 func (f *GetChatMessageListFilter) SetLimit(val int) *GetChatMessageListFilter {
@@ -452,6 +743,8 @@ func (f *GetChatMessageListFilter) SetLastMessageID(val int64) *GetChatMessageLi
 }
 
 // GetChatMessageList 获取消息列表
+// 设置了 BeforeMessageID 或 AfterMessageID 时按游标获取最多 Limit 条消息,
+// 否则获取从 LastMessageID 开始的 Limit 个消息ID范围内的消息
 func GetChatMessageList(filter *GetChatMessageListFilter) ([]*ChatMessage, error) {
 	if filter.Sort == nil {
 		filter.Sort = bson.M{"message_id": -1}
@@ -465,16 +758,41 @@ func GetChatMessageList(filter *GetChatMessageListFilter) ([]*ChatMessage, error
 		filter.Limit = new(int)
 	}
 
+	query := bson.M{
+		"room_id":      filter.RoomID,
+		"session_type": filter.SessionType,
+	}
+	findOpts := options.Find().SetSort(filter.Sort)
+
+	if filter.BeforeMessageID != nil || filter.AfterMessageID != nil {
+		cond := bson.M{}
+		if filter.BeforeMessageID != nil {
+			cond["$lt"] = *filter.BeforeMessageID
+		}
+		if filter.AfterMessageID != nil {
+			cond["$gt"] = *filter.AfterMessageID
+		}
+		query["message_id"] = cond
+
+		limit := int64(*filter.Limit)
+		if limit <= 0 || limit > defaultMaxLimit {
+			limit = defaultLimit
+		}
+		findOpts.SetLimit(limit)
+	} else {
+		query["message_id"] = bson.M{
+			"$gte": *filter.LastMessageID,
+			"$lt":  (*filter.LastMessageID) + int64(*filter.Limit),
+		}
+	}
+
+	if filter.UserID != nil {
+		query["deleted_by"] = bson.M{"$ne": *filter.UserID}
+	}
+
 	rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
 		Collection(CollectionMessage).
-		Find(GlobCtx, bson.M{
-			"room_id":      filter.RoomID,
-			"session_type": filter.SessionType,
-			"message_id": bson.M{
-				"$gte": *filter.LastMessageID,
-				"$lt":  (*filter.LastMessageID) + int64(*filter.Limit),
-			},
-		}, options.Find().SetSort(filter.Sort))
+		Find(GlobCtx, query, findOpts)
 	if err != nil {
 		if errors.IsNoRecord(err) {
 			return nil, errors.Wrap(err)
@@ -562,6 +880,28 @@ func GetLastChatMessageList(roomID string, sessionType int, opts ...*GetOptions)
 // ==================================================================================
 // ============================== 缓存操作 ============================================
 // ==================================================================================
+// updateLastChatMessageListCache 替换最近消息列表缓存中的某条消息,缓存中没有该消息时不处理
+func updateLastChatMessageListCache(msg *ChatMessage) {
+	cacheKey := cacheKeyFormatLastMessageList(msg.RoomID, msg.SessionType)
+	score := strconv.FormatInt(msg.MessageID, 10)
+	removed, err := GlobCache.ZRemRangeByScore(GlobCtx, cacheKey, score, score).Result()
+	if err != nil {
+		// 有可能是空记录缓存,直接删除,下次读取时重建
+		GlobCache.Del(GlobCtx, cacheKey)
+		return
+	}
+
+	if removed == 0 {
+		return
+	}
+
+	err = GlobCache.ZAdd(GlobCtx, cacheKey, driver.Z{Member: msg, Score: float64(msg.MessageID)}).Err()
+	if err != nil {
+		log.Warn().Err(err).Str("cache_key", cacheKey).Msg("更新缓存中的聊天消息失败")
+		GlobCache.Del(GlobCtx, cacheKey)
+	}
+}
+
 // cacheKeyFormatLastMessageList 格式化最后消息列表的缓存 key
 func cacheKeyFormatLastMessageList(roomID string, sessionType int) string {
 	return fmt.Sprintf("%s:chat_message:last_list:%d_%s", CacheKeyPrefix, sessionType, roomID)
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jerbe/jim/errors"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/6 15:30
+  @describe : 按发送人跟ActionID对聊天消息发送去重
+*/
+
+// chatActionSeparator 保存的值由请求摘要跟发送结果组成,中间使用该分隔符,发送结果为空时表示还在发送中
+const chatActionSeparator = "|"
+
+// ErrChatActionConflict 相同的ActionID已经用于内容不同的请求
+var ErrChatActionConflict = errors.New("chat action id used by another request")
+
+// ClaimChatAction 按发送人跟ActionID占用一次发送,占用成功时返回true
+// 占用失败时返回之前保存的发送结果,之前的发送还没有完成时返回空字符串
+// requestHash 为请求内容的摘要,跟占用时保存的摘要不一致时返回 ErrChatActionConflict
+// pendingExpiration 为占位的有效期,防止发送过程中服务异常导致一直无法重试
+func ClaimChatAction(senderID int64, actionID, requestHash string, pendingExpiration time.Duration) (bool, string, error) {
+	cacheKey := cacheKeyFormatChatAction(senderID, actionID)
+	ok, err := GlobDB.Redis.SetNX(GlobCtx, cacheKey, requestHash+chatActionSeparator, pendingExpiration).Result()
+	if err != nil {
+		return false, "", errors.Wrap(err)
+	}
+
+	if ok {
+		return true, "", nil
+	}
+
+	value, err := GlobDB.Redis.Get(GlobCtx, cacheKey).Result()
+	if err != nil {
+		// 占位刚好过期,当作还在发送中,让客户端稍后重试
+		if errors.IsNoRecord(err) {
+			return false, "", nil
+		}
+		return false, "", errors.Wrap(err)
+	}
+
+	hash, result, _ := strings.Cut(value, chatActionSeparator)
+	if hash != requestHash {
+		return false, "", errors.Wrap(ErrChatActionConflict)
+	}
+	return false, result, nil
+}
+
+// SetChatActionResult 保存发送结果,在 expiration 时间内相同ActionID的发送都直接返回该结果
+func SetChatActionResult(senderID int64, actionID, requestHash, result string, expiration time.Duration) error {
+	err := GlobDB.Redis.Set(GlobCtx, cacheKeyFormatChatAction(senderID, actionID), requestHash+chatActionSeparator+result, expiration).Err()
+	return errors.Wrap(err)
+}
+
+// ReleaseChatAction 发送失败时释放占用,让客户端可以使用相同的ActionID重试
+func ReleaseChatAction(senderID int64, actionID string) error {
+	err := GlobDB.Redis.Del(GlobCtx, cacheKeyFormatChatAction(senderID, actionID)).Err()
+	return errors.Wrap(err)
+}
+
+// cacheKeyFormatChatAction 格式化发送去重的缓存 key
+func cacheKeyFormatChatAction(senderID int64, actionID string) string {
+	return fmt.Sprintf("%s:chat_message:action:%d:%s", CacheKeyPrefix, senderID, actionID)
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/jerbe/jim/errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/28 15:40
+  @describe :
+*/
+
+// ChatMessageBodySize 消息主体中的文件大小,单位字节
+// 早期版本以字符串保存,读取时兼容字符串跟数字两种格式
+type ChatMessageBodySize int64
+
+// UnmarshalBSONValue 实现bson.ValueUnmarshaler接口
+func (s *ChatMessageBodySize) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	val := bson.RawValue{Type: t, Value: data}
+	switch t {
+	case bsontype.Int32:
+		*s = ChatMessageBodySize(val.Int32())
+	case bsontype.Int64:
+		*s = ChatMessageBodySize(val.Int64())
+	case bsontype.Double:
+		*s = ChatMessageBodySize(val.Double())
+	case bsontype.String:
+		*s = parseChatMessageBodySize(val.StringValue())
+	case bsontype.Null, bsontype.Undefined:
+		*s = 0
+	default:
+		return errors.New(fmt.Sprintf("无法将bson类型%s解析为文件大小", t))
+	}
+	return nil
+}
+
+// UnmarshalJSON 实现json.Unmarshaler接口
+func (s *ChatMessageBodySize) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var str string
+		if err := json.Unmarshal(data, &str); err != nil {
+			return err
+		}
+		*s = parseChatMessageBodySize(str)
+		return nil
+	}
+
+	var size int64
+	if err := json.Unmarshal(data, &size); err != nil {
+		return err
+	}
+	*s = ChatMessageBodySize(size)
+	return nil
+}
+
+// parseChatMessageBodySize 解析字符串格式的文件大小,无法解析时当作0
+func parseChatMessageBodySize(str string) ChatMessageBodySize {
+	size, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return ChatMessageBodySize(size)
+}
@@ -0,0 +1,267 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jerbe/jim/errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/23 10:36
+  @describe :
+*/
+
+// ChatConversation 用户在某个房间的会话设置
+// 每个用户在每个房间最多一条记录,没有记录时表示使用默认设置
+type ChatConversation struct {
+	// ID
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+
+	// UserID 用户ID
+	UserID int64 `bson:"user_id" json:"user_id"`
+
+	// RoomID 房间ID
+	RoomID string `bson:"room_id" json:"room_id"`
+
+	// SessionType 会话类型, 1-私聊,2-群聊,99-世界频道
+	SessionType int `bson:"session_type" json:"session_type"`
+
+	// TargetID 目标ID; 朋友ID/群ID/世界频道ID
+	TargetID int64 `bson:"target_id" json:"target_id"`
+
+	// Pinned 是否置顶
+	Pinned bool `bson:"pinned" json:"pinned"`
+
+	// Muted 是否免打扰
+	Muted bool `bson:"muted" json:"muted"`
+
+	// ReadMessageID 已读到的消息ID,用于计算未读数
+	ReadMessageID int64 `bson:"read_message_id" json:"read_message_id"`
+
+	// ClearedMessageID 清空会话时的最后消息ID,小于等于该ID的消息对该用户隐藏
+	ClearedMessageID int64 `bson:"cleared_message_id" json:"cleared_message_id"`
+
+	// MentionedMessageID 最后一条@了该用户的消息ID,大于已读位置时表示有人@了该用户
+	MentionedMessageID int64 `bson:"mentioned_message_id" json:"mentioned_message_id"`
+
+	// CreatedAt 创建时间
+	CreatedAt int64 `bson:"created_at" json:"created_at"`
+
+	// UpdatedAt 最后更新时间
+	UpdatedAt int64 `bson:"updated_at" json:"updated_at"`
+}
+
+// createChatConversationIndexes 创建会话设置的索引
+func createChatConversationIndexes(db *mongo.Database) error {
+	_, err := db.Collection(CollectionConversation).Indexes().CreateMany(GlobCtx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "room_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// 用于统计群消息的已读人数
+			Keys: bson.D{{Key: "room_id", Value: 1}, {Key: "read_message_id", Value: 1}},
+		},
+	})
+	return errors.Wrap(err)
+}
+
+// GetChatConversation 获取用户在某个房间的会话设置
+func GetChatConversation(userID int64, roomID string) (*ChatConversation, error) {
+	conversation := new(ChatConversation)
+	err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionConversation).
+		FindOne(GlobCtx, bson.M{"user_id": userID, "room_id": roomID}).
+		Decode(conversation)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return conversation, nil
+}
+
+// GetChatConversations 获取用户的所有会话设置, key 为房间ID
+func GetChatConversations(userID int64) (map[string]*ChatConversation, error) {
+	rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionConversation).
+		Find(GlobCtx, bson.M{"user_id": userID})
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	defer rs.Close(GlobCtx)
+	conversations := make(map[string]*ChatConversation)
+	for rs.Next(GlobCtx) {
+		conversation := new(ChatConversation)
+		err = rs.Decode(conversation)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		conversations[conversation.RoomID] = conversation
+	}
+	return conversations, nil
+}
+
+// UpdateChatConversationFilter 更新会话设置过滤器
+type UpdateChatConversationFilter struct {
+	// UserID 用户ID
+	UserID int64
+
+	// RoomID 房间ID
+	RoomID string
+
+	// SessionType 会话类型,记录不存在时写入
+	SessionType int
+
+	// TargetID 目标ID,记录不存在时写入
+	TargetID int64
+}
+
+// UpdateChatConversationData 更新会话设置数据
+type UpdateChatConversationData struct {
+	// Pinned 是否置顶
+	Pinned *bool
+
+	// Muted 是否免打扰
+	Muted *bool
+
+	// ReadMessageID 已读到的消息ID,只会前进不会后退
+	ReadMessageID *int64
+
+	// ClearedMessageID 清空会话时的最后消息ID,只会前进不会后退
+	ClearedMessageID *int64
+}
+
+// SetPinned 设置是否置顶
+func (d *UpdateChatConversationData) SetPinned(val bool) *UpdateChatConversationData {
+	d.Pinned = &val
+	return d
+}
+
+// SetMuted 设置是否免打扰
+func (d *UpdateChatConversationData) SetMuted(val bool) *UpdateChatConversationData {
+	d.Muted = &val
+	return d
+}
+
+// SetReadMessageID 设置已读到的消息ID
+func (d *UpdateChatConversationData) SetReadMessageID(val int64) *UpdateChatConversationData {
+	d.ReadMessageID = &val
+	return d
+}
+
+// SetClearedMessageID 设置清空会话时的最后消息ID
+func (d *UpdateChatConversationData) SetClearedMessageID(val int64) *UpdateChatConversationData {
+	d.ClearedMessageID = &val
+	return d
+}
+
+// UpdateChatConversation 更新会话设置,记录不存在时自动创建,返回更新后的会话设置
+func UpdateChatConversation(filter *UpdateChatConversationFilter, data *UpdateChatConversationData) (*ChatConversation, error) {
+	if filter.UserID <= 0 || filter.RoomID == "" {
+		return nil, errors.Wrap(errors.ParamsInvalid)
+	}
+
+	now := time.Now().UnixMilli()
+	set := bson.M{"updated_at": now}
+	if data.Pinned != nil {
+		set["pinned"] = *data.Pinned
+	}
+	if data.Muted != nil {
+		set["muted"] = *data.Muted
+	}
+
+	update := bson.M{
+		"$set": set,
+		"$setOnInsert": bson.M{
+			"session_type": filter.SessionType,
+			"target_id":    filter.TargetID,
+			"created_at":   now,
+		},
+	}
+	maxFields := bson.M{}
+	if data.ReadMessageID != nil {
+		maxFields["read_message_id"] = *data.ReadMessageID
+	}
+	if data.ClearedMessageID != nil {
+		maxFields["cleared_message_id"] = *data.ClearedMessageID
+	}
+	if len(maxFields) > 0 {
+		update["$max"] = maxFields
+	}
+
+	conversation := new(ChatConversation)
+	err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionConversation).
+		FindOneAndUpdate(GlobCtx, bson.M{
+			"user_id": filter.UserID,
+			"room_id": filter.RoomID,
+		}, update, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).
+		Decode(conversation)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return conversation, nil
+}
+
+// Mentioned 用户在已读位置之后是否被@过
+func (c *ChatConversation) Mentioned() bool {
+	return c.MentionedMessageID > c.ReadMessageID && c.MentionedMessageID > c.ClearedMessageID
+}
+
+// MarkChatConversationsMentioned 记录多个用户在某个房间被@的消息ID,记录不存在时自动创建
+func MarkChatConversationsMentioned(filter *UpdateChatConversationFilter, messageID int64, userIDs []int64) error {
+	if filter.RoomID == "" || messageID <= 0 {
+		return errors.Wrap(errors.ParamsInvalid)
+	}
+
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	now := time.Now().UnixMilli()
+	models := make([]mongo.WriteModel, 0, len(userIDs))
+	for _, userID := range userIDs {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"user_id": userID, "room_id": filter.RoomID}).
+			SetUpdate(bson.M{
+				"$set": bson.M{"updated_at": now},
+				"$max": bson.M{"mentioned_message_id": messageID},
+				"$setOnInsert": bson.M{
+					"session_type": filter.SessionType,
+					"target_id":    filter.TargetID,
+					"created_at":   now,
+				},
+			}).
+			SetUpsert(true))
+	}
+
+	_, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionConversation).
+		BulkWrite(GlobCtx, models, options.BulkWrite().SetOrdered(false))
+	return errors.Wrap(err)
+}
+
+// CountChatConversationReaders 统计房间中已读到某条消息的用户数量
+func CountChatConversationReaders(roomID string, messageID int64, excludeUserIDs ...int64) (int64, error) {
+	filter := bson.M{
+		"room_id":         roomID,
+		"read_message_id": bson.M{"$gte": messageID},
+	}
+	if len(excludeUserIDs) > 0 {
+		filter["user_id"] = bson.M{"$nin": excludeUserIDs}
+	}
+
+	count, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionConversation).
+		CountDocuments(GlobCtx, filter)
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+	return count, nil
+}
@@ -0,0 +1,159 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jerbe/jim/errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/22 15:20
+  @describe :
+*/
+
+// ChatCursor 设备在某个房间的消息同步游标
+// 每个用户的每个设备在每个房间都有一条记录,记录该设备已经收到的最大消息ID
+type ChatCursor struct {
+	// ID
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+
+	// UserID 用户ID
+	UserID int64 `bson:"user_id" json:"user_id"`
+
+	// DeviceID 设备ID,由前端生成并保持不变
+	DeviceID string `bson:"device_id" json:"device_id"`
+
+	// RoomID 房间ID
+	RoomID string `bson:"room_id" json:"room_id"`
+
+	// SessionType 会话类型, 1-私聊,2-群聊
+	SessionType int `bson:"session_type" json:"session_type"`
+
+	// MessageID 已经同步到的消息ID,对应 ChatMessage.MessageID
+	MessageID int64 `bson:"message_id" json:"message_id"`
+
+	// UpdatedAt 最后更新时间
+	UpdatedAt int64 `bson:"updated_at" json:"updated_at"`
+}
+
+// createChatCursorIndexes 创建同步游标的索引
+func createChatCursorIndexes(db *mongo.Database) error {
+	_, err := db.Collection(CollectionCursor).Indexes().CreateOne(GlobCtx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "device_id", Value: 1}, {Key: "room_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return errors.Wrap(err)
+}
+
+// GetChatCursors 获取设备在所有房间的同步游标, key 为房间ID
+func GetChatCursors(userID int64, deviceID string) (map[string]*ChatCursor, error) {
+	rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionCursor).
+		Find(GlobCtx, bson.M{
+			"user_id":   userID,
+			"device_id": deviceID,
+		})
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	defer rs.Close(GlobCtx)
+	cursors := make(map[string]*ChatCursor)
+	for rs.Next(GlobCtx) {
+		cursor := new(ChatCursor)
+		err = rs.Decode(cursor)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		cursors[cursor.RoomID] = cursor
+	}
+	return cursors, nil
+}
+
+// UpdateChatCursor 推进设备在某个房间的同步游标,游标只会前进不会后退
+func UpdateChatCursor(cursor *ChatCursor) error {
+	now := time.Now().UnixMilli()
+	_, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionCursor).
+		UpdateOne(GlobCtx, bson.M{
+			"user_id":   cursor.UserID,
+			"device_id": cursor.DeviceID,
+			"room_id":   cursor.RoomID,
+		}, bson.M{
+			"$max": bson.M{"message_id": cursor.MessageID},
+			"$set": bson.M{
+				"session_type": cursor.SessionType,
+				"updated_at":   now,
+			},
+		}, options.Update().SetUpsert(true))
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+// GetChatRooms 获取多个聊天室房间数据,按最后更新时间倒序排列
+func GetChatRooms(roomIDs []string) ([]*ChatRoom, error) {
+	if len(roomIDs) == 0 {
+		return nil, errors.Wrap(errors.NoRecords)
+	}
+
+	rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionRoom).
+		Find(GlobCtx, bson.M{
+			"room_id": bson.M{"$in": roomIDs},
+		}, options.Find().SetSort(bson.M{"updated_at": -1}))
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	defer rs.Close(GlobCtx)
+	rooms := make([]*ChatRoom, 0, len(roomIDs))
+	for rs.Next(GlobCtx) {
+		room := new(ChatRoom)
+		err = rs.Decode(room)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+// GetChatMessagesAfter 获取房间中消息ID大于 afterMessageID 的消息,按消息ID正序排列
+// 会排除 userID 删除过的消息
+func GetChatMessagesAfter(roomID string, sessionType int, userID, afterMessageID int64, limit int64) ([]*ChatMessage, error) {
+	if limit <= 0 || limit > defaultMaxLimit {
+		limit = defaultLimit
+	}
+
+	rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMessage).
+		Find(GlobCtx, bson.M{
+			"room_id":      roomID,
+			"session_type": sessionType,
+			"message_id":   bson.M{"$gt": afterMessageID},
+			"deleted_by":   bson.M{"$ne": userID},
+		}, options.Find().SetSort(bson.M{"message_id": 1}).SetLimit(limit))
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	defer rs.Close(GlobCtx)
+	messages := make([]*ChatMessage, 0, limit)
+	for rs.Next(GlobCtx) {
+		msg := new(ChatMessage)
+		err = rs.Decode(msg)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
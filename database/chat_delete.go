@@ -0,0 +1,115 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jerbe/jim/errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/25 16:12
+  @describe :
+*/
+
+// DeleteChatMessagesFilter 删除聊天消息过滤器
+// MessageIDs 跟 StartMessageID/EndMessageID 二选一,都设置时以 MessageIDs 为准
+type DeleteChatMessagesFilter struct {
+	// RoomID 房间ID
+	RoomID string
+
+	// SessionType 会话类型
+	SessionType int
+
+	// UserID 删除消息的用户ID
+	UserID int64
+
+	// MessageIDs 需要删除的消息ID列表
+	MessageIDs []int64
+
+	// StartMessageID 需要删除的起始消息ID,包含该消息
+	StartMessageID int64
+
+	// EndMessageID 需要删除的结束消息ID,包含该消息
+	EndMessageID int64
+}
+
+// DeleteChatMessages 为用户删除消息,只对该用户隐藏,其他人依然可以看到
+// 返回新删除的消息数量
+func DeleteChatMessages(filter *DeleteChatMessagesFilter) (int64, error) {
+	if filter.UserID <= 0 || filter.RoomID == "" {
+		return 0, errors.Wrap(errors.ParamsInvalid)
+	}
+
+	var messageIDCond bson.M
+	switch {
+	case len(filter.MessageIDs) > 0:
+		messageIDCond = bson.M{"$in": filter.MessageIDs}
+	case filter.StartMessageID > 0 && filter.EndMessageID >= filter.StartMessageID:
+		messageIDCond = bson.M{"$gte": filter.StartMessageID, "$lte": filter.EndMessageID}
+	default:
+		return 0, errors.Wrap(errors.ParamsInvalid)
+	}
+
+	db := GlobDB.Mongo.Database(DatabaseMongodbIM)
+	rs, err := db.Collection(CollectionMessage).
+		UpdateMany(GlobCtx, bson.M{
+			"room_id":      filter.RoomID,
+			"session_type": filter.SessionType,
+			"message_id":   messageIDCond,
+			"deleted_by":   bson.M{"$ne": filter.UserID},
+		}, bson.M{
+			"$addToSet": bson.M{"deleted_by": filter.UserID},
+			"$set":      bson.M{"updated_at": time.Now().UnixMilli()},
+		})
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+
+	if rs.ModifiedCount == 0 {
+		return 0, nil
+	}
+
+	// 房间中保存了最后一条消息的副本,会话列表依赖它判断是否显示
+	_, err = db.Collection(CollectionRoom).
+		UpdateOne(GlobCtx, bson.M{
+			"room_id":                 filter.RoomID,
+			"last_message.message_id": messageIDCond,
+		}, bson.M{
+			"$addToSet": bson.M{"last_message.deleted_by": filter.UserID},
+		})
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+
+	// 最近消息列表的缓存中带有删除人列表,需要清除
+	GlobCache.Del(GlobCtx, cacheKeyFormatLastMessageList(filter.RoomID, filter.SessionType))
+	return rs.ModifiedCount, nil
+}
+
+// VisibleTo 消息是否对用户可见
+// clearedMessageID 为用户清空会话时的最后消息ID
+func (m *ChatMessage) VisibleTo(userID, clearedMessageID int64) bool {
+	if m.MessageID <= clearedMessageID {
+		return false
+	}
+	for _, id := range m.DeletedBy {
+		if id == userID {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterVisibleChatMessages 过滤出对用户可见的消息
+func FilterVisibleChatMessages(messages []*ChatMessage, userID, clearedMessageID int64) []*ChatMessage {
+	visible := make([]*ChatMessage, 0, len(messages))
+	for _, msg := range messages {
+		if msg.VisibleTo(userID, clearedMessageID) {
+			visible = append(visible, msg)
+		}
+	}
+	return visible
+}
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jerbe/jim/errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/27 16:05
+  @describe :
+*/
+
+// ChatMessageRevision 消息的历史版本
+type ChatMessageRevision struct {
+	// Body 该版本的消息主体
+	Body ChatMessageBody `bson:"body" json:"body"`
+
+	// CreatedAt 该版本的生效时间,第一个版本为消息的发送时间
+	CreatedAt int64 `bson:"created_at" json:"created_at"`
+}
+
+// EditChatMessageFilter 编辑消息过滤器
+type EditChatMessageFilter struct {
+	// RoomID 房间ID
+	RoomID string
+
+	// SessionType 会话类型
+	SessionType int
+
+	// MessageID 消息ID
+	MessageID int64
+
+	// SenderID 发送人ID,只能编辑自己的消息
+	SenderID int64
+
+	// CreatedAfter 大于0时只能编辑该时间(毫秒)之后发送的消息
+	CreatedAfter int64
+}
+
+// EditChatMessage 编辑一条文本消息,编辑前的内容会追加到历史版本中,返回编辑后的消息
+// 没有符合条件的消息时返回 errors.NoRecords
+func EditChatMessage(filter *EditChatMessageFilter, text string) (*ChatMessage, error) {
+	if filter.SenderID <= 0 || filter.MessageID <= 0 {
+		return nil, errors.Wrap(errors.ParamsInvalid)
+	}
+
+	query := bson.M{
+		"room_id":      filter.RoomID,
+		"session_type": filter.SessionType,
+		"message_id":   filter.MessageID,
+		"sender_id":    filter.SenderID,
+		"type":         ChatMessageTypePlainText,
+		"status":       bson.M{"$nin": bson.A{ChatMessageStatusRollback, ChatMessageStatusExpired}},
+	}
+	if filter.CreatedAfter > 0 {
+		query["created_at"] = bson.M{"$gt": filter.CreatedAfter}
+	}
+
+	// 使用管道更新,在同一个原子操作里把当前内容追加到历史版本
+	now := time.Now().UnixMilli()
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"revisions": bson.M{"$concatArrays": bson.A{
+				bson.M{"$ifNull": bson.A{"$revisions", bson.A{}}},
+				bson.A{bson.M{
+					"body":       "$body",
+					"created_at": bson.M{"$ifNull": bson.A{"$edited_at", "$created_at"}},
+				}},
+			}},
+			"body.text":  text,
+			"edited_at":  now,
+			"updated_at": now,
+		}}},
+	}
+
+	db := GlobDB.Mongo.Database(DatabaseMongodbIM)
+	msg := new(ChatMessage)
+	err := db.Collection(CollectionMessage).
+		FindOneAndUpdate(GlobCtx, query, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).
+		Decode(msg)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	// 如果编辑的是房间的最后一条消息,同步更新房间中的副本
+	_, err = db.Collection(CollectionRoom).
+		UpdateOne(GlobCtx, bson.M{
+			"room_id":                 msg.RoomID,
+			"last_message.message_id": msg.MessageID,
+		}, bson.M{
+			"$set": bson.M{
+				"last_message.body":       msg.Body,
+				"last_message.edited_at":  msg.EditedAt,
+				"last_message.updated_at": msg.UpdatedAt,
+			},
+		})
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	updateLastChatMessageListCache(msg)
+	return msg, nil
+}
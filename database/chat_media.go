@@ -0,0 +1,129 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jerbe/jim/errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/2 16:05
+  @describe :
+*/
+
+// UpdateChatMessageMediaFilter 补充消息媒体元数据过滤器
+type UpdateChatMessageMediaFilter struct {
+	// RoomID 房间ID
+	RoomID string
+
+	// SessionType 会话类型
+	SessionType int
+
+	// MessageID 消息ID
+	MessageID int64
+
+	// MediaID 消息主体中的媒体文件ID,防止消息被修改后补充了错误的元数据
+	MediaID string
+}
+
+// UpdateChatMessageMedia 把后台提取的媒体元数据补充到消息主体中,返回更新后的消息
+// 只更新 body 中的 width,height,blurhash,thumbnails,poster,poster_variant,duration 字段
+func UpdateChatMessageMedia(filter *UpdateChatMessageMediaFilter, body *ChatMessageBody) (*ChatMessage, error) {
+	if filter.MessageID <= 0 || filter.MediaID == "" {
+		return nil, errors.Wrap(errors.ParamsInvalid)
+	}
+
+	now := time.Now().UnixMilli()
+	set := bson.M{
+		"body.width":          body.Width,
+		"body.height":         body.Height,
+		"body.blurhash":       body.Blurhash,
+		"body.thumbnails":     body.Thumbnails,
+		"body.poster":         body.Poster,
+		"body.poster_variant": body.PosterVariant,
+		"body.duration":       body.Duration,
+		"updated_at":          now,
+	}
+
+	db := GlobDB.Mongo.Database(DatabaseMongodbIM)
+	msg := new(ChatMessage)
+	err := db.Collection(CollectionMessage).
+		FindOneAndUpdate(GlobCtx, bson.M{
+			"room_id":       filter.RoomID,
+			"session_type":  filter.SessionType,
+			"message_id":    filter.MessageID,
+			"body.media_id": filter.MediaID,
+		}, bson.M{"$set": set}, options.FindOneAndUpdate().SetReturnDocument(options.After)).
+		Decode(msg)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	// 如果是房间的最后一条消息,同步更新房间中的副本
+	_, err = db.Collection(CollectionRoom).
+		UpdateOne(GlobCtx, bson.M{
+			"room_id":                 msg.RoomID,
+			"last_message.message_id": msg.MessageID,
+		}, bson.M{
+			"$set": bson.M{
+				"last_message.body":       msg.Body,
+				"last_message.updated_at": msg.UpdatedAt,
+			},
+		})
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	updateLastChatMessageListCache(msg)
+	return msg, nil
+}
+
+// chatMessageMediaFilter 主体或者合并转发的条目中引用了媒体文件的消息
+func chatMessageMediaFilter(mediaID string) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"body.media_id": mediaID},
+		bson.M{"body.items.body.media_id": mediaID},
+	}}
+}
+
+// HasChatMessageMediaForUser 判断媒体文件是否在用户参与的私聊或者世界频道中发送过
+func HasChatMessageMediaForUser(mediaID string, userID int64) (bool, error) {
+	count, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMessage).
+		CountDocuments(GlobCtx, bson.M{"$and": bson.A{
+			chatMessageMediaFilter(mediaID),
+			bson.M{"$or": bson.A{
+				bson.M{"session_type": ChatMessageSessionTypeWorld},
+				bson.M{"session_type": ChatMessageSessionTypePrivate, "sender_id": userID},
+				bson.M{"session_type": ChatMessageSessionTypePrivate, "receiver_id": userID},
+			}},
+		}}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, errors.Wrap(err)
+	}
+	return count > 0, nil
+}
+
+// GetChatMessageMediaGroupIDs 获取发送过该媒体文件的群ID
+func GetChatMessageMediaGroupIDs(mediaID string) ([]int64, error) {
+	filter := chatMessageMediaFilter(mediaID)
+	filter["session_type"] = ChatMessageSessionTypeGroup
+	rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMessage).
+		Distinct(GlobCtx, "receiver_id", filter)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	groupIDs := make([]int64, 0, len(rs))
+	for _, v := range rs {
+		if id, ok := v.(int64); ok {
+			groupIDs = append(groupIDs, id)
+		}
+	}
+	return groupIDs, nil
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jerbe/jim/errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/7 10:10
+  @describe : 聊天消息推送的发件箱
+*/
+
+// ChatMessageOutbox 消息的待推送标记
+// 跟消息在同一次插入中写入,推送成功后删除;推送失败时由后台任务按退避时间重新推送
+type ChatMessageOutbox struct {
+	// ActionID 发送时的行为ID,重新推送时带上,方便客户端对应发送请求
+	ActionID string `bson:"action_id,omitempty"`
+
+	// Attempts 后台任务已经尝试推送的次数
+	Attempts int `bson:"attempts"`
+
+	// NextAttemptAt 下一次尝试推送的时间(毫秒)
+	NextAttemptAt int64 `bson:"next_attempt_at"`
+}
+
+// createChatOutboxIndexes 创建待推送消息的索引,只索引带有待推送标记的消息
+func createChatOutboxIndexes(db *mongo.Database) error {
+	_, err := db.Collection(CollectionMessage).Indexes().CreateOne(GlobCtx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "outbox.next_attempt_at", Value: 1}},
+		Options: options.Index().SetPartialFilterExpression(bson.M{"outbox": bson.M{"$exists": true}}),
+	})
+	return errors.Wrap(err)
+}
+
+// ClaimChatMessageOutbox 领取一条到了重试时间的待推送消息,领取后在 lease 时间内其他实例不会再领取
+// 没有需要推送的消息时返回 errors.NoRecords
+func ClaimChatMessageOutbox(lease time.Duration) (*ChatMessage, error) {
+	now := time.Now().UnixMilli()
+	msg := new(ChatMessage)
+	err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMessage).
+		FindOneAndUpdate(GlobCtx, bson.M{
+			"outbox":                 bson.M{"$exists": true},
+			"outbox.next_attempt_at": bson.M{"$lte": now},
+		}, bson.M{
+			"$set": bson.M{"outbox.next_attempt_at": now + lease.Milliseconds()},
+			"$inc": bson.M{"outbox.attempts": 1},
+		}, options.FindOneAndUpdate().
+			SetSort(bson.M{"outbox.next_attempt_at": 1}).
+			SetReturnDocument(options.After)).
+		Decode(msg)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return msg, nil
+}
+
+// DelayChatMessageOutbox 推送失败后设置下一次尝试推送的时间
+func DelayChatMessageOutbox(id primitive.ObjectID, nextAttemptAt int64) error {
+	_, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMessage).
+		UpdateOne(GlobCtx, bson.M{
+			"_id":    id,
+			"outbox": bson.M{"$exists": true},
+		}, bson.M{
+			"$set": bson.M{"outbox.next_attempt_at": nextAttemptAt},
+		})
+	return errors.Wrap(err)
+}
+
+// MarkChatMessagePublished 推送成功后删除消息的待推送标记
+func MarkChatMessagePublished(id primitive.ObjectID) error {
+	_, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMessage).
+		UpdateOne(GlobCtx, bson.M{"_id": id}, bson.M{"$unset": bson.M{"outbox": ""}})
+	return errors.Wrap(err)
+}
+
+// CountChatMessageOutbox 统计还没有推送成功的消息数量
+// 带上 outbox.next_attempt_at 的条件才会使用只索引待推送消息的部分索引,否则会扫描整个消息集合
+func CountChatMessageOutbox() (int64, error) {
+	count, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMessage).
+		CountDocuments(GlobCtx, bson.M{
+			"outbox":                 bson.M{"$exists": true},
+			"outbox.next_attempt_at": bson.M{"$gte": 0},
+		})
+	return count, errors.Wrap(err)
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jerbe/jim/errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/27 10:12
+  @describe :
+*/
+
+// UpdateChatMessageReactionFilter 更新表情回应过滤器
+type UpdateChatMessageReactionFilter struct {
+	// RoomID 房间ID
+	RoomID string
+
+	// SessionType 会话类型
+	SessionType int
+
+	// MessageID 消息ID
+	MessageID int64
+
+	// UserID 回应人ID
+	UserID int64
+
+	// Emoji 表情,调用方需要保证不包含 '.' 跟 '$' 等mongodb字段名不允许的字符
+	Emoji string
+
+	// MaxReactions 添加回应时消息最多可以有多少种不同的表情,为0时不限制
+	MaxReactions int
+}
+
+// ErrChatReactionLimit 消息的表情回应种类已达上限
+var ErrChatReactionLimit = errors.New("chat reaction limit reached")
+
+// UpdateChatMessageReaction 添加或取消用户对消息的表情回应,返回更新后的消息
+// 已撤回的消息不能回应,没有符合条件的消息时返回 errors.NoRecords
+// 添加一种新的表情时如果种类已达 MaxReactions 返回 ErrChatReactionLimit
+func UpdateChatMessageReaction(filter *UpdateChatMessageReactionFilter, add bool) (*ChatMessage, error) {
+	if filter.UserID <= 0 || filter.Emoji == "" {
+		return nil, errors.Wrap(errors.ParamsInvalid)
+	}
+
+	field := fmt.Sprintf("reactions.%s", filter.Emoji)
+	update := bson.M{
+		"$set": bson.M{"updated_at": time.Now().UnixMilli()},
+	}
+	if add {
+		update["$addToSet"] = bson.M{field: filter.UserID}
+	} else {
+		update["$pull"] = bson.M{field: filter.UserID}
+	}
+
+	query := bson.M{
+		"room_id":      filter.RoomID,
+		"session_type": filter.SessionType,
+		"message_id":   filter.MessageID,
+		"status":       bson.M{"$nin": bson.A{ChatMessageStatusRollback, ChatMessageStatusExpired}},
+	}
+	limited := add && filter.MaxReactions > 0
+	if limited {
+		// 已有的表情可以继续回应,新的表情需要种类数量未达上限
+		query["$or"] = bson.A{
+			bson.M{field: bson.M{"$exists": true}},
+			bson.M{"$expr": bson.M{"$lt": bson.A{
+				bson.M{"$size": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$reactions", bson.M{}}}}},
+				filter.MaxReactions,
+			}}},
+		}
+	}
+
+	msg := new(ChatMessage)
+	err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMessage).
+		FindOneAndUpdate(GlobCtx, query, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).
+		Decode(msg)
+	if err != nil {
+		if limited && errors.Is(err, mongo.ErrNoDocuments) {
+			// 区分消息不存在跟表情种类已达上限
+			delete(query, "$or")
+			cnt, cntErr := GlobDB.Mongo.Database(DatabaseMongodbIM).
+				Collection(CollectionMessage).
+				CountDocuments(GlobCtx, query, options.Count().SetLimit(1))
+			if cntErr != nil {
+				return nil, errors.Wrap(cntErr)
+			}
+			if cnt > 0 {
+				return nil, errors.Wrap(ErrChatReactionLimit)
+			}
+		}
+		return nil, errors.Wrap(err)
+	}
+
+	// 取消回应后没有人回应的表情直接移除
+	if !add && len(msg.Reactions[filter.Emoji]) == 0 {
+		delete(msg.Reactions, filter.Emoji)
+		_, err = GlobDB.Mongo.Database(DatabaseMongodbIM).
+			Collection(CollectionMessage).
+			UpdateOne(GlobCtx, bson.M{"_id": msg.ID, field: bson.M{"$size": 0}}, bson.M{"$unset": bson.M{field: ""}})
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+	}
+
+	updateLastChatMessageListCache(msg)
+	return msg, nil
+}
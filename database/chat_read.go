@@ -0,0 +1,209 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jerbe/jim/errors"
+
+	"github.com/jerbe/jcache/v2"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/24 14:08
+  @describe :
+*/
+
+// GetChatRoom 获取聊天室房间数据
+func GetChatRoom(roomID string) (*ChatRoom, error) {
+	room := new(ChatRoom)
+	err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionRoom).
+		FindOne(GlobCtx, bson.M{"room_id": roomID}).
+		Decode(room)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return room, nil
+}
+
+// GetChatMessagesByIDs 根据消息ID获取房间中的多条消息
+func GetChatMessagesByIDs(roomID string, sessionType int, messageIDs []int64) ([]*ChatMessage, error) {
+	if len(messageIDs) == 0 {
+		return nil, errors.Wrap(errors.NoRecords)
+	}
+
+	rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMessage).
+		Find(GlobCtx, bson.M{
+			"room_id":      roomID,
+			"session_type": sessionType,
+			"message_id":   bson.M{"$in": messageIDs},
+		}, options.Find().SetSort(bson.M{"message_id": 1}))
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	defer rs.Close(GlobCtx)
+	messages := make([]*ChatMessage, 0, len(messageIDs))
+	for rs.Next(GlobCtx) {
+		msg := new(ChatMessage)
+		err = rs.Decode(msg)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// ReadChatMessages 将房间中对方发给 readerID 且消息ID小于等于 messageID 的消息标记为已读
+// 返回被标记的消息数量
+func ReadChatMessages(roomID string, sessionType int, readerID, messageID int64) (int64, error) {
+	rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMessage).
+		UpdateMany(GlobCtx, bson.M{
+			"room_id":      roomID,
+			"session_type": sessionType,
+			"receiver_id":  readerID,
+			"message_id":   bson.M{"$lte": messageID},
+			"read_status":  ChatMessageReadStatusUnread,
+		}, bson.M{
+			"$set": bson.M{
+				"read_status": ChatMessageReadStatusRead,
+				"send_status": ChatMessageSendStatusDelivered,
+				"updated_at":  time.Now().UnixMilli(),
+			},
+		})
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+	return rs.ModifiedCount, nil
+}
+
+// CountChatUnreadMessages 统计房间中对用户可见的未读消息数量,最多统计 limit 条
+// 只统计消息ID大于 afterMessageID、创建时间不早于 afterCreatedAt 的其他人发送的正常消息
+func CountChatUnreadMessages(roomID string, userID, afterMessageID, afterCreatedAt, limit int64) (int64, error) {
+	filter := bson.M{
+		"room_id":    roomID,
+		"message_id": bson.M{"$gt": afterMessageID},
+		"status":     ChatMessageStatusNormal,
+		"sender_id":  bson.M{"$ne": userID},
+		"deleted_by": bson.M{"$ne": userID},
+	}
+	if afterCreatedAt > 0 {
+		filter["created_at"] = bson.M{"$gte": afterCreatedAt}
+	}
+
+	cnt, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMessage).
+		CountDocuments(GlobCtx, filter, options.Count().SetLimit(limit))
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+	return cnt, nil
+}
+
+// ==================================================================================
+// ============================== 未读计数 ============================================
+// ==================================================================================
+// 未读数保存在redis的hash中,每个用户一个key,field为房间ID,value为未读数量
+// 只有key存在时才会累加,key不存在时由调用方从mongodb中计算后整体写入,保证计数不会缺失房间
+
+// chatUnreadExistsField 占位字段,保证用户没有任何房间时key也存在
+const chatUnreadExistsField = "_"
+
+// incrChatUnreadScript key存在时才累加未读数
+const incrChatUnreadScript = `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("HINCRBY", KEYS[1], ARGV[1], 1)
+end
+return 0
+`
+
+// IncrChatUnreadCount 给多个用户在某个房间的未读数加一
+func IncrChatUnreadCount(roomID string, userIDs ...int64) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	pipe := GlobDB.Redis.Pipeline()
+	for _, userID := range userIDs {
+		pipe.Eval(GlobCtx, incrChatUnreadScript, []string{cacheKeyFormatChatUnread(userID)}, roomID)
+	}
+	_, err := pipe.Exec(GlobCtx)
+	return errors.Wrap(err)
+}
+
+// SetChatUnreadCount 设置用户在某个房间的未读数,key不存在时不设置
+func SetChatUnreadCount(userID int64, roomID string, count int64) error {
+	cacheKey := cacheKeyFormatChatUnread(userID)
+	exists, err := GlobDB.Redis.Exists(GlobCtx, cacheKey).Result()
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if exists == 0 {
+		return nil
+	}
+
+	if count < 0 {
+		count = 0
+	}
+	return errors.Wrap(GlobDB.Redis.HSet(GlobCtx, cacheKey, roomID, count).Err())
+}
+
+// GetChatUnreadCounts 获取用户所有房间的未读数, key 为房间ID
+// 缓存不存在时返回 errors.NoRecords
+func GetChatUnreadCounts(userID int64) (map[string]int64, error) {
+	values, err := GlobDB.Redis.HGetAll(GlobCtx, cacheKeyFormatChatUnread(userID)).Result()
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	if len(values) == 0 {
+		return nil, errors.Wrap(errors.NoRecords)
+	}
+
+	counts := make(map[string]int64, len(values))
+	for roomID, val := range values {
+		if roomID == chatUnreadExistsField {
+			continue
+		}
+		count, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			continue
+		}
+		counts[roomID] = count
+	}
+	return counts, nil
+}
+
+// SetChatUnreadCounts 整体写入用户所有房间的未读数
+func SetChatUnreadCounts(userID int64, counts map[string]int64) error {
+	cacheKey := cacheKeyFormatChatUnread(userID)
+	values := make(map[string]any, len(counts)+1)
+	values[chatUnreadExistsField] = 0
+	for roomID, count := range counts {
+		if count < 0 {
+			count = 0
+		}
+		values[roomID] = count
+	}
+
+	pipe := GlobDB.Redis.TxPipeline()
+	pipe.Del(GlobCtx, cacheKey)
+	pipe.HSet(GlobCtx, cacheKey, values)
+	pipe.Expire(GlobCtx, cacheKey, jcache.RandomExpirationDuration())
+	_, err := pipe.Exec(GlobCtx)
+	return errors.Wrap(err)
+}
+
+// cacheKeyFormatChatUnread 格式化用户未读数的缓存 key
+func cacheKeyFormatChatUnread(userID int64) string {
+	return fmt.Sprintf("%s:chat_message:unread:%d", CacheKeyPrefix, userID)
+}
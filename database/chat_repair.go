@@ -0,0 +1,195 @@
+package database
+
+import (
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/8 14:30
+  @describe : 检查并修复房间跟消息之间的不一致
+*/
+
+// ChatRoomRepairResult 检查一个房间的结果
+type ChatRoomRepairResult struct {
+	// LastMessageRepaired 房间的最后一条消息落后于实际最新的消息,已经修复
+	LastMessageRepaired bool
+
+	// MessageIDGap 房间的消息ID比实际最大的消息ID多出的数量
+	// 这些消息ID保存消息前中断了,只做记录不回退,避免跟正在写入的消息使用相同的消息ID
+	MessageIDGap int64
+}
+
+// createChatRoomIndexes 创建房间跟按房间查询消息需要的索引
+func createChatRoomIndexes(db *mongo.Database) error {
+	_, err := db.Collection(CollectionRoom).Indexes().CreateMany(GlobCtx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "room_id", Value: 1}}, Options: options.Index().SetUnique(true).SetName("room_id_unique")},
+		{Keys: bson.D{{Key: "updated_at", Value: 1}}},
+	})
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	// 唯一索引已经覆盖旧版本的索引
+	_, err = db.Collection(CollectionRoom).Indexes().DropOne(GlobCtx, "room_id_1")
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && (cmdErr.Code == mongoErrNamespaceNotFound || cmdErr.Code == mongoErrIndexNotFound)) {
+		return errors.Wrap(err)
+	}
+
+	_, err = db.Collection(CollectionMessage).Indexes().CreateOne(GlobCtx, mongo.IndexModel{
+		Keys: bson.D{{Key: "room_id", Value: 1}, {Key: "message_id", Value: -1}},
+	})
+	return errors.Wrap(err)
+}
+
+// migrateDuplicateChatRooms 旧版本的 room_id 索引不唯一,并发写入第一条消息时可能创建了重复的房间
+// 创建唯一索引前需要先清理,唯一索引已经存在时不再执行
+func migrateDuplicateChatRooms(db *mongo.Database) error {
+	rs, err := db.Collection(CollectionRoom).Indexes().List(GlobCtx)
+	var cmdErr mongo.CommandError
+	if err != nil {
+		if errors.As(err, &cmdErr) && cmdErr.Code == mongoErrNamespaceNotFound {
+			return nil
+		}
+		return errors.Wrap(err)
+	}
+
+	var indexes []struct {
+		Name string `bson:"name"`
+	}
+	if err = rs.All(GlobCtx, &indexes); err != nil {
+		return errors.Wrap(err)
+	}
+	for _, index := range indexes {
+		if index.Name == "room_id_unique" {
+			return nil
+		}
+	}
+
+	deleted, err := removeDuplicateChatRooms(db)
+	if err != nil {
+		return err
+	}
+	log.Info().Int64("deleted", deleted).Msg("数据迁移:清理重复的房间")
+	return nil
+}
+
+// removeDuplicateChatRooms 删除重复的房间,每个房间ID只保留消息ID最大的一条,返回删除的数量
+// 消息按房间ID保存,删除重复的房间不会丢失消息;保留的房间最后一条消息落后时由 RepairChatRoom 修复
+func removeDuplicateChatRooms(db *mongo.Database) (int64, error) {
+	coll := db.Collection(CollectionRoom)
+	rs, err := coll.Aggregate(GlobCtx, mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "room_id", Value: 1}, {Key: "last_message_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$room_id",
+			"ids":   bson.M{"$push": "$_id"},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+
+	defer rs.Close(GlobCtx)
+	var deleted int64
+	for rs.Next(GlobCtx) {
+		var group struct {
+			RoomID string               `bson:"_id"`
+			IDs    []primitive.ObjectID `bson:"ids"`
+		}
+		if err = rs.Decode(&group); err != nil {
+			return deleted, errors.Wrap(err)
+		}
+
+		// 第一条是消息ID最大的房间
+		dr, err := coll.DeleteMany(GlobCtx, bson.M{"_id": bson.M{"$in": group.IDs[1:]}})
+		if err != nil {
+			return deleted, errors.Wrap(err)
+		}
+		deleted += dr.DeletedCount
+		log.Warn().Str("room_id", group.RoomID).Int64("deleted", dr.DeletedCount).Msg("数据迁移:删除重复的房间")
+	}
+	return deleted, errors.Wrap(rs.Err())
+}
+
+// GetChatRoomsUpdatedBetween 获取在 [start, end) 时间(毫秒)内有新消息的房间
+// 只返回检查需要的字段,最后一条消息只有消息ID
+func GetChatRoomsUpdatedBetween(start, end int64) ([]*ChatRoom, error) {
+	rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionRoom).
+		Find(GlobCtx, bson.M{
+			"updated_at": bson.M{"$gte": start, "$lt": end},
+		}, options.Find().SetProjection(bson.M{
+			"room_id":                 1,
+			"session_type":            1,
+			"last_message_id":         1,
+			"last_message.message_id": 1,
+			"updated_at":              1,
+		}))
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	defer rs.Close(GlobCtx)
+	rooms := make([]*ChatRoom, 0)
+	if err = rs.All(GlobCtx, &rooms); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return rooms, nil
+}
+
+// RepairChatRoom 根据房间中实际保存的消息检查并修复房间数据
+// 不使用事务写入消息时,中途失败会留下落后的最后一条消息或者没有对应消息的消息ID
+// 消息ID只会递增,没有对应消息的消息ID只记录在结果中,不会回退
+func RepairChatRoom(room *ChatRoom) (*ChatRoomRepairResult, error) {
+	coll := GlobDB.Mongo.Database(DatabaseMongodbIM).Collection(CollectionMessage)
+	latest := new(ChatMessage)
+	err := coll.FindOne(GlobCtx, bson.M{"room_id": room.RoomID}, options.FindOne().SetSort(bson.M{"message_id": -1})).Decode(latest)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errors.Wrap(err)
+	}
+	hasLatest := err == nil
+
+	result := new(ChatRoomRepairResult)
+	var maxMessageID int64
+	if hasLatest {
+		maxMessageID = latest.MessageID
+	}
+
+	// 消息已经保存,但是更新最后一条消息前中断了
+	if hasLatest && room.LastMessage.MessageID < maxMessageID {
+		rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+			Collection(CollectionRoom).
+			UpdateOne(GlobCtx, bson.M{
+				"room_id": room.RoomID,
+				"$or": bson.A{
+					bson.M{"last_message": bson.M{"$eq": nil}},
+					bson.M{"last_message.message_id": bson.M{"$lt": maxMessageID}},
+				},
+			}, bson.M{
+				"$set": bson.M{"last_message": latest},
+			})
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		result.LastMessageRepaired = rs.ModifiedCount > 0
+		if result.LastMessageRepaired {
+			// 缓存中可能也缺少这条消息,直接删除,下次读取时重建
+			GlobCache.Del(GlobCtx, cacheKeyFormatLastMessageList(room.RoomID, room.SessionType))
+		}
+	}
+
+	// 消息ID已经递增,但是保存消息前中断了,或者消息还在写入
+	if room.LastMessageID > maxMessageID {
+		result.MessageIDGap = room.LastMessageID - maxMessageID
+	}
+	return result, nil
+}
@@ -0,0 +1,172 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/8 16:20
+  @describe :
+*/
+
+// newRepairTestMessage 生成一个使用独立房间的消息,避免跟其他测试数据互相影响
+func newRepairTestMessage(roomID string) *ChatMessage {
+	return &ChatMessage{
+		RoomID:      roomID,
+		Type:        1,
+		SessionType: 1,
+		SenderID:    1,
+		ReceiverID:  2,
+		SendStatus:  1,
+		Status:      1,
+		Body:        ChatMessageBody{Text: "纯文本消息"},
+		CreatedAt:   time.Now().UnixMilli(),
+		UpdatedAt:   time.Now().UnixMilli(),
+	}
+}
+
+// incrRepairTestRoomCounter 只递增房间的消息ID,模拟保存消息前中断的写入
+func incrRepairTestRoomCounter(t *testing.T, roomID string) {
+	_, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionRoom).
+		UpdateOne(GlobCtx, bson.M{"room_id": roomID}, bson.M{"$inc": bson.M{"last_message_id": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairChatRoom(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare 准备房间数据,返回检查时使用的房间
+		prepare              func(t *testing.T, roomID string) *ChatRoom
+		wantLastMessage      bool
+		wantMessageIDGap     int64
+		wantLastMessageID    int64
+		wantLastMessageMsgID int64
+	}{
+		{
+			name: "记录没有对应消息的消息ID",
+			prepare: func(t *testing.T, roomID string) *ChatRoom {
+				if err := AddChatMessage(newRepairTestMessage(roomID)); err != nil {
+					t.Fatal(err)
+				}
+				incrRepairTestRoomCounter(t, roomID)
+				room, err := GetChatRoom(roomID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return room
+			},
+			wantMessageIDGap:     1,
+			wantLastMessageID:    2,
+			wantLastMessageMsgID: 1,
+		},
+		{
+			name: "修复落后的最后一条消息",
+			prepare: func(t *testing.T, roomID string) *ChatRoom {
+				first := newRepairTestMessage(roomID)
+				if err := AddChatMessage(first); err != nil {
+					t.Fatal(err)
+				}
+				if err := AddChatMessage(newRepairTestMessage(roomID)); err != nil {
+					t.Fatal(err)
+				}
+
+				// 模拟保存消息后更新最后一条消息前中断
+				_, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+					Collection(CollectionRoom).
+					UpdateOne(GlobCtx, bson.M{"room_id": roomID}, bson.M{"$set": bson.M{"last_message": first}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				room, err := GetChatRoom(roomID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return room
+			},
+			wantLastMessage:      true,
+			wantLastMessageID:    2,
+			wantLastMessageMsgID: 2,
+		},
+		{
+			name: "不回退检查后仍在写入的房间",
+			prepare: func(t *testing.T, roomID string) *ChatRoom {
+				if err := AddChatMessage(newRepairTestMessage(roomID)); err != nil {
+					t.Fatal(err)
+				}
+				incrRepairTestRoomCounter(t, roomID)
+				room, err := GetChatRoom(roomID)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// 读取房间后又有新的写入递增了消息ID
+				incrRepairTestRoomCounter(t, roomID)
+				return room
+			},
+			wantMessageIDGap:     1,
+			wantLastMessageID:    3,
+			wantLastMessageMsgID: 1,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roomID := fmt.Sprintf("repair_test_%d_%d", time.Now().UnixNano(), i)
+			room := tt.prepare(t, roomID)
+
+			result, err := RepairChatRoom(room)
+			if err != nil {
+				t.Fatalf("RepairChatRoom() error = %v", err)
+			}
+			if result.LastMessageRepaired != tt.wantLastMessage {
+				t.Errorf("RepairChatRoom() LastMessageRepaired = %v, want %v", result.LastMessageRepaired, tt.wantLastMessage)
+			}
+			if result.MessageIDGap != tt.wantMessageIDGap {
+				t.Errorf("RepairChatRoom() MessageIDGap = %v, want %v", result.MessageIDGap, tt.wantMessageIDGap)
+			}
+
+			got, err := GetChatRoom(roomID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.LastMessageID != tt.wantLastMessageID {
+				t.Errorf("RepairChatRoom() last_message_id = %v, want %v", got.LastMessageID, tt.wantLastMessageID)
+			}
+			if got.LastMessage.MessageID != tt.wantLastMessageMsgID {
+				t.Errorf("RepairChatRoom() last_message.message_id = %v, want %v", got.LastMessage.MessageID, tt.wantLastMessageMsgID)
+			}
+		})
+	}
+}
+
+func TestAddChatMessageWithoutTransaction(t *testing.T) {
+	supported := mongoTransactionSupported
+	mongoTransactionSupported = false
+	defer func() { mongoTransactionSupported = supported }()
+
+	roomID := fmt.Sprintf("repair_test_%d", time.Now().UnixNano())
+	for i := int64(1); i <= 2; i++ {
+		msg := newRepairTestMessage(roomID)
+		if err := AddChatMessage(msg); err != nil {
+			t.Fatalf("AddChatMessage() error = %v", err)
+		}
+		if msg.MessageID != i {
+			t.Errorf("AddChatMessage() message_id = %v, want %v", msg.MessageID, i)
+		}
+	}
+
+	room, err := GetChatRoom(roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.LastMessageID != 2 || room.LastMessage.MessageID != 2 {
+		t.Errorf("AddChatMessage() room last_message_id = %v, last_message.message_id = %v, want 2", room.LastMessageID, room.LastMessage.MessageID)
+	}
+}
@@ -0,0 +1,236 @@
+package database
+
+import (
+	"time"
+
+	"github.com/jerbe/jim/errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/5 10:15
+  @describe : 定时消息跟阅后即焚消息
+*/
+
+// ErrChatScheduleDelivered 定时消息已经发送过,通常是上一次发送后还没来得及删除任务
+var ErrChatScheduleDelivered = errors.New("chat schedule already delivered")
+
+// ChatSchedule 定时消息任务
+// 保存在mongodb中,服务重启后不会丢失;多个实例通过 LockedUntil 租约抢占任务
+type ChatSchedule struct {
+	// ID 任务ID
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+
+	// UserID 发送人ID
+	UserID int64 `bson:"user_id" json:"user_id"`
+
+	// SessionType 会话类型
+	SessionType int `bson:"session_type" json:"session_type"`
+
+	// TargetID 目标ID; 朋友ID/群ID/世界频道ID
+	TargetID int64 `bson:"target_id" json:"target_id"`
+
+	// Request 发送请求,由 handler 序列化,到期后按普通消息重新发送
+	Request string `bson:"request" json:"request"`
+
+	// RunAt 发送时间(毫秒)
+	RunAt int64 `bson:"run_at" json:"run_at"`
+
+	// LockedUntil 租约到期时间(毫秒),被某个实例领取后在该时间前其他实例不会再领取
+	LockedUntil int64 `bson:"locked_until" json:"locked_until"`
+
+	// Attempts 已经领取的次数
+	Attempts int `bson:"attempts" json:"attempts"`
+
+	// CreatedAt 创建时间
+	CreatedAt int64 `bson:"created_at" json:"created_at"`
+}
+
+// createChatScheduleIndexes 创建定时消息跟过期消息需要的索引
+func createChatScheduleIndexes(db *mongo.Database) error {
+	_, err := db.Collection(CollectionSchedule).Indexes().CreateMany(GlobCtx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "run_at", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "run_at", Value: 1}}},
+	})
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	_, err = db.Collection(CollectionMessage).Indexes().CreateMany(GlobCtx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "schedule_id", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"schedule_id": bson.M{"$exists": true}}),
+		},
+		{
+			Keys:    bson.D{{Key: "expire_at", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"expire_at": bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	// 旧版本清空过期消息时没有删除过期时间,这些消息会一直留在索引中被重复扫描
+	_, err = db.Collection(CollectionMessage).UpdateMany(GlobCtx, bson.M{
+		"expire_at": bson.M{"$exists": true},
+		"status":    ChatMessageStatusExpired,
+	}, bson.M{
+		"$unset": bson.M{"expire_at": ""},
+	})
+	return errors.Wrap(err)
+}
+
+// AddChatSchedule 添加定时消息任务
+func AddChatSchedule(schedule *ChatSchedule) error {
+	if schedule.UserID <= 0 || schedule.RunAt <= 0 || schedule.Request == "" {
+		return errors.Wrap(errors.ParamsInvalid)
+	}
+
+	if schedule.CreatedAt == 0 {
+		schedule.CreatedAt = time.Now().UnixMilli()
+	}
+
+	rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionSchedule).
+		InsertOne(GlobCtx, schedule)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	schedule.ID = rs.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// ClaimChatSchedule 领取一个已到期的定时消息任务,领取后在 lease 时间内其他实例不会再领取
+// 处理失败时不需要归还,租约到期后会被重新领取;没有到期的任务时返回 errors.NoRecords
+func ClaimChatSchedule(lease time.Duration) (*ChatSchedule, error) {
+	now := time.Now().UnixMilli()
+	schedule := new(ChatSchedule)
+	err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionSchedule).
+		FindOneAndUpdate(GlobCtx, bson.M{
+			"run_at":       bson.M{"$lte": now},
+			"locked_until": bson.M{"$lte": now},
+		}, bson.M{
+			"$set": bson.M{"locked_until": now + lease.Milliseconds()},
+			"$inc": bson.M{"attempts": 1},
+		}, options.FindOneAndUpdate().
+			SetSort(bson.M{"run_at": 1}).
+			SetReturnDocument(options.After)).
+		Decode(schedule)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return schedule, nil
+}
+
+// RemoveChatSchedule 删除定时消息任务
+func RemoveChatSchedule(id primitive.ObjectID) error {
+	_, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionSchedule).
+		DeleteOne(GlobCtx, bson.M{"_id": id})
+	return errors.Wrap(err)
+}
+
+// GetChatSchedules 获取用户还未发送的定时消息,按发送时间正序排列
+func GetChatSchedules(userID int64) ([]*ChatSchedule, error) {
+	rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionSchedule).
+		Find(GlobCtx, bson.M{"user_id": userID}, options.Find().SetSort(bson.M{"run_at": 1}))
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	defer rs.Close(GlobCtx)
+	schedules := make([]*ChatSchedule, 0)
+	if err = rs.All(GlobCtx, &schedules); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return schedules, nil
+}
+
+// CancelChatSchedule 取消用户的一条定时消息,已经被领取正在发送的不能取消
+// 没有符合条件的任务时返回 errors.NoRecords
+func CancelChatSchedule(userID int64, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return errors.Wrap(errors.NoRecords)
+	}
+
+	rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionSchedule).
+		DeleteOne(GlobCtx, bson.M{
+			"_id":          oid,
+			"user_id":      userID,
+			"locked_until": bson.M{"$lte": time.Now().UnixMilli()},
+		})
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if rs.DeletedCount == 0 {
+		return errors.Wrap(errors.NoRecords)
+	}
+	return nil
+}
+
+// ExpireChatMessage 清空一条已经到期的阅后即焚消息,返回清空后的消息
+// 使用 FindOneAndUpdate 保证多个实例同时处理时一条消息只会被清空一次;没有到期的消息时返回 errors.NoRecords
+// 清空时删除过期时间,让消息离开过期时间的部分索引,状态为过期的消息依然不能被转发
+func ExpireChatMessage() (*ChatMessage, error) {
+	now := time.Now().UnixMilli()
+	db := GlobDB.Mongo.Database(DatabaseMongodbIM)
+	msg := new(ChatMessage)
+	err := db.Collection(CollectionMessage).
+		FindOneAndUpdate(GlobCtx, bson.M{
+			"expire_at": bson.M{"$gt": 0, "$lte": now},
+			"status":    bson.M{"$ne": ChatMessageStatusExpired},
+		}, bson.M{
+			"$set": bson.M{
+				"status":     ChatMessageStatusExpired,
+				"body":       ChatMessageBody{},
+				"updated_at": now,
+			},
+			"$unset": bson.M{"expire_at": "", "revisions": "", "reactions": ""},
+		}, options.FindOneAndUpdate().
+			SetSort(bson.M{"expire_at": 1}).
+			SetReturnDocument(options.After)).
+		Decode(msg)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	// 房间中的最后一条消息副本跟其他消息中的回复快照也要一起清空
+	_, err = db.Collection(CollectionRoom).
+		UpdateOne(GlobCtx, bson.M{
+			"room_id":                 msg.RoomID,
+			"last_message.message_id": msg.MessageID,
+		}, bson.M{
+			"$set": bson.M{
+				"last_message.status":     ChatMessageStatusExpired,
+				"last_message.body":       ChatMessageBody{},
+				"last_message.updated_at": now,
+			},
+			"$unset": bson.M{"last_message.expire_at": ""},
+		})
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	_, err = db.Collection(CollectionMessage).
+		UpdateMany(GlobCtx, bson.M{
+			"reply_to.room_id":    msg.RoomID,
+			"reply_to.message_id": msg.MessageID,
+		}, bson.M{
+			"$set": bson.M{"reply_to.body": ChatMessageBody{}},
+		})
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	updateLastChatMessageListCache(msg)
+	return msg, nil
+}
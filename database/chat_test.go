@@ -39,7 +39,7 @@ func TestAddMessage(t *testing.T) {
 						Text:          "纯文本消息",
 						Src:           "",
 						Format:        "",
-						Size:          "",
+						Size:          0,
 						Longitude:     "",
 						Latitude:      "",
 						Scale:         0,
@@ -78,7 +78,7 @@ func BenchmarkAddMessageWithTransaction(b *testing.B) {
 					Text:          "纯文本消息",
 					Src:           "",
 					Format:        "",
-					Size:          "",
+					Size:          0,
 					Longitude:     "",
 					Latitude:      "",
 					Scale:         0,
@@ -113,7 +113,7 @@ func BenchmarkAddMessage(b *testing.B) {
 					Text:          "纯文本消息",
 					Src:           "",
 					Format:        "",
-					Size:          "",
+					Size:          0,
 					Longitude:     "",
 					Latitude:      "",
 					Scale:         0,
@@ -145,7 +145,7 @@ func TestAddMessageWithTransaction(t *testing.T) {
 			Text:          "纯文本消息",
 			Src:           "",
 			Format:        "",
-			Size:          "",
+			Size:          0,
 			Longitude:     "",
 			Latitude:      "",
 			Scale:         0,
@@ -178,7 +178,7 @@ func TestRollbackMessage(t *testing.T) {
 				Text:          "纯文本消息",
 				Src:           "",
 				Format:        "",
-				Size:          "",
+				Size:          0,
 				Longitude:     "",
 				Latitude:      "",
 				Scale:         0,
@@ -193,12 +193,20 @@ func TestRollbackMessage(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if ok, err := RollbackChatMessage(msg.ID); (err != nil) != false {
-			t.Errorf("RollbackChatMessage() error = %v, wantErr %v", err, false)
-		} else {
-			if !ok {
-				t.Errorf("RollbackChatMessage() ok = %v, want %v", ok, true)
-			}
+		rollback, err := RollbackChatMessage(&RollbackChatMessageFilter{
+			RoomID:      msg.RoomID,
+			SessionType: msg.SessionType,
+			MessageID:   msg.MessageID,
+			SenderID:    msg.SenderID,
+		})
+		if err != nil {
+			t.Fatalf("RollbackChatMessage() error = %v, wantErr %v", err, false)
+		}
+		if rollback.Status != ChatMessageStatusRollback {
+			t.Errorf("RollbackChatMessage() status = %v, want %v", rollback.Status, ChatMessageStatusRollback)
+		}
+		if rollback.Body.Text != "" {
+			t.Errorf("RollbackChatMessage() body.text = %v, want empty", rollback.Body.Text)
 		}
 
 	})
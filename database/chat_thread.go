@@ -0,0 +1,72 @@
+package database
+
+import (
+	"regexp"
+
+	"github.com/jerbe/jim/errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/26 15:20
+  @describe :
+*/
+
+// UpdateChatThreadReply 话题有新回复时更新根消息的回复数量跟最后回复时间
+// 话题房间的消息ID是连续递增的,所以最新回复的消息ID就是回复数量
+func UpdateChatThreadReply(roomID string, sessionType int, rootMessageID, replyMessageID, repliedAt int64) error {
+	root := new(ChatMessage)
+	err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMessage).
+		FindOneAndUpdate(GlobCtx, bson.M{
+			"room_id":      roomID,
+			"session_type": sessionType,
+			"message_id":   rootMessageID,
+		}, bson.M{
+			"$max": bson.M{
+				"thread_reply_count": replyMessageID,
+				"thread_replied_at":  repliedAt,
+			},
+		}, options.FindOneAndUpdate().SetReturnDocument(options.After)).
+		Decode(root)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	updateLastChatMessageListCache(root)
+	return nil
+}
+
+// GetChatThreadRoomsUpdatedAfter 获取房间中在指定时间(毫秒)之后有新回复的话题房间
+// updatedAfter 的 key 为所属的房间ID;话题房间号以所属房间号开头,按前缀匹配可以使用 room_id 索引
+func GetChatThreadRoomsUpdatedAfter(updatedAfter map[string]int64) ([]*ChatRoom, error) {
+	if len(updatedAfter) == 0 {
+		return []*ChatRoom{}, nil
+	}
+
+	conds := make(bson.A, 0, len(updatedAfter))
+	for roomID, after := range updatedAfter {
+		conds = append(conds, bson.M{
+			"room_id":    primitive.Regex{Pattern: "^" + regexp.QuoteMeta(roomID+"_thread_")},
+			"updated_at": bson.M{"$gt": after},
+		})
+	}
+
+	rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionRoom).
+		Find(GlobCtx, bson.M{"$or": conds})
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	defer rs.Close(GlobCtx)
+	rooms := make([]*ChatRoom, 0)
+	if err = rs.All(GlobCtx, &rooms); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return rooms, nil
+}
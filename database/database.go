@@ -7,6 +7,7 @@ import (
 
 	"github.com/jerbe/jim/config"
 	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
 
 	"github.com/jerbe/jcache/v2"
 	"github.com/jerbe/jcache/v2/driver"
@@ -14,6 +15,7 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
@@ -41,6 +43,12 @@ var (
 	// TableGroupMembers 群组成员表
 	TableGroupMembers = DatabaseMySQLIM + ".`group_member`"
 
+	// TableGroupPins 群置顶消息表
+	TableGroupPins = DatabaseMySQLIM + ".`group_pin`"
+
+	// TableGroupAnnouncements 群公告表,保存所有历史版本
+	TableGroupAnnouncements = DatabaseMySQLIM + ".`group_announcement`"
+
 	// TableUsers 用户数据表
 	TableUsers = DatabaseMySQLIM + ".`users`"
 
@@ -51,9 +59,13 @@ var (
 	TableUserRelationInvite = DatabaseMySQLIM + ".`user_relation_invite`"
 
 	// MongoDB 库跟集合
-	DatabaseMongodbIM = "jim"
-	CollectionRoom    = "room"
-	CollectionMessage = "message"
+	DatabaseMongodbIM      = "jim"
+	CollectionRoom         = "room"
+	CollectionMessage      = "message"
+	CollectionCursor       = "cursor"
+	CollectionConversation = "conversation"
+	CollectionMedia        = "media"
+	CollectionSchedule     = "schedule"
 )
 
 func constDatabase() {
@@ -63,6 +75,12 @@ func constDatabase() {
 	// TableGroupMembers 群组成员表
 	TableGroupMembers = DatabaseMySQLIM + ".`group_member`"
 
+	// TableGroupPins 群置顶消息表
+	TableGroupPins = DatabaseMySQLIM + ".`group_pin`"
+
+	// TableGroupAnnouncements 群公告表,保存所有历史版本
+	TableGroupAnnouncements = DatabaseMySQLIM + ".`group_announcement`"
+
 	// TableUsers 用户数据表
 	TableUsers = DatabaseMySQLIM + ".`users`"
 
@@ -82,6 +100,9 @@ var (
 
 	GlobCache *jcache.Client
 
+	// mongoTransactionSupported MongoDB 是否支持事务,只有副本集跟分片集群支持事务
+	mongoTransactionSupported bool
+
 	initialized bool
 )
 
@@ -157,6 +178,27 @@ func Init(cfg config.Config) (db *Database, err error) {
 	}
 	db.Mongo = mongodbCli
 
+	// 检测是否可以使用事务写入消息
+	if !mongodbCfg.DisableTransaction {
+		mongoTransactionSupported, err = detectMongoTransaction(mongodbCli)
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Info().Bool("transaction", mongoTransactionSupported).Msg("聊天消息写入方式")
+
+	// 执行mongodb数据迁移,部分迁移需要在创建索引之前完成
+	err = migrateMongo(mongodbCli.Database(DatabaseMongodbIM))
+	if err != nil {
+		return nil, err
+	}
+
+	// 创建mongodb索引
+	err = initMongoIndexes(mongodbCli.Database(DatabaseMongodbIM))
+	if err != nil {
+		return nil, err
+	}
+
 	// 变量重新整理一遍
 	constDatabase()
 
@@ -210,6 +252,65 @@ func initRedis(cfg config.Redis) (redis.UniversalClient, error) {
 	return redisCli, nil
 }
 
+// migrateMongo 执行mongodb的数据迁移,每个迁移只处理旧版本留下的数据,执行结果会记录日志
+func migrateMongo(db *mongo.Database) error {
+	if err := migrateDuplicateChatRooms(db); err != nil {
+		return err
+	}
+	return nil
+}
+
+// initMongoIndexes 创建mongodb集合需要的索引,索引已经存在时不会重复创建
+func initMongoIndexes(db *mongo.Database) error {
+	if err := createChatRoomIndexes(db); err != nil {
+		return err
+	}
+
+	if err := createChatCursorIndexes(db); err != nil {
+		return err
+	}
+
+	if err := createChatConversationIndexes(db); err != nil {
+		return err
+	}
+
+	if err := createMediaIndexes(db); err != nil {
+		return err
+	}
+
+	if err := createChatScheduleIndexes(db); err != nil {
+		return err
+	}
+
+	if err := createChatOutboxIndexes(db); err != nil {
+		return err
+	}
+	return nil
+}
+
+// detectMongoTransaction 检测 MongoDB 是否部署为副本集或分片集群
+func detectMongoTransaction(cli *mongo.Client) (bool, error) {
+	result := bson.M{}
+	err := cli.Database("admin").RunCommand(GlobCtx, bson.D{{Key: "hello", Value: 1}}).Decode(&result)
+	if err != nil {
+		// 4.4.2 之前的版本不支持 hello 命令
+		err = cli.Database("admin").RunCommand(GlobCtx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&result)
+		if err != nil {
+			return false, errors.Wrap(err)
+		}
+	}
+
+	if _, ok := result["setName"]; ok {
+		return true, nil
+	}
+	return result["msg"] == "isdbgrid", nil
+}
+
+// MongoTransactionEnabled 是否使用事务写入聊天消息
+func MongoTransactionEnabled() bool {
+	return mongoTransactionSupported
+}
+
 // checkCacheEmpty 检测缓存是佛是空记录
 func checkCacheEmpty(cacheKey string) bool {
 	v, err := GlobCache.Get(GlobCtx, cacheKey).Result()
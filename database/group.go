@@ -35,6 +35,12 @@ type Group struct {
 	CreatedAt   time.Time `db:"created_at" json:"created_at"`
 	UpdaterID   int64     `db:"updater_id" json:"updater_id"`
 	UpdatedAt   time.Time `db:"updated_at" json:"updated_at"`
+
+	// Announcement 当前群公告,只有 FillGroupExtras 后才有值
+	Announcement *GroupAnnouncement `db:"-" json:"announcement,omitempty"`
+
+	// Pins 置顶消息,只有 FillGroupExtras 后才有值
+	Pins []*GroupPin `db:"-" json:"pins,omitempty"`
 }
 
 // GroupMember 群成员信息
@@ -134,6 +140,33 @@ func GetGroup(id int64, opts ...*GetOptions) (*Group, error) {
 	return group, nil
 }
 
+// GetGroups 获取多个群组信息
+func GetGroups(ids []int64, opts ...*GetOptions) ([]*Group, error) {
+	if len(ids) == 0 {
+		return nil, errors.Wrap(errors.NoRecords)
+	}
+
+	opt := MergeGetOptions(opts)
+	sqlQuery := fmt.Sprintf("SELECT `id`,`name`,`max_member`,`owner_id`,`speak_status`,`updated_at`,`updater_id`,`creator_id`,`created_at` FROM %s WHERE `id` IN (?)", TableGroups)
+	sqlQuery, sqlArgs, err := sqlx.In(sqlQuery, ids)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	rows, err := opt.SQLExt().Query(sqlQuery, sqlArgs...)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	defer rows.Close()
+	var groups []*Group
+	err = sqlx.StructScan(rows, &groups)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return groups, nil
+}
+
 type UpdateGroupData struct {
 	Name        *string   `db:"name" json:"name"`
 	MaxMember   *int      `db:"max_member" json:"max_member"`
@@ -389,6 +422,30 @@ func GetGroupMemberIDsString(groupID int64, opts ...*GetOptions) ([]string, erro
 	return userIDs, nil
 }
 
+// GetUserGroupIDs 获取用户加入的所有群组ID
+func GetUserGroupIDs(userID int64, opts ...*GetOptions) ([]int64, error) {
+	opt := MergeGetOptions(opts)
+	sqlQuery := fmt.Sprintf("SELECT `group_id` FROM %s WHERE `user_id` = ?", TableGroupMembers)
+
+	rs, err := opt.SQLExt().Query(sqlQuery, userID)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	defer rs.Close()
+	var groupIDs []int64
+	for rs.Next() {
+		var id int64
+		err = rs.Scan(&id)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		groupIDs = append(groupIDs, id)
+	}
+
+	return groupIDs, nil
+}
+
 type RemoveGroupMembersFilter struct {
 	// 群ID
 	GroupID int64 `db:"group_id"`
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jerbe/jim/errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/4 10:50
+  @describe :
+*/
+
+const (
+	// GroupAnnouncementMaxLength 群公告的最大字符数
+	GroupAnnouncementMaxLength = 2000
+)
+
+// GroupAnnouncement 群公告,每次发布都会新增一个版本,版本号最大的为当前公告
+type GroupAnnouncement struct {
+	// ID 公告记录ID
+	ID int64 `db:"id" json:"id"`
+
+	// GroupID 群ID
+	GroupID int64 `db:"group_id" json:"group_id"`
+
+	// Content 公告内容,为空表示公告已被清空
+	Content string `db:"content" json:"content"`
+
+	// AuthorID 发布人ID
+	AuthorID int64 `db:"author_id" json:"author_id"`
+
+	// Revision 版本号,从1开始
+	Revision int `db:"revision" json:"revision"`
+
+	// CreatedAt 发布时间
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// AddGroupAnnouncement 发布一个新版本的群公告,版本号在上一个版本的基础上加1
+// 并发发布时唯一索引会让后提交的失败,不会出现相同的版本号
+func AddGroupAnnouncement(announcement *GroupAnnouncement, opts ...*SetOptions) error {
+	opt := MergeSetOptions(opts)
+	if announcement.GroupID <= 0 || announcement.AuthorID <= 0 {
+		return errors.Wrap(errors.ParamsInvalid)
+	}
+
+	if announcement.CreatedAt.IsZero() {
+		announcement.CreatedAt = time.Now()
+	}
+
+	sqlQuery := fmt.Sprintf("INSERT INTO %s (`group_id`,`content`,`author_id`,`revision`,`created_at`) SELECT ?, ?, ?, IFNULL(MAX(`revision`), 0) + 1, ? FROM %s WHERE `group_id` = ?", TableGroupAnnouncements, TableGroupAnnouncements)
+	rs, err := opt.SQLExt().Exec(sqlQuery, announcement.GroupID, announcement.Content, announcement.AuthorID, announcement.CreatedAt, announcement.GroupID)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	id, err := rs.LastInsertId()
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	announcement.ID = id
+
+	sqlQuery = fmt.Sprintf("SELECT `revision` FROM %s WHERE `id` = ?", TableGroupAnnouncements)
+	err = sqlx.Get(opt.SQLExt(), &announcement.Revision, sqlQuery, id)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+// GetGroupAnnouncement 获取群的当前公告,从未发布过时返回 errors.NoRecords
+func GetGroupAnnouncement(groupID int64, opts ...*GetOptions) (*GroupAnnouncement, error) {
+	opt := MergeGetOptions(opts)
+	sqlQuery := fmt.Sprintf("SELECT `id`,`group_id`,`content`,`author_id`,`revision`,`created_at` FROM %s WHERE `group_id` = ? ORDER BY `revision` DESC LIMIT 1", TableGroupAnnouncements)
+
+	announcement := new(GroupAnnouncement)
+	err := sqlx.Get(opt.SQLExt(), announcement, sqlQuery, groupID)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return announcement, nil
+}
+
+// GetGroupAnnouncementRevisions 获取群公告的历史版本,按版本号倒序
+// beforeRevision 大于0时只获取该版本之前的版本,用于分页
+func GetGroupAnnouncementRevisions(groupID int64, beforeRevision, limit int, opts ...*GetOptions) ([]*GroupAnnouncement, error) {
+	opt := MergeGetOptions(opts)
+	if limit <= 0 {
+		return nil, errors.Wrap(errors.ParamsInvalid)
+	}
+
+	sqlQuery := fmt.Sprintf("SELECT `id`,`group_id`,`content`,`author_id`,`revision`,`created_at` FROM %s WHERE `group_id` = ? AND (? = 0 OR `revision` < ?) ORDER BY `revision` DESC LIMIT ?", TableGroupAnnouncements)
+
+	announcements := make([]*GroupAnnouncement, 0)
+	err := sqlx.Select(opt.SQLExt(), &announcements, sqlQuery, groupID, beforeRevision, beforeRevision, limit)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return announcements, nil
+}
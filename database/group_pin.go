@@ -0,0 +1,151 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jerbe/jim/errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/4 10:20
+  @describe :
+*/
+
+const (
+	// GroupMaxPins 每个群最多置顶的消息数量
+	GroupMaxPins = 10
+)
+
+// ErrGroupPinLimit 群置顶消息数量已达上限
+var ErrGroupPinLimit = errors.New("group pin limit reached")
+
+// GroupPin 群置顶消息
+type GroupPin struct {
+	// ID 置顶记录ID
+	ID int64 `db:"id" json:"id"`
+
+	// GroupID 群ID
+	GroupID int64 `db:"group_id" json:"group_id"`
+
+	// MessageID 被置顶的消息ID
+	MessageID int64 `db:"message_id" json:"message_id"`
+
+	// PinnerID 置顶人ID
+	PinnerID int64 `db:"pinner_id" json:"pinner_id"`
+
+	// CreatedAt 置顶时间
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// AddGroupPin 置顶一条群消息,已经置顶过的返回 errors.NotChange,数量达到 GroupMaxPins 的返回 ErrGroupPinLimit
+// 数量限制在同一条 INSERT 语句中判断,并发置顶也不会超出上限
+func AddGroupPin(pin *GroupPin, opts ...*SetOptions) error {
+	opt := MergeSetOptions(opts)
+	if pin.GroupID <= 0 || pin.MessageID <= 0 || pin.PinnerID <= 0 {
+		return errors.Wrap(errors.ParamsInvalid)
+	}
+
+	if pin.CreatedAt.IsZero() {
+		pin.CreatedAt = time.Now()
+	}
+
+	sqlQuery := fmt.Sprintf("INSERT IGNORE INTO %s (`group_id`,`message_id`,`pinner_id`,`created_at`) SELECT ?, ?, ?, ? FROM DUAL WHERE (SELECT COUNT(*) FROM %s WHERE `group_id` = ?) < ?", TableGroupPins, TableGroupPins)
+	rs, err := opt.SQLExt().Exec(sqlQuery, pin.GroupID, pin.MessageID, pin.PinnerID, pin.CreatedAt, pin.GroupID, GroupMaxPins)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	cnt, err := rs.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if cnt == 0 {
+		// 没有写入时区分是已经置顶过还是数量已满
+		var exists int64
+		sqlQuery = fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE `group_id` = ? AND `message_id` = ?", TableGroupPins)
+		if err = sqlx.Get(opt.SQLExt(), &exists, sqlQuery, pin.GroupID, pin.MessageID); err != nil {
+			return errors.Wrap(err)
+		}
+		if exists > 0 {
+			return errors.Wrap(errors.NotChange)
+		}
+		return errors.Wrap(ErrGroupPinLimit)
+	}
+
+	id, err := rs.LastInsertId()
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	pin.ID = id
+	return nil
+}
+
+// RemoveGroupPin 取消置顶一条群消息,没有置顶过的返回 errors.NotChange
+func RemoveGroupPin(groupID, messageID int64, opts ...*SetOptions) error {
+	opt := MergeSetOptions(opts)
+	if groupID <= 0 || messageID <= 0 {
+		return errors.Wrap(errors.ParamsInvalid)
+	}
+
+	sqlQuery := fmt.Sprintf("DELETE FROM %s WHERE `group_id` = ? AND `message_id` = ?", TableGroupPins)
+	rs, err := opt.SQLExt().Exec(sqlQuery, groupID, messageID)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	cnt, err := rs.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	if cnt == 0 {
+		return errors.Wrap(errors.NotChange)
+	}
+	return nil
+}
+
+// GetGroupPins 获取群的置顶消息,最后置顶的排在最前面
+func GetGroupPins(groupID int64, opts ...*GetOptions) ([]*GroupPin, error) {
+	opt := MergeGetOptions(opts)
+	sqlQuery := fmt.Sprintf("SELECT `id`,`group_id`,`message_id`,`pinner_id`,`created_at` FROM %s WHERE `group_id` = ? ORDER BY `id` DESC", TableGroupPins)
+
+	pins := make([]*GroupPin, 0)
+	err := sqlx.Select(opt.SQLExt(), &pins, sqlQuery, groupID)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return pins, nil
+}
+
+// GetGroupPinCount 获取群的置顶消息数量
+func GetGroupPinCount(groupID int64, opts ...*GetOptions) (int64, error) {
+	opt := MergeGetOptions(opts)
+	sqlQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE `group_id` = ?", TableGroupPins)
+
+	var cnt int64
+	err := sqlx.Get(opt.SQLExt(), &cnt, sqlQuery, groupID)
+	if err != nil {
+		return 0, errors.Wrap(err)
+	}
+	return cnt, nil
+}
+
+// FillGroupExtras 填充群的当前公告跟置顶消息,公告被清空时不填充
+func FillGroupExtras(group *Group, opts ...*GetOptions) error {
+	announcement, err := GetGroupAnnouncement(group.ID, opts...)
+	if err != nil && !errors.IsNoRecord(err) {
+		return errors.Wrap(err)
+	}
+	if announcement != nil && announcement.Content != "" {
+		group.Announcement = announcement
+	}
+
+	group.Pins, err = GetGroupPins(group.ID, opts...)
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	return nil
+}
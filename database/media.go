@@ -0,0 +1,370 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jerbe/jim/errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/30 10:05
+  @describe :
+*/
+
+const (
+	// mongoErrNamespaceNotFound 集合不存在的错误码
+	mongoErrNamespaceNotFound = 26
+
+	// mongoErrIndexNotFound 索引不存在的错误码
+	mongoErrIndexNotFound = 27
+)
+
+// Media 上传的媒体文件
+// 每个用户上传的文件各有一条记录,相同内容的文件在存储中只保存一份
+type Media struct {
+	// ID
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+
+	// Checksum 文件内容的sha256
+	Checksum string `bson:"checksum" json:"checksum"`
+
+	// Key 文件在存储中的键
+	Key string `bson:"key" json:"key"`
+
+	// Name 上传时的文件名
+	Name string `bson:"name" json:"name"`
+
+	// ContentType 嗅探出的文件类型
+	ContentType string `bson:"content_type" json:"content_type"`
+
+	// Size 文件字节数
+	Size int64 `bson:"size" json:"size"`
+
+	// UploaderID 上传的用户ID
+	UploaderID int64 `bson:"uploader_id" json:"uploader_id"`
+
+	// CreatedAt 创建时间
+	CreatedAt int64 `bson:"created_at" json:"created_at"`
+
+	// Metadata 后台任务提取的元数据,为空时表示还没有提取
+	Metadata *MediaMetadata `bson:"metadata,omitempty" json:"metadata,omitempty"`
+}
+
+// MediaMetadata 图片跟视频的元数据
+type MediaMetadata struct {
+	// Width 宽度,单位像素
+	Width int `bson:"width,omitempty" json:"width,omitempty"`
+
+	// Height 高度,单位像素
+	Height int `bson:"height,omitempty" json:"height,omitempty"`
+
+	// Blurhash 模糊占位图的blurhash,视频使用封面计算
+	Blurhash string `bson:"blurhash,omitempty" json:"blurhash,omitempty"`
+
+	// Thumbnails 图片的缩略图,按尺寸从小到大排列
+	Thumbnails []MediaThumbnail `bson:"thumbnails,omitempty" json:"thumbnails,omitempty"`
+
+	// PosterKey 视频封面在存储中的键
+	PosterKey string `bson:"poster_key,omitempty" json:"poster_key,omitempty"`
+
+	// Duration 视频时长,单位毫秒
+	Duration int64 `bson:"duration,omitempty" json:"duration,omitempty"`
+
+	// Error 提取失败的原因,失败后不再重试
+	Error string `bson:"error,omitempty" json:"error,omitempty"`
+
+	// ProcessedAt 提取完成的时间
+	ProcessedAt int64 `bson:"processed_at" json:"processed_at"`
+}
+
+// MediaThumbnail 缩略图
+type MediaThumbnail struct {
+	// Size 生成时使用的最长边像素,同时作为缩略图的标识
+	Size int `bson:"size" json:"size"`
+
+	// Width 宽度,单位像素
+	Width int `bson:"width" json:"width"`
+
+	// Height 高度,单位像素
+	Height int `bson:"height" json:"height"`
+
+	// Key 缩略图在存储中的键
+	Key string `bson:"key" json:"key"`
+}
+
+// createMediaIndexes 创建媒体文件的索引,以及按媒体文件查找消息的索引
+func createMediaIndexes(db *mongo.Database) error {
+	// 旧版本按 checksum 全局唯一,现在每个用户各有一条记录
+	_, err := db.Collection(CollectionMedia).Indexes().DropOne(GlobCtx, "checksum_1")
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && (cmdErr.Code == mongoErrNamespaceNotFound || cmdErr.Code == mongoErrIndexNotFound)) {
+		return errors.Wrap(err)
+	}
+
+	_, err = db.Collection(CollectionMedia).Indexes().CreateOne(GlobCtx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "checksum", Value: 1}, {Key: "uploader_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	_, err = db.Collection(CollectionMessage).Indexes().CreateMany(GlobCtx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "body.media_id", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"body.media_id": bson.M{"$exists": true}}),
+		},
+		{
+			Keys:    bson.D{{Key: "body.items.body.media_id", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"body.items.body.media_id": bson.M{"$exists": true}}),
+		},
+	})
+	return errors.Wrap(err)
+}
+
+// AddMedia 添加媒体文件记录
+// 相同用户相同 Checksum 的记录已经存在时返回已经存在的记录
+func AddMedia(media *Media) (*Media, error) {
+	if media.CreatedAt == 0 {
+		media.CreatedAt = time.Now().UnixMilli()
+	}
+
+	rs, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMedia).
+		InsertOne(GlobCtx, media)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return GetUserMediaByChecksum(media.UploaderID, media.Checksum)
+		}
+		return nil, errors.Wrap(err)
+	}
+
+	media.ID = rs.InsertedID.(primitive.ObjectID)
+	return media, nil
+}
+
+// GetMedia 根据ID获取媒体文件记录
+func GetMedia(id string) (*Media, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, errors.Wrap(errors.NoRecords)
+	}
+
+	media := new(Media)
+	err = GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMedia).
+		FindOne(GlobCtx, bson.M{"_id": oid}).
+		Decode(media)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return media, nil
+}
+
+// GetUserMediaByChecksum 根据文件内容的sha256获取用户自己上传的媒体文件记录
+func GetUserMediaByChecksum(userID int64, checksum string) (*Media, error) {
+	media := new(Media)
+	err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMedia).
+		FindOne(GlobCtx, bson.M{"checksum": checksum, "uploader_id": userID}).
+		Decode(media)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return media, nil
+}
+
+// GetMediaByChecksum 根据文件内容的sha256获取任意用户上传的媒体文件记录
+// 只用于复用存储中已经保存的文件,不能把记录返回给其他用户
+func GetMediaByChecksum(checksum string) (*Media, error) {
+	media := new(Media)
+	err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMedia).
+		FindOne(GlobCtx, bson.M{"checksum": checksum}).
+		Decode(media)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return media, nil
+}
+
+// UpdateMediaMetadata 保存媒体文件的元数据
+func UpdateMediaMetadata(id primitive.ObjectID, metadata *MediaMetadata) error {
+	if metadata.ProcessedAt == 0 {
+		metadata.ProcessedAt = time.Now().UnixMilli()
+	}
+
+	_, err := GlobDB.Mongo.Database(DatabaseMongodbIM).
+		Collection(CollectionMedia).
+		UpdateOne(GlobCtx, bson.M{"_id": id}, bson.M{"$set": bson.M{"metadata": metadata}})
+	return errors.Wrap(err)
+}
+
+// ==================================================================================
+// ============================== 元数据提取队列 ======================================
+// ==================================================================================
+// 提取元数据比较耗时,放到redis列表中由后台任务处理,多个实例可以共同消费
+
+// MediaMetadataJob 元数据提取任务
+type MediaMetadataJob struct {
+	// MediaID 媒体文件ID
+	MediaID string `json:"media_id"`
+
+	// RoomID 引用该文件的消息所在的房间ID,为空时只提取元数据
+	RoomID string `json:"room_id,omitempty"`
+
+	// SessionType 引用该文件的消息的会话类型
+	SessionType int `json:"session_type,omitempty"`
+
+	// MessageID 引用该文件的消息ID,提取完成后把元数据补充到消息主体中
+	MessageID int64 `json:"message_id,omitempty"`
+}
+
+// MarshalBinary 实现encoding.BinaryMarshaler接口
+func (j *MediaMetadataJob) MarshalBinary() ([]byte, error) {
+	return json.Marshal(j)
+}
+
+// PushMediaMetadataJob 添加元数据提取任务
+func PushMediaMetadataJob(job *MediaMetadataJob) error {
+	err := GlobDB.Redis.RPush(GlobCtx, cacheKeyFormatMediaMetadataQueue(), job).Err()
+	return errors.Wrap(err)
+}
+
+// PopMediaMetadataJob 阻塞获取一个元数据提取任务,超时后返回 redis.Nil
+func PopMediaMetadataJob(ctx context.Context, timeout time.Duration) (*MediaMetadataJob, error) {
+	rs, err := GlobDB.Redis.BLPop(ctx, timeout, cacheKeyFormatMediaMetadataQueue()).Result()
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	// 返回值为 [key, value]
+	job := new(MediaMetadataJob)
+	if err = json.Unmarshal([]byte(rs[1]), job); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return job, nil
+}
+
+// cacheKeyFormatMediaMetadataQueue 格式化元数据提取队列的缓存 key
+func cacheKeyFormatMediaMetadataQueue() string {
+	return fmt.Sprintf("%s:media:metadata:queue", CacheKeyPrefix)
+}
+
+// ==================================================================================
+// ============================== 分片上传会话 ========================================
+// ==================================================================================
+// 分片上传会话保存在redis中,过期后自动清除,已上传的分片序号保存在单独的set中
+
+// MediaUpload 分片上传会话
+type MediaUpload struct {
+	// UploadID 上传ID
+	UploadID string `json:"upload_id"`
+
+	// UserID 上传的用户ID
+	UserID int64 `json:"user_id"`
+
+	// Name 文件名
+	Name string `json:"name"`
+
+	// Size 文件字节数
+	Size int64 `json:"size"`
+
+	// Checksum 客户端声明的文件内容sha256
+	Checksum string `json:"checksum"`
+
+	// ChunkSize 每个分片的字节数,最后一个分片可以小于该值
+	ChunkSize int64 `json:"chunk_size"`
+
+	// TotalChunks 分片数量
+	TotalChunks int `json:"total_chunks"`
+
+	// CreatedAt 创建时间
+	CreatedAt int64 `json:"created_at"`
+}
+
+// MarshalBinary 实现encoding.BinaryMarshaler接口
+func (u *MediaUpload) MarshalBinary() ([]byte, error) {
+	return json.Marshal(u)
+}
+
+// UnmarshalBinary 实现encoding.BinaryUnmarshaler接口
+func (u *MediaUpload) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, u)
+}
+
+// SetMediaUpload 保存分片上传会话,会话已经存在时只刷新有效期
+func SetMediaUpload(upload *MediaUpload, expiration time.Duration) (*MediaUpload, error) {
+	cacheKey := cacheKeyFormatMediaUpload(upload.UploadID)
+	ok, err := GlobDB.Redis.SetNX(GlobCtx, cacheKey, upload, expiration).Result()
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	if ok {
+		return upload, nil
+	}
+
+	pipe := GlobDB.Redis.Pipeline()
+	pipe.Expire(GlobCtx, cacheKey, expiration)
+	pipe.Expire(GlobCtx, cacheKeyFormatMediaUploadChunks(upload.UploadID), expiration)
+	if _, err = pipe.Exec(GlobCtx); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return GetMediaUpload(upload.UploadID)
+}
+
+// GetMediaUpload 获取分片上传会话
+func GetMediaUpload(uploadID string) (*MediaUpload, error) {
+	upload := new(MediaUpload)
+	err := GlobDB.Redis.Get(GlobCtx, cacheKeyFormatMediaUpload(uploadID)).Scan(upload)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return upload, nil
+}
+
+// AddMediaUploadChunk 记录已经上传的分片序号
+func AddMediaUploadChunk(uploadID string, index int, expiration time.Duration) error {
+	cacheKey := cacheKeyFormatMediaUploadChunks(uploadID)
+	pipe := GlobDB.Redis.TxPipeline()
+	pipe.SAdd(GlobCtx, cacheKey, index)
+	pipe.Expire(GlobCtx, cacheKey, expiration)
+	_, err := pipe.Exec(GlobCtx)
+	return errors.Wrap(err)
+}
+
+// GetMediaUploadChunks 获取已经上传的分片序号
+func GetMediaUploadChunks(uploadID string) ([]int, error) {
+	var chunks []int
+	err := GlobDB.Redis.SMembers(GlobCtx, cacheKeyFormatMediaUploadChunks(uploadID)).ScanSlice(&chunks)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return chunks, nil
+}
+
+// DeleteMediaUpload 删除分片上传会话
+func DeleteMediaUpload(uploadID string) error {
+	err := GlobDB.Redis.Del(GlobCtx, cacheKeyFormatMediaUpload(uploadID), cacheKeyFormatMediaUploadChunks(uploadID)).Err()
+	return errors.Wrap(err)
+}
+
+// cacheKeyFormatMediaUpload 格式化分片上传会话的缓存 key
+func cacheKeyFormatMediaUpload(uploadID string) string {
+	return fmt.Sprintf("%s:media:upload:%s", CacheKeyPrefix, uploadID)
+}
+
+// cacheKeyFormatMediaUploadChunks 格式化已上传分片的缓存 key
+func cacheKeyFormatMediaUploadChunks(uploadID string) string {
+	return fmt.Sprintf("%s:media:upload:%s:chunks", CacheKeyPrefix, uploadID)
+}
@@ -299,6 +299,30 @@ func GetUserRelationByUsersID(userAID int64, userBID int64, opts ...*GetOptions)
 	return relation, nil
 }
 
+// GetUserRelationTargetIDs 获取跟该用户建立过关系的所有用户ID,不区分好友状态
+func GetUserRelationTargetIDs(userID int64, opts ...*GetOptions) ([]int64, error) {
+	opt := MergeGetOptions(opts)
+	sqlQuery := fmt.Sprintf("SELECT IF(`user_a_id` = ?, `user_b_id`, `user_a_id`) FROM %s WHERE `user_a_id` = ? OR `user_b_id` = ?", TableUserRelation)
+
+	rs, err := opt.SQLExt().Query(sqlQuery, userID, userID, userID)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	defer rs.Close()
+	var userIDs []int64
+	for rs.Next() {
+		var id int64
+		err = rs.Scan(&id)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+		userIDs = append(userIDs, id)
+	}
+
+	return userIDs, nil
+}
+
 // UpdateUserRelationFilter 更新用户关系过滤器
 type UpdateUserRelationFilter struct {
 	ID int64 `db:"id" json:"id"`
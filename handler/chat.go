@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/jerbe/jim/config"
 	"github.com/jerbe/jim/database"
 	"github.com/jerbe/jim/errors"
 	"github.com/jerbe/jim/log"
@@ -36,8 +37,8 @@ type ChatMessage struct {
 	// SessionType 会话类型; 1:私聊, 2:群聊
 	SessionType int `json:"session_type" binding:"required" enums:"1,2" example:"1"`
 
-	// Type 消息类型; 1-纯文本,2-图片,3-语音,4-视频, 5-位置
-	Type int `json:"type" enums:"1,2,3,4,5" binding:"required" example:"1"`
+	// Type 消息类型; 1-纯文本,2-图片,3-语音,4-视频,5-位置,6-文件,7-表情贴纸,8-卡片,9-系统通知,10-自定义,11-合并转发
+	Type int `json:"type" enums:"1,2,3,4,5,6,7,8,9,10,11" binding:"required" example:"1"`
 
 	// SenderID 发送方ID
 	SenderID int64 `json:"sender_id" example:"1234456"`
@@ -48,11 +49,69 @@ type ChatMessage struct {
 	// MessageID 消息ID
 	MessageID int64 `json:"message_id" example:"123"`
 
+	// ReadStatus 已读状态,只有私聊有效; 0-未读,1-已读
+	ReadStatus int `json:"read_status" enums:"0,1" example:"0"`
+
+	// Status 消息状态; 1-正常,3-已撤回,4-已过期;不是正常状态时消息主体为空
+	Status int `json:"status" enums:"1,3,4" example:"1"`
+
 	// CreatedAt 创建
-	CreatedAt int64 `json:"created_at"example:"12345678901234"`
+	CreatedAt int64 `json:"created_at" example:"12345678901234"`
 
 	// Body 消息体;
 	Body ChatMessageBody `json:"body" binding:"required"`
+
+	// ReplyTo 回复的消息快照
+	ReplyTo *ChatMessageQuote `json:"reply_to,omitempty"`
+
+	// ThreadID 所属话题的根消息ID,为0时表示不在话题中
+	ThreadID int64 `json:"thread_id,omitempty" example:"0"`
+
+	// ThreadReplyCount 以该消息为根的话题回复数量
+	ThreadReplyCount int64 `json:"thread_reply_count,omitempty" example:"0"`
+
+	// Reactions 表情回应汇总
+	Reactions []*ChatMessageReaction `json:"reactions,omitempty"`
+
+	// EditedAt 最后编辑时间,为0时表示没有编辑过
+	EditedAt int64 `json:"edited_at,omitempty" example:"0"`
+
+	// Mentions 被@的用户ID列表
+	Mentions []int64 `json:"mentions,omitempty"`
+
+	// MentionAll 是否@所有人
+	MentionAll bool `json:"mention_all,omitempty" example:"false"`
+
+	// ExpireAt 过期时间,大于0时到期后消息会对所有人清空
+	ExpireAt int64 `json:"expire_at,omitempty" example:"0"`
+
+	// ScheduleID 定时消息的任务ID,只有还未发送的定时消息才有
+	ScheduleID string `json:"schedule_id,omitempty" example:"651e2a4f9d7a3bcd72000001"`
+
+	// SendAt 定时消息的发送时间,只有还未发送的定时消息才有
+	SendAt int64 `json:"send_at,omitempty" example:"0"`
+
+	// ForwardFromID 逐条转发时原消息的发送人ID,不是转发的消息不返回
+	ForwardFromID int64 `json:"forward_from_id,omitempty" example:"0"`
+}
+
+// ChatMessageQuote 被回复消息的快照
+// @Description 被回复消息的快照
+type ChatMessageQuote struct {
+	// MessageID 被回复的消息ID
+	MessageID int64 `json:"message_id" example:"120"`
+
+	// SenderID 被回复消息的发送人ID
+	SenderID int64 `json:"sender_id" example:"1234456"`
+
+	// Type 被回复消息的类型; 1-纯文本,2-图片,3-语音,4-视频, 5-位置
+	Type int `json:"type" example:"1"`
+
+	// Body 被回复消息的主体,文本会被截断
+	Body ChatMessageBody `json:"body"`
+
+	// CreatedAt 被回复消息的发送时间
+	CreatedAt int64 `json:"created_at" example:"12345678901234"`
 }
 
 func (cm *ChatMessage) MarshalBinary() ([]byte, error) {
@@ -66,17 +125,83 @@ func (cm *ChatMessage) UnmarshalBinary(data []byte) error {
 // ChatMessageBody 消息主体
 // @Description 消息主体
 type ChatMessageBody struct {
-	// 文本信息。适用消息类型: 1
+	// 文本信息。适用消息类型: 1,9
 	Text string `json:"text,omitempty" example:"这是一条聊天文案"`
 
-	// 来源地址。通用字段，适用消息类型: 2,3,4
+	// 来源地址。通用字段，适用消息类型: 2,3,4,6,7
 	Src string `json:"src,omitempty" example:"https://www.baidu.com/logo.png"`
 
-	// 文件格式。适用消息类型: 2,3,4
+	// 文件格式。适用消息类型: 2,3,4,7
 	Format string `json:"format,omitempty" example:"jpeg"`
 
-	// 文件大小。适用消息类型: 2,3,4
-	Size string `json:"size,omitempty" example:"1234567890"`
+	// 文件大小,单位字节。适用消息类型: 2,3,4,6
+	Size int64 `json:"size,omitempty" example:"1234567890"`
+
+	// 媒体文件ID,来源地址是本服务上传的文件时由服务端填写,此时 src 为每次读取时重新签名的地址。适用消息类型: 2,3,4,6
+	MediaID string `json:"media_id,omitempty" example:"6517a2c9e1b4a0d1c2f3e4a5"`
+
+	// 宽度,单位像素,由服务端提取。适用消息类型: 2,4
+	Width int `json:"width,omitempty" example:"1920"`
+
+	// 高度,单位像素,由服务端提取。适用消息类型: 2,4
+	Height int `json:"height,omitempty" example:"1080"`
+
+	// 模糊占位图的blurhash,由服务端提取。适用消息类型: 2,4
+	Blurhash string `json:"blurhash,omitempty" example:"LEHV6nWB2yk8pyo0adR*.7kCMdnj"`
+
+	// 缩略图,按尺寸从小到大排列,由服务端生成。适用消息类型: 2
+	Thumbnails []ChatMessageThumbnail `json:"thumbnails,omitempty"`
+
+	// 视频封面地址,由服务端生成。适用消息类型: 4
+	Poster string `json:"poster,omitempty" example:"https://im.example.com/api/v1/media/file/6517a2c9e1b4a0d1c2f3e4a5/poster?expires=1696000000&signature=abc"`
+
+	// posterVariant 视频封面的标识,读取时用来生成带签名的封面地址
+	posterVariant string
+
+	// 时长,单位毫秒,由服务端提取。适用消息类型: 4
+	Duration int64 `json:"duration,omitempty" example:"12500"`
+
+	// 文件名称。适用消息类型: 6
+	Name string `json:"name,omitempty" example:"报告.pdf"`
+
+	// 文件MIME类型。适用消息类型: 6
+	Mime string `json:"mime,omitempty" example:"application/pdf"`
+
+	// 表情贴纸ID。适用消息类型: 7
+	StickerID string `json:"sticker_id,omitempty" example:"cat_01"`
+
+	// 表情贴纸所属的表情包ID。适用消息类型: 7
+	PackID string `json:"pack_id,omitempty" example:"cat"`
+
+	// 卡片类型, link-链接,user-用户名片,group-群名片。适用消息类型: 8
+	CardType string `json:"card_type,omitempty" enums:"link,user,group" example:"link"`
+
+	// 卡片标题。适用消息类型: 8
+	Title string `json:"title,omitempty" example:"标题"`
+
+	// 卡片描述。适用消息类型: 8
+	Description string `json:"description,omitempty" example:"描述"`
+
+	// 链接地址。适用消息类型: 8
+	URL string `json:"url,omitempty" example:"https://www.baidu.com"`
+
+	// 名片对应的用户ID或者群ID。适用消息类型: 8
+	TargetID int64 `json:"target_id,omitempty" example:"1"`
+
+	// 系统通知事件, member_joined-群成员加入,group_renamed-群名称修改,announcement_updated-群公告更新。适用消息类型: 9
+	Event string `json:"event,omitempty" example:"member_joined"`
+
+	// 触发系统通知的用户ID。适用消息类型: 9
+	OperatorID int64 `json:"operator_id,omitempty" example:"1"`
+
+	// 系统通知涉及的用户ID列表。适用消息类型: 9
+	UserIDs []int64 `json:"user_ids,omitempty" example:"1,2"`
+
+	// 自定义消息的应用类型标识。适用消息类型: 10
+	CustomType string `json:"custom_type,omitempty" example:"order"`
+
+	// 自定义消息的JSON数据,服务端不解析。适用消息类型: 10
+	Data json.RawMessage `json:"data,omitempty" swaggertype:"object"`
 
 	// 位置信息-经度。 适用消息类型: 5
 	Longitude string `json:"longitude,omitempty" example:"0.213124212313"`
@@ -89,6 +214,41 @@ type ChatMessageBody struct {
 
 	// 位置信息标签。适用消息类型: 5
 	LocationLabel string `json:"location_label,omitempty" example:"成人影视学院"`
+
+	// 合并转发的消息快照,按原消息的发送时间正序排列,只能由转发接口生成。适用消息类型: 11
+	Items []ChatMessageForwardItem `json:"items,omitempty"`
+}
+
+// ChatMessageForwardItem 合并转发中的一条消息快照
+// @Description 合并转发中的一条消息快照,保留原消息的发送人跟发送时间
+type ChatMessageForwardItem struct {
+	// SenderID 原消息的发送人ID
+	SenderID int64 `json:"sender_id" example:"1234456"`
+
+	// Type 原消息的类型
+	Type int `json:"type" example:"1"`
+
+	// Body 原消息的主体
+	Body ChatMessageBody `json:"body"`
+
+	// CreatedAt 原消息的发送时间
+	CreatedAt int64 `json:"created_at" example:"12345678901234"`
+}
+
+// ChatMessageThumbnail 图片消息的缩略图
+// @Description 图片消息的缩略图
+type ChatMessageThumbnail struct {
+	// Src 缩略图地址
+	Src string `json:"src" example:"https://im.example.com/api/v1/media/file/6517a2c9e1b4a0d1c2f3e4a5/thumb_480?expires=1696000000&signature=abc"`
+
+	// Width 宽度,单位像素
+	Width int `json:"width" example:"480"`
+
+	// Height 高度,单位像素
+	Height int `json:"height" example:"270"`
+
+	// variant 缩略图的标识,读取时用来生成带签名的缩略图地址
+	variant string
 }
 
 // SendChatMessageRequest 聊天发送消息请求参数
@@ -100,14 +260,38 @@ type SendChatMessageRequest struct {
 	// SessionType 会话类型; 1:私聊, 2:群聊
 	SessionType int `json:"session_type" binding:"required" enums:"1,2" example:"1"`
 
-	// Type 消息类型; 1-纯文本,2-图片,3-语音,4-视频, 5-位置
-	Type int `json:"type" enums:"1,2,3,4,5" binding:"required" example:"1"`
+	// Type 消息类型; 1-纯文本,2-图片,3-语音,4-视频,5-位置,6-文件,7-表情贴纸,8-卡片,9-系统通知,10-自定义
+	Type int `json:"type" enums:"1,2,3,4,5,6,7,8,9,10" binding:"required" example:"1"`
 
 	// TargetID 目标ID; 可以是用户ID,也可以是群ID,也可以是世界频道ID
 	TargetID int64 `json:"target_id" binding:"required" example:"1234"`
 
 	// Body 消息体;
 	Body ChatMessageBody `json:"body" binding:"required"`
+
+	// ReplyToMessageID 回复的消息ID,在话题中时为话题内的消息ID
+	ReplyToMessageID int64 `json:"reply_to_message_id" example:"0"`
+
+	// ThreadID 话题的根消息ID,大于0时消息发送到该话题中
+	ThreadID int64 `json:"thread_id" example:"0"`
+
+	// Mentions 被@的用户ID列表,只有群聊有效,不是群成员的会被忽略
+	Mentions []int64 `json:"mentions" example:"1,2"`
+
+	// MentionAll 是否@所有人,只有群主跟管理员可以使用
+	MentionAll bool `json:"mention_all" example:"false"`
+
+	// SendAt 定时发送的时间,单位毫秒; 大于当前时间时消息会在该时间发送,发送前可以取消
+	SendAt int64 `json:"send_at" example:"0"`
+
+	// TTL 阅后即焚的有效期,单位秒; 大于0时消息发送后超过该时间会对所有人清空
+	TTL int `json:"ttl" example:"0"`
+
+	// scheduleID 定时消息到期发送时的任务ID,用于防止重复发送
+	scheduleID string
+
+	// forwardFromID 逐条转发时原消息的发送人ID
+	forwardFromID int64
 }
 
 // SendChatMessageHandler
@@ -123,8 +307,6 @@ type SendChatMessageRequest struct {
 // @Failure      500  {object}  Response
 // @Router       /v1/chat/message/send [post]
 func SendChatMessageHandler(ctx *gin.Context) {
-	currentUser := LoginUserFromContext(ctx)
-
 	req := &SendChatMessageRequest{}
 	err := ctx.BindJSON(req)
 	if err != nil {
@@ -132,45 +314,94 @@ func SendChatMessageHandler(ctx *gin.Context) {
 		return
 	}
 
-	if !goutils.In(req.SessionType, database.ChatMessageSessionTypePrivate, database.ChatMessageSessionTypeGroup, database.ChatMessageSessionTypeWorld) {
-		JSONError(ctx, StatusError, MessageInvalidSessionType)
+	rsp, err := sendChatMessageByRequest(ctx, req)
+	if err != nil {
+		JSONResponseError(ctx, err)
 		return
 	}
+	JSON(ctx, rsp)
+}
+
+// sendChatMessageByRequest 校验发送请求并以当前登录用户的身份发送聊天消息
+// HTTP 跟 websocket 共用该方法,保证两边的校验逻辑一致
+func sendChatMessageByRequest(ctx *gin.Context, req *SendChatMessageRequest) (*ChatMessage, error) {
+	if err := validateSendChatMessageRequest(req); err != nil {
+		return nil, err
+	}
+	return sendValidatedChatMessage(ctx, req, LoginUserFromContext(ctx))
+}
+
+// sendChatMessageAsUser 校验发送请求并以指定用户的身份发送聊天消息
+// 定时消息到期后由后台任务直接调用,不依赖HTTP请求
+func sendChatMessageAsUser(ctx context.Context, req *SendChatMessageRequest, currentUser *database.User) (*ChatMessage, error) {
+	if err := validateSendChatMessageRequest(req); err != nil {
+		return nil, err
+	}
+	return sendValidatedChatMessage(ctx, req, currentUser)
+}
+
+// validateSendChatMessageRequest 校验发送请求的各个字段
+func validateSendChatMessageRequest(req *SendChatMessageRequest) error {
+	if !goutils.In(req.SessionType, database.ChatMessageSessionTypePrivate, database.ChatMessageSessionTypeGroup, database.ChatMessageSessionTypeWorld) {
+		return NewResponseError(MessageInvalidSessionType)
+	}
 
 	if req.TargetID <= 0 {
-		JSONError(ctx, StatusError, MessageInvalidTargetID)
-		return
+		return NewResponseError(MessageInvalidTargetID)
 	}
 
-	if !(req.Type > 0 && req.Type <= 5) {
-		JSONError(ctx, StatusError, MessageInvalidType)
-		return
+	if utils.StringLen(req.ActionID) > maxChatActionIDLength {
+		return NewResponseError(MessageInvalidFormat("action_id"))
 	}
 
-	// 检验各个字段是否正确
+	if err := validateSendChatMessageBody(req.Type, &req.Body); err != nil {
+		return err
+	}
 
-	// 私聊状态
-	if req.SessionType == database.ChatMessageSessionTypePrivate { //私聊
-		sendChatMessageToFriend(ctx, req, currentUser)
-		return
+	if req.ReplyToMessageID < 0 {
+		return NewResponseError(MessageInvalidReplyToMessageID)
 	}
 
-	// 群聊
-	if req.SessionType == database.ChatMessageSessionTypeGroup {
-		sendChatMessageToGroup(ctx, req, currentUser)
-		return
+	if req.ThreadID < 0 {
+		return NewResponseError(MessageInvalidThreadID)
 	}
 
-	if req.SessionType == database.ChatMessageSessionTypeWorld {
-		sendChatMessage(ctx, req, nil)
-		return
+	if !validChatMentions(req) {
+		return NewResponseError(MessageInvalidMentions)
 	}
 
+	return validateChatSchedule(req)
+}
+
+// sendValidatedChatMessage 以指定用户的身份按会话类型发送已经校验过的聊天消息
+func sendValidatedChatMessage(ctx context.Context, req *SendChatMessageRequest, currentUser *database.User) (*ChatMessage, error) {
+	// 客户端超时重试时会带上相同的ActionID,直接返回第一次的发送结果
+	// 定时消息到期发送时已经有任务ID防止重复,不再去重
+	if req.ActionID != "" && req.scheduleID == "" {
+		return sendChatMessageOnce(ctx, req, currentUser)
+	}
+	return dispatchChatMessage(ctx, req, currentUser)
+}
+
+// dispatchChatMessage 按会话类型发送已经校验过的聊天消息
+func dispatchChatMessage(ctx context.Context, req *SendChatMessageRequest, currentUser *database.User) (*ChatMessage, error) {
+	// 定时消息先保存任务,到期后再按普通消息重新校验跟发送
+	if req.SendAt > time.Now().UnixMilli() {
+		return scheduleChatMessage(ctx, req, currentUser)
+	}
+
+	switch req.SessionType {
+	case database.ChatMessageSessionTypePrivate: // 私聊
+		return sendChatMessageToFriend(ctx, req, currentUser)
+	case database.ChatMessageSessionTypeGroup: // 群聊
+		return sendChatMessageToGroup(ctx, req, currentUser)
+	default: // 世界频道
+		return sendChatMessage(ctx, req, currentUser, nil)
+	}
 }
 
 // sendChatMessage 发送聊天消息
-func sendChatMessage(ctx *gin.Context, req *SendChatMessageRequest, pubSubMsgFn func(*pubsub.ChatMessage) error) {
-	currentUser := LoginUserFromContext(ctx)
+func sendChatMessage(ctx context.Context, req *SendChatMessageRequest, currentUser *database.User, pubSubMsgFn func(*pubsub.ChatMessage) error) (*ChatMessage, error) {
 	targetID := req.TargetID
 
 	roomID := ""
@@ -184,112 +415,137 @@ func sendChatMessage(ctx *gin.Context, req *SendChatMessageRequest, pubSubMsgFn
 		roomID = utils.FormatWorldRoomID(targetID)
 	}
 
+	// 图片跟视频的元数据还没有提取完成时,消息保存后交给后台任务补充
+	mediaPending, err := fillChatMessageMedia(ctx, currentUser.ID, req.Type, &req.Body)
+	if err != nil {
+		return nil, err
+	}
+
 	now := time.Now()
 	// 插入消息数据库
 	msg := &database.ChatMessage{
-		RoomID:      roomID,
-		Type:        req.Type,
-		SessionType: req.SessionType,
-		SenderID:    currentUser.ID,
-		ReceiverID:  targetID,
-		SendStatus:  1,
-		ReadStatus:  0,
-		Status:      1,
-		CreatedAt:   now.UnixMilli(),
-		UpdatedAt:   now.UnixMilli(),
-		Body: database.ChatMessageBody{
-			Text:          req.Body.Text,
-			Src:           req.Body.Src,
-			Format:        req.Body.Format,
-			Size:          req.Body.Size,
-			Longitude:     req.Body.Longitude,
-			Latitude:      req.Body.Latitude,
-			Scale:         req.Body.Scale,
-			LocationLabel: req.Body.LocationLabel,
-		},
-	}
-
-	err := database.AddChatMessage(msg)
+		RoomID:        roomID,
+		Type:          req.Type,
+		SessionType:   req.SessionType,
+		SenderID:      currentUser.ID,
+		ReceiverID:    targetID,
+		SendStatus:    database.ChatMessageSendStatusSent,
+		ReadStatus:    database.ChatMessageReadStatusUnread,
+		Status:        database.ChatMessageStatusNormal,
+		CreatedAt:     now.UnixMilli(),
+		UpdatedAt:     now.UnixMilli(),
+		Body:          chatMessageBodyToDatabase(&req.Body),
+		Mentions:      req.Mentions,
+		MentionAll:    req.MentionAll,
+		ScheduleID:    req.scheduleID,
+		ForwardFromID: req.forwardFromID,
+		Outbox:        newChatMessageOutbox(req.ActionID, now),
+	}
+
+	if req.TTL > 0 {
+		msg.ExpireAt = now.Add(time.Duration(req.TTL) * time.Second).UnixMilli()
+	}
+
+	if err := fillChatMessageReference(ctx, req, msg); err != nil {
+		return nil, err
+	}
+
+	err = database.AddChatMessage(msg)
 	if err != nil {
-		log.ErrorFromGinContext(ctx).Err(err).
+		if errors.Is(err, database.ErrChatScheduleDelivered) {
+			return nil, err
+		}
+		log.ErrorFromContext(ctx).Err(err).
 			Str("err_format", fmt.Sprintf("%+v", err)).
 			Int64("user_id", currentUser.ID).
 			Int64("receiver_id", msg.ReceiverID).
 			Int("session_type", msg.SessionType).
 			Msg("添加聊天消息失败")
-		JSONError(ctx, StatusError, MessageInternalServerError)
-		return
+		return nil, errors.Wrap(err)
 	}
 
-	rsp := &ChatMessage{
-		ID:          msg.ID.Hex(),
-		ActionID:    req.ActionID,
-		SessionType: msg.SessionType,
-		Type:        msg.Type,
-		SenderID:    currentUser.ID,
-		ReceiverID:  msg.ReceiverID,
-		MessageID:   msg.MessageID,
-		CreatedAt:   msg.CreatedAt,
-		Body: ChatMessageBody{
-			Text:          req.Body.Text,
-			Src:           req.Body.Src,
-			Format:        req.Body.Format,
-			Size:          req.Body.Size,
-			Longitude:     req.Body.Longitude,
-			Latitude:      req.Body.Latitude,
-			Scale:         req.Body.Scale,
-			LocationLabel: req.Body.LocationLabel,
-		},
+	if mediaPending {
+		enqueueMediaMetadataJob(ctx, &database.MediaMetadataJob{
+			MediaID:     msg.Body.MediaID,
+			RoomID:      msg.RoomID,
+			SessionType: msg.SessionType,
+			MessageID:   msg.MessageID,
+		})
 	}
-	JSON(ctx, rsp)
+
+	// 话题中的消息有独立的消息ID序列,不影响会话的已读位置跟未读数
+	if msg.ThreadID > 0 {
+		err = database.UpdateChatThreadReply(roomID, msg.SessionType, msg.ThreadID, msg.MessageID, msg.CreatedAt)
+		if err != nil {
+			log.WarnFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("更新话题回复数量失败")
+		}
+	} else {
+		markChatConversationRead(ctx, currentUser.ID, msg)
+	}
+
+	rsp := chatMessageFromDatabase(msg)
+	rsp.ActionID = req.ActionID
 
 	psData := fillChatMessageForPublish(rsp)
 
 	if pubSubMsgFn != nil {
 		if err = pubSubMsgFn(psData); err != nil {
-			log.ErrorFromGinContext(ctx).Err(err).
+			log.ErrorFromContext(ctx).Err(err).
 				Str("err_format", fmt.Sprintf("%+v", err)).
 				Int64("user_id", currentUser.ID).
 				Int64("receiver_id", msg.ReceiverID).
 				Int("session_type", msg.SessionType).
 				Msg("执行推送消息操作方法失败")
-			return
+			return rsp, nil
 		}
 	}
 
+	// 推送之后 psData 会被回收,所以要先用推送目标增加未读数跟计算被@的用户
+	if msg.ThreadID == 0 {
+		incrChatUnreadCounts(ctx, msg, psData.PublishTargets)
+	}
+	mentionedIDs := chatMentionedUserIDs(msg, psData.PublishTargets)
+
 	err = pubsub.PublishChatMessage(ctx, psData)
 	if err != nil {
-		log.ErrorFromGinContext(ctx).Err(err).
+		log.ErrorFromContext(ctx).Err(err).
 			Str("err_format", fmt.Sprintf("%+v", err)).
 			Int64("user_id", currentUser.ID).
 			Int64("receiver_id", msg.ReceiverID).
 			Int("session_type", msg.SessionType).
-			Msg("推送聊天消息到管道失败")
-
-		//@ todo 需要重做推送
+			Msg("推送聊天消息到管道失败,稍后由后台任务重新推送")
+	} else {
+		markChatMessagePublished(ctx, msg)
 	}
 
-	return
+	notifyChatMention(ctx, msg, mentionedIDs)
+	return rsp, nil
 }
 
 // sendChatMessageToFriend 向好友发送聊天消息
-func sendChatMessageToFriend(ctx *gin.Context, req *SendChatMessageRequest, currentUser *database.User) {
-	targetID := req.TargetID
+func sendChatMessageToFriend(ctx context.Context, req *SendChatMessageRequest, currentUser *database.User) (*ChatMessage, error) {
 	if currentUser.ID == req.TargetID {
-		JSONError(ctx, StatusError, MessageChatYourself)
-		return
+		return nil, NewResponseError(MessageChatYourself)
+	}
+
+	if err := checkChatFriendRelation(ctx, currentUser.ID, req.TargetID); err != nil {
+		return nil, err
 	}
 
+	// 发送聊天消息
+	return sendChatMessage(ctx, req, currentUser, nil)
+}
+
+// checkChatFriendRelation 检测与对方是否为可以聊天的好友关系
+func checkChatFriendRelation(ctx context.Context, userID, targetID int64) error {
 	// 检测与对方的关系
-	relation, err := database.GetUserRelationByUsersID(currentUser.ID, targetID)
+	relation, err := database.GetUserRelationByUsersID(userID, targetID)
 	if err != nil {
 		if errors.IsNoRecord(err) {
-			JSONError(ctx, StatusError, MessageNotFriends)
-			return
+			return NewResponseError(MessageNotFriends)
 		}
-		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取好友关系失败")
-		JSONError(ctx, StatusError, MessageInternalServerError)
-		return
+		log.ErrorFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取好友关系失败")
+		return errors.Wrap(err)
 	}
 
 	// 把对方拉黑的
@@ -303,75 +559,231 @@ func sendChatMessageToFriend(ctx *gin.Context, req *SendChatMessageRequest, curr
 
 	// 被对方删除
 	if relation.Status != 0b11 {
-		JSONError(ctx, StatusError, MessageNotFriends)
-		return
+		return NewResponseError(MessageNotFriends)
 	}
 
 	// 被对方拉黑的
-	if (relation.UserAID == currentUser.ID && relation.BlockStatus&0b01 == 0) ||
-		(relation.UserBID == currentUser.ID && relation.BlockStatus&0b10 == 0) {
-		JSONError(ctx, StatusError, MessageBlockYou)
-		return
+	if (relation.UserAID == userID && relation.BlockStatus&0b01 == 0) ||
+		(relation.UserBID == userID && relation.BlockStatus&0b10 == 0) {
+		return NewResponseError(MessageBlockYou)
 	}
-
-	// 发送聊天消息
-	sendChatMessage(ctx, req, nil)
-	return
+	return nil
 }
 
 // sendChatMessageToGroup 发送群聊信息
-func sendChatMessageToGroup(ctx *gin.Context, req *SendChatMessageRequest, currentUser *database.User) {
+func sendChatMessageToGroup(ctx context.Context, req *SendChatMessageRequest, currentUser *database.User) (*ChatMessage, error) {
 
 	targetID := req.TargetID
 
-	// 获取群消息
-	group, err := database.GetGroup(targetID)
+	group, member, err := checkChatGroupMember(ctx, currentUser.ID, targetID)
 	if err != nil {
-		if errors.IsNoRecord(err) {
-			JSONError(ctx, StatusError, "找不到该群")
-			return
-		}
-
-		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取群信息失败")
-		JSONError(ctx, StatusError, MessageInternalServerError)
-		return
-	}
-
-	// 判断当前用户是否在群内
-	member, err := database.GetGroupMember(targetID, currentUser.ID)
-	if err != nil {
-		if errors.IsNoRecord(err) {
-			JSONError(ctx, StatusError, "您不是该群成员")
-			return
-		}
-
-		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取群成员失败")
-		JSONError(ctx, StatusError, MessageInternalServerError)
-		return
+		return nil, err
 	}
 
 	// 不是群管理以上的成员就或提示
 	if group.SpeakStatus == 0 && member.Role > 0 {
-		JSONError(ctx, StatusError, "已全员禁言")
-		return
+		return nil, NewResponseError("已全员禁言")
 	}
 
 	if member.SpeakStatus == 0 {
-		JSONError(ctx, StatusError, "您已经被禁言")
-		return
+		return nil, NewResponseError("您已经被禁言")
 	}
 
-	sendChatMessage(ctx, req, func(message *pubsub.ChatMessage) error {
-		// 先查出所有群成员ID,这样订阅到的实例无需再次获取群成员信息
-		memberIDs, err := database.GetGroupMemberIDs(targetID)
-		if err != nil && !errors.IsNoRecord(err) {
-			return errors.Wrap(err)
-		}
+	// 只有群主跟管理员可以@所有人
+	if req.MentionAll && member.Role != 1 && member.Role != 2 {
+		return nil, NewResponseError(MessageMentionAllForbidden)
+	}
+
+	// 先查出所有群成员ID,这样订阅到的实例无需再次获取群成员信息
+	memberIDs, err := database.GetGroupMemberIDs(targetID)
+	if err != nil && !errors.IsNoRecord(err) {
+		log.ErrorFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取群成员ID列表失败")
+		return nil, errors.Wrap(err)
+	}
+	req.Mentions = filterChatMentions(req.Mentions, currentUser.ID, memberIDs)
+
+	return sendChatMessage(ctx, req, currentUser, func(message *pubsub.ChatMessage) error {
 		message.PublishTargets = memberIDs
 		return nil
 	})
-	return
+}
+
+// chatMessageFromDatabase 将数据库的聊天消息转换成返回给客户端的聊天消息
+func chatMessageFromDatabase(item *database.ChatMessage) *ChatMessage {
+	msg := &ChatMessage{
+		ID:               item.ID.Hex(),
+		SessionType:      item.SessionType,
+		Type:             item.Type,
+		SenderID:         item.SenderID,
+		ReceiverID:       item.ReceiverID,
+		MessageID:        item.MessageID,
+		ReadStatus:       item.ReadStatus,
+		Status:           item.Status,
+		CreatedAt:        item.CreatedAt,
+		Body:             chatMessageBodyFromDatabase(&item.Body),
+		ThreadID:         item.ThreadID,
+		ThreadReplyCount: item.ThreadReplyCount,
+		Reactions:        chatMessageReactionsFromDatabase(item.Reactions, 0),
+		EditedAt:         item.EditedAt,
+		Mentions:         item.Mentions,
+		MentionAll:       item.MentionAll,
+		ExpireAt:         item.ExpireAt,
+		ForwardFromID:    item.ForwardFromID,
+	}
 
+	// 撤回跟过期的消息不再返回内容,旧数据中可能还保留着主体
+	if item.Status != database.ChatMessageStatusNormal {
+		msg.Body = ChatMessageBody{}
+		msg.Reactions = nil
+	}
+
+	if item.ReplyTo != nil {
+		msg.ReplyTo = &ChatMessageQuote{
+			MessageID: item.ReplyTo.MessageID,
+			SenderID:  item.ReplyTo.SenderID,
+			Type:      item.ReplyTo.Type,
+			Body:      chatMessageBodyFromDatabase(&item.ReplyTo.Body),
+			CreatedAt: item.ReplyTo.CreatedAt,
+		}
+	}
+	return msg
+}
+
+// chatMessageFromDatabaseForUser 将数据库的聊天消息转换成返回给某个用户的聊天消息
+// 跟 chatMessageFromDatabase 的区别是会标记该用户回应过的表情
+func chatMessageFromDatabaseForUser(item *database.ChatMessage, userID int64) *ChatMessage {
+	msg := chatMessageFromDatabase(item)
+	msg.Reactions = chatMessageReactionsFromDatabase(item.Reactions, userID)
+	return msg
+}
+
+// chatMessageBodyFromDatabase 将数据库的消息主体转换成返回给客户端的消息主体
+func chatMessageBodyFromDatabase(body *database.ChatMessageBody) ChatMessageBody {
+	rsp := ChatMessageBody{
+		Text:          body.Text,
+		Src:           body.Src,
+		Format:        body.Format,
+		Size:          int64(body.Size),
+		MediaID:       body.MediaID,
+		Width:         body.Width,
+		Height:        body.Height,
+		Blurhash:      body.Blurhash,
+		Poster:        body.Poster,
+		Duration:      body.Duration,
+		Name:          body.Name,
+		Mime:          body.Mime,
+		StickerID:     body.StickerID,
+		PackID:        body.PackID,
+		CardType:      body.CardType,
+		Title:         body.Title,
+		Description:   body.Description,
+		URL:           body.URL,
+		TargetID:      body.TargetID,
+		Event:         body.Event,
+		OperatorID:    body.OperatorID,
+		UserIDs:       body.UserIDs,
+		CustomType:    body.CustomType,
+		Longitude:     body.Longitude,
+		Latitude:      body.Latitude,
+		Scale:         body.Scale,
+		LocationLabel: body.LocationLabel,
+	}
+	if body.Data != "" {
+		rsp.Data = json.RawMessage(body.Data)
+	}
+
+	// 旧数据只保存了带签名的地址,从地址中取出标识
+	rsp.posterVariant = body.PosterVariant
+	if rsp.posterVariant == "" {
+		rsp.posterVariant = mediaVariantFromSrc(body.Poster)
+	}
+	for _, thumb := range body.Thumbnails {
+		variant := thumb.Variant
+		if variant == "" {
+			variant = mediaVariantFromSrc(thumb.Src)
+		}
+		rsp.Thumbnails = append(rsp.Thumbnails, ChatMessageThumbnail{Src: thumb.Src, Width: thumb.Width, Height: thumb.Height, variant: variant})
+	}
+
+	// 本服务上传的文件每次读取时重新签名,消息中保存的地址不会过期
+	if body.MediaID != "" {
+		expiresAt := time.Now().Add(mediaURLExpire()).Unix()
+		rsp.Src = mediaURL(body.MediaID, expiresAt)
+		signChatMessageMediaVariants(&rsp, body.MediaID, expiresAt)
+	}
+	for i := range body.Items {
+		item := &body.Items[i]
+		rsp.Items = append(rsp.Items, ChatMessageForwardItem{
+			SenderID:  item.SenderID,
+			Type:      item.Type,
+			Body:      chatMessageBodyFromDatabase(&item.Body),
+			CreatedAt: item.CreatedAt,
+		})
+	}
+	return rsp
+}
+
+// chatMessageBodyToDatabase 将客户端的消息主体转换成保存到数据库的消息主体
+func chatMessageBodyToDatabase(body *ChatMessageBody) database.ChatMessageBody {
+	// 有标识的缩略图跟封面只保存标识,地址在读取时签名
+	var thumbnails []database.ChatMessageThumbnail
+	for _, thumb := range body.Thumbnails {
+		src := thumb.Src
+		if thumb.variant != "" {
+			src = ""
+		}
+		thumbnails = append(thumbnails, database.ChatMessageThumbnail{Src: src, Width: thumb.Width, Height: thumb.Height, Variant: thumb.variant})
+	}
+
+	poster := body.Poster
+	if body.posterVariant != "" {
+		poster = ""
+	}
+
+	var items []database.ChatMessageForwardItem
+	for i := range body.Items {
+		item := &body.Items[i]
+		items = append(items, database.ChatMessageForwardItem{
+			SenderID:  item.SenderID,
+			Type:      item.Type,
+			Body:      chatMessageBodyToDatabase(&item.Body),
+			CreatedAt: item.CreatedAt,
+		})
+	}
+
+	return database.ChatMessageBody{
+		Text:          body.Text,
+		Src:           body.Src,
+		Format:        body.Format,
+		Size:          database.ChatMessageBodySize(body.Size),
+		MediaID:       body.MediaID,
+		Width:         body.Width,
+		Height:        body.Height,
+		Blurhash:      body.Blurhash,
+		Poster:        poster,
+		PosterVariant: body.posterVariant,
+		Duration:      body.Duration,
+		Thumbnails:    thumbnails,
+		Name:          body.Name,
+		Mime:          body.Mime,
+		StickerID:     body.StickerID,
+		PackID:        body.PackID,
+		CardType:      body.CardType,
+		Title:         body.Title,
+		Description:   body.Description,
+		URL:           body.URL,
+		TargetID:      body.TargetID,
+		Event:         body.Event,
+		OperatorID:    body.OperatorID,
+		UserIDs:       body.UserIDs,
+		CustomType:    body.CustomType,
+		Data:          string(body.Data),
+		Longitude:     body.Longitude,
+		Latitude:      body.Latitude,
+		Scale:         body.Scale,
+		LocationLabel: body.LocationLabel,
+		Items:         items,
+	}
 }
 
 // fillChatMessageForPublish 填充推送用的聊天消息
@@ -384,19 +796,69 @@ func fillChatMessageForPublish(rsp *ChatMessage) *pubsub.ChatMessage {
 	msg.SenderID = rsp.SenderID
 	msg.MessageID = rsp.MessageID
 	msg.CreatedAt = rsp.CreatedAt
+	msg.ThreadID = rsp.ThreadID
+	msg.Mentions = rsp.Mentions
+	msg.MentionAll = rsp.MentionAll
+	msg.ExpireAt = rsp.ExpireAt
+	msg.ForwardFromID = rsp.ForwardFromID
+	msg.Body = fillChatMessageBodyForPublish(&rsp.Body)
+
+	if rsp.ReplyTo != nil {
+		msg.ReplyTo = &pubsub.ChatMessageQuote{
+			MessageID: rsp.ReplyTo.MessageID,
+			SenderID:  rsp.ReplyTo.SenderID,
+			Type:      rsp.ReplyTo.Type,
+			Body:      fillChatMessageBodyForPublish(&rsp.ReplyTo.Body),
+			CreatedAt: rsp.ReplyTo.CreatedAt,
+		}
+	}
+	return msg
+}
 
+// fillChatMessageBodyForPublish 填充推送用的消息主体
+func fillChatMessageBodyForPublish(body *ChatMessageBody) *pubsub.ChatMessageBody {
 	msgBody := pubsub.NewChatMessageBody()
-	msgBody.Text = rsp.Body.Text
-	msgBody.Src = rsp.Body.Src
-	msgBody.Format = rsp.Body.Format
-	msgBody.Size = rsp.Body.Size
-	msgBody.Longitude = rsp.Body.Longitude
-	msgBody.Latitude = rsp.Body.Latitude
-	msgBody.Scale = rsp.Body.Scale
-	msgBody.LocationLabel = rsp.Body.LocationLabel
-
-	msg.Body = msgBody
-	return msg
+	msgBody.Text = body.Text
+	msgBody.Src = body.Src
+	msgBody.Format = body.Format
+	msgBody.Size = body.Size
+	msgBody.MediaID = body.MediaID
+	msgBody.Width = body.Width
+	msgBody.Height = body.Height
+	msgBody.Blurhash = body.Blurhash
+	msgBody.Poster = body.Poster
+	msgBody.Duration = body.Duration
+	for _, thumb := range body.Thumbnails {
+		msgBody.Thumbnails = append(msgBody.Thumbnails, pubsub.ChatMessageThumbnail{Src: thumb.Src, Width: thumb.Width, Height: thumb.Height})
+	}
+	msgBody.Name = body.Name
+	msgBody.Mime = body.Mime
+	msgBody.StickerID = body.StickerID
+	msgBody.PackID = body.PackID
+	msgBody.CardType = body.CardType
+	msgBody.Title = body.Title
+	msgBody.Description = body.Description
+	msgBody.URL = body.URL
+	msgBody.TargetID = body.TargetID
+	msgBody.Event = body.Event
+	msgBody.OperatorID = body.OperatorID
+	msgBody.UserIDs = body.UserIDs
+	msgBody.CustomType = body.CustomType
+	msgBody.Data = body.Data
+	msgBody.Longitude = body.Longitude
+	msgBody.Latitude = body.Latitude
+	msgBody.Scale = body.Scale
+	msgBody.LocationLabel = body.LocationLabel
+	for i := range body.Items {
+		item := &body.Items[i]
+		msgBody.Items = append(msgBody.Items, pubsub.ChatMessageForwardItem{
+			SenderID:  item.SenderID,
+			Type:      item.Type,
+			Body:      *fillChatMessageBodyForPublish(&item.Body),
+			CreatedAt: item.CreatedAt,
+		})
+	}
+	return msgBody
 }
 
 // RollbackChatMessageRequest 回滚聊天消息请求参数
@@ -409,6 +871,9 @@ type RollbackChatMessageRequest struct {
 
 	// MessageID 消息ID
 	MessageID int64 `form:"message_id" json:"message_id"`
+
+	// ThreadID 消息所在话题的根消息ID,不在话题中时为0
+	ThreadID int64 `form:"thread_id" json:"thread_id"`
 }
 
 // RollbackChatMessageHandler 撤回聊天消息处理方法
@@ -424,8 +889,6 @@ type RollbackChatMessageRequest struct {
 // @Failure      500  {object}  Response
 // @Router       /v1/chat/message/rollback [post]
 func RollbackChatMessageHandler(ctx *gin.Context) {
-	currentUser := LoginUserFromContext(ctx)
-
 	req := &RollbackChatMessageRequest{}
 	err := ctx.BindJSON(req)
 	if err != nil {
@@ -433,54 +896,227 @@ func RollbackChatMessageHandler(ctx *gin.Context) {
 		return
 	}
 
-	if !goutils.In(req.SessionType, database.ChatMessageSessionTypePrivate, database.ChatMessageSessionTypeGroup) {
-		JSONError(ctx, StatusError, MessageInvalidSessionType)
+	if err = rollbackChatMessageByRequest(ctx, req); err != nil {
+		JSONResponseError(ctx, err)
 		return
 	}
+	JSON(ctx)
+}
+
+// rollbackChatMessageByRequest 校验撤回请求并撤回聊天消息
+// HTTP 跟 websocket 共用该方法
+func rollbackChatMessageByRequest(ctx *gin.Context, req *RollbackChatMessageRequest) error {
+	if !goutils.In(req.SessionType, database.ChatMessageSessionTypePrivate, database.ChatMessageSessionTypeGroup) {
+		return NewResponseError(MessageInvalidSessionType)
+	}
 
 	if req.TargetID <= 0 {
-		JSONError(ctx, StatusError, MessageInvalidTargetID)
-		return
+		return NewResponseError(MessageInvalidTargetID)
 	}
 
-	var roomID string
-	switch req.SessionType {
+	if req.MessageID <= 0 {
+		return NewResponseError(MessageInvalidMessageID)
+	}
+
+	if req.ThreadID < 0 {
+		return NewResponseError(MessageInvalidThreadID)
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+	roomID, err := chatRoomIDWithPermission(currentUser.ID, req.SessionType, req.TargetID)
+	if err != nil {
+		return err
+	}
+	if req.ThreadID > 0 {
+		roomID = utils.FormatThreadRoomID(roomID, req.ThreadID)
+	}
+
+	now := time.Now()
+	filter := &database.RollbackChatMessageFilter{
+		RoomID:       roomID,
+		SessionType:  req.SessionType,
+		MessageID:    req.MessageID,
+		SenderID:     currentUser.ID,
+		CreatedAfter: now.Add(-chatRollbackWindow()).UnixMilli(),
+	}
+
+	var publishTargets []int64
+	if req.SessionType == database.ChatMessageSessionTypeGroup {
+		if err = fillGroupRollbackFilter(ctx, currentUser.ID, req, filter); err != nil {
+			return err
+		}
+
+		publishTargets, err = database.GetGroupMemberIDs(req.TargetID)
+		if err != nil {
+			log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取群成员ID列表失败")
+			return errors.Wrap(err)
+		}
+	}
+
+	msg, err := database.RollbackChatMessage(filter)
+	if err != nil {
+		// 消息不存在、已撤回或者超过了撤回时间
+		if errors.IsNoRecord(err) {
+			return NewResponseError(MessageRollbackChatMessageFailure)
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("撤回聊天消息失败")
+		return errors.Wrap(err)
+	}
+
+	err = pubsub.PublishChatMessageRollback(ctx, &pubsub.ChatMessageRollback{
+		SessionType:    msg.SessionType,
+		SenderID:       msg.SenderID,
+		ReceiverID:     msg.ReceiverID,
+		MessageID:      msg.MessageID,
+		ThreadID:       msg.ThreadID,
+		OperatorID:     currentUser.ID,
+		RollbackAt:     now.UnixMilli(),
+		PublishTargets: publishTargets,
+	})
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("推送撤回通知到管道失败")
+	}
+	return nil
+}
+
+// fillGroupRollbackFilter 群聊中撤回他人消息时,校验撤回人的角色并调整过滤条件
+// 群主可以撤回任何人的消息,管理员只能撤回普通成员的消息
+func fillGroupRollbackFilter(ctx *gin.Context, operatorID int64, req *RollbackChatMessageRequest, filter *database.RollbackChatMessageFilter) error {
+	messages, err := database.GetChatMessagesByIDs(filter.RoomID, filter.SessionType, []int64{req.MessageID})
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取聊天消息失败")
+		return errors.Wrap(err)
+	}
+	if len(messages) == 0 {
+		return NewResponseError(MessageNotFound)
+	}
+
+	senderID := messages[0].SenderID
+	if senderID == operatorID {
+		return nil
+	}
+
+	operator, err := database.GetGroupMember(req.TargetID, operatorID)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			return NewResponseError(MessageForbidden)
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取群成员失败")
+		return errors.Wrap(err)
+	}
+
+	// 发送人已经退群的,按普通成员处理
+	senderRole := 0
+	sender, err := database.GetGroupMember(req.TargetID, senderID)
+	if err != nil && !errors.IsNoRecord(err) {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取群成员失败")
+		return errors.Wrap(err)
+	}
+	if sender != nil {
+		senderRole = sender.Role
+	}
+
+	if !canRollbackGroupMessage(operator.Role, senderRole) {
+		return NewResponseError(MessageForbidden)
+	}
+
+	filter.SenderID = senderID
+	filter.CreatedAfter = 0
+	if window := config.GlobConfig().Chat.AdminRollbackWindow; window > 0 {
+		filter.CreatedAfter = time.Now().Add(-window).UnixMilli()
+	}
+	return nil
+}
+
+// canRollbackGroupMessage 群成员角色是否可以撤回他人的消息
+// 角色: 0-普通成员,1-群主,2-管理员
+func canRollbackGroupMessage(operatorRole, senderRole int) bool {
+	switch operatorRole {
+	case 1:
+		return true
+	case 2:
+		return senderRole == 0
+	}
+	return false
+}
+
+// chatRollbackWindow 发送人撤回自己消息的时间窗口,未配置时默认2分钟
+func chatRollbackWindow() time.Duration {
+	if window := config.GlobConfig().Chat.RollbackWindow; window > 0 {
+		return window
+	}
+	return 2 * time.Minute
+}
+
+// chatRoomIDWithPermission 检测用户是否属于该会话,并返回房间ID
+// 私聊需要跟对方建立过关系,群聊需要是该群成员
+func chatRoomIDWithPermission(userID int64, sessionType int, targetID int64) (string, error) {
+	switch sessionType {
 	case database.ChatMessageSessionTypePrivate:
 		// 如果没有建立过关系,无法进行聊天消息配置
-		u, _ := database.GetUserRelationByUsersID(currentUser.ID, req.TargetID)
+		u, _ := database.GetUserRelationByUsersID(userID, targetID)
 		if u == nil {
-			JSONError(ctx, StatusError, MessageForbidden)
-			return
+			return "", NewResponseError(MessageForbidden)
 		}
-		roomID = utils.FormatPrivateRoomID(currentUser.ID, req.TargetID)
+		return utils.FormatPrivateRoomID(userID, targetID), nil
 	case database.ChatMessageSessionTypeGroup:
 		// 检测是否是该群成员
-		m, _ := database.GetGroupMember(req.TargetID, currentUser.ID)
+		m, _ := database.GetGroupMember(targetID, userID)
 		if m == nil {
-			JSONError(ctx, StatusError, MessageForbidden)
-			return
+			return "", NewResponseError(MessageForbidden)
 		}
-		roomID = utils.FormatGroupRoomID(req.TargetID)
+		return utils.FormatGroupRoomID(targetID), nil
 	}
+	return "", NewResponseError(MessageInvalidSessionType)
+}
 
-	ok, err := database.RollbackChatMessage(roomID, req.SessionType, currentUser.ID, req.MessageID)
+// checkChatGroupMember 检测群是否存在以及用户是否为该群成员
+func checkChatGroupMember(ctx context.Context, userID, groupID int64) (*database.Group, *database.GroupMember, error) {
+	// 获取群消息
+	group, err := database.GetGroup(groupID)
 	if err != nil {
-		JSONError(ctx, StatusError, MessageInternalServerError)
-		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("撤回聊天消息失败")
-		return
-	}
+		if errors.IsNoRecord(err) {
+			return nil, nil, NewResponseError("找不到该群")
+		}
 
-	if !ok {
-		JSONError(ctx, StatusError, MessageRollbackChatMessageFailure)
-		return
+		log.ErrorFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取群信息失败")
+		return nil, nil, errors.Wrap(err)
 	}
-	JSON(ctx)
-}
 
-// DeleteChatMessageHandler 删除聊天消息处理方法
+	// 判断当前用户是否在群内
+	member, err := database.GetGroupMember(groupID, userID)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			return nil, nil, NewResponseError("您不是该群成员")
+		}
 
-func DeleteChatMessageHandler(ctx *gin.Context) {
+		log.ErrorFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取群成员失败")
+		return nil, nil, errors.Wrap(err)
+	}
+	return group, member, nil
+}
 
+// chatRoomIDWithReadPermission 检测用户是否可以阅读该会话的聊天记录,并返回房间ID
+// 跟发送消息使用相同的好友关系跟群成员检测,世界频道所有人都可以阅读
+func chatRoomIDWithReadPermission(ctx *gin.Context, userID int64, sessionType int, targetID int64) (string, error) {
+	switch sessionType {
+	case database.ChatMessageSessionTypePrivate:
+		if userID == targetID {
+			return "", NewResponseError(MessageChatYourself)
+		}
+		if err := checkChatFriendRelation(ctx, userID, targetID); err != nil {
+			return "", err
+		}
+		return utils.FormatPrivateRoomID(userID, targetID), nil
+	case database.ChatMessageSessionTypeGroup:
+		if _, _, err := checkChatGroupMember(ctx, userID, targetID); err != nil {
+			return "", err
+		}
+		return utils.FormatGroupRoomID(targetID), nil
+	case database.ChatMessageSessionTypeWorld:
+		return utils.FormatWorldRoomID(targetID), nil
+	}
+	return "", NewResponseError(MessageInvalidSessionType)
 }
 
 // GetLastChatMessagesRequest
@@ -514,66 +1150,52 @@ func GetLastChatMessagesHandler(ctx *gin.Context) {
 		return
 	}
 
-	if req.TargetID <= 0 {
-		JSONError(ctx, StatusError, MessageInvalidTargetID)
+	rsps, err := getLastChatMessagesByRequest(ctx, req)
+	if err != nil {
+		JSONResponseError(ctx, err)
 		return
 	}
+	JSON(ctx, rsps)
+}
 
-	if !goutils.In(req.SessionType, database.ChatMessageSessionTypePrivate, database.ChatMessageSessionTypePrivate, database.ChatMessageSessionTypePrivate) {
-		JSONError(ctx, StatusError, MessageInvalidSessionType)
-		return
+// getLastChatMessagesByRequest 校验请求并获取最近的聊天消息
+// HTTP 跟 websocket 共用该方法
+func getLastChatMessagesByRequest(ctx *gin.Context, req *GetLastChatMessagesRequest) ([]*ChatMessage, error) {
+	if req.TargetID <= 0 {
+		return nil, NewResponseError(MessageInvalidTargetID)
 	}
 
-	currentUser := LoginUserFromContext(ctx)
-	roomID := ""
+	if !goutils.In(req.SessionType, database.ChatMessageSessionTypePrivate, database.ChatMessageSessionTypeGroup, database.ChatMessageSessionTypeWorld) {
+		return nil, NewResponseError(MessageInvalidSessionType)
+	}
 
-	// @TODO 验证用户是否有房间聊天记录阅读权限
-	switch req.SessionType {
-	case database.ChatMessageSessionTypePrivate:
-		roomID = utils.FormatPrivateRoomID(currentUser.ID, req.TargetID)
-	case database.ChatMessageSessionTypeGroup:
-		roomID = utils.FormatGroupRoomID(req.TargetID)
-	case database.ChatMessageSessionTypeWorld:
-		roomID = utils.FormatWorldRoomID(req.TargetID)
+	currentUser := LoginUserFromContext(ctx)
+	roomID, err := chatRoomIDWithReadPermission(ctx, currentUser.ID, req.SessionType, req.TargetID)
+	if err != nil {
+		return nil, err
 	}
 
 	list, err := database.GetLastChatMessageList(roomID, req.SessionType)
 	if err != nil {
 		if errors.IsNoRecord(err) {
-			JSONError(ctx, StatusError, MessageNotFound)
-			return
+			return nil, NewResponseError(MessageNotFound)
 		}
 		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("获取最近消息列表失败")
-		JSONError(ctx, StatusError, MessageInternalServerError)
-		return
+		return nil, errors.Wrap(err)
 	}
 
+	// 最近消息列表是房间共用的缓存,需要再排除当前用户删除过的消息
+	clearedMessageID, err := chatConversationClearedMessageID(ctx, currentUser.ID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	list = database.FilterVisibleChatMessages(list, currentUser.ID, clearedMessageID)
+
 	rsps := make([]*ChatMessage, len(list))
 	for i := 0; i < len(list); i++ {
-		item := list[i]
-		msg := &ChatMessage{
-			ID:          item.ID.Hex(),
-			SessionType: item.SessionType,
-			Type:        item.Type,
-			SenderID:    item.SenderID,
-			ReceiverID:  item.ReceiverID,
-			MessageID:   item.MessageID,
-			CreatedAt:   item.CreatedAt,
-			Body: ChatMessageBody{
-				Text:          item.Body.Text,
-				Src:           item.Body.Src,
-				Format:        item.Body.Format,
-				Size:          item.Body.Size,
-				Longitude:     item.Body.Longitude,
-				Latitude:      item.Body.Latitude,
-				Scale:         item.Body.Scale,
-				LocationLabel: item.Body.LocationLabel,
-			},
-		}
-		rsps[i] = msg
+		rsps[i] = chatMessageFromDatabaseForUser(list[i], currentUser.ID)
 	}
-	JSON(ctx, rsps)
-
+	return rsps, nil
 }
 
 // ========================================================================================
@@ -634,3 +1256,43 @@ func SubscribeChatMessageHandler(ctx context.Context, payload *pubsub.Payload) {
 		websocketManager.PushData(wsPayload)
 	}
 }
+
+// SubscribeChatMessageRollbackHandler 接收消息撤回通知
+func SubscribeChatMessageRollbackHandler(ctx context.Context, payload *pubsub.Payload) {
+	rollback := new(pubsub.ChatMessageRollback)
+	err := payload.UnmarshalData(rollback)
+	if err != nil {
+		log.Error().Err(err).Str("payload.channel", payload.Channel).Str("payload.type", payload.Type).Send()
+		return
+	}
+
+	targets, ok := chatPushTargets(rollback.SessionType, rollback.SenderID, rollback.ReceiverID, rollback.PublishTargets)
+	if !ok {
+		return
+	}
+
+	rollback.PublishTargets = nil
+	websocketManager.PushData(websocket.Payload{Type: payload.Type, Data: rollback}, targets...)
+}
+
+// chatPushTargets 根据会话类型计算消息变更需要推送的用户
+// 私聊推送给双方,群聊推送给预先填好的群成员,世界频道返回空列表表示推送给所有在线用户
+// 返回false表示没有需要推送的用户
+func chatPushTargets(sessionType int, userAID, userBID int64, publishTargets []int64) ([]any, bool) {
+	switch sessionType {
+	case database.ChatMessageSessionTypePrivate:
+		return []any{userAID, userBID}, true
+	case database.ChatMessageSessionTypeGroup:
+		if len(publishTargets) == 0 {
+			return nil, false
+		}
+		targets := make([]any, len(publishTargets))
+		for i, id := range publishTargets {
+			targets[i] = id
+		}
+		return targets, true
+	case database.ChatMessageSessionTypeWorld:
+		return nil, true
+	}
+	return nil, false
+}
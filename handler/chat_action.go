@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jerbe/jim/config"
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/6 15:50
+  @describe : 按发送人跟ActionID对聊天消息发送跟转发去重
+*/
+
+const (
+	// maxChatActionIDLength ActionID的最大长度
+	maxChatActionIDLength = 64
+
+	// chatActionPendingExpiration 发送中占位的有效期,发送过程中服务异常时超过该时间客户端可以重试
+	chatActionPendingExpiration = 30 * time.Second
+)
+
+// sendChatMessageOnce 同一个发送人使用相同的ActionID在时间窗口内只发送一次
+// 重复发送时直接返回第一次的发送结果,第一次还没发送完成时返回错误让客户端稍后重试
+func sendChatMessageOnce(ctx context.Context, req *SendChatMessageRequest, currentUser *database.User) (*ChatMessage, error) {
+	rsp := new(ChatMessage)
+	err := chatActionOnce(ctx, currentUser.ID, req.ActionID, req, rsp, func() error {
+		msg, err := dispatchChatMessage(ctx, req, currentUser)
+		if err != nil {
+			return err
+		}
+		*rsp = *msg
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// chatActionOnce 同一个用户使用相同的ActionID在时间窗口内只执行一次 fn
+// fn 执行成功后把 result 保存下来,重复请求时直接把第一次的结果解析到 result 中
+// request 用于比较重复请求的内容,跟第一次的请求不一致时返回错误,避免客户端复用ActionID时拿到其他请求的结果
+func chatActionOnce(ctx context.Context, userID int64, actionID string, request, result any, fn func() error) error {
+	requestHash, err := chatActionRequestHash(request)
+	if err != nil {
+		log.ErrorFromContext(ctx).Err(err).Str("action_id", actionID).Msg("计算请求摘要失败")
+		return errors.Wrap(err)
+	}
+
+	claimed, data, err := database.ClaimChatAction(userID, actionID, requestHash, chatActionPendingExpiration)
+	if err != nil {
+		if errors.Is(err, database.ErrChatActionConflict) {
+			return NewResponseError(MessageChatActionConflict)
+		}
+		// 去重只是为了防止重试产生重复消息,缓存异常时不影响正常发送
+		log.WarnFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("action_id", actionID).Msg("占用发送ActionID失败")
+		return fn()
+	}
+
+	if !claimed {
+		if data == "" {
+			return NewResponseError(MessageChatActionPending)
+		}
+
+		if err = json.Unmarshal([]byte(data), result); err != nil {
+			log.ErrorFromContext(ctx).Err(err).Str("action_id", actionID).Msg("解析重复发送的结果失败")
+			return errors.Wrap(err)
+		}
+		return nil
+	}
+
+	if err = fn(); err != nil {
+		if releaseErr := database.ReleaseChatAction(userID, actionID); releaseErr != nil {
+			log.WarnFromContext(ctx).Err(releaseErr).Str("err_format", fmt.Sprintf("%+v", releaseErr)).Str("action_id", actionID).Msg("释放发送ActionID失败")
+		}
+		return err
+	}
+
+	raw, err := json.Marshal(result)
+	if err == nil {
+		err = database.SetChatActionResult(userID, actionID, requestHash, string(raw), chatActionIDWindow())
+	}
+	if err != nil {
+		log.WarnFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("action_id", actionID).Msg("保存发送结果失败")
+	}
+	return nil
+}
+
+// chatActionRequestHash 计算请求内容的摘要
+func chatActionRequestHash(request any) (string, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return "", errors.Wrap(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// chatActionIDWindow 相同ActionID重复发送时返回第一次发送结果的时间窗口
+func chatActionIDWindow() time.Duration {
+	if window := config.GlobConfig().Chat.ActionIDWindow; window > 0 {
+		return window
+	}
+	return 10 * time.Minute
+}
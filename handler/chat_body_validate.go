@@ -0,0 +1,235 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jerbe/jim/config"
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/utils"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/29 10:15
+  @describe :
+*/
+
+const (
+	// defaultMaxChatTextLength 未配置时文本消息的最大字符数
+	defaultMaxChatTextLength = 5000
+
+	// maxChatMessageFileNameLength 文件名称的最大长度
+	maxChatMessageFileNameLength = 255
+
+	// maxChatMessageCardTextLength 卡片标题跟描述的最大长度
+	maxChatMessageCardTextLength = 500
+
+	// maxChatMessageLocationLabelLength 位置标签的最大长度
+	maxChatMessageLocationLabelLength = 200
+
+	// maxChatMessageCustomTypeLength 自定义消息类型标识的最大长度
+	maxChatMessageCustomTypeLength = 64
+
+	// maxChatMessageCustomDataSize 自定义消息JSON数据的最大字节数
+	maxChatMessageCustomDataSize = 8 << 10
+)
+
+var (
+	// chatPictureFormats 图片消息允许的格式
+	chatPictureFormats = []string{database.ChatMessageBodyFormatJPEG, database.ChatMessageBodyFormatPNG, database.ChatMessageBodyFormatGIF, database.ChatMessageBodyFormatWEBP}
+
+	// chatVoiceFormats 语音消息允许的格式
+	chatVoiceFormats = []string{database.ChatMessageBodyFormatMP3, database.ChatMessageBodyFormatVMA}
+
+	// chatVideoFormats 视频消息允许的格式
+	chatVideoFormats = []string{database.ChatMessageBodyFormatMP4}
+)
+
+// maxChatTextLength 文本消息的最大字符数
+func maxChatTextLength() int {
+	if length := config.GlobConfig().Chat.MaxTextLength; length > 0 {
+		return length
+	}
+	return defaultMaxChatTextLength
+}
+
+// validateChatText 校验文本内容,不能为空白且不能超过最大字符数
+func validateChatText(text string) error {
+	if strings.TrimSpace(text) == "" {
+		return NewResponseError("文本内容不能为空")
+	}
+
+	if length := maxChatTextLength(); utils.StringLen(text) > length {
+		return NewResponseError(fmt.Sprintf("文本内容不能超过%d个字符", length))
+	}
+	return nil
+}
+
+// validateChatMessageSrc 校验媒体地址,只允许http/https,配置了域名白名单时只允许白名单中的域名及其子域名
+func validateChatMessageSrc(src string) error {
+	if src == "" {
+		return NewResponseError("'body.src'不能为空")
+	}
+
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return NewResponseError(MessageInvalidFormat("body.src"))
+	}
+
+	if !chatMediaHostAllowed(u.Hostname(), config.GlobConfig().Chat.MediaHosts) {
+		return NewResponseError("'body.src'的域名不在允许范围内")
+	}
+	return nil
+}
+
+// chatMediaHostAllowed 判断域名是否在白名单中,白名单为空时不限制
+func chatMediaHostAllowed(hostname string, hosts []string) bool {
+	if len(hosts) == 0 {
+		return true
+	}
+
+	hostname = strings.ToLower(hostname)
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimPrefix(host, "."))
+		if hostname == host || strings.HasSuffix(hostname, "."+host) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateChatMediaBody 校验图片、语音、视频这类媒体消息的公共字段
+func validateChatMediaBody(body *ChatMessageBody, kind string, formats []string) error {
+	if err := validateChatMessageSrc(body.Src); err != nil {
+		return err
+	}
+
+	body.Format = strings.ToLower(body.Format)
+	var ok bool
+	for _, format := range formats {
+		if body.Format == format {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return NewResponseError(fmt.Sprintf("%s格式只支持%s", kind, strings.Join(formats, ",")))
+	}
+
+	if body.Size < 0 {
+		return NewResponseError(MessageInvalidFormat("body.size"))
+	}
+	return nil
+}
+
+// validateTextChatMessageBody 校验文本消息
+func validateTextChatMessageBody(body *ChatMessageBody) error {
+	return validateChatText(body.Text)
+}
+
+// validatePictureChatMessageBody 校验图片消息
+func validatePictureChatMessageBody(body *ChatMessageBody) error {
+	return validateChatMediaBody(body, "图片", chatPictureFormats)
+}
+
+// validateVoiceChatMessageBody 校验语音消息
+func validateVoiceChatMessageBody(body *ChatMessageBody) error {
+	return validateChatMediaBody(body, "语音", chatVoiceFormats)
+}
+
+// validateVideoChatMessageBody 校验视频消息
+func validateVideoChatMessageBody(body *ChatMessageBody) error {
+	return validateChatMediaBody(body, "视频", chatVideoFormats)
+}
+
+// validateLocationChatMessageBody 校验位置消息,经纬度必须是合法范围内的数字
+func validateLocationChatMessageBody(body *ChatMessageBody) error {
+	latitude, err := strconv.ParseFloat(body.Latitude, 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		return NewResponseError("'body.latitude'必须是-90到90之间的数字")
+	}
+
+	longitude, err := strconv.ParseFloat(body.Longitude, 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		return NewResponseError("'body.longitude'必须是-180到180之间的数字")
+	}
+
+	if body.Scale < 0 {
+		return NewResponseError(MessageInvalidFormat("body.scale"))
+	}
+
+	if utils.StringLen(body.LocationLabel) > maxChatMessageLocationLabelLength {
+		return NewResponseError(fmt.Sprintf("'body.location_label'不能超过%d个字符", maxChatMessageLocationLabelLength))
+	}
+	return nil
+}
+
+// validateFileChatMessageBody 校验文件消息
+func validateFileChatMessageBody(body *ChatMessageBody) error {
+	if err := validateChatMessageSrc(body.Src); err != nil {
+		return err
+	}
+
+	if body.Name == "" || utils.StringLen(body.Name) > maxChatMessageFileNameLength {
+		return NewResponseError(MessageInvalidFormat("body.name"))
+	}
+
+	if body.Size <= 0 {
+		return NewResponseError(MessageInvalidFormat("body.size"))
+	}
+	return nil
+}
+
+// validateStickerChatMessageBody 校验表情贴纸消息
+func validateStickerChatMessageBody(body *ChatMessageBody) error {
+	if body.StickerID == "" && body.Src == "" {
+		return NewResponseError(MessageInvalidFormat("body.sticker_id"))
+	}
+
+	if body.Src != "" {
+		return validateChatMessageSrc(body.Src)
+	}
+	return nil
+}
+
+// validateCardChatMessageBody 校验卡片消息
+func validateCardChatMessageBody(body *ChatMessageBody) error {
+	if utils.StringLen(body.Title) > maxChatMessageCardTextLength {
+		return NewResponseError(MessageInvalidFormat("body.title"))
+	}
+
+	if utils.StringLen(body.Description) > maxChatMessageCardTextLength {
+		return NewResponseError(MessageInvalidFormat("body.description"))
+	}
+
+	switch body.CardType {
+	case database.ChatMessageCardTypeLink:
+		u, err := url.Parse(body.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return NewResponseError(MessageInvalidFormat("body.url"))
+		}
+	case database.ChatMessageCardTypeUser, database.ChatMessageCardTypeGroup:
+		if body.TargetID <= 0 {
+			return NewResponseError(MessageInvalidFormat("body.target_id"))
+		}
+	default:
+		return NewResponseError(MessageInvalidFormat("body.card_type"))
+	}
+	return nil
+}
+
+// validateCustomChatMessageBody 校验自定义消息,只校验数据是合法的JSON,不解析内容
+func validateCustomChatMessageBody(body *ChatMessageBody) error {
+	if body.CustomType == "" || utils.StringLen(body.CustomType) > maxChatMessageCustomTypeLength {
+		return NewResponseError(MessageInvalidFormat("body.custom_type"))
+	}
+
+	if len(body.Data) == 0 || len(body.Data) > maxChatMessageCustomDataSize || !json.Valid(body.Data) {
+		return NewResponseError(MessageInvalidFormat("body.data"))
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/utils"
+
+	goutils "github.com/jerbe/go-utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/23 11:12
+  @describe :
+*/
+
+// ChatConversation 会话
+// @Description 会话
+type ChatConversation struct {
+	// TargetID 目标ID; 朋友ID/群ID/世界频道ID
+	TargetID int64 `json:"target_id" example:"1"`
+
+	// SessionType 会话类型; 1-私人会话;2-群聊会话;99-世界频道会话
+	SessionType int `json:"session_type" enums:"1,2,99" example:"1"`
+
+	// Name 显示名称; 好友昵称/群名称/世界频道名称
+	Name string `json:"name" example:"昵称"`
+
+	// Avatar 头像地址,只有私聊会话有
+	Avatar string `json:"avatar,omitempty" format:"url" example:"https://www.baidu.com/logo.png"`
+
+	// LastMessageID 最后一条消息ID
+	LastMessageID int64 `json:"last_message_id" example:"120"`
+
+	// LastMessage 最后一条消息
+	LastMessage *ChatMessage `json:"last_message,omitempty"`
+
+	// UnreadCount 未读消息数量
+	UnreadCount int64 `json:"unread_count" example:"3"`
+
+	// Pinned 是否置顶
+	Pinned bool `json:"pinned" example:"false"`
+
+	// Muted 是否免打扰
+	Muted bool `json:"muted" example:"false"`
+
+	// Mentioned 未读消息中是否有人@了当前用户
+	Mentioned bool `json:"mentioned" example:"false"`
+
+	// UpdatedAt 最后活跃时间
+	UpdatedAt int64 `json:"updated_at" example:"12345678901234"`
+}
+
+// GetChatConversationsHandler
+// @Summary      获取会话列表
+// @Description  返回用户的私聊、群聊跟世界频道会话,置顶的会话排在最前面,其余按最后活跃时间倒序排列
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response{data=[]ChatConversation}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/conversations [get]
+func GetChatConversationsHandler(ctx *gin.Context) {
+	rsps, err := getChatConversations(ctx)
+	if err != nil {
+		JSONResponseError(ctx, err)
+		return
+	}
+	JSON(ctx, rsps)
+}
+
+// chatConversationTarget 会话对应的目标
+type chatConversationTarget struct {
+	targetID    int64
+	sessionType int
+}
+
+// getChatConversations 获取当前登录用户的会话列表
+func getChatConversations(ctx *gin.Context) ([]*ChatConversation, error) {
+	currentUser := LoginUserFromContext(ctx)
+
+	friendIDs, err := database.GetUserRelationTargetIDs(currentUser.ID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取用户关系列表失败")
+		return nil, errors.Wrap(err)
+	}
+
+	groupIDs, err := database.GetUserGroupIDs(currentUser.ID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取用户群组列表失败")
+		return nil, errors.Wrap(err)
+	}
+
+	conversations, err := database.GetChatConversations(currentUser.ID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取会话设置失败")
+		return nil, errors.Wrap(err)
+	}
+
+	targets := make(map[string]chatConversationTarget, len(friendIDs)+len(groupIDs))
+	for _, id := range friendIDs {
+		targets[utils.FormatPrivateRoomID(currentUser.ID, id)] = chatConversationTarget{targetID: id, sessionType: database.ChatMessageSessionTypePrivate}
+	}
+	for _, id := range groupIDs {
+		targets[utils.FormatGroupRoomID(id)] = chatConversationTarget{targetID: id, sessionType: database.ChatMessageSessionTypeGroup}
+	}
+
+	// 世界频道没有成员关系,用户发过言或者设置过的世界频道才会出现在会话列表中
+	for roomID, conversation := range conversations {
+		if conversation.SessionType == database.ChatMessageSessionTypeWorld {
+			targets[roomID] = chatConversationTarget{targetID: conversation.TargetID, sessionType: conversation.SessionType}
+		}
+	}
+
+	if len(targets) == 0 {
+		return []*ChatConversation{}, nil
+	}
+
+	roomIDs := make([]string, 0, len(targets))
+	for roomID := range targets {
+		roomIDs = append(roomIDs, roomID)
+	}
+
+	rooms, err := database.GetChatRooms(roomIDs)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取聊天室列表失败")
+		return nil, errors.Wrap(err)
+	}
+
+	unreadCounts := getChatUnreadCounts(ctx, currentUser.ID, rooms, conversations)
+
+	rsps := make([]*ChatConversation, 0, len(rooms))
+	var userIDs, roomGroupIDs []int64
+	for _, room := range rooms {
+		target, ok := targets[room.RoomID]
+		if !ok || target.sessionType != room.SessionType {
+			continue
+		}
+
+		rsp := &ChatConversation{
+			TargetID:      target.targetID,
+			SessionType:   target.sessionType,
+			LastMessageID: room.LastMessageID,
+			UnreadCount:   unreadCounts[room.RoomID],
+			UpdatedAt:     room.UpdatedAt,
+		}
+
+		var clearedMessageID int64
+		if conversation, ok := conversations[room.RoomID]; ok {
+			rsp.Pinned = conversation.Pinned
+			rsp.Muted = conversation.Muted
+			rsp.Mentioned = conversation.Mentioned()
+			clearedMessageID = conversation.ClearedMessageID
+		}
+
+		// 最后一条消息被当前用户删除或者清空时不显示
+		if room.LastMessage.MessageID > 0 && room.LastMessage.VisibleTo(currentUser.ID, clearedMessageID) {
+			rsp.LastMessage = chatMessageFromDatabaseForUser(&room.LastMessage, currentUser.ID)
+		}
+
+		switch target.sessionType {
+		case database.ChatMessageSessionTypePrivate:
+			userIDs = append(userIDs, target.targetID)
+		case database.ChatMessageSessionTypeGroup:
+			roomGroupIDs = append(roomGroupIDs, target.targetID)
+		case database.ChatMessageSessionTypeWorld:
+			rsp.Name = fmt.Sprintf("世界频道%d", target.targetID)
+		}
+		rsps = append(rsps, rsp)
+	}
+
+	if err = fillChatConversationsDisplay(rsps, userIDs, roomGroupIDs); err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取会话显示信息失败")
+		return nil, errors.Wrap(err)
+	}
+
+	// 房间已经按最后活跃时间倒序排列,这里只需要把置顶的会话提到前面
+	sort.SliceStable(rsps, func(i, j int) bool {
+		return rsps[i].Pinned && !rsps[j].Pinned
+	})
+	return rsps, nil
+}
+
+// fillChatConversationsDisplay 填充会话的显示名称跟头像
+func fillChatConversationsDisplay(rsps []*ChatConversation, userIDs, groupIDs []int64) error {
+	names := make(map[int64]string)
+	avatars := make(map[int64]string)
+	if len(userIDs) > 0 {
+		users, err := database.GetUsers(userIDs)
+		if err != nil && !errors.IsNoRecord(err) {
+			return errors.Wrap(err)
+		}
+		for _, u := range users {
+			names[u.ID] = u.Nickname
+			avatars[u.ID] = u.Avatar
+		}
+	}
+
+	groupNames := make(map[int64]string)
+	if len(groupIDs) > 0 {
+		groups, err := database.GetGroups(groupIDs)
+		if err != nil && !errors.IsNoRecord(err) {
+			return errors.Wrap(err)
+		}
+		for _, g := range groups {
+			groupNames[g.ID] = g.Name
+		}
+	}
+
+	for _, rsp := range rsps {
+		switch rsp.SessionType {
+		case database.ChatMessageSessionTypePrivate:
+			rsp.Name = names[rsp.TargetID]
+			rsp.Avatar = avatars[rsp.TargetID]
+		case database.ChatMessageSessionTypeGroup:
+			rsp.Name = groupNames[rsp.TargetID]
+		}
+	}
+	return nil
+}
+
+// UpdateChatConversationRequest 更新会话设置请求参数
+// @Description 更新会话设置请求参数
+type UpdateChatConversationRequest struct {
+	// TargetID 目标ID; 朋友ID/群ID/世界频道ID
+	TargetID int64 `json:"target_id" binding:"required" example:"1"`
+
+	// SessionType 会话类型; 1-私人会话;2-群聊会话;99-世界频道会话
+	SessionType int `json:"session_type" binding:"required" enums:"1,2,99" example:"1"`
+
+	// Pinned 是否置顶
+	Pinned *bool `json:"pinned" example:"true"`
+
+	// Muted 是否免打扰
+	Muted *bool `json:"muted" example:"false"`
+}
+
+// UpdateChatConversationHandler
+// @Summary      更新会话设置
+// @Description  设置会话置顶跟免打扰
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Param        jsonRaw    body      UpdateChatConversationRequest  true  "请求JSON数据体"
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/conversation/update [post]
+func UpdateChatConversationHandler(ctx *gin.Context) {
+	req := new(UpdateChatConversationRequest)
+	err := ctx.BindJSON(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	if req.TargetID <= 0 {
+		JSONError(ctx, StatusError, MessageInvalidTargetID)
+		return
+	}
+
+	if req.Pinned == nil && req.Muted == nil {
+		JSONError(ctx, StatusError, MessageInvalidParams)
+		return
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+
+	var roomID string
+	if req.SessionType == database.ChatMessageSessionTypeWorld {
+		roomID = utils.FormatWorldRoomID(req.TargetID)
+	} else {
+		roomID, err = chatRoomIDWithPermission(currentUser.ID, req.SessionType, req.TargetID)
+		if err != nil {
+			JSONResponseError(ctx, err)
+			return
+		}
+	}
+
+	data := new(database.UpdateChatConversationData)
+	if req.Pinned != nil {
+		data.SetPinned(*req.Pinned)
+	}
+	if req.Muted != nil {
+		data.SetMuted(*req.Muted)
+	}
+
+	_, err = database.UpdateChatConversation(&database.UpdateChatConversationFilter{
+		UserID:      currentUser.ID,
+		RoomID:      roomID,
+		SessionType: req.SessionType,
+		TargetID:    req.TargetID,
+	}, data)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("更新会话设置失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+	JSON(ctx)
+}
+
+// markChatConversationRead 将会话标记为已读到指定的消息
+// 发送者发出的消息对发送者自己来说一定是已读的
+func markChatConversationRead(ctx context.Context, userID int64, msg *database.ChatMessage) {
+	if !goutils.In(msg.SessionType, database.ChatMessageSessionTypePrivate, database.ChatMessageSessionTypeGroup, database.ChatMessageSessionTypeWorld) {
+		return
+	}
+
+	_, err := database.UpdateChatConversation(&database.UpdateChatConversationFilter{
+		UserID:      userID,
+		RoomID:      msg.RoomID,
+		SessionType: msg.SessionType,
+		TargetID:    msg.ReceiverID,
+	}, new(database.UpdateChatConversationData).SetReadMessageID(msg.MessageID))
+	if err != nil {
+		log.WarnFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", msg.RoomID).Msg("更新会话已读位置失败")
+		return
+	}
+
+	if err = database.SetChatUnreadCount(userID, msg.RoomID, 0); err != nil {
+		log.WarnFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", msg.RoomID).Msg("更新未读数缓存失败")
+	}
+}
@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/pubsub"
+	"github.com/jerbe/jim/utils"
+	"github.com/jerbe/jim/websocket"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/25 16:40
+  @describe :
+*/
+
+// maxDeleteMessageIDs 一次最多按ID删除的消息数量
+const maxDeleteMessageIDs = 100
+
+// DeleteChatMessageRequest 删除聊天消息请求参数
+// @Description 删除聊天消息请求参数,按ID删除、按范围删除、清空会话三选一
+type DeleteChatMessageRequest struct {
+	// TargetID 目标ID; 朋友ID/群ID/世界频道ID
+	TargetID int64 `json:"target_id" binding:"required" example:"1"`
+
+	// SessionType 会话类型; 1-私人会话;2-群聊会话;99-世界频道会话
+	SessionType int `json:"session_type" binding:"required" enums:"1,2,99" example:"1"`
+
+	// MessageIDs 需要删除的消息ID列表,最多100个
+	MessageIDs []int64 `json:"message_ids" example:"1,2,3"`
+
+	// StartMessageID 按范围删除的起始消息ID,包含该消息
+	StartMessageID int64 `json:"start_message_id" example:"1"`
+
+	// EndMessageID 按范围删除的结束消息ID,包含该消息
+	EndMessageID int64 `json:"end_message_id" example:"100"`
+
+	// Clear 是否清空会话,不能在话题中使用
+	Clear bool `json:"clear" example:"false"`
+
+	// ThreadID 消息所在话题的根消息ID,不在话题中时为0
+	ThreadID int64 `json:"thread_id" example:"0"`
+}
+
+// DeleteChatMessageResponse 删除聊天消息返回参数
+// @Description 删除聊天消息返回参数
+type DeleteChatMessageResponse struct {
+	// DeletedCount 本次删除的消息数量,清空会话时为0
+	DeletedCount int64 `json:"deleted_count" example:"3"`
+
+	// ClearedMessageID 清空会话时的最后消息ID,小于等于该ID的消息都不再显示
+	ClearedMessageID int64 `json:"cleared_message_id,omitempty" example:"120"`
+}
+
+// DeleteChatMessageHandler
+// @Summary      删除聊天消息
+// @Description  只为当前用户删除消息,其他人依然可以看到;支持按ID删除、按范围删除跟清空会话,并通知当前用户的其他设备
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Param        jsonRaw    body      DeleteChatMessageRequest  true  "请求JSON数据体"
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response{data=DeleteChatMessageResponse}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/message/delete [post]
+func DeleteChatMessageHandler(ctx *gin.Context) {
+	req := new(DeleteChatMessageRequest)
+	err := ctx.BindJSON(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	rsp, err := deleteChatMessageByRequest(ctx, req)
+	if err != nil {
+		JSONResponseError(ctx, err)
+		return
+	}
+	JSON(ctx, rsp)
+}
+
+// deleteChatMessageByRequest 校验请求并为当前用户删除消息
+// HTTP 跟 websocket 共用该方法
+func deleteChatMessageByRequest(ctx *gin.Context, req *DeleteChatMessageRequest) (*DeleteChatMessageResponse, error) {
+	if req.TargetID <= 0 {
+		return nil, NewResponseError(MessageInvalidTargetID)
+	}
+
+	// 三种删除方式只能选一种
+	modes := 0
+	if len(req.MessageIDs) > 0 {
+		if len(req.MessageIDs) > maxDeleteMessageIDs {
+			return nil, NewResponseError(MessageInvalidFormat("message_ids"))
+		}
+		modes++
+	}
+	if req.StartMessageID > 0 || req.EndMessageID > 0 {
+		if req.StartMessageID <= 0 || req.EndMessageID < req.StartMessageID {
+			return nil, NewResponseError(MessageInvalidFormat("start_message_id"))
+		}
+		modes++
+	}
+	if req.Clear {
+		modes++
+	}
+	if modes != 1 {
+		return nil, NewResponseError(MessageInvalidParams)
+	}
+
+	// 清空只作用于会话本身,话题有独立的消息ID序列
+	if req.ThreadID < 0 || (req.ThreadID > 0 && req.Clear) {
+		return nil, NewResponseError(MessageInvalidThreadID)
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+
+	var roomID string
+	var err error
+	if req.SessionType == database.ChatMessageSessionTypeWorld {
+		roomID = utils.FormatWorldRoomID(req.TargetID)
+	} else {
+		roomID, err = chatRoomIDWithPermission(currentUser.ID, req.SessionType, req.TargetID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if req.ThreadID > 0 {
+		roomID = utils.FormatThreadRoomID(roomID, req.ThreadID)
+	}
+
+	rsp := new(DeleteChatMessageResponse)
+	if req.Clear {
+		rsp.ClearedMessageID, err = clearChatConversation(ctx, currentUser.ID, roomID, req)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		rsp.DeletedCount, err = database.DeleteChatMessages(&database.DeleteChatMessagesFilter{
+			RoomID:         roomID,
+			SessionType:    req.SessionType,
+			UserID:         currentUser.ID,
+			MessageIDs:     req.MessageIDs,
+			StartMessageID: req.StartMessageID,
+			EndMessageID:   req.EndMessageID,
+		})
+		if err != nil {
+			log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("删除聊天消息失败")
+			return nil, errors.Wrap(err)
+		}
+
+		// 没有新删除的消息,不需要通知其他设备
+		if rsp.DeletedCount == 0 {
+			return rsp, nil
+		}
+	}
+
+	err = pubsub.PublishChatMessageDeleted(ctx, &pubsub.ChatMessageDeleted{
+		UserID:           currentUser.ID,
+		SessionType:      req.SessionType,
+		TargetID:         req.TargetID,
+		ThreadID:         req.ThreadID,
+		MessageIDs:       req.MessageIDs,
+		StartMessageID:   req.StartMessageID,
+		EndMessageID:     req.EndMessageID,
+		ClearedMessageID: rsp.ClearedMessageID,
+		DeletedAt:        time.Now().UnixMilli(),
+	})
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("推送消息删除通知到管道失败")
+	}
+	return rsp, nil
+}
+
+// clearChatConversation 清空会话
+// 只记录清空时的最后消息ID,不修改消息本身,同时把会话标记为全部已读
+func clearChatConversation(ctx *gin.Context, userID int64, roomID string, req *DeleteChatMessageRequest) (int64, error) {
+	room, err := database.GetChatRoom(roomID)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			return 0, NewResponseError(MessageNotFound)
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("获取聊天室失败")
+		return 0, errors.Wrap(err)
+	}
+
+	conversation, err := database.UpdateChatConversation(&database.UpdateChatConversationFilter{
+		UserID:      userID,
+		RoomID:      roomID,
+		SessionType: req.SessionType,
+		TargetID:    req.TargetID,
+	}, new(database.UpdateChatConversationData).
+		SetClearedMessageID(room.LastMessageID).
+		SetReadMessageID(room.LastMessageID))
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("清空会话失败")
+		return 0, errors.Wrap(err)
+	}
+
+	if err = database.SetChatUnreadCount(userID, roomID, 0); err != nil {
+		log.WarnFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("更新未读数缓存失败")
+	}
+	return conversation.ClearedMessageID, nil
+}
+
+// chatConversationClearedMessageID 获取用户清空会话时的最后消息ID,没有清空过时返回0
+func chatConversationClearedMessageID(ctx *gin.Context, userID int64, roomID string) (int64, error) {
+	conversation, err := database.GetChatConversation(userID, roomID)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			return 0, nil
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("获取会话设置失败")
+		return 0, errors.Wrap(err)
+	}
+	return conversation.ClearedMessageID, nil
+}
+
+// ========================================================================================
+// ============================ SUBSCRIBE HANDLER =========================================
+// ========================================================================================
+
+// SubscribeChatMessageDeletedHandler 接收消息删除通知
+func SubscribeChatMessageDeletedHandler(ctx context.Context, payload *pubsub.Payload) {
+	deleted := new(pubsub.ChatMessageDeleted)
+	err := payload.UnmarshalData(deleted)
+	if err != nil {
+		log.Error().Err(err).Str("payload.channel", payload.Channel).Str("payload.type", payload.Type).Send()
+		return
+	}
+
+	// 删除只对删除人生效,只推送给删除人的所有设备
+	websocketManager.PushData(websocket.Payload{Type: payload.Type, Data: deleted}, deleted.UserID)
+}
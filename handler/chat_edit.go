@@ -0,0 +1,263 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jerbe/jim/config"
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/pubsub"
+	"github.com/jerbe/jim/utils"
+	"github.com/jerbe/jim/websocket"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/27 16:30
+  @describe :
+*/
+
+// EditChatMessageRequest 编辑聊天消息请求参数
+// @Description 编辑聊天消息请求参数,只能编辑自己发送的文本消息
+type EditChatMessageRequest struct {
+	// TargetID 目标ID; 朋友ID/群ID/世界频道ID
+	TargetID int64 `json:"target_id" binding:"required" example:"1"`
+
+	// SessionType 会话类型; 1-私人会话;2-群聊会话;99-世界频道会话
+	SessionType int `json:"session_type" binding:"required" enums:"1,2,99" example:"1"`
+
+	// MessageID 消息ID
+	MessageID int64 `json:"message_id" binding:"required" example:"120"`
+
+	// ThreadID 消息所在话题的根消息ID,不在话题中时为0
+	ThreadID int64 `json:"thread_id" example:"0"`
+
+	// Text 编辑后的文本
+	Text string `json:"text" binding:"required" example:"编辑后的文案"`
+}
+
+// EditChatMessageHandler
+// @Summary      编辑聊天消息
+// @Description  编辑自己发送的文本消息,编辑前的内容会保留为历史版本,编辑会推送给会话中的所有人
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Param        jsonRaw    body      EditChatMessageRequest  true  "请求JSON数据体"
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response{data=ChatMessage}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/message/edit [post]
+func EditChatMessageHandler(ctx *gin.Context) {
+	req := new(EditChatMessageRequest)
+	err := ctx.BindJSON(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	rsp, err := editChatMessageByRequest(ctx, req)
+	if err != nil {
+		JSONResponseError(ctx, err)
+		return
+	}
+	JSON(ctx, rsp)
+}
+
+// editChatMessageByRequest 校验请求并编辑聊天消息
+// HTTP 跟 websocket 共用该方法
+func editChatMessageByRequest(ctx *gin.Context, req *EditChatMessageRequest) (*ChatMessage, error) {
+	if req.TargetID <= 0 {
+		return nil, NewResponseError(MessageInvalidTargetID)
+	}
+
+	if req.MessageID <= 0 {
+		return nil, NewResponseError(MessageInvalidMessageID)
+	}
+
+	if req.ThreadID < 0 {
+		return nil, NewResponseError(MessageInvalidThreadID)
+	}
+
+	if err := validateChatText(req.Text); err != nil {
+		return nil, err
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+	roomID, err := chatRoomIDWithReadPermission(ctx, currentUser.ID, req.SessionType, req.TargetID)
+	if err != nil {
+		return nil, err
+	}
+	if req.ThreadID > 0 {
+		roomID = utils.FormatThreadRoomID(roomID, req.ThreadID)
+	}
+
+	msg, err := database.EditChatMessage(&database.EditChatMessageFilter{
+		RoomID:       roomID,
+		SessionType:  req.SessionType,
+		MessageID:    req.MessageID,
+		SenderID:     currentUser.ID,
+		CreatedAfter: time.Now().Add(-chatEditWindow()).UnixMilli(),
+	}, req.Text)
+	if err != nil {
+		// 消息不存在、不是自己发送的文本消息、已撤回或者超过了编辑时间
+		if errors.IsNoRecord(err) {
+			return nil, NewResponseError(MessageEditChatMessageFailure)
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("编辑聊天消息失败")
+		return nil, errors.Wrap(err)
+	}
+
+	rsp := chatMessageFromDatabaseForUser(msg, currentUser.ID)
+
+	edit := &pubsub.ChatMessageEdit{
+		SessionType: msg.SessionType,
+		SenderID:    msg.SenderID,
+		ReceiverID:  msg.ReceiverID,
+		MessageID:   msg.MessageID,
+		ThreadID:    msg.ThreadID,
+		Body:        fillChatMessageBodyForPublish(&rsp.Body),
+		EditedAt:    msg.EditedAt,
+	}
+
+	if req.SessionType == database.ChatMessageSessionTypeGroup {
+		edit.PublishTargets, err = database.GetGroupMemberIDs(req.TargetID)
+		if err != nil {
+			log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取群成员ID列表失败")
+		}
+	}
+
+	if err = pubsub.PublishChatMessageEdit(ctx, edit); err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("推送编辑通知到管道失败")
+	}
+	return rsp, nil
+}
+
+// chatEditWindow 发送人编辑自己消息的时间窗口,未配置时默认15分钟
+func chatEditWindow() time.Duration {
+	if window := config.GlobConfig().Chat.EditWindow; window > 0 {
+		return window
+	}
+	return 15 * time.Minute
+}
+
+// GetChatMessageRevisionsRequest 获取消息历史版本请求参数
+// @Description 获取消息历史版本请求参数
+type GetChatMessageRevisionsRequest struct {
+	// TargetID 目标ID; 朋友ID/群ID/世界频道ID
+	TargetID int64 `form:"target_id" json:"target_id" binding:"required" example:"1"`
+
+	// SessionType 会话类型; 1-私人会话;2-群聊会话;99-世界频道会话
+	SessionType int `form:"session_type" json:"session_type" binding:"required" enums:"1,2,99" example:"1"`
+
+	// MessageID 消息ID
+	MessageID int64 `form:"message_id" json:"message_id" binding:"required" example:"120"`
+
+	// ThreadID 消息所在话题的根消息ID,不在话题中时为0
+	ThreadID int64 `form:"thread_id" json:"thread_id" example:"0"`
+}
+
+// ChatMessageRevision 消息的历史版本
+// @Description 消息的历史版本
+type ChatMessageRevision struct {
+	// Body 该版本的消息主体
+	Body ChatMessageBody `json:"body"`
+
+	// CreatedAt 该版本的生效时间,第一个版本为消息的发送时间
+	CreatedAt int64 `json:"created_at" example:"12345678901234"`
+}
+
+// GetChatMessageRevisionsHandler
+// @Summary      获取消息历史版本
+// @Description  返回消息编辑前的所有版本,按时间正序排列,不包含当前版本
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Param        target_id    query      int  true  "目标ID; 朋友ID/群ID/世界频道ID"
+// @Param        session_type    query      int  true  "会话类型; 1-私人会话;2-群聊会话;99-世界频道会话"
+// @Param        message_id    query      int  true  "消息ID"
+// @Param        thread_id    query      int  false  "消息所在话题的根消息ID"
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response{data=[]ChatMessageRevision}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/message/revisions [get]
+func GetChatMessageRevisionsHandler(ctx *gin.Context) {
+	req := new(GetChatMessageRevisionsRequest)
+	err := ctx.BindQuery(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	if req.TargetID <= 0 {
+		JSONError(ctx, StatusError, MessageInvalidTargetID)
+		return
+	}
+
+	if req.MessageID <= 0 {
+		JSONError(ctx, StatusError, MessageInvalidMessageID)
+		return
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+	roomID, err := chatRoomIDWithReadPermission(ctx, currentUser.ID, req.SessionType, req.TargetID)
+	if err != nil {
+		JSONResponseError(ctx, err)
+		return
+	}
+	if req.ThreadID > 0 {
+		roomID = utils.FormatThreadRoomID(roomID, req.ThreadID)
+	}
+
+	messages, err := database.GetChatMessagesByIDs(roomID, req.SessionType, []int64{req.MessageID})
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("获取聊天消息失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+
+	// 撤回的消息不再提供历史版本
+	if len(messages) == 0 || messages[0].Status == database.ChatMessageStatusRollback || messages[0].Status == database.ChatMessageStatusExpired {
+		JSONError(ctx, StatusError, MessageNotFound)
+		return
+	}
+
+	rsps := make([]*ChatMessageRevision, len(messages[0].Revisions))
+	for i, revision := range messages[0].Revisions {
+		rsps[i] = &ChatMessageRevision{
+			Body:      chatMessageBodyFromDatabase(&revision.Body),
+			CreatedAt: revision.CreatedAt,
+		}
+	}
+	JSON(ctx, rsps)
+}
+
+// ========================================================================================
+// ============================ SUBSCRIBE HANDLER =========================================
+// ========================================================================================
+
+// SubscribeChatMessageEditHandler 接收消息编辑通知
+func SubscribeChatMessageEditHandler(ctx context.Context, payload *pubsub.Payload) {
+	edit := new(pubsub.ChatMessageEdit)
+	err := payload.UnmarshalData(edit)
+	if err != nil {
+		log.Error().Err(err).Str("payload.channel", payload.Channel).Str("payload.type", payload.Type).Send()
+		return
+	}
+
+	targets, ok := chatPushTargets(edit.SessionType, edit.SenderID, edit.ReceiverID, edit.PublishTargets)
+	if !ok {
+		return
+	}
+
+	edit.PublishTargets = nil
+	websocketManager.PushData(websocket.Payload{Type: payload.Type, Data: edit}, targets...)
+}
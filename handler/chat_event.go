@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jerbe/jim/config"
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/pubsub"
+	"github.com/jerbe/jim/websocket"
+
+	goutils "github.com/jerbe/go-utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/25 10:35
+  @describe :
+*/
+
+const (
+	// chatEventLimitWindow 瞬时事件限流的时间窗口
+	chatEventLimitWindow = time.Second * 5
+
+	// chatEventLimitTimes 每个发送人在一个时间窗口内最多可以发送的瞬时事件数量
+	chatEventLimitTimes = 10
+)
+
+// SendChatEventRequest 发送聊天瞬时事件请求参数
+// @Description 发送聊天瞬时事件请求参数
+type SendChatEventRequest struct {
+	// TargetID 目标ID; 朋友ID/群ID
+	TargetID int64 `json:"target_id" binding:"required" example:"1"`
+
+	// SessionType 会话类型; 1-私人会话;2-群聊会话
+	SessionType int `json:"session_type" binding:"required" enums:"1,2" example:"1"`
+
+	// Event 事件类型; typing-正在输入,recording-正在录音,stopped-停止
+	Event string `json:"event" binding:"required" enums:"typing,recording,stopped" example:"typing"`
+}
+
+// SendChatEventHandler
+// @Summary      发送聊天瞬时事件
+// @Description  发送正在输入、正在录音等瞬时事件,只推送给在线的对方或群成员,不会保存
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Param        jsonRaw    body      SendChatEventRequest  true  "请求JSON数据体"
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/event [post]
+func SendChatEventHandler(ctx *gin.Context) {
+	req := new(SendChatEventRequest)
+	err := ctx.BindJSON(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	if err = sendChatEventByRequest(ctx, req); err != nil {
+		JSONResponseError(ctx, err)
+		return
+	}
+	JSON(ctx)
+}
+
+// sendChatEventByRequest 校验请求并发布聊天瞬时事件
+// HTTP 跟 websocket 共用该方法
+func sendChatEventByRequest(ctx *gin.Context, req *SendChatEventRequest) error {
+	if req.TargetID <= 0 {
+		return NewResponseError(MessageInvalidTargetID)
+	}
+
+	if !goutils.In(req.Event, pubsub.ChatEventTyping, pubsub.ChatEventRecording, pubsub.ChatEventStopped) {
+		return NewResponseError(MessageInvalidEvent)
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+	if currentUser.ID == req.TargetID && req.SessionType == database.ChatMessageSessionTypePrivate {
+		return NewResponseError(MessageChatYourself)
+	}
+
+	// 跟发送消息使用相同的检测,被删除,被拉黑或者已经退群时不能发送
+	switch req.SessionType {
+	case database.ChatMessageSessionTypePrivate:
+		if err := checkChatFriendRelation(ctx, currentUser.ID, req.TargetID); err != nil {
+			return err
+		}
+	case database.ChatMessageSessionTypeGroup:
+		if _, _, err := checkChatGroupMember(ctx, currentUser.ID, req.TargetID); err != nil {
+			return err
+		}
+	default:
+		return NewResponseError(MessageInvalidSessionType)
+	}
+
+	allow, err := allowChatEvent(currentUser.ID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("检查瞬时事件频率失败")
+		return errors.Wrap(err)
+	}
+	if !allow {
+		return NewResponseError(MessageTooFrequent)
+	}
+
+	event := &pubsub.ChatEvent{
+		Event:       req.Event,
+		SessionType: req.SessionType,
+		SenderID:    currentUser.ID,
+		ReceiverID:  req.TargetID,
+		CreatedAt:   time.Now().UnixMilli(),
+	}
+
+	if req.SessionType == database.ChatMessageSessionTypeGroup {
+		event.PublishTargets, err = database.GetGroupMemberIDs(req.TargetID)
+		if err != nil {
+			log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取群成员ID列表失败")
+			return errors.Wrap(err)
+		}
+	}
+
+	if err = pubsub.PublishChatEvent(ctx, event); err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("推送瞬时事件到管道失败")
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+// incrChatEventLimitScript 计数并在没有过期时间时设置过期时间
+// 计数跟设置过期时间在同一个脚本中执行,不会留下没有过期时间的计数
+const incrChatEventLimitScript = `
+local times = redis.call("INCR", KEYS[1])
+if redis.call("PTTL", KEYS[1]) < 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return times
+`
+
+// allowChatEvent 检查发送人是否还可以发送瞬时事件
+// 使用redis计数,多个服务实例共享同一个发送人的限额
+func allowChatEvent(userID int64) (bool, error) {
+	limitRedisKey := fmt.Sprintf("%s:chat_event:limit:%d", config.GlobConfig().Main.ServerName, userID)
+	times, err := database.GlobDB.Redis.Eval(context.Background(), incrChatEventLimitScript, []string{limitRedisKey}, chatEventLimitWindow.Milliseconds()).Int64()
+	if err != nil {
+		return false, errors.Wrap(err)
+	}
+	return times <= chatEventLimitTimes, nil
+}
+
+// ========================================================================================
+// ============================ SUBSCRIBE HANDLER =========================================
+// ========================================================================================
+
+// SubscribeChatEventHandler 接收聊天瞬时事件
+func SubscribeChatEventHandler(ctx context.Context, payload *pubsub.Payload) {
+	event := new(pubsub.ChatEvent)
+	err := payload.UnmarshalData(event)
+	if err != nil {
+		log.Error().Err(err).Str("payload.channel", payload.Channel).Str("payload.type", payload.Type).Send()
+		return
+	}
+
+	var targets []any
+	switch event.SessionType {
+	case database.ChatMessageSessionTypePrivate:
+		targets = []any{event.ReceiverID}
+	case database.ChatMessageSessionTypeGroup:
+		targets = make([]any, 0, len(event.PublishTargets))
+		for _, id := range event.PublishTargets {
+			// 不需要推送给发送人自己
+			if id != event.SenderID {
+				targets = append(targets, id)
+			}
+		}
+	}
+
+	if len(targets) == 0 {
+		return
+	}
+
+	// 推送目标已经由发布方填好,推送数据中不需要再带上
+	event.PublishTargets = nil
+	websocketManager.PushData(websocket.Payload{Type: payload.Type, Data: event}, targets...)
+}
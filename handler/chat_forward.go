@@ -0,0 +1,318 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/utils"
+
+	goutils "github.com/jerbe/go-utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/6 10:20
+  @describe : 消息转发跟合并转发
+*/
+
+const (
+	// maxForwardMessageIDs 一次最多转发的消息数量
+	maxForwardMessageIDs = 100
+
+	// maxForwardTargets 一次最多转发到的会话数量
+	maxForwardTargets = 10
+)
+
+// ForwardChatMessageRequest 转发聊天消息请求参数
+// @Description 转发聊天消息请求参数,把来源会话中的消息逐条或者合并成一条转发到多个私聊或群聊中
+type ForwardChatMessageRequest struct {
+	// ActionID 行为ID,由前端生成
+	ActionID string `json:"action_id" example:"8d7a3bcd72"`
+
+	// SessionType 来源会话类型; 1-私人会话;2-群聊会话;99-世界频道会话
+	SessionType int `json:"session_type" binding:"required" enums:"1,2,99" example:"1"`
+
+	// TargetID 来源会话的目标ID; 朋友ID/群ID/世界频道ID
+	TargetID int64 `json:"target_id" binding:"required" example:"1"`
+
+	// ThreadID 来源消息所在话题的根消息ID,不在话题中时为0
+	ThreadID int64 `json:"thread_id" example:"0"`
+
+	// MessageIDs 需要转发的消息ID列表,最多100个
+	MessageIDs []int64 `json:"message_ids" binding:"required" example:"1,2,3"`
+
+	// Merge 是否合并成一条合并转发消息
+	Merge bool `json:"merge" example:"false"`
+
+	// Title 合并转发卡片的标题,为空时由客户端生成
+	Title string `json:"title" example:"群聊的聊天记录"`
+
+	// Targets 转发到的会话,只能是私聊或群聊,最多10个
+	Targets []ChatForwardTarget `json:"targets" binding:"required"`
+}
+
+// ChatForwardTarget 转发到的会话
+// @Description 转发到的会话
+type ChatForwardTarget struct {
+	// SessionType 会话类型; 1-私人会话;2-群聊会话
+	SessionType int `json:"session_type" enums:"1,2" example:"1"`
+
+	// TargetID 目标ID; 朋友ID/群ID
+	TargetID int64 `json:"target_id" example:"1"`
+}
+
+// ChatForwardResult 转发到一个会话的结果
+// @Description 转发到一个会话的结果,各个会话之间互不影响
+type ChatForwardResult struct {
+	// SessionType 会话类型; 1-私人会话;2-群聊会话
+	SessionType int `json:"session_type" example:"1"`
+
+	// TargetID 目标ID; 朋友ID/群ID
+	TargetID int64 `json:"target_id" example:"1"`
+
+	// Messages 发送成功的消息
+	Messages []*ChatMessage `json:"messages"`
+
+	// Error 发送失败的原因,为空时表示全部发送成功
+	Error string `json:"error,omitempty" example:"您与对方不是好友关系"`
+}
+
+// ForwardChatMessageHandler
+// @Summary      转发聊天消息
+// @Description  把当前用户可以阅读的消息逐条或者合并转发到多个私聊或群聊中,每个会话的权限检测跟发送消息一样,返回每个会话的发送结果
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Param        jsonRaw    body      ForwardChatMessageRequest  true  "请求JSON数据体"
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response{data=[]ChatForwardResult}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/message/forward [post]
+func ForwardChatMessageHandler(ctx *gin.Context) {
+	req := new(ForwardChatMessageRequest)
+	err := ctx.BindJSON(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	rsp, err := forwardChatMessageByRequest(ctx, req)
+	if err != nil {
+		JSONResponseError(ctx, err)
+		return
+	}
+	JSON(ctx, rsp)
+}
+
+// forwardChatMessageByRequest 校验转发请求并转发聊天消息
+// HTTP 跟 websocket 共用该方法
+func forwardChatMessageByRequest(ctx *gin.Context, req *ForwardChatMessageRequest) ([]*ChatForwardResult, error) {
+	if !goutils.In(req.SessionType, database.ChatMessageSessionTypePrivate, database.ChatMessageSessionTypeGroup, database.ChatMessageSessionTypeWorld) {
+		return nil, NewResponseError(MessageInvalidSessionType)
+	}
+
+	if req.TargetID <= 0 {
+		return nil, NewResponseError(MessageInvalidTargetID)
+	}
+
+	if req.ThreadID < 0 {
+		return nil, NewResponseError(MessageInvalidThreadID)
+	}
+
+	if err := validateForwardChatMessageRequest(req); err != nil {
+		return nil, err
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+	roomID, err := chatRoomIDWithReadPermission(ctx, currentUser.ID, req.SessionType, req.TargetID)
+	if err != nil {
+		return nil, err
+	}
+
+	clearedMessageID, err := chatConversationClearedMessageID(ctx, currentUser.ID, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.ThreadID > 0 {
+		roomID = utils.FormatThreadRoomID(roomID, req.ThreadID)
+		clearedMessageID = 0
+	}
+
+	messages, err := database.GetChatMessagesByIDs(roomID, req.SessionType, req.MessageIDs)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("获取被转发的消息失败")
+		return nil, errors.Wrap(err)
+	}
+
+	// 有任何一条消息不能转发时整个请求失败,避免转发出去的内容跟用户选择的不一致
+	if len(messages) != len(req.MessageIDs) {
+		return nil, NewResponseError(MessageForwardChatMessageFailure)
+	}
+	for _, msg := range messages {
+		if !chatForwardable(msg, currentUser.ID, clearedMessageID) {
+			return nil, NewResponseError(MessageForwardChatMessageFailure)
+		}
+	}
+
+	sendReqs := forwardSendChatMessageRequests(req, messages)
+	forward := func() []*ChatForwardResult {
+		results := make([]*ChatForwardResult, len(req.Targets))
+		for i, target := range req.Targets {
+			results[i] = forwardChatMessageToTarget(ctx, currentUser, target, sendReqs)
+		}
+		return results
+	}
+	if req.ActionID == "" {
+		return forward(), nil
+	}
+
+	// 跟发送消息使用同一个ActionID去重,客户端重试时返回第一次的转发结果
+	var results []*ChatForwardResult
+	err = chatActionOnce(ctx, currentUser.ID, req.ActionID, req, &results, func() error {
+		results = forward()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// validateForwardChatMessageRequest 校验需要转发的消息跟转发到的会话,并去掉重复的ID
+func validateForwardChatMessageRequest(req *ForwardChatMessageRequest) error {
+	if utils.StringLen(req.ActionID) > maxChatActionIDLength {
+		return NewResponseError(MessageInvalidFormat("action_id"))
+	}
+
+	if len(req.MessageIDs) == 0 || len(req.MessageIDs) > maxForwardMessageIDs {
+		return NewResponseError(MessageInvalidFormat("message_ids"))
+	}
+
+	messageIDs := make([]int64, 0, len(req.MessageIDs))
+	seenMessageIDs := make(map[int64]struct{}, len(req.MessageIDs))
+	for _, id := range req.MessageIDs {
+		if id <= 0 {
+			return NewResponseError(MessageInvalidFormat("message_ids"))
+		}
+		if _, ok := seenMessageIDs[id]; ok {
+			continue
+		}
+		seenMessageIDs[id] = struct{}{}
+		messageIDs = append(messageIDs, id)
+	}
+	req.MessageIDs = messageIDs
+
+	if len(req.Targets) == 0 || len(req.Targets) > maxForwardTargets {
+		return NewResponseError(MessageInvalidFormat("targets"))
+	}
+
+	targets := make([]ChatForwardTarget, 0, len(req.Targets))
+	seenTargets := make(map[ChatForwardTarget]struct{}, len(req.Targets))
+	for _, target := range req.Targets {
+		if !goutils.In(target.SessionType, database.ChatMessageSessionTypePrivate, database.ChatMessageSessionTypeGroup) || target.TargetID <= 0 {
+			return NewResponseError(MessageInvalidFormat("targets"))
+		}
+		if _, ok := seenTargets[target]; ok {
+			continue
+		}
+		seenTargets[target] = struct{}{}
+		targets = append(targets, target)
+	}
+	req.Targets = targets
+
+	req.Title = strings.TrimSpace(req.Title)
+	if utils.StringLen(req.Title) > maxChatMessageCardTextLength {
+		return NewResponseError(MessageInvalidFormat("title"))
+	}
+	return nil
+}
+
+// chatForwardable 判断消息是否可以被用户转发
+// 撤回,过期,阅后即焚,被用户删除或清空的消息跟系统通知都不能转发
+func chatForwardable(msg *database.ChatMessage, userID, clearedMessageID int64) bool {
+	if msg.Status == database.ChatMessageStatusRollback || msg.Status == database.ChatMessageStatusExpired {
+		return false
+	}
+
+	if msg.ExpireAt > 0 || msg.Type == database.ChatMessageTypeSystem {
+		return false
+	}
+	return msg.VisibleTo(userID, clearedMessageID)
+}
+
+// forwardSendChatMessageRequests 根据被转发的消息生成发送请求
+// 合并转发时生成一条合并转发消息,否则每条消息生成一个请求并记录原发送人
+func forwardSendChatMessageRequests(req *ForwardChatMessageRequest, messages []*database.ChatMessage) []*SendChatMessageRequest {
+	if req.Merge {
+		body := ChatMessageBody{Title: req.Title}
+		for _, msg := range messages {
+			body.Items = append(body.Items, ChatMessageForwardItem{
+				SenderID:  msg.SenderID,
+				Type:      msg.Type,
+				Body:      chatMessageBodyFromDatabase(&msg.Body),
+				CreatedAt: msg.CreatedAt,
+			})
+		}
+		return []*SendChatMessageRequest{{
+			ActionID: req.ActionID,
+			Type:     database.ChatMessageTypeMerged,
+			Body:     body,
+		}}
+	}
+
+	sendReqs := make([]*SendChatMessageRequest, len(messages))
+	for i, msg := range messages {
+		// 转发的消息再次转发时保留最初的发送人
+		forwardFromID := msg.SenderID
+		if msg.ForwardFromID > 0 {
+			forwardFromID = msg.ForwardFromID
+		}
+
+		sendReqs[i] = &SendChatMessageRequest{
+			ActionID:      req.ActionID,
+			Type:          msg.Type,
+			Body:          chatMessageBodyFromDatabase(&msg.Body),
+			forwardFromID: forwardFromID,
+		}
+	}
+	return sendReqs
+}
+
+// forwardChatMessageToTarget 把消息发送到一个会话中
+// 跟普通消息一样使用 sendChatMessageToFriend 跟 sendChatMessageToGroup 检测权限,发送失败时不再发送剩下的消息
+func forwardChatMessageToTarget(ctx *gin.Context, currentUser *database.User, target ChatForwardTarget, sendReqs []*SendChatMessageRequest) *ChatForwardResult {
+	result := &ChatForwardResult{
+		SessionType: target.SessionType,
+		TargetID:    target.TargetID,
+		Messages:    make([]*ChatMessage, 0, len(sendReqs)),
+	}
+
+	for _, sendReq := range sendReqs {
+		// 发送过程中会修改请求,每个会话都使用一份副本
+		r := *sendReq
+		r.SessionType = target.SessionType
+		r.TargetID = target.TargetID
+
+		var rsp *ChatMessage
+		var err error
+		if target.SessionType == database.ChatMessageSessionTypePrivate {
+			rsp, err = sendChatMessageToFriend(ctx, &r, currentUser)
+		} else {
+			rsp, err = sendChatMessageToGroup(ctx, &r, currentUser)
+		}
+		if err != nil {
+			_, result.Error = responseErrorFrom(err)
+			break
+		}
+		result.Messages = append(result.Messages, rsp)
+	}
+	return result
+}
@@ -0,0 +1,193 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/utils"
+
+	goutils "github.com/jerbe/go-utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/26 10:05
+  @describe :
+*/
+
+const (
+	// defaultHistoryLimit 历史消息默认返回的数量
+	defaultHistoryLimit = 20
+
+	// maxHistoryLimit 历史消息最多返回的数量
+	maxHistoryLimit = 100
+)
+
+const (
+	// chatHistoryDirectionBefore 获取游标之前(更早)的消息
+	chatHistoryDirectionBefore = "before"
+
+	// chatHistoryDirectionAfter 获取游标之后(更新)的消息
+	chatHistoryDirectionAfter = "after"
+)
+
+// GetChatMessageHistoryRequest 获取历史聊天消息请求参数
+// @Description 获取历史聊天消息请求参数
+type GetChatMessageHistoryRequest struct {
+	// TargetID 目标ID; 朋友ID/群ID/世界频道ID
+	TargetID int64 `form:"target_id" json:"target_id" binding:"required" example:"1"`
+
+	// SessionType 会话类型; 1-私人会话;2-群聊会话;99-世界频道会话
+	SessionType int `form:"session_type" json:"session_type" binding:"required" enums:"1,2,99" example:"1"`
+
+	// ThreadID 话题的根消息ID,大于0时获取该话题中的消息
+	ThreadID int64 `form:"thread_id" json:"thread_id" example:"0"`
+
+	// MessageID 游标消息ID,返回结果不包含该消息;向前获取时为0表示从最新的消息开始
+	MessageID int64 `form:"message_id" json:"message_id" example:"120"`
+
+	// Direction 获取方向; before-更早的消息,after-更新的消息;默认before
+	Direction string `form:"direction" json:"direction" enums:"before,after" example:"before"`
+
+	// Limit 返回数量,默认20,最大100
+	Limit int `form:"limit" json:"limit" example:"20"`
+}
+
+// ChatMessageHistory 历史聊天消息
+// @Description 历史聊天消息
+type ChatMessageHistory struct {
+	// HasMore 该方向上是否还有更多消息
+	HasMore bool `json:"has_more" example:"true"`
+
+	// Messages 消息列表,按消息ID正序排列
+	Messages []*ChatMessage `json:"messages"`
+}
+
+// GetChatMessageHistoryHandler
+// @Summary      获取历史聊天消息
+// @Description  以消息ID为游标分页获取聊天消息,会排除当前用户删除过的消息
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Param        target_id    query      int  true  "目标ID; 朋友ID/群ID/世界频道ID"
+// @Param        session_type    query      int  true  "会话类型; 1-私人会话;2-群聊会话;99-世界频道会话"
+// @Param        thread_id    query      int  false  "话题的根消息ID,大于0时获取该话题中的消息"
+// @Param        message_id    query      int  false  "游标消息ID,返回结果不包含该消息"
+// @Param        direction    query      string  false  "获取方向; before-更早的消息,after-更新的消息"
+// @Param        limit    query      int  false  "返回数量,默认20,最大100"
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response{data=ChatMessageHistory}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/message/history [get]
+func GetChatMessageHistoryHandler(ctx *gin.Context) {
+	req := new(GetChatMessageHistoryRequest)
+	err := ctx.BindQuery(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	rsp, err := getChatMessageHistoryByRequest(ctx, req)
+	if err != nil {
+		JSONResponseError(ctx, err)
+		return
+	}
+	JSON(ctx, rsp)
+}
+
+// getChatMessageHistoryByRequest 校验请求并获取历史聊天消息
+// HTTP 跟 websocket 共用该方法
+func getChatMessageHistoryByRequest(ctx *gin.Context, req *GetChatMessageHistoryRequest) (*ChatMessageHistory, error) {
+	if req.TargetID <= 0 {
+		return nil, NewResponseError(MessageInvalidTargetID)
+	}
+
+	if req.MessageID < 0 {
+		return nil, NewResponseError(MessageInvalidMessageID)
+	}
+
+	if req.ThreadID < 0 {
+		return nil, NewResponseError(MessageInvalidThreadID)
+	}
+
+	if req.Direction == "" {
+		req.Direction = chatHistoryDirectionBefore
+	}
+	if !goutils.In(req.Direction, chatHistoryDirectionBefore, chatHistoryDirectionAfter) {
+		return nil, NewResponseError(MessageInvalidFormat("direction"))
+	}
+
+	if req.Limit == 0 {
+		req.Limit = defaultHistoryLimit
+	}
+	if req.Limit < 0 || req.Limit > maxHistoryLimit {
+		return nil, NewResponseError(MessageInvalidLimit)
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+	roomID, err := chatRoomIDWithReadPermission(ctx, currentUser.ID, req.SessionType, req.TargetID)
+	if err != nil {
+		return nil, err
+	}
+
+	// 清空会话之前的消息不再返回,话题有独立的消息ID序列,不受清空会话影响
+	var clearedMessageID int64
+	if req.ThreadID > 0 {
+		roomID = utils.FormatThreadRoomID(roomID, req.ThreadID)
+	} else {
+		clearedMessageID, err = chatConversationClearedMessageID(ctx, currentUser.ID, roomID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 多取一条用于判断是否还有更多消息
+	filter := (&database.GetChatMessageListFilter{
+		RoomID:      roomID,
+		SessionType: req.SessionType,
+	}).SetUserID(currentUser.ID).SetLimit(req.Limit + 1)
+
+	switch req.Direction {
+	case chatHistoryDirectionBefore:
+		filter.SetSort(database.ChatMessageSortDesc).SetAfterMessageID(clearedMessageID)
+		if req.MessageID > 0 {
+			filter.SetBeforeMessageID(req.MessageID)
+		}
+	case chatHistoryDirectionAfter:
+		afterMessageID := req.MessageID
+		if clearedMessageID > afterMessageID {
+			afterMessageID = clearedMessageID
+		}
+		filter.SetSort(database.ChatMessageSortAsc).SetAfterMessageID(afterMessageID)
+	}
+
+	list, err := database.GetChatMessageList(filter)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("获取历史消息失败")
+		return nil, errors.Wrap(err)
+	}
+
+	rsp := &ChatMessageHistory{HasMore: len(list) > req.Limit}
+	if rsp.HasMore {
+		list = list[:req.Limit]
+	}
+
+	rsp.Messages = make([]*ChatMessage, len(list))
+	for i := 0; i < len(list); i++ {
+		rsp.Messages[i] = chatMessageFromDatabaseForUser(list[i], currentUser.ID)
+	}
+
+	// 向前获取时是倒序查询的,统一转成正序返回
+	if req.Direction == chatHistoryDirectionBefore {
+		for i, j := 0, len(rsp.Messages)-1; i < j; i, j = i+1, j-1 {
+			rsp.Messages[i], rsp.Messages[j] = rsp.Messages[j], rsp.Messages[i]
+		}
+	}
+	return rsp, nil
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/pubsub"
+	"github.com/jerbe/jim/websocket"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/28 10:20
+  @describe :
+*/
+
+// maxChatMentions 一条消息最多@的用户数量
+const maxChatMentions = 50
+
+// validChatMentions 校验发送请求中的@参数,只有群聊可以@
+func validChatMentions(req *SendChatMessageRequest) bool {
+	if len(req.Mentions) == 0 && !req.MentionAll {
+		return true
+	}
+
+	if req.SessionType != database.ChatMessageSessionTypeGroup {
+		return false
+	}
+
+	if len(req.Mentions) > maxChatMentions {
+		return false
+	}
+
+	for _, id := range req.Mentions {
+		if id <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// filterChatMentions 去掉重复的、自己以及不是群成员的@用户
+func filterChatMentions(mentions []int64, senderID int64, memberIDs []int64) []int64 {
+	if len(mentions) == 0 {
+		return nil
+	}
+
+	members := make(map[int64]struct{}, len(memberIDs))
+	for _, id := range memberIDs {
+		members[id] = struct{}{}
+	}
+
+	seen := make(map[int64]struct{}, len(mentions))
+	filtered := make([]int64, 0, len(mentions))
+	for _, id := range mentions {
+		if id == senderID {
+			continue
+		}
+		if _, ok := members[id]; !ok {
+			continue
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		filtered = append(filtered, id)
+	}
+
+	if len(filtered) == 0 {
+		return nil
+	}
+	return filtered
+}
+
+// chatMentionedUserIDs 计算消息需要通知的被@用户, @所有人时为除发送人外的所有群成员
+func chatMentionedUserIDs(msg *database.ChatMessage, memberIDs []int64) []int64 {
+	if !msg.MentionAll {
+		return msg.Mentions
+	}
+
+	userIDs := make([]int64, 0, len(memberIDs))
+	for _, id := range memberIDs {
+		if id != msg.SenderID {
+			userIDs = append(userIDs, id)
+		}
+	}
+	return userIDs
+}
+
+// notifyChatMention 记录会话的@标记并推送@通知
+// @通知跟聊天消息分开推送,会话开启了免打扰也能收到
+func notifyChatMention(ctx context.Context, msg *database.ChatMessage, userIDs []int64) {
+	if len(userIDs) == 0 {
+		return
+	}
+
+	// 话题中的消息ID跟会话的已读位置不是同一个序列,只推送通知不记录标记
+	if msg.ThreadID == 0 {
+		err := database.MarkChatConversationsMentioned(&database.UpdateChatConversationFilter{
+			RoomID:      msg.RoomID,
+			SessionType: msg.SessionType,
+			TargetID:    msg.ReceiverID,
+		}, msg.MessageID, userIDs)
+		if err != nil {
+			log.WarnFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", msg.RoomID).Msg("记录会话@标记失败")
+		}
+	}
+
+	err := pubsub.PublishChatMention(ctx, &pubsub.ChatMention{
+		SessionType:    msg.SessionType,
+		SenderID:       msg.SenderID,
+		ReceiverID:     msg.ReceiverID,
+		MessageID:      msg.MessageID,
+		ThreadID:       msg.ThreadID,
+		MentionAll:     msg.MentionAll,
+		CreatedAt:      msg.CreatedAt,
+		PublishTargets: userIDs,
+	})
+	if err != nil {
+		log.ErrorFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", msg.RoomID).Msg("推送@通知到管道失败")
+	}
+}
+
+// ========================================================================================
+// ============================ SUBSCRIBE HANDLER =========================================
+// ========================================================================================
+
+// SubscribeChatMentionHandler 接收@通知,只推送给被@的用户
+func SubscribeChatMentionHandler(ctx context.Context, payload *pubsub.Payload) {
+	mention := new(pubsub.ChatMention)
+	err := payload.UnmarshalData(mention)
+	if err != nil {
+		log.Error().Err(err).Str("payload.channel", payload.Channel).Str("payload.type", payload.Type).Send()
+		return
+	}
+
+	targets, ok := chatPushTargets(database.ChatMessageSessionTypeGroup, 0, 0, mention.PublishTargets)
+	if !ok {
+		return
+	}
+
+	mention.PublishTargets = nil
+	websocketManager.PushData(websocket.Payload{Type: payload.Type, Data: mention}, targets...)
+}
@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/28 16:05
+  @describe :
+*/
+
+// ChatMessageBodyValidator 消息主体校验方法,返回的错误信息会直接返回给客户端
+type ChatMessageBodyValidator func(body *ChatMessageBody) error
+
+// ChatMessageTypeDefinition 消息类型定义
+type ChatMessageTypeDefinition struct {
+	// Type 消息类型值
+	Type int
+
+	// Name 类型名称
+	Name string
+
+	// ServerOnly 是否只能由服务端生成,客户端发送该类型的消息会被拒绝
+	ServerOnly bool
+
+	// Fields 客户端可以填写的消息主体字段,使用json字段名;其他字段在校验前清空
+	// 为nil时保留除服务端生成的字段以外的所有字段
+	Fields []string
+
+	// Validate 消息主体校验方法,为nil时不校验
+	Validate ChatMessageBodyValidator
+}
+
+// chatMessageBodyFields 客户端可以填写的消息主体字段,key 为json字段名
+// 合并转发的消息快照跟系统通知的字段只能由服务端生成,不在其中
+var chatMessageBodyFields = map[string]func(dst, src *ChatMessageBody){
+	"text":           func(dst, src *ChatMessageBody) { dst.Text = src.Text },
+	"src":            func(dst, src *ChatMessageBody) { dst.Src = src.Src },
+	"format":         func(dst, src *ChatMessageBody) { dst.Format = src.Format },
+	"size":           func(dst, src *ChatMessageBody) { dst.Size = src.Size },
+	"name":           func(dst, src *ChatMessageBody) { dst.Name = src.Name },
+	"mime":           func(dst, src *ChatMessageBody) { dst.Mime = src.Mime },
+	"sticker_id":     func(dst, src *ChatMessageBody) { dst.StickerID = src.StickerID },
+	"pack_id":        func(dst, src *ChatMessageBody) { dst.PackID = src.PackID },
+	"card_type":      func(dst, src *ChatMessageBody) { dst.CardType = src.CardType },
+	"title":          func(dst, src *ChatMessageBody) { dst.Title = src.Title },
+	"description":    func(dst, src *ChatMessageBody) { dst.Description = src.Description },
+	"url":            func(dst, src *ChatMessageBody) { dst.URL = src.URL },
+	"target_id":      func(dst, src *ChatMessageBody) { dst.TargetID = src.TargetID },
+	"custom_type":    func(dst, src *ChatMessageBody) { dst.CustomType = src.CustomType },
+	"data":           func(dst, src *ChatMessageBody) { dst.Data = src.Data },
+	"longitude":      func(dst, src *ChatMessageBody) { dst.Longitude = src.Longitude },
+	"latitude":       func(dst, src *ChatMessageBody) { dst.Latitude = src.Latitude },
+	"scale":          func(dst, src *ChatMessageBody) { dst.Scale = src.Scale },
+	"location_label": func(dst, src *ChatMessageBody) { dst.LocationLabel = src.LocationLabel },
+}
+
+// chatMessageTypes 已注册的消息类型
+var chatMessageTypes = struct {
+	sync.RWMutex
+	types map[int]*ChatMessageTypeDefinition
+}{types: make(map[int]*ChatMessageTypeDefinition)}
+
+func init() {
+	for _, def := range []ChatMessageTypeDefinition{
+		{Type: database.ChatMessageTypePlainText, Name: "text", Fields: []string{"text"}, Validate: validateTextChatMessageBody},
+		{Type: database.ChatMessageTypePicture, Name: "picture", Fields: []string{"src", "format", "size"}, Validate: validatePictureChatMessageBody},
+		{Type: database.ChatMessageTypeVoice, Name: "voice", Fields: []string{"src", "format", "size"}, Validate: validateVoiceChatMessageBody},
+		{Type: database.ChatMessageTypeVideo, Name: "video", Fields: []string{"src", "format", "size"}, Validate: validateVideoChatMessageBody},
+		{Type: database.ChatMessageTypeLocation, Name: "location", Fields: []string{"longitude", "latitude", "scale", "location_label"}, Validate: validateLocationChatMessageBody},
+		{Type: database.ChatMessageTypeFile, Name: "file", Fields: []string{"src", "size", "name", "mime"}, Validate: validateFileChatMessageBody},
+		{Type: database.ChatMessageTypeSticker, Name: "sticker", Fields: []string{"src", "format", "sticker_id", "pack_id"}, Validate: validateStickerChatMessageBody},
+		{Type: database.ChatMessageTypeCard, Name: "card", Fields: []string{"card_type", "title", "description", "url", "target_id"}, Validate: validateCardChatMessageBody},
+		{Type: database.ChatMessageTypeSystem, Name: "system", ServerOnly: true},
+		{Type: database.ChatMessageTypeCustom, Name: "custom", Fields: []string{"custom_type", "data"}, Validate: validateCustomChatMessageBody},
+		{Type: database.ChatMessageTypeMerged, Name: "merged", ServerOnly: true},
+	} {
+		if err := RegisterChatMessageType(def); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterChatMessageType 注册消息类型,基于jim开发的应用可以在启动时注册自己的消息类型
+// 已经注册过的类型不能被覆盖
+func RegisterChatMessageType(def ChatMessageTypeDefinition) error {
+	if def.Type <= 0 {
+		return errors.New(fmt.Sprintf("消息类型'%d'无效", def.Type))
+	}
+
+	for _, field := range def.Fields {
+		if _, ok := chatMessageBodyFields[field]; !ok {
+			return errors.New(fmt.Sprintf("消息类型'%d'的字段'%s'无效", def.Type, field))
+		}
+	}
+
+	chatMessageTypes.Lock()
+	defer chatMessageTypes.Unlock()
+	if _, ok := chatMessageTypes.types[def.Type]; ok {
+		return errors.New(fmt.Sprintf("消息类型'%d'已经注册", def.Type))
+	}
+	chatMessageTypes.types[def.Type] = &def
+	return nil
+}
+
+// chatMessageTypeDefinition 获取已注册的消息类型定义
+func chatMessageTypeDefinition(typ int) (*ChatMessageTypeDefinition, bool) {
+	chatMessageTypes.RLock()
+	defer chatMessageTypes.RUnlock()
+	def, ok := chatMessageTypes.types[typ]
+	return def, ok
+}
+
+// validateSendChatMessageBody 校验客户端发送的消息类型跟消息主体
+func validateSendChatMessageBody(typ int, body *ChatMessageBody) error {
+	def, ok := chatMessageTypeDefinition(typ)
+	if !ok || def.ServerOnly {
+		return NewResponseError(MessageInvalidType)
+	}
+
+	// 不属于该类型的字段不保存,避免伪造合并转发或者系统通知的内容
+	*body = keepChatMessageBodyFields(body, def.Fields)
+
+	// 自定义数据不解析,但是所有类型都要限制大小
+	if len(body.Data) > 0 && (len(body.Data) > maxChatMessageCustomDataSize || !json.Valid(body.Data)) {
+		return NewResponseError(MessageInvalidFormat("body.data"))
+	}
+
+	if def.Validate == nil {
+		return nil
+	}
+
+	if err := def.Validate(body); err != nil {
+		var rspErr *ResponseError
+		if errors.As(err, &rspErr) {
+			return rspErr
+		}
+		return NewResponseError(err.Error())
+	}
+	return nil
+}
+
+// keepChatMessageBodyFields 返回只保留了指定字段的消息主体,fields 为nil时保留所有客户端可以填写的字段
+func keepChatMessageBodyFields(body *ChatMessageBody, fields []string) ChatMessageBody {
+	var kept ChatMessageBody
+	if fields == nil {
+		for _, keep := range chatMessageBodyFields {
+			keep(&kept, body)
+		}
+		return kept
+	}
+
+	for _, field := range fields {
+		chatMessageBodyFields[field](&kept, body)
+	}
+	return kept
+}
@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/jerbe/jim/config"
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/pubsub"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/7 10:40
+  @describe : 聊天消息推送失败后的重新推送
+*/
+
+const (
+	// chatOutboxGrace 消息保存后等待直接推送的时间,超过该时间还没有推送成功的消息才由后台任务重新推送
+	chatOutboxGrace = 10 * time.Second
+
+	// chatOutboxLease 领取待推送消息后的租约时间
+	chatOutboxLease = 30 * time.Second
+
+	// chatOutboxMinBackoff 第一次重新推送失败后的等待时间,之后每次翻倍
+	chatOutboxMinBackoff = 2 * time.Second
+
+	// chatOutboxMaxBackoff 重新推送的最长等待时间
+	chatOutboxMaxBackoff = 5 * time.Minute
+
+	// chatOutboxMaxAttempts 最多重新推送的次数,超过后放弃实时推送,客户端依然可以通过同步接口获取
+	chatOutboxMaxAttempts = 20
+
+	// chatOutboxBacklogInterval 更新积压数量指标的间隔,统计需要遍历索引,不跟推送一样频繁
+	chatOutboxBacklogInterval = time.Minute
+)
+
+// 指标通过 expvar 暴露,在 pprof 服务的 `/debug/vars` 下可以查看
+var (
+	chatOutboxMetrics = expvar.NewMap("chat_outbox")
+
+	// metricChatOutboxBacklog 还没有推送成功的消息数量
+	metricChatOutboxBacklog = new(expvar.Int)
+
+	// metricChatOutboxPublished 由后台任务重新推送成功的消息数量
+	metricChatOutboxPublished = new(expvar.Int)
+
+	// metricChatOutboxFailures 后台任务重新推送失败的次数
+	metricChatOutboxFailures = new(expvar.Int)
+
+	// metricChatOutboxDropped 超过最多重新推送次数被放弃的消息数量
+	metricChatOutboxDropped = new(expvar.Int)
+)
+
+func init() {
+	chatOutboxMetrics.Set("backlog", metricChatOutboxBacklog)
+	chatOutboxMetrics.Set("published", metricChatOutboxPublished)
+	chatOutboxMetrics.Set("failures", metricChatOutboxFailures)
+	chatOutboxMetrics.Set("dropped", metricChatOutboxDropped)
+}
+
+// newChatMessageOutbox 生成跟消息一起保存的待推送标记
+func newChatMessageOutbox(actionID string, now time.Time) *database.ChatMessageOutbox {
+	return &database.ChatMessageOutbox{
+		ActionID:      actionID,
+		NextAttemptAt: now.Add(chatOutboxGrace).UnixMilli(),
+	}
+}
+
+// markChatMessagePublished 直接推送成功后删除待推送标记
+// 删除失败时后台任务会再推送一次,客户端按消息ID去重即可
+func markChatMessagePublished(ctx context.Context, msg *database.ChatMessage) {
+	if err := database.MarkChatMessagePublished(msg.ID); err != nil {
+		log.WarnFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).
+			Str("room_id", msg.RoomID).
+			Int64("message_id", msg.MessageID).
+			Msg("删除消息待推送标记失败")
+	}
+}
+
+// InitChatOutboxRelay 启动重新推送失败消息的后台任务
+// 多个实例同时运行时通过原子领取保证同一时间只有一个实例推送同一条消息
+func InitChatOutboxRelay() {
+	go runChatOutboxRelay(context.Background())
+}
+
+// runChatOutboxRelay 定时重新推送还没有推送成功的消息,并按更长的间隔更新积压数量
+func runChatOutboxRelay(ctx context.Context) {
+	defer func() {
+		if obj := recover(); obj != nil {
+			log.Error().Str("recover", fmt.Sprintf("%+v", obj)).Msg("消息重新推送任务异常")
+			go runChatOutboxRelay(ctx)
+		}
+	}()
+
+	ticker := time.NewTicker(chatOutboxInterval())
+	defer ticker.Stop()
+
+	backlogTicker := time.NewTicker(chatOutboxBacklogInterval)
+	defer backlogTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			relayChatMessageOutbox(ctx)
+		case <-backlogTicker.C:
+			updateChatOutboxBacklog()
+		}
+	}
+}
+
+// updateChatOutboxBacklog 更新还没有推送成功的消息数量
+func updateChatOutboxBacklog() {
+	backlog, err := database.CountChatMessageOutbox()
+	if err != nil {
+		log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("统计待推送消息数量失败")
+		return
+	}
+	metricChatOutboxBacklog.Set(backlog)
+}
+
+// relayChatMessageOutbox 领取并推送所有到了重试时间的消息
+func relayChatMessageOutbox(ctx context.Context) {
+	for {
+		msg, err := database.ClaimChatMessageOutbox(chatOutboxLease)
+		if err != nil {
+			if !errors.IsNoRecord(err) {
+				log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("领取待推送消息失败")
+			}
+			return
+		}
+
+		err = publishChatMessageOutbox(ctx, msg)
+		if err == nil {
+			metricChatOutboxPublished.Add(1)
+		} else {
+			metricChatOutboxFailures.Add(1)
+			log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).
+				Str("room_id", msg.RoomID).
+				Int64("message_id", msg.MessageID).
+				Int("attempts", msg.Outbox.Attempts).
+				Msg("重新推送聊天消息失败")
+
+			if msg.Outbox.Attempts < chatOutboxMaxAttempts {
+				nextAttemptAt := time.Now().Add(chatOutboxBackoff(msg.Outbox.Attempts)).UnixMilli()
+				if err = database.DelayChatMessageOutbox(msg.ID, nextAttemptAt); err != nil {
+					log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("message_id", msg.MessageID).Msg("设置消息重新推送时间失败")
+				}
+				continue
+			}
+			metricChatOutboxDropped.Add(1)
+		}
+
+		if err = database.MarkChatMessagePublished(msg.ID); err != nil {
+			log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("message_id", msg.MessageID).Msg("删除消息待推送标记失败")
+		}
+	}
+}
+
+// publishChatMessageOutbox 根据保存的消息重新生成推送数据并推送
+// 已经撤回或者过期的消息不再推送
+func publishChatMessageOutbox(ctx context.Context, msg *database.ChatMessage) error {
+	if msg.Status != database.ChatMessageStatusNormal {
+		return nil
+	}
+
+	var publishTargets []int64
+	if msg.SessionType == database.ChatMessageSessionTypeGroup {
+		var err error
+		publishTargets, err = database.GetGroupMemberIDs(msg.ReceiverID)
+		if err != nil && !errors.IsNoRecord(err) {
+			return errors.Wrap(err)
+		}
+	}
+
+	rsp := chatMessageFromDatabase(msg)
+	rsp.ActionID = msg.Outbox.ActionID
+	psData := fillChatMessageForPublish(rsp)
+	psData.PublishTargets = publishTargets
+	return errors.Wrap(pubsub.PublishChatMessage(ctx, psData))
+}
+
+// chatOutboxBackoff 第 attempts 次重新推送失败后的等待时间,按指数增长
+func chatOutboxBackoff(attempts int) time.Duration {
+	backoff := chatOutboxMinBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= chatOutboxMaxBackoff {
+			return chatOutboxMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// chatOutboxInterval 检查推送失败的消息的间隔
+func chatOutboxInterval() time.Duration {
+	if interval := config.GlobConfig().Chat.OutboxInterval; interval > 0 {
+		return interval
+	}
+	return time.Second
+}
@@ -0,0 +1,334 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jerbe/jim/config"
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/pubsub"
+	"github.com/jerbe/jim/utils"
+	"github.com/jerbe/jim/websocket"
+
+	goutils "github.com/jerbe/go-utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/27 10:30
+  @describe :
+*/
+
+const (
+	// ChatReactionActionAdd 添加表情回应
+	ChatReactionActionAdd = "add"
+
+	// ChatReactionActionRemove 取消表情回应
+	ChatReactionActionRemove = "remove"
+)
+
+// maxReactionEmojiLength 表情的最大字符数,组合表情会由多个字符组成
+const maxReactionEmojiLength = 16
+
+// chatMaxReactions 每条消息最多可以有多少种不同的表情回应
+func chatMaxReactions() int {
+	if v := config.GlobConfig().Chat.MaxReactions; v > 0 {
+		return v
+	}
+	return 20
+}
+
+// ChatMessageReaction 表情回应汇总
+// @Description 表情回应汇总
+type ChatMessageReaction struct {
+	// Emoji 表情
+	Emoji string `json:"emoji" example:"👍"`
+
+	// Count 回应人数
+	Count int `json:"count" example:"3"`
+
+	// ReactedByMe 当前用户是否回应了该表情
+	ReactedByMe bool `json:"reacted_by_me" example:"true"`
+}
+
+// ReactChatMessageRequest 表情回应请求参数
+// @Description 表情回应请求参数
+type ReactChatMessageRequest struct {
+	// TargetID 目标ID; 朋友ID/群ID/世界频道ID
+	TargetID int64 `json:"target_id" binding:"required" example:"1"`
+
+	// SessionType 会话类型; 1-私人会话;2-群聊会话;99-世界频道会话
+	SessionType int `json:"session_type" binding:"required" enums:"1,2,99" example:"1"`
+
+	// MessageID 消息ID
+	MessageID int64 `json:"message_id" binding:"required" example:"120"`
+
+	// ThreadID 消息所在话题的根消息ID,不在话题中时为0
+	ThreadID int64 `json:"thread_id" example:"0"`
+
+	// Emoji 表情
+	Emoji string `json:"emoji" binding:"required" example:"👍"`
+
+	// Action 操作; add-添加,remove-取消
+	Action string `json:"action" binding:"required" enums:"add,remove" example:"add"`
+}
+
+// ReactChatMessageHandler
+// @Summary      表情回应
+// @Description  添加或取消对消息的表情回应,变更会推送给会话中的所有人
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Param        jsonRaw    body      ReactChatMessageRequest  true  "请求JSON数据体"
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response{data=[]ChatMessageReaction}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/message/reaction [post]
+func ReactChatMessageHandler(ctx *gin.Context) {
+	req := new(ReactChatMessageRequest)
+	err := ctx.BindJSON(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	rsps, err := reactChatMessageByRequest(ctx, req)
+	if err != nil {
+		JSONResponseError(ctx, err)
+		return
+	}
+	JSON(ctx, rsps)
+}
+
+// reactChatMessageByRequest 校验请求并更新表情回应,返回该消息最新的回应汇总
+// HTTP 跟 websocket 共用该方法
+func reactChatMessageByRequest(ctx *gin.Context, req *ReactChatMessageRequest) ([]*ChatMessageReaction, error) {
+	if req.TargetID <= 0 {
+		return nil, NewResponseError(MessageInvalidTargetID)
+	}
+
+	if req.MessageID <= 0 {
+		return nil, NewResponseError(MessageInvalidMessageID)
+	}
+
+	if req.ThreadID < 0 {
+		return nil, NewResponseError(MessageInvalidThreadID)
+	}
+
+	if !goutils.In(req.Action, ChatReactionActionAdd, ChatReactionActionRemove) {
+		return nil, NewResponseError(MessageInvalidFormat("action"))
+	}
+
+	if !validReactionEmoji(req.Emoji) {
+		return nil, NewResponseError(MessageInvalidFormat("emoji"))
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+	roomID, err := chatRoomIDWithReadPermission(ctx, currentUser.ID, req.SessionType, req.TargetID)
+	if err != nil {
+		return nil, err
+	}
+	if req.ThreadID > 0 {
+		roomID = utils.FormatThreadRoomID(roomID, req.ThreadID)
+	}
+
+	msg, err := database.UpdateChatMessageReaction(&database.UpdateChatMessageReactionFilter{
+		RoomID:       roomID,
+		SessionType:  req.SessionType,
+		MessageID:    req.MessageID,
+		UserID:       currentUser.ID,
+		Emoji:        req.Emoji,
+		MaxReactions: chatMaxReactions(),
+	}, req.Action == ChatReactionActionAdd)
+	if err != nil {
+		if errors.Is(err, database.ErrChatReactionLimit) {
+			return nil, NewResponseError(fmt.Sprintf("表情回应种类不能超过%d", chatMaxReactions()))
+		}
+		if errors.IsNoRecord(err) {
+			return nil, NewResponseError(MessageNotFound)
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("更新表情回应失败")
+		return nil, errors.Wrap(err)
+	}
+
+	reaction := &pubsub.ChatMessageReaction{
+		SessionType: req.SessionType,
+		ReactorID:   currentUser.ID,
+		ReceiverID:  req.TargetID,
+		MessageID:   msg.MessageID,
+		ThreadID:    req.ThreadID,
+		Emoji:       req.Emoji,
+		Action:      req.Action,
+		Count:       len(msg.Reactions[req.Emoji]),
+		ReactedAt:   time.Now().UnixMilli(),
+	}
+
+	if req.SessionType == database.ChatMessageSessionTypeGroup {
+		reaction.PublishTargets, err = database.GetGroupMemberIDs(req.TargetID)
+		if err != nil {
+			log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取群成员ID列表失败")
+		}
+	}
+
+	if err = pubsub.PublishChatMessageReaction(ctx, reaction); err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("推送表情回应到管道失败")
+	}
+
+	rsps := chatMessageReactionsFromDatabase(msg.Reactions, currentUser.ID)
+	if rsps == nil {
+		rsps = []*ChatMessageReaction{}
+	}
+	return rsps, nil
+}
+
+// validReactionEmoji 检查表情是否有效
+// 配置了允许的表情时只能使用配置中的表情,否则必须是一个标准emoji
+func validReactionEmoji(emoji string) bool {
+	if allowed := config.GlobConfig().Chat.ReactionEmojis; len(allowed) > 0 {
+		// 表情会作为mongodb的字段名保存,配置中的表情也不能包含 '.' 跟 '$'
+		if strings.ContainsAny(emoji, ".$\x00") {
+			return false
+		}
+		for _, v := range allowed {
+			if v == emoji {
+				return true
+			}
+		}
+		return false
+	}
+
+	runes := []rune(emoji)
+	if len(runes) == 0 || len(runes) > maxReactionEmojiLength {
+		return false
+	}
+
+	// 组合用的字符不能出现在开头,连接符也不能出现在结尾
+	if reactionEmojiModifier(runes[0]) || runes[len(runes)-1] == zeroWidthJoiner {
+		return false
+	}
+
+	// 数字键帽表情以 0-9#* 开头,必须以 U+20E3 结尾
+	if strings.ContainsRune("0123456789#*", runes[0]) {
+		return len(runes) <= 3 && runes[len(runes)-1] == combiningKeycap && (len(runes) == 2 || runes[1] == variationSelector16)
+	}
+
+	for i, r := range runes {
+		if reactionEmojiModifier(r) {
+			// 连接符后面必须跟着一个emoji
+			if r == zeroWidthJoiner && (i+1 >= len(runes) || reactionEmojiModifier(runes[i+1])) {
+				return false
+			}
+			continue
+		}
+		if !reactionEmojiRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	// zeroWidthJoiner 连接多个emoji组成一个组合表情
+	zeroWidthJoiner = '\u200D'
+
+	// variationSelector16 要求以emoji样式显示
+	variationSelector16 = '\uFE0F'
+
+	// combiningKeycap 键帽
+	combiningKeycap = '\u20E3'
+)
+
+// reactionEmojiModifier 是否是只能跟在emoji后面的组合字符
+func reactionEmojiModifier(r rune) bool {
+	switch {
+	case r == zeroWidthJoiner, r == variationSelector16, r == '\uFE0E', r == combiningKeycap:
+		return true
+	case r >= 0x1F3FB && r <= 0x1F3FF: // 肤色
+		return true
+	case r >= 0xE0020 && r <= 0xE007F: // 旗帜标签
+		return true
+	}
+	return false
+}
+
+// reactionEmojiRune 是否是emoji所在区块的字符
+func reactionEmojiRune(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF: // 麻将、扑克、区域指示符、各类符号与象形文字、表情、交通、补充符号
+		return true
+	case r >= 0x2600 && r <= 0x27BF: // 杂项符号、装饰符号
+		return true
+	case r >= 0x2300 && r <= 0x23FF: // 杂项技术符号
+		return true
+	case r >= 0x2B00 && r <= 0x2BFF: // 杂项符号和箭头
+		return true
+	case r >= 0x2190 && r <= 0x21FF, r >= 0x25A0 && r <= 0x25FF, r == 0x2934, r == 0x2935: // 箭头、几何图形
+		return true
+	case r == 0x00A9, r == 0x00AE, r == 0x203C, r == 0x2049, r == 0x2122, r == 0x2139, r == 0x24C2,
+		r == 0x3030, r == 0x303D, r == 0x3297, r == 0x3299:
+		return true
+	}
+	return false
+}
+
+// chatMessageReactionsFromDatabase 将数据库中的表情回应转换成汇总,按回应人数倒序排列
+// userID 用于标记当前用户是否回应过,为0时不标记
+func chatMessageReactionsFromDatabase(reactions map[string][]int64, userID int64) []*ChatMessageReaction {
+	if len(reactions) == 0 {
+		return nil
+	}
+
+	rsps := make([]*ChatMessageReaction, 0, len(reactions))
+	for emoji, userIDs := range reactions {
+		if len(userIDs) == 0 {
+			continue
+		}
+		rsp := &ChatMessageReaction{Emoji: emoji, Count: len(userIDs)}
+		for _, id := range userIDs {
+			if userID > 0 && id == userID {
+				rsp.ReactedByMe = true
+				break
+			}
+		}
+		rsps = append(rsps, rsp)
+	}
+
+	sort.Slice(rsps, func(i, j int) bool {
+		if rsps[i].Count != rsps[j].Count {
+			return rsps[i].Count > rsps[j].Count
+		}
+		return rsps[i].Emoji < rsps[j].Emoji
+	})
+	return rsps
+}
+
+// ========================================================================================
+// ============================ SUBSCRIBE HANDLER =========================================
+// ========================================================================================
+
+// SubscribeChatMessageReactionHandler 接收表情回应变更
+func SubscribeChatMessageReactionHandler(ctx context.Context, payload *pubsub.Payload) {
+	reaction := new(pubsub.ChatMessageReaction)
+	err := payload.UnmarshalData(reaction)
+	if err != nil {
+		log.Error().Err(err).Str("payload.channel", payload.Channel).Str("payload.type", payload.Type).Send()
+		return
+	}
+
+	targets, ok := chatPushTargets(reaction.SessionType, reaction.ReactorID, reaction.ReceiverID, reaction.PublishTargets)
+	if !ok {
+		return
+	}
+
+	reaction.PublishTargets = nil
+	websocketManager.PushData(websocket.Payload{Type: payload.Type, Data: reaction}, targets...)
+}
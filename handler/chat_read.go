@@ -0,0 +1,364 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/pubsub"
+	"github.com/jerbe/jim/utils"
+	"github.com/jerbe/jim/websocket"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/24 15:30
+  @describe :
+*/
+
+// maxReadCountMessageIDs 一次最多查询的消息已读人数数量
+const maxReadCountMessageIDs = 50
+
+// maxChatUnreadCount 缓存不存在时每个房间最多统计的未读数量
+const maxChatUnreadCount = 999
+
+// ReadChatMessageRequest 标记已读请求参数
+// @Description 标记已读请求参数
+type ReadChatMessageRequest struct {
+	// TargetID 目标ID; 朋友ID/群ID/世界频道ID
+	TargetID int64 `json:"target_id" binding:"required" example:"1"`
+
+	// SessionType 会话类型; 1-私人会话;2-群聊会话;99-世界频道会话
+	SessionType int `json:"session_type" binding:"required" enums:"1,2,99" example:"1"`
+
+	// MessageID 已读到的消息ID
+	MessageID int64 `json:"message_id" binding:"required" example:"120"`
+}
+
+// ReadChatMessageResponse 标记已读返回参数
+// @Description 标记已读返回参数
+type ReadChatMessageResponse struct {
+	// ReadMessageID 已读到的消息ID
+	ReadMessageID int64 `json:"read_message_id" example:"120"`
+
+	// UnreadCount 该会话剩余的未读数量
+	UnreadCount int64 `json:"unread_count" example:"0"`
+}
+
+// ReadChatMessageHandler
+// @Summary      标记已读
+// @Description  将会话标记为已读到指定的消息,私聊会给对方推送已读回执
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Param        jsonRaw    body      ReadChatMessageRequest  true  "请求JSON数据体"
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response{data=ReadChatMessageResponse}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/message/read [post]
+func ReadChatMessageHandler(ctx *gin.Context) {
+	req := new(ReadChatMessageRequest)
+	err := ctx.BindJSON(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	rsp, err := readChatMessageByRequest(ctx, req)
+	if err != nil {
+		JSONResponseError(ctx, err)
+		return
+	}
+	JSON(ctx, rsp)
+}
+
+// readChatMessageByRequest 校验请求并标记已读
+// HTTP 跟 websocket 共用该方法
+func readChatMessageByRequest(ctx *gin.Context, req *ReadChatMessageRequest) (*ReadChatMessageResponse, error) {
+	if req.TargetID <= 0 {
+		return nil, NewResponseError(MessageInvalidTargetID)
+	}
+
+	if req.MessageID <= 0 {
+		return nil, NewResponseError(MessageInvalidMessageID)
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+
+	var roomID string
+	var err error
+	if req.SessionType == database.ChatMessageSessionTypeWorld {
+		roomID = utils.FormatWorldRoomID(req.TargetID)
+	} else {
+		roomID, err = chatRoomIDWithPermission(currentUser.ID, req.SessionType, req.TargetID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	room, err := database.GetChatRoom(roomID)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			return nil, NewResponseError(MessageNotFound)
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("获取聊天室失败")
+		return nil, errors.Wrap(err)
+	}
+
+	if req.MessageID > room.LastMessageID {
+		return nil, NewResponseError(MessageInvalidMessageID)
+	}
+
+	// mongodb 为持久化的已读位置,redis 只保存由此计算出来的未读数
+	conversation, err := database.UpdateChatConversation(&database.UpdateChatConversationFilter{
+		UserID:      currentUser.ID,
+		RoomID:      roomID,
+		SessionType: req.SessionType,
+		TargetID:    req.TargetID,
+	}, new(database.UpdateChatConversationData).SetReadMessageID(req.MessageID))
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("更新会话已读位置失败")
+		return nil, errors.Wrap(err)
+	}
+
+	rsp := &ReadChatMessageResponse{
+		ReadMessageID: conversation.ReadMessageID,
+		UnreadCount:   room.LastMessageID - conversation.ReadMessageID,
+	}
+	if rsp.UnreadCount < 0 {
+		rsp.UnreadCount = 0
+	}
+
+	if err = database.SetChatUnreadCount(currentUser.ID, roomID, rsp.UnreadCount); err != nil {
+		log.WarnFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("更新未读数缓存失败")
+	}
+
+	// 只有私聊才有逐条的已读状态跟已读回执,群聊通过已读人数接口获取
+	if req.SessionType != database.ChatMessageSessionTypePrivate {
+		return rsp, nil
+	}
+
+	count, err := database.ReadChatMessages(roomID, req.SessionType, currentUser.ID, conversation.ReadMessageID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("标记消息已读失败")
+		return nil, errors.Wrap(err)
+	}
+
+	// 没有新标记的消息,说明之前已经推送过回执
+	if count == 0 {
+		return rsp, nil
+	}
+
+	err = pubsub.PublishChatReadReceipt(ctx, &pubsub.ChatReadReceipt{
+		SessionType: req.SessionType,
+		ReaderID:    currentUser.ID,
+		TargetID:    req.TargetID,
+		MessageID:   conversation.ReadMessageID,
+		ReadAt:      time.Now().UnixMilli(),
+	})
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("推送已读回执到管道失败")
+	}
+	return rsp, nil
+}
+
+// GetChatMessageReadCountRequest 获取消息已读人数请求参数
+// @Description 获取消息已读人数请求参数
+type GetChatMessageReadCountRequest struct {
+	// TargetID 目标ID; 朋友ID/群ID
+	TargetID int64 `form:"target_id" json:"target_id" binding:"required" example:"1"`
+
+	// SessionType 会话类型; 1-私人会话;2-群聊会话
+	SessionType int `form:"session_type" json:"session_type" binding:"required" enums:"1,2" example:"2"`
+
+	// MessageIDs 消息ID列表,最多50个
+	MessageIDs []int64 `form:"message_ids" json:"message_ids" binding:"required" example:"1,2,3"`
+}
+
+// ChatMessageReadCount 消息已读人数
+// @Description 消息已读人数
+type ChatMessageReadCount struct {
+	// MessageID 消息ID
+	MessageID int64 `json:"message_id" example:"120"`
+
+	// ReadCount 已读人数,不包含发送人
+	ReadCount int64 `json:"read_count" example:"3"`
+}
+
+// GetChatMessageReadCountHandler
+// @Summary      获取消息已读人数
+// @Description  统计已读到指定消息的人数,不包含发送人
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Param        target_id    query      int  true  "目标ID; 朋友ID/群ID"
+// @Param        session_type    query      int  true  "会话类型; 1-私人会话;2-群聊会话"
+// @Param        message_ids    query      []int  true  "消息ID列表" collectionFormat(multi)
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response{data=[]ChatMessageReadCount}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/message/read_count [get]
+func GetChatMessageReadCountHandler(ctx *gin.Context) {
+	req := new(GetChatMessageReadCountRequest)
+	err := ctx.BindQuery(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	rsps, err := getChatMessageReadCountByRequest(ctx, req)
+	if err != nil {
+		JSONResponseError(ctx, err)
+		return
+	}
+	JSON(ctx, rsps)
+}
+
+// getChatMessageReadCountByRequest 校验请求并统计消息已读人数
+// HTTP 跟 websocket 共用该方法
+func getChatMessageReadCountByRequest(ctx *gin.Context, req *GetChatMessageReadCountRequest) ([]*ChatMessageReadCount, error) {
+	if req.TargetID <= 0 {
+		return nil, NewResponseError(MessageInvalidTargetID)
+	}
+
+	if len(req.MessageIDs) == 0 || len(req.MessageIDs) > maxReadCountMessageIDs {
+		return nil, NewResponseError(MessageInvalidFormat("message_ids"))
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+	roomID, err := chatRoomIDWithPermission(currentUser.ID, req.SessionType, req.TargetID)
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := database.GetChatMessagesByIDs(roomID, req.SessionType, req.MessageIDs)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("获取聊天消息失败")
+		return nil, errors.Wrap(err)
+	}
+
+	rsps := make([]*ChatMessageReadCount, 0, len(messages))
+	for _, msg := range messages {
+		count, err := database.CountChatConversationReaders(roomID, msg.MessageID, msg.SenderID)
+		if err != nil {
+			log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("统计消息已读人数失败")
+			return nil, errors.Wrap(err)
+		}
+		rsps = append(rsps, &ChatMessageReadCount{MessageID: msg.MessageID, ReadCount: count})
+	}
+	return rsps, nil
+}
+
+// incrChatUnreadCounts 给消息的接收人增加未读数
+// 私聊的接收人是对方,群聊的接收人是除发送人以外的所有群成员,世界频道不计未读数
+func incrChatUnreadCounts(ctx context.Context, msg *database.ChatMessage, memberIDs []int64) {
+	var userIDs []int64
+	switch msg.SessionType {
+	case database.ChatMessageSessionTypePrivate:
+		userIDs = []int64{msg.ReceiverID}
+	case database.ChatMessageSessionTypeGroup:
+		userIDs = make([]int64, 0, len(memberIDs))
+		for _, id := range memberIDs {
+			if id != msg.SenderID {
+				userIDs = append(userIDs, id)
+			}
+		}
+	}
+
+	if err := database.IncrChatUnreadCount(msg.RoomID, userIDs...); err != nil {
+		log.WarnFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", msg.RoomID).Msg("增加未读数失败")
+	}
+}
+
+// getChatUnreadCounts 获取用户所有房间的未读数
+// 优先从redis获取,缓存不存在时从mongodb统计对用户可见的未读消息,并写回缓存
+func getChatUnreadCounts(ctx *gin.Context, userID int64, rooms []*database.ChatRoom, conversations map[string]*database.ChatConversation) map[string]int64 {
+	counts, err := database.GetChatUnreadCounts(userID)
+	if err == nil {
+		return counts
+	}
+
+	if !errors.IsNoRecord(err) {
+		log.WarnFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取未读数缓存失败")
+	}
+
+	counts = make(map[string]int64, len(rooms))
+	for _, room := range rooms {
+		count, err := countChatUnreadMessages(userID, room, conversations[room.RoomID])
+		if err != nil {
+			// 有房间统计失败时不写回缓存,避免错误的未读数一直保留
+			log.WarnFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", room.RoomID).Msg("统计未读数失败")
+			return counts
+		}
+		counts[room.RoomID] = count
+	}
+
+	if err = database.SetChatUnreadCounts(userID, counts); err != nil {
+		log.WarnFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("写入未读数缓存失败")
+	}
+	return counts
+}
+
+// countChatUnreadMessages 统计用户在房间中的未读数
+// 从已读位置、清空位置中较大的一个开始统计,群聊只统计用户入群之后的消息,世界频道不计未读数
+func countChatUnreadMessages(userID int64, room *database.ChatRoom, conversation *database.ChatConversation) (int64, error) {
+	var afterMessageID, afterCreatedAt int64
+	if conversation != nil {
+		afterMessageID = conversation.ReadMessageID
+		if conversation.ClearedMessageID > afterMessageID {
+			afterMessageID = conversation.ClearedMessageID
+		}
+	}
+	if room.LastMessageID <= afterMessageID {
+		return 0, nil
+	}
+
+	switch room.SessionType {
+	case database.ChatMessageSessionTypePrivate:
+	case database.ChatMessageSessionTypeGroup:
+		// 群消息的接收方ID即群ID
+		member, err := database.GetGroupMember(room.LastMessage.ReceiverID, userID)
+		if err != nil {
+			if errors.IsNoRecord(err) {
+				return 0, nil
+			}
+			return 0, errors.Wrap(err)
+		}
+		afterCreatedAt = member.CreatedAt.UnixMilli()
+	default:
+		return 0, nil
+	}
+
+	return database.CountChatUnreadMessages(room.RoomID, userID, afterMessageID, afterCreatedAt, maxChatUnreadCount)
+}
+
+// ========================================================================================
+// ============================ SUBSCRIBE HANDLER =========================================
+// ========================================================================================
+
+// SubscribeChatReadReceiptHandler 接收已读回执
+func SubscribeChatReadReceiptHandler(ctx context.Context, payload *pubsub.Payload) {
+	receipt := new(pubsub.ChatReadReceipt)
+	err := payload.UnmarshalData(receipt)
+	if err != nil {
+		log.Error().Err(err).Str("payload.channel", payload.Channel).Str("payload.type", payload.Type).Send()
+		return
+	}
+
+	wsPayload := websocket.Payload{
+		Type: payload.Type,
+		Data: receipt,
+	}
+
+	// 推送给发送人,同时推送给阅读人的其他设备,让其他设备同步清除未读
+	websocketManager.PushData(wsPayload, receipt.TargetID, receipt.ReaderID)
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/jerbe/jim/config"
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/log"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/8 15:10
+  @describe : 定时检查并修复房间跟消息之间的不一致
+*/
+
+const (
+	// chatRepairGrace 房间最后更新超过该时间后才检查,需要大于消息写入的超时时间,避免把正在写入的消息当作不一致
+	chatRepairGrace = time.Minute
+
+	// chatRepairLookback 启动后第一次检查的时间范围,覆盖重启前中断的写入
+	chatRepairLookback = time.Hour
+)
+
+// 指标通过 expvar 暴露,在 pprof 服务的 `/debug/vars` 下可以查看
+var (
+	chatRepairMetrics = expvar.NewMap("chat_repair")
+
+	// metricChatRepairChecked 检查过的房间数量
+	metricChatRepairChecked = new(expvar.Int)
+
+	// metricChatRepairLastMessage 修复了最后一条消息的房间数量
+	metricChatRepairLastMessage = new(expvar.Int)
+
+	// metricChatRepairGap 没有对应消息的消息ID数量
+	metricChatRepairGap = new(expvar.Int)
+)
+
+func init() {
+	chatRepairMetrics.Set("checked", metricChatRepairChecked)
+	chatRepairMetrics.Set("last_message", metricChatRepairLastMessage)
+	chatRepairMetrics.Set("message_id_gap", metricChatRepairGap)
+}
+
+// InitChatRepairJob 启动检查并修复房间数据的后台任务
+// 修复都是条件更新,多个实例同时运行时结果一样
+func InitChatRepairJob() {
+	go runChatRepairJob(context.Background(), time.Now().Add(-chatRepairLookback))
+}
+
+// runChatRepairJob 定时检查上一次检查之后有新消息的房间
+func runChatRepairJob(ctx context.Context, since time.Time) {
+	defer func() {
+		if obj := recover(); obj != nil {
+			log.Error().Str("recover", fmt.Sprintf("%+v", obj)).Msg("房间数据修复任务异常")
+			go runChatRepairJob(ctx, since)
+		}
+	}()
+
+	ticker := time.NewTicker(chatRepairInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		start, end, ok := chatRepairRange(since, time.Now())
+		if !ok {
+			continue
+		}
+
+		rooms, err := database.GetChatRoomsUpdatedBetween(start.UnixMilli(), end.UnixMilli())
+		if err != nil {
+			log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取需要检查的房间失败")
+			continue
+		}
+
+		for _, room := range rooms {
+			repairChatRoom(room)
+		}
+		since = end
+	}
+}
+
+// repairChatRoom 检查并修复一个房间,记录修复结果
+func repairChatRoom(room *database.ChatRoom) {
+	result, err := database.RepairChatRoom(room)
+	if err != nil {
+		log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", room.RoomID).Msg("检查房间数据失败")
+		return
+	}
+	metricChatRepairChecked.Add(1)
+
+	if result.LastMessageRepaired {
+		metricChatRepairLastMessage.Add(1)
+	}
+	metricChatRepairGap.Add(result.MessageIDGap)
+
+	if result.LastMessageRepaired || result.MessageIDGap > 0 {
+		log.Warn().Str("room_id", room.RoomID).
+			Bool("last_message_repaired", result.LastMessageRepaired).
+			Int64("message_id_gap", result.MessageIDGap).
+			Int64("last_message_id", room.LastMessageID).
+			Msg("房间跟消息的数据不一致")
+	}
+}
+
+// chatRepairRange 计算本次需要检查的房间最后更新时间范围 [start, end)
+// 最近 chatRepairGrace 内更新的房间可能还在写入,留到下一次检查
+func chatRepairRange(since, now time.Time) (time.Time, time.Time, bool) {
+	end := now.Add(-chatRepairGrace)
+	if !end.After(since) {
+		return since, since, false
+	}
+	return since, end, true
+}
+
+// chatRepairInterval 检查房间数据的间隔
+func chatRepairInterval() time.Duration {
+	if interval := config.GlobConfig().Chat.RepairInterval; interval > 0 {
+		return interval
+	}
+	return time.Minute
+}
@@ -0,0 +1,356 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jerbe/jim/config"
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/pubsub"
+	"github.com/jerbe/jim/websocket"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/5 11:00
+  @describe : 定时消息跟阅后即焚消息
+*/
+
+const (
+	// chatScheduleLease 领取定时消息任务后的租约时间,超过该时间没有处理完会被重新领取
+	chatScheduleLease = time.Minute
+
+	// chatScheduleMaxAttempts 定时消息任务最多领取的次数,超过后放弃发送
+	chatScheduleMaxAttempts = 5
+)
+
+// validateChatSchedule 校验定时发送时间跟阅后即焚有效期
+func validateChatSchedule(req *SendChatMessageRequest) error {
+	if req.SendAt < 0 || req.SendAt > time.Now().Add(chatMaxScheduleDelay()).UnixMilli() {
+		return NewResponseError(MessageInvalidSendAt)
+	}
+
+	if req.TTL < 0 || time.Duration(req.TTL)*time.Second > chatMaxTTL() {
+		return NewResponseError(MessageInvalidTTL)
+	}
+	return nil
+}
+
+// scheduleChatMessage 保存定时消息任务,到期后由 InitChatScheduler 启动的后台任务发送
+// 这里只检测会话权限,其他依赖消息状态的校验(回复,话题等)在发送时进行
+func scheduleChatMessage(ctx context.Context, req *SendChatMessageRequest, currentUser *database.User) (*ChatMessage, error) {
+	switch req.SessionType {
+	case database.ChatMessageSessionTypePrivate, database.ChatMessageSessionTypeGroup:
+		if req.SessionType == database.ChatMessageSessionTypePrivate && req.TargetID == currentUser.ID {
+			return nil, NewResponseError(MessageChatYourself)
+		}
+		if _, err := chatRoomIDWithPermission(currentUser.ID, req.SessionType, req.TargetID); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	schedule := &database.ChatSchedule{
+		UserID:      currentUser.ID,
+		SessionType: req.SessionType,
+		TargetID:    req.TargetID,
+		Request:     string(data),
+		RunAt:       req.SendAt,
+	}
+	if err = database.AddChatSchedule(schedule); err != nil {
+		log.ErrorFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("保存定时消息失败")
+		return nil, errors.Wrap(err)
+	}
+
+	return scheduledChatMessage(schedule, req), nil
+}
+
+// scheduledChatMessage 将还未发送的定时消息转换成响应结构
+func scheduledChatMessage(schedule *database.ChatSchedule, req *SendChatMessageRequest) *ChatMessage {
+	return &ChatMessage{
+		ActionID:    req.ActionID,
+		SessionType: req.SessionType,
+		Type:        req.Type,
+		SenderID:    schedule.UserID,
+		ReceiverID:  req.TargetID,
+		Status:      database.ChatMessageStatusNormal,
+		Body:        req.Body,
+		ThreadID:    req.ThreadID,
+		Mentions:    req.Mentions,
+		MentionAll:  req.MentionAll,
+		CreatedAt:   schedule.CreatedAt,
+		ScheduleID:  schedule.ID.Hex(),
+		SendAt:      schedule.RunAt,
+	}
+}
+
+// GetScheduledChatMessagesHandler
+// @Summary      获取定时消息列表
+// @Description  获取当前用户还未发送的定时消息,按发送时间正序排列
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response{data=[]ChatMessage}
+// @Failure      400  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/message/scheduled [get]
+func GetScheduledChatMessagesHandler(ctx *gin.Context) {
+	currentUser := LoginUserFromContext(ctx)
+	schedules, err := database.GetChatSchedules(currentUser.ID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取定时消息失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+
+	rsps := make([]*ChatMessage, 0, len(schedules))
+	for _, schedule := range schedules {
+		req := new(SendChatMessageRequest)
+		if err = json.Unmarshal([]byte(schedule.Request), req); err != nil {
+			log.ErrorFromGinContext(ctx).Err(err).Str("schedule_id", schedule.ID.Hex()).Msg("解析定时消息失败")
+			continue
+		}
+		rsps = append(rsps, scheduledChatMessage(schedule, req))
+	}
+	JSON(ctx, rsps)
+}
+
+// CancelScheduledChatMessageRequest 取消定时消息请求参数
+// @Description 取消定时消息请求参数
+type CancelScheduledChatMessageRequest struct {
+	// ScheduleID 定时消息的任务ID
+	ScheduleID string `json:"schedule_id" binding:"required" example:"651e2a4f9d7a3bcd72000001"`
+}
+
+// CancelScheduledChatMessageHandler
+// @Summary      取消定时消息
+// @Description  取消一条还未发送的定时消息,正在发送中的消息不能取消
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Param        CancelScheduledChatMessageRequest  body  CancelScheduledChatMessageRequest  true  "请求JSON数据体"
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response
+// @Failure      400  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/message/scheduled/cancel [post]
+func CancelScheduledChatMessageHandler(ctx *gin.Context) {
+	req := new(CancelScheduledChatMessageRequest)
+	err := ctx.BindJSON(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	if err = cancelScheduledChatMessageByRequest(ctx, req); err != nil {
+		JSONResponseError(ctx, err)
+		return
+	}
+	JSON(ctx)
+}
+
+// cancelScheduledChatMessageByRequest 校验并取消定时消息
+func cancelScheduledChatMessageByRequest(ctx *gin.Context, req *CancelScheduledChatMessageRequest) error {
+	if req.ScheduleID == "" {
+		return NewResponseError(MessageInvalidScheduleID)
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+	err := database.CancelChatSchedule(currentUser.ID, req.ScheduleID)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			return NewResponseError(MessageCancelChatScheduleFailure)
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("取消定时消息失败")
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+// InitChatScheduler 启动发送定时消息跟清空过期消息的后台任务
+// 任务保存在mongodb中,多个实例同时运行时通过原子领取保证每条消息只处理一次
+func InitChatScheduler() {
+	go runChatScheduler(context.Background())
+}
+
+// runChatScheduler 定时处理到期的定时消息跟阅后即焚消息
+func runChatScheduler(ctx context.Context) {
+	defer func() {
+		if obj := recover(); obj != nil {
+			log.Error().Str("recover", fmt.Sprintf("%+v", obj)).Msg("定时消息任务异常")
+			go runChatScheduler(ctx)
+		}
+	}()
+
+	ticker := time.NewTicker(chatScheduleInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		sendDueChatSchedules(ctx)
+		expireChatMessages(ctx)
+	}
+}
+
+// sendDueChatSchedules 领取并发送所有已到期的定时消息
+func sendDueChatSchedules(ctx context.Context) {
+	for {
+		schedule, err := database.ClaimChatSchedule(chatScheduleLease)
+		if err != nil {
+			if !errors.IsNoRecord(err) {
+				log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("领取定时消息任务失败")
+			}
+			return
+		}
+
+		err = sendChatSchedule(ctx, schedule)
+		if err != nil && schedule.Attempts < chatScheduleMaxAttempts {
+			// 不删除任务,租约到期后重新发送
+			log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).
+				Str("schedule_id", schedule.ID.Hex()).
+				Int("attempts", schedule.Attempts).
+				Msg("发送定时消息失败")
+			continue
+		}
+		if err != nil {
+			log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).
+				Str("schedule_id", schedule.ID.Hex()).
+				Int("attempts", schedule.Attempts).
+				Msg("发送定时消息失败次数过多,放弃发送")
+		}
+
+		if err = database.RemoveChatSchedule(schedule.ID); err != nil {
+			log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("schedule_id", schedule.ID.Hex()).Msg("删除定时消息任务失败")
+		}
+	}
+}
+
+// sendChatSchedule 以发送人的身份发送定时消息
+// 发送时的权限跟消息校验跟普通消息一样,校验不通过的消息直接丢弃
+func sendChatSchedule(ctx context.Context, schedule *database.ChatSchedule) error {
+	req := new(SendChatMessageRequest)
+	if err := json.Unmarshal([]byte(schedule.Request), req); err != nil {
+		log.Error().Err(err).Str("schedule_id", schedule.ID.Hex()).Msg("解析定时消息失败,丢弃该消息")
+		return nil
+	}
+	req.SendAt = 0
+	req.scheduleID = schedule.ID.Hex()
+
+	user, err := database.GetUser(schedule.UserID)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			return nil
+		}
+		return errors.Wrap(err)
+	}
+
+	_, err = sendChatMessageAsUser(ctx, req, user)
+	if err == nil || errors.Is(err, database.ErrChatScheduleDelivered) {
+		return nil
+	}
+
+	// 发送人已经没有权限或者消息已经不合法,重试也不会成功
+	var rspErr *ResponseError
+	if errors.As(err, &rspErr) {
+		log.Warn().Str("schedule_id", schedule.ID.Hex()).Str("reason", rspErr.Message).Msg("定时消息校验不通过,丢弃该消息")
+		return nil
+	}
+	return err
+}
+
+// expireChatMessages 清空所有已到期的阅后即焚消息并通知会话中的用户
+func expireChatMessages(ctx context.Context) {
+	for {
+		msg, err := database.ExpireChatMessage()
+		if err != nil {
+			if !errors.IsNoRecord(err) {
+				log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("清空过期消息失败")
+			}
+			return
+		}
+
+		var publishTargets []int64
+		if msg.SessionType == database.ChatMessageSessionTypeGroup {
+			publishTargets, err = database.GetGroupMemberIDs(msg.ReceiverID)
+			if err != nil {
+				log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取群成员ID列表失败")
+				continue
+			}
+		}
+
+		err = pubsub.PublishChatMessageExpired(ctx, &pubsub.ChatMessageExpired{
+			SessionType:    msg.SessionType,
+			SenderID:       msg.SenderID,
+			ReceiverID:     msg.ReceiverID,
+			MessageID:      msg.MessageID,
+			ThreadID:       msg.ThreadID,
+			ExpiredAt:      msg.UpdatedAt,
+			PublishTargets: publishTargets,
+		})
+		if err != nil {
+			log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("发布过期消息通知失败")
+		}
+	}
+}
+
+// chatMaxScheduleDelay 定时消息最长可以延后发送的时间
+func chatMaxScheduleDelay() time.Duration {
+	if delay := config.GlobConfig().Chat.MaxScheduleDelay; delay > 0 {
+		return delay
+	}
+	return 30 * 24 * time.Hour
+}
+
+// chatMaxTTL 阅后即焚消息最长的有效期
+func chatMaxTTL() time.Duration {
+	if ttl := config.GlobConfig().Chat.MaxTTL; ttl > 0 {
+		return ttl
+	}
+	return 7 * 24 * time.Hour
+}
+
+// chatScheduleInterval 检查定时消息跟过期消息的间隔
+func chatScheduleInterval() time.Duration {
+	if interval := config.GlobConfig().Chat.ScheduleInterval; interval > 0 {
+		return interval
+	}
+	return time.Second
+}
+
+// ========================================================================================
+// ============================ SUBSCRIBE HANDLER =========================================
+// ========================================================================================
+
+// SubscribeChatMessageExpiredHandler 接收阅后即焚消息过期通知
+func SubscribeChatMessageExpiredHandler(ctx context.Context, payload *pubsub.Payload) {
+	expired := new(pubsub.ChatMessageExpired)
+	err := payload.UnmarshalData(expired)
+	if err != nil {
+		log.Error().Err(err).Str("payload.channel", payload.Channel).Str("payload.type", payload.Type).Send()
+		return
+	}
+
+	targets, ok := chatPushTargets(expired.SessionType, expired.SenderID, expired.ReceiverID, expired.PublishTargets)
+	if !ok {
+		return
+	}
+
+	expired.PublishTargets = nil
+	websocketManager.PushData(websocket.Payload{Type: payload.Type, Data: expired}, targets...)
+}
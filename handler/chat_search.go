@@ -0,0 +1,290 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/search"
+	"github.com/jerbe/jim/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/3 14:10
+  @describe :
+*/
+
+const (
+	// defaultSearchLimit 搜索默认返回的数量
+	defaultSearchLimit = 20
+
+	// maxSearchLimit 搜索最多返回的数量
+	maxSearchLimit = 50
+
+	// maxSearchOffset 搜索最多可以跳过的数量,再往后请缩小时间范围
+	maxSearchOffset = 1000
+
+	// maxSearchKeywordLength 关键词的最大长度
+	maxSearchKeywordLength = 64
+)
+
+// SearchChatMessagesRequest 搜索聊天消息请求参数
+// @Description 搜索聊天消息请求参数
+type SearchChatMessagesRequest struct {
+	// Keyword 关键词,多个关键词用空格分隔,需要全部命中
+	Keyword string `form:"keyword" json:"keyword" example:"周末 聚餐"`
+
+	// SessionType 会话类型,跟 target_id 一起使用时只搜索该会话; 1-私人会话;2-群聊会话;99-世界频道会话
+	SessionType int `form:"session_type" json:"session_type" enums:"1,2,99" example:"1"`
+
+	// TargetID 目标ID; 朋友ID/群ID/世界频道ID,为0时搜索所有好友跟群的聊天记录
+	TargetID int64 `form:"target_id" json:"target_id" example:"0"`
+
+	// SenderID 大于0时只搜索该用户发送的消息
+	SenderID int64 `form:"sender_id" json:"sender_id" example:"0"`
+
+	// Type 大于0时只搜索该类型的消息
+	Type int `form:"type" json:"type" example:"1"`
+
+	// StartTime 开始时间,单位毫秒,包含该时间
+	StartTime int64 `form:"start_time" json:"start_time" example:"1696000000000"`
+
+	// EndTime 结束时间,单位毫秒,不包含该时间
+	EndTime int64 `form:"end_time" json:"end_time" example:"1696086400000"`
+
+	// Offset 跳过的数量,最大1000
+	Offset int `form:"offset" json:"offset" example:"0"`
+
+	// Limit 返回数量,默认20,最大50
+	Limit int `form:"limit" json:"limit" example:"20"`
+}
+
+// ChatMessageHighlight 命中关键词的片段
+// @Description 命中关键词的片段
+type ChatMessageHighlight struct {
+	// Field 命中的消息主体字段
+	Field string `json:"field" enums:"text,name,title,description" example:"text"`
+
+	// Snippet 包含关键词的片段,过长的内容会被截断并加上省略号
+	Snippet string `json:"snippet" example:"…这个周末一起去聚餐吧"`
+
+	// Ranges 关键词在片段中的位置,按字符计算,每项为 [开始,结束)
+	Ranges [][2]int `json:"ranges" swaggertype:"array,integer" example:"3,5"`
+}
+
+// ChatMessageSearchHit 搜索命中的聊天消息
+// @Description 搜索命中的聊天消息
+type ChatMessageSearchHit struct {
+	*ChatMessage
+
+	// Highlights 命中关键词的片段
+	Highlights []ChatMessageHighlight `json:"highlights,omitempty"`
+}
+
+// ChatMessageSearchResult 聊天消息搜索结果
+// @Description 聊天消息搜索结果
+type ChatMessageSearchResult struct {
+	// HasMore 是否还有更多结果
+	HasMore bool `json:"has_more" example:"true"`
+
+	// Messages 命中的消息,按发送时间倒序排列
+	Messages []*ChatMessageSearchHit `json:"messages"`
+}
+
+// SearchChatMessagesHandler
+// @Summary      搜索聊天消息
+// @Description  在当前用户可以阅读的会话中按关键词,发送人,时间范围跟消息类型搜索,会排除撤回,删除跟清空过的消息
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Param        keyword    query      string  false  "关键词,多个关键词用空格分隔"
+// @Param        session_type    query      int  false  "会话类型; 1-私人会话;2-群聊会话;99-世界频道会话"
+// @Param        target_id    query      int  false  "目标ID,为0时搜索所有好友跟群"
+// @Param        sender_id    query      int  false  "发送人ID"
+// @Param        type    query      int  false  "消息类型"
+// @Param        start_time    query      int  false  "开始时间,单位毫秒"
+// @Param        end_time    query      int  false  "结束时间,单位毫秒"
+// @Param        offset    query      int  false  "跳过的数量"
+// @Param        limit    query      int  false  "返回数量,默认20,最大50"
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response{data=ChatMessageSearchResult}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/message/search [get]
+func SearchChatMessagesHandler(ctx *gin.Context) {
+	req := new(SearchChatMessagesRequest)
+	err := ctx.BindQuery(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	rsp, err := searchChatMessagesByRequest(ctx, req)
+	if err != nil {
+		JSONResponseError(ctx, err)
+		return
+	}
+	JSON(ctx, rsp)
+}
+
+// searchChatMessagesByRequest 校验请求并搜索聊天消息
+// HTTP 跟 websocket 共用该方法
+func searchChatMessagesByRequest(ctx *gin.Context, req *SearchChatMessagesRequest) (*ChatMessageSearchResult, error) {
+	if err := validateSearchChatMessagesRequest(req); err != nil {
+		return nil, err
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+	rooms, err := chatSearchRooms(ctx, currentUser.ID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// 多取一条用于判断是否还有更多结果
+	hits, err := search.GlobSearcher.SearchChatMessages(ctx, &search.Query{
+		UserID:    currentUser.ID,
+		Rooms:     rooms,
+		Keyword:   req.Keyword,
+		SenderID:  req.SenderID,
+		Type:      req.Type,
+		StartTime: req.StartTime,
+		EndTime:   req.EndTime,
+		Offset:    req.Offset,
+		Limit:     req.Limit + 1,
+	})
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("keyword", req.Keyword).Msg("搜索聊天消息失败")
+		return nil, errors.Wrap(err)
+	}
+
+	rsp := &ChatMessageSearchResult{HasMore: len(hits) > req.Limit}
+	if rsp.HasMore {
+		hits = hits[:req.Limit]
+	}
+
+	rsp.Messages = make([]*ChatMessageSearchHit, len(hits))
+	for i, hit := range hits {
+		rsp.Messages[i] = &ChatMessageSearchHit{ChatMessage: chatMessageFromDatabaseForUser(hit.Message, currentUser.ID)}
+		for _, h := range hit.Highlights {
+			rsp.Messages[i].Highlights = append(rsp.Messages[i].Highlights, ChatMessageHighlight{
+				Field:   h.Field,
+				Snippet: h.Snippet,
+				Ranges:  h.Ranges,
+			})
+		}
+	}
+	return rsp, nil
+}
+
+// validateSearchChatMessagesRequest 校验搜索请求参数,并设置默认返回数量
+func validateSearchChatMessagesRequest(req *SearchChatMessagesRequest) error {
+	if utils.StringLen(req.Keyword) > maxSearchKeywordLength {
+		return NewResponseError(MessageInvalidKeyword)
+	}
+
+	if req.TargetID < 0 || (req.TargetID == 0 && req.SessionType != 0) {
+		return NewResponseError(MessageInvalidTargetID)
+	}
+
+	if req.SenderID < 0 {
+		return NewResponseError(MessageInvalidUserID)
+	}
+
+	if req.Type < 0 {
+		return NewResponseError(MessageInvalidType)
+	}
+	if req.Type > 0 {
+		if _, ok := chatMessageTypeDefinition(req.Type); !ok {
+			return NewResponseError(MessageInvalidType)
+		}
+	}
+
+	if len(search.Terms(req.Keyword)) == 0 && req.SenderID == 0 && req.Type == 0 {
+		return NewResponseError(MessageSearchConditionRequired)
+	}
+
+	if req.StartTime < 0 {
+		return NewResponseError(MessageInvalidFormat("start_time"))
+	}
+	if req.EndTime < 0 || (req.EndTime > 0 && req.EndTime <= req.StartTime) {
+		return NewResponseError(MessageInvalidFormat("end_time"))
+	}
+
+	if req.Offset < 0 || req.Offset > maxSearchOffset {
+		return NewResponseError(MessageInvalidOffset)
+	}
+
+	if req.Limit == 0 {
+		req.Limit = defaultSearchLimit
+	}
+	if req.Limit < 0 || req.Limit > maxSearchLimit {
+		return NewResponseError(MessageInvalidLimit)
+	}
+	return nil
+}
+
+// chatSearchRooms 获取用户可以搜索的房间
+// 指定了会话时使用阅读权限检测;否则搜索所有好友跟群,好友使用跟发送消息相同的关系检测,世界频道消息量太大不参与
+func chatSearchRooms(ctx *gin.Context, userID int64, req *SearchChatMessagesRequest) ([]search.Room, error) {
+	if req.TargetID > 0 {
+		roomID, err := chatRoomIDWithReadPermission(ctx, userID, req.SessionType, req.TargetID)
+		if err != nil {
+			return nil, err
+		}
+
+		clearedMessageID, err := chatConversationClearedMessageID(ctx, userID, roomID)
+		if err != nil {
+			return nil, err
+		}
+		return []search.Room{{RoomID: roomID, SessionType: req.SessionType, ClearedMessageID: clearedMessageID}}, nil
+	}
+
+	friendIDs, err := database.GetUserRelationTargetIDs(userID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取用户关系列表失败")
+		return nil, errors.Wrap(err)
+	}
+
+	groupIDs, err := database.GetUserGroupIDs(userID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取用户群组列表失败")
+		return nil, errors.Wrap(err)
+	}
+
+	conversations, err := database.GetChatConversations(userID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取会话设置失败")
+		return nil, errors.Wrap(err)
+	}
+
+	rooms := make([]search.Room, 0, len(friendIDs)+len(groupIDs))
+	addRoom := func(roomID string, sessionType int) {
+		room := search.Room{RoomID: roomID, SessionType: sessionType}
+		if conversation, ok := conversations[roomID]; ok {
+			room.ClearedMessageID = conversation.ClearedMessageID
+		}
+		rooms = append(rooms, room)
+	}
+
+	for _, id := range friendIDs {
+		// 已经不是好友或者被对方拉黑的,跟发送消息一样不能再查看
+		if err = checkChatFriendRelation(ctx, userID, id); err != nil {
+			var rspErr *ResponseError
+			if errors.As(err, &rspErr) {
+				continue
+			}
+			return nil, err
+		}
+		addRoom(utils.FormatPrivateRoomID(userID, id), database.ChatMessageSessionTypePrivate)
+	}
+
+	for _, id := range groupIDs {
+		addRoom(utils.FormatGroupRoomID(id), database.ChatMessageSessionTypeGroup)
+	}
+	return rooms, nil
+}
@@ -0,0 +1,375 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/utils"
+
+	goutils "github.com/jerbe/go-utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/22 16:02
+  @describe :
+*/
+
+const (
+	// defaultSyncLimit 同步时每个房间默认返回的消息数量
+	defaultSyncLimit = 50
+
+	// maxSyncLimit 同步时每个房间最多返回的消息数量
+	maxSyncLimit = 200
+)
+
+// SyncChatRoom 需要同步的房间
+// @Description 需要同步的房间
+type SyncChatRoom struct {
+	// TargetID 目标ID; 朋友ID/群ID
+	TargetID int64 `json:"target_id" example:"1"`
+
+	// SessionType 会话类型; 1-私人会话;2-群聊会话
+	SessionType int `json:"session_type" enums:"1,2" example:"1"`
+
+	// ThreadID 话题的根消息ID,大于0时该房间是会话中的一个话题,消息ID是话题内的序列
+	ThreadID int64 `json:"thread_id,omitempty" example:"0"`
+
+	// LastMessageID 房间的最后一条消息ID
+	LastMessageID int64 `json:"last_message_id" example:"120"`
+
+	// CursorMessageID 该设备已经同步到的消息ID
+	CursorMessageID int64 `json:"cursor_message_id" example:"100"`
+
+	// HasMore 是否还有未返回的消息,确认后再次同步即可获取
+	HasMore bool `json:"has_more" example:"false"`
+
+	// Messages 游标之后的消息,按消息ID正序排列
+	Messages []*ChatMessage `json:"messages"`
+}
+
+// SyncChatRequest 同步聊天消息请求参数
+// @Description 同步聊天消息请求参数
+type SyncChatRequest struct {
+	// DeviceID 设备ID,由前端生成并保持不变
+	DeviceID string `form:"device_id" json:"device_id" binding:"required" example:"8d7a3bcd72"`
+
+	// Limit 每个房间最多返回的消息数量,默认50,最大200
+	Limit int64 `form:"limit" json:"limit" example:"50"`
+}
+
+// SyncChatHandler
+// @Summary      同步聊天消息
+// @Description  返回该设备游标之后有新消息的所有房间,客户端重连后调用即可补齐离线期间的消息
+// @Description  话题作为单独的房间返回,带有 thread_id;确认时也需要带上 thread_id
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Param        device_id    query      string  true  "设备ID"
+// @Param        limit    query      int  false  "每个房间最多返回的消息数量"
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response{data=[]SyncChatRoom}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/sync [get]
+func SyncChatHandler(ctx *gin.Context) {
+	req := new(SyncChatRequest)
+	err := ctx.BindQuery(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	rsps, err := syncChatByRequest(ctx, req)
+	if err != nil {
+		JSONResponseError(ctx, err)
+		return
+	}
+	JSON(ctx, rsps)
+}
+
+// syncChatByRequest 校验请求并获取需要同步的房间
+// HTTP 跟 websocket 共用该方法
+func syncChatByRequest(ctx *gin.Context, req *SyncChatRequest) ([]*SyncChatRoom, error) {
+	if req.DeviceID == "" || utils.StringLen(req.DeviceID) > 64 {
+		return nil, NewResponseError(MessageInvalidDeviceID)
+	}
+
+	if req.Limit < 0 || req.Limit > maxSyncLimit {
+		return nil, NewResponseError(MessageInvalidLimit)
+	}
+
+	if req.Limit == 0 {
+		req.Limit = defaultSyncLimit
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+
+	// 找出用户所在的所有房间,世界频道消息量太大,不参与同步
+	friendIDs, err := database.GetUserRelationTargetIDs(currentUser.ID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取用户关系列表失败")
+		return nil, errors.Wrap(err)
+	}
+
+	groupIDs, err := database.GetUserGroupIDs(currentUser.ID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取用户群组列表失败")
+		return nil, errors.Wrap(err)
+	}
+
+	targets := make(map[string]int64, len(friendIDs)+len(groupIDs))
+	roomIDs := make([]string, 0, len(friendIDs)+len(groupIDs))
+	for _, id := range friendIDs {
+		roomID := utils.FormatPrivateRoomID(currentUser.ID, id)
+		targets[roomID] = id
+		roomIDs = append(roomIDs, roomID)
+	}
+	for _, id := range groupIDs {
+		roomID := utils.FormatGroupRoomID(id)
+		targets[roomID] = id
+		roomIDs = append(roomIDs, roomID)
+	}
+
+	if len(roomIDs) == 0 {
+		return []*SyncChatRoom{}, nil
+	}
+
+	rooms, err := database.GetChatRooms(roomIDs)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取聊天室列表失败")
+		return nil, errors.Wrap(err)
+	}
+
+	cursors, err := database.GetChatCursors(currentUser.ID, req.DeviceID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("device_id", req.DeviceID).Msg("获取同步游标失败")
+		return nil, errors.Wrap(err)
+	}
+
+	conversations, err := database.GetChatConversations(currentUser.ID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取会话设置失败")
+		return nil, errors.Wrap(err)
+	}
+
+	threadRooms, err := chatSyncThreadRooms(ctx, targets, cursors)
+	if err != nil {
+		return nil, err
+	}
+
+	rsps := make([]*SyncChatRoom, 0, len(rooms)+len(threadRooms))
+	for _, room := range append(rooms, threadRooms...) {
+		// 只同步私聊跟群聊
+		if !goutils.In(room.SessionType, database.ChatMessageSessionTypePrivate, database.ChatMessageSessionTypeGroup) {
+			continue
+		}
+
+		parentRoomID, threadID, isThread := utils.ParseThreadRoomID(room.RoomID)
+		if !isThread {
+			parentRoomID = room.RoomID
+		}
+
+		var cursorMessageID int64
+		if cursor, ok := cursors[room.RoomID]; ok {
+			cursorMessageID = cursor.MessageID
+		} else if room.LastMessageID > req.Limit {
+			// 新设备或者新话题没有游标,只返回最近的消息,更早的消息通过历史消息接口获取
+			cursorMessageID = room.LastMessageID - req.Limit
+		}
+
+		if room.LastMessageID <= cursorMessageID {
+			continue
+		}
+
+		// 清空过的会话不需要同步清空之前的消息;话题有独立的消息ID序列,不受清空影响
+		afterMessageID := cursorMessageID
+		if conversation, ok := conversations[room.RoomID]; ok && !isThread && conversation.ClearedMessageID > afterMessageID {
+			afterMessageID = conversation.ClearedMessageID
+		}
+
+		list, err := database.GetChatMessagesAfter(room.RoomID, room.SessionType, currentUser.ID, afterMessageID, req.Limit)
+		if err != nil {
+			log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", room.RoomID).Msg("获取同步消息失败")
+			return nil, errors.Wrap(err)
+		}
+
+		messages := make([]*ChatMessage, len(list))
+		for i := 0; i < len(list); i++ {
+			messages[i] = chatMessageFromDatabaseForUser(list[i], currentUser.ID)
+		}
+
+		hasMore := false
+		if len(list) > 0 {
+			hasMore = list[len(list)-1].MessageID < room.LastMessageID
+		}
+
+		rsps = append(rsps, &SyncChatRoom{
+			TargetID:        targets[parentRoomID],
+			SessionType:     room.SessionType,
+			ThreadID:        threadID,
+			LastMessageID:   room.LastMessageID,
+			CursorMessageID: cursorMessageID,
+			HasMore:         hasMore,
+			Messages:        messages,
+		})
+	}
+	return rsps, nil
+}
+
+// chatSyncThreadRooms 获取需要同步的话题房间
+// 已经有游标的话题继续同步;没有游标的话题只同步该设备最后一次确认所属房间之后有新回复的
+func chatSyncThreadRooms(ctx *gin.Context, targets map[string]int64, cursors map[string]*database.ChatCursor) ([]*database.ChatRoom, error) {
+	trackedRoomIDs := make([]string, 0)
+	updatedAfter := make(map[string]int64)
+	for roomID, cursor := range cursors {
+		parentRoomID, _, ok := utils.ParseThreadRoomID(roomID)
+		if !ok {
+			if _, in := targets[roomID]; in {
+				updatedAfter[roomID] = cursor.UpdatedAt
+			}
+			continue
+		}
+
+		// 已经退出或者删除的会话中的话题不再同步
+		if _, in := targets[parentRoomID]; in {
+			trackedRoomIDs = append(trackedRoomIDs, roomID)
+		}
+	}
+
+	rooms, err := database.GetChatThreadRoomsUpdatedAfter(updatedAfter)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取话题房间列表失败")
+		return nil, errors.Wrap(err)
+	}
+
+	found := make(map[string]struct{}, len(rooms))
+	for _, room := range rooms {
+		found[room.RoomID] = struct{}{}
+	}
+
+	missing := make([]string, 0, len(trackedRoomIDs))
+	for _, roomID := range trackedRoomIDs {
+		if _, ok := found[roomID]; !ok {
+			missing = append(missing, roomID)
+		}
+	}
+	if len(missing) == 0 {
+		return rooms, nil
+	}
+
+	tracked, err := database.GetChatRooms(missing)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取话题房间列表失败")
+		return nil, errors.Wrap(err)
+	}
+	return append(rooms, tracked...), nil
+}
+
+// AckChatSyncRequest 确认同步请求参数
+// @Description 确认同步请求参数
+type AckChatSyncRequest struct {
+	// DeviceID 设备ID,由前端生成并保持不变
+	DeviceID string `json:"device_id" binding:"required" example:"8d7a3bcd72"`
+
+	// TargetID 目标ID; 朋友ID/群ID
+	TargetID int64 `json:"target_id" binding:"required" example:"1"`
+
+	// SessionType 会话类型; 1-私人会话;2-群聊会话
+	SessionType int `json:"session_type" binding:"required" enums:"1,2" example:"1"`
+
+	// ThreadID 话题的根消息ID,确认话题中的消息时填写,否则为0
+	ThreadID int64 `json:"thread_id" example:"0"`
+
+	// MessageID 已经收到的最大消息ID
+	MessageID int64 `json:"message_id" binding:"required" example:"120"`
+}
+
+// AckChatSyncHandler
+// @Summary      确认同步
+// @Description  推进该设备在房间中的同步游标,游标只会前进不会后退
+// @Tags         聊天
+// @Accept       json
+// @Produce      json
+// @Param        jsonRaw    body      AckChatSyncRequest  true  "请求JSON数据体"
+// @Security 	 APIKeyQuery
+// @Success      200  {object}  Response
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/chat/sync/ack [post]
+func AckChatSyncHandler(ctx *gin.Context) {
+	req := new(AckChatSyncRequest)
+	err := ctx.BindJSON(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	if err = ackChatSyncByRequest(ctx, req); err != nil {
+		JSONResponseError(ctx, err)
+		return
+	}
+	JSON(ctx)
+}
+
+// ackChatSyncByRequest 校验请求并推进同步游标
+// HTTP 跟 websocket 共用该方法
+func ackChatSyncByRequest(ctx *gin.Context, req *AckChatSyncRequest) error {
+	if req.DeviceID == "" || utils.StringLen(req.DeviceID) > 64 {
+		return NewResponseError(MessageInvalidDeviceID)
+	}
+
+	if req.TargetID <= 0 {
+		return NewResponseError(MessageInvalidTargetID)
+	}
+
+	if req.MessageID <= 0 {
+		return NewResponseError(MessageInvalidMessageID)
+	}
+
+	if req.ThreadID < 0 {
+		return NewResponseError(MessageInvalidThreadID)
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+	roomID, err := chatRoomIDWithPermission(currentUser.ID, req.SessionType, req.TargetID)
+	if err != nil {
+		return err
+	}
+	if req.ThreadID > 0 {
+		roomID = utils.FormatThreadRoomID(roomID, req.ThreadID)
+	}
+
+	room, err := database.GetChatRoom(roomID)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			return NewResponseError(MessageNotFound)
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("获取聊天室失败")
+		return errors.Wrap(err)
+	}
+
+	// 游标只会前进,超过最后一条消息的游标会让该设备跳过之后的消息
+	if req.MessageID > room.LastMessageID {
+		return NewResponseError(MessageInvalidMessageID)
+	}
+
+	err = database.UpdateChatCursor(&database.ChatCursor{
+		UserID:      currentUser.ID,
+		DeviceID:    req.DeviceID,
+		RoomID:      roomID,
+		SessionType: req.SessionType,
+		MessageID:   req.MessageID,
+	})
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Str("device_id", req.DeviceID).Msg("更新同步游标失败")
+		return errors.Wrap(err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/pubsub"
+	"github.com/jerbe/jim/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/28 17:10
+  @describe :
+*/
+
+// sendGroupSystemMessage 在群聊中发送服务端生成的系统通知
+// 系统通知的发送人为0,所有群成员都会增加未读数
+func sendGroupSystemMessage(ctx *gin.Context, groupID int64, body *database.ChatMessageBody) error {
+	memberIDs, err := database.GetGroupMemberIDs(groupID)
+	if err != nil && !errors.IsNoRecord(err) {
+		return errors.Wrap(err)
+	}
+
+	now := time.Now()
+	msg := &database.ChatMessage{
+		RoomID:      utils.FormatGroupRoomID(groupID),
+		Type:        database.ChatMessageTypeSystem,
+		SessionType: database.ChatMessageSessionTypeGroup,
+		ReceiverID:  groupID,
+		SendStatus:  database.ChatMessageSendStatusSent,
+		ReadStatus:  database.ChatMessageReadStatusUnread,
+		Status:      database.ChatMessageStatusNormal,
+		CreatedAt:   now.UnixMilli(),
+		UpdatedAt:   now.UnixMilli(),
+		Body:        *body,
+		Outbox:      newChatMessageOutbox("", now),
+	}
+
+	if err = database.AddChatMessage(msg); err != nil {
+		return errors.Wrap(err)
+	}
+
+	incrChatUnreadCounts(ctx, msg, memberIDs)
+
+	rsp := chatMessageFromDatabase(msg)
+	psData := fillChatMessageForPublish(rsp)
+	psData.PublishTargets = memberIDs
+	if err = pubsub.PublishChatMessage(ctx, psData); err != nil {
+		return errors.Wrap(err)
+	}
+
+	markChatMessagePublished(ctx, msg)
+	return nil
+}
+
+// notifyGroupMemberJoined 发送群成员加入的系统通知
+func notifyGroupMemberJoined(ctx *gin.Context, groupID, operatorID int64, userIDs []int64) {
+	if len(userIDs) == 0 {
+		return
+	}
+
+	err := sendGroupSystemMessage(ctx, groupID, &database.ChatMessageBody{
+		Event:      database.ChatMessageSystemEventMemberJoined,
+		OperatorID: operatorID,
+		UserIDs:    userIDs,
+	})
+	if err != nil {
+		log.WarnFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", groupID).Msg("发送群成员加入通知失败")
+	}
+}
+
+// notifyGroupRenamed 发送群名称修改的系统通知
+func notifyGroupRenamed(ctx *gin.Context, groupID, operatorID int64, name string) {
+	err := sendGroupSystemMessage(ctx, groupID, &database.ChatMessageBody{
+		Event:      database.ChatMessageSystemEventGroupRenamed,
+		OperatorID: operatorID,
+		Text:       name,
+	})
+	if err != nil {
+		log.WarnFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", groupID).Msg("发送群名称修改通知失败")
+	}
+}
+
+// notifyGroupAnnouncementUpdated 发送群公告更新的系统通知
+func notifyGroupAnnouncementUpdated(ctx *gin.Context, groupID, operatorID int64, content string) {
+	err := sendGroupSystemMessage(ctx, groupID, &database.ChatMessageBody{
+		Event:      database.ChatMessageSystemEventAnnouncementUpdated,
+		OperatorID: operatorID,
+		Text:       content,
+	})
+	if err != nil {
+		log.WarnFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", groupID).Msg("发送群公告更新通知失败")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/goccy/go-json"
 	"github.com/gorilla/websocket"
 	goutils "github.com/jerbe/go-utils"
+	"github.com/jerbe/jim/database"
 	"sync"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -348,6 +350,509 @@ func TestWebsocketHandler(t *testing.T) {
 	}
 }
 
+func TestParseWSMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		message    string
+		wantStatus int
+		wantAction string
+	}{
+		{
+			name:       "无效的JSON",
+			message:    `{"action":`,
+			wantStatus: StatusError,
+		},
+		{
+			name:       "未知的行为",
+			message:    `{"action":"chat.unknown","action_id":"1"}`,
+			wantStatus: StatusError,
+			wantAction: "chat.unknown",
+		},
+		{
+			name:       "缺少数据体",
+			message:    `{"action":"chat.send","action_id":"2"}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatSend,
+		},
+		{
+			name:       "应用层心跳",
+			message:    `{"action":"ping","action_id":"3"}`,
+			wantStatus: StatusOK,
+			wantAction: WebsocketActionPing,
+		},
+		{
+			name:       "同步缺少设备ID",
+			message:    `{"action":"chat.sync","action_id":"4","data":{}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatSync,
+		},
+		{
+			name:       "瞬时事件类型无效",
+			message:    `{"action":"chat.event","action_id":"5","data":{"target_id":1,"session_type":1,"event":"unknown"}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatEvent,
+		},
+		{
+			name:       "删除消息未指定删除方式",
+			message:    `{"action":"chat.delete","action_id":"6","data":{"target_id":1,"session_type":1}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatDelete,
+		},
+		{
+			name:       "删除消息范围无效",
+			message:    `{"action":"chat.delete","action_id":"7","data":{"target_id":1,"session_type":1,"start_message_id":10,"end_message_id":5}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatDelete,
+		},
+		{
+			name:       "撤回缺少消息ID",
+			message:    `{"action":"chat.rollback","action_id":"8","data":{"target_id":1,"session_type":1}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatRollback,
+		},
+		{
+			name:       "历史消息方向无效",
+			message:    `{"action":"chat.history","action_id":"9","data":{"target_id":1,"session_type":1,"direction":"up"}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatHistory,
+		},
+		{
+			name:       "历史消息数量超过限制",
+			message:    `{"action":"chat.history","action_id":"10","data":{"target_id":1,"session_type":1,"limit":1000}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatHistory,
+		},
+		{
+			name:       "发送到无效的话题",
+			message:    `{"action":"chat.send","action_id":"11","data":{"target_id":1,"session_type":1,"type":1,"body":{"text":"hi"},"thread_id":-1}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatSend,
+		},
+		{
+			name:       "表情包含非法字符",
+			message:    `{"action":"chat.reaction","action_id":"12","data":{"target_id":1,"session_type":1,"message_id":1,"emoji":"$set","action":"add"}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatReaction,
+		},
+		{
+			name:       "编辑为空白文本",
+			message:    `{"action":"chat.edit","action_id":"13","data":{"target_id":1,"session_type":1,"message_id":1,"text":"  "}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatEdit,
+		},
+		{
+			name:       "私聊@用户",
+			message:    `{"action":"chat.send","action_id":"14","data":{"target_id":1,"session_type":1,"type":1,"body":{"text":"hi"},"mentions":[2]}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatSend,
+		},
+		{
+			name:       "搜索没有任何条件",
+			message:    `{"action":"chat.search","action_id":"15","data":{"keyword":" "}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatSearch,
+		},
+		{
+			name:       "阅后即焚有效期为负数",
+			message:    `{"action":"chat.send","action_id":"16","data":{"target_id":1,"session_type":1,"type":1,"body":{"text":"hi"},"ttl":-1}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatSend,
+		},
+		{
+			name:       "定时发送时间超过上限",
+			message:    `{"action":"chat.send","action_id":"17","data":{"target_id":1,"session_type":1,"type":1,"body":{"text":"hi"},"send_at":99999999999999}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatSend,
+		},
+		{
+			name:       "转发没有目标会话",
+			message:    `{"action":"chat.forward","action_id":"18","data":{"target_id":1,"session_type":1,"message_ids":[1],"targets":[]}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatForward,
+		},
+		{
+			name:       "ActionID超长",
+			message:    `{"action":"chat.send","action_id":"19","data":{"action_id":"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa","target_id":1,"session_type":1,"type":1,"body":{"text":"hi"}}}`,
+			wantStatus: StatusError,
+			wantAction: WebsocketActionChatSend,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gin.CreateTestContextOnly(httptest.NewRecorder(), gin.New())
+			rsp := parseWSMessage(ctx, []byte(tt.message))
+			if rsp.Status != tt.wantStatus {
+				t.Errorf("parseWSMessage() status = %v, want %v", rsp.Status, tt.wantStatus)
+			}
+			if rsp.Action != tt.wantAction {
+				t.Errorf("parseWSMessage() action = %v, want %v", rsp.Action, tt.wantAction)
+			}
+		})
+	}
+}
+
+func TestCanRollbackGroupMessage(t *testing.T) {
+	tests := []struct {
+		name         string
+		operatorRole int
+		senderRole   int
+		want         bool
+	}{
+		{name: "群主撤回普通成员", operatorRole: 1, senderRole: 0, want: true},
+		{name: "群主撤回管理员", operatorRole: 1, senderRole: 2, want: true},
+		{name: "管理员撤回普通成员", operatorRole: 2, senderRole: 0, want: true},
+		{name: "管理员撤回管理员", operatorRole: 2, senderRole: 2, want: false},
+		{name: "管理员撤回群主", operatorRole: 2, senderRole: 1, want: false},
+		{name: "普通成员撤回他人", operatorRole: 0, senderRole: 0, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canRollbackGroupMessage(tt.operatorRole, tt.senderRole); got != tt.want {
+				t.Errorf("canRollbackGroupMessage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterChatMentions(t *testing.T) {
+	memberIDs := []int64{1, 2, 3, 4}
+	tests := []struct {
+		name     string
+		mentions []int64
+		want     []int64
+	}{
+		{name: "没有@", mentions: nil, want: nil},
+		{name: "正常@", mentions: []int64{2, 3}, want: []int64{2, 3}},
+		{name: "去掉重复", mentions: []int64{2, 2, 3}, want: []int64{2, 3}},
+		{name: "去掉自己", mentions: []int64{1, 2}, want: []int64{2}},
+		{name: "去掉非群成员", mentions: []int64{5, 4}, want: []int64{4}},
+		{name: "全部无效", mentions: []int64{1, 6}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := filterChatMentions(tt.mentions, 1, memberIDs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterChatMentions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSendChatMessageBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		typ     int
+		body    ChatMessageBody
+		wantErr bool
+	}{
+		{name: "未注册的类型", typ: 999, wantErr: true},
+		{name: "正常文本", typ: 1, body: ChatMessageBody{Text: "hi"}},
+		{name: "空白文本", typ: 1, body: ChatMessageBody{Text: "  "}, wantErr: true},
+		{name: "文本超长", typ: 1, body: ChatMessageBody{Text: strings.Repeat("字", 5001)}, wantErr: true},
+		{name: "正常图片", typ: 2, body: ChatMessageBody{Src: "https://a.com/1.png", Format: "PNG", Size: 1024}},
+		{name: "图片缺少地址", typ: 2, body: ChatMessageBody{Format: "png"}, wantErr: true},
+		{name: "图片格式不支持", typ: 2, body: ChatMessageBody{Src: "https://a.com/1.bmp", Format: "bmp"}, wantErr: true},
+		{name: "图片地址协议无效", typ: 2, body: ChatMessageBody{Src: "ftp://a.com/1.png", Format: "png"}, wantErr: true},
+		{name: "语音格式为视频格式", typ: 3, body: ChatMessageBody{Src: "https://a.com/1.mp4", Format: "mp4"}, wantErr: true},
+		{name: "正常视频", typ: 4, body: ChatMessageBody{Src: "https://a.com/1.mp4", Format: "mp4"}},
+		{name: "正常位置", typ: 5, body: ChatMessageBody{Latitude: "24.48", Longitude: "118.08", Scale: 15}},
+		{name: "纬度超出范围", typ: 5, body: ChatMessageBody{Latitude: "91", Longitude: "118.08"}, wantErr: true},
+		{name: "经度不是数字", typ: 5, body: ChatMessageBody{Latitude: "24.48", Longitude: "东经118"}, wantErr: true},
+		{name: "客户端发送系统通知", typ: 9, body: ChatMessageBody{Event: "member_joined"}, wantErr: true},
+		{name: "正常文件", typ: 6, body: ChatMessageBody{Src: "https://a.com/1.pdf", Name: "1.pdf", Size: 1024}},
+		{name: "文件缺少大小", typ: 6, body: ChatMessageBody{Src: "https://a.com/1.pdf", Name: "1.pdf"}, wantErr: true},
+		{name: "正常表情贴纸", typ: 7, body: ChatMessageBody{StickerID: "cat_01"}},
+		{name: "空表情贴纸", typ: 7, wantErr: true},
+		{name: "正常链接卡片", typ: 8, body: ChatMessageBody{CardType: "link", URL: "https://www.baidu.com"}},
+		{name: "链接卡片地址无效", typ: 8, body: ChatMessageBody{CardType: "link", URL: "javascript:alert(1)"}, wantErr: true},
+		{name: "用户名片缺少ID", typ: 8, body: ChatMessageBody{CardType: "user"}, wantErr: true},
+		{name: "正常自定义消息", typ: 10, body: ChatMessageBody{CustomType: "order", Data: []byte(`{"id":1}`)}},
+		{name: "自定义消息数据不是JSON", typ: 10, body: ChatMessageBody{CustomType: "order", Data: []byte(`{id}`)}, wantErr: true},
+		{name: "客户端发送合并转发", typ: 11, body: ChatMessageBody{Items: []ChatMessageForwardItem{{SenderID: 1, Type: 1}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSendChatMessageBody(tt.typ, &tt.body); (err != nil) != tt.wantErr {
+				t.Errorf("validateSendChatMessageBody() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateSendChatMessageBodyFields(t *testing.T) {
+	body := ChatMessageBody{
+		Text:       "hi",
+		Event:      "member_joined",
+		OperatorID: 1,
+		UserIDs:    []int64{2},
+		Data:       []byte(`{"id":1}`),
+		Items:      []ChatMessageForwardItem{{SenderID: 3, Type: 1, Body: ChatMessageBody{Text: "伪造"}, CreatedAt: 1}},
+	}
+	if err := validateSendChatMessageBody(1, &body); err != nil {
+		t.Fatalf("validateSendChatMessageBody() error = %v", err)
+	}
+	if !reflect.DeepEqual(body, ChatMessageBody{Text: "hi"}) {
+		t.Errorf("validateSendChatMessageBody() body = %+v, want only text", body)
+	}
+
+	// 没有声明字段的类型也不能带上服务端生成的字段,自定义数据同样限制大小
+	if err := RegisterChatMessageType(ChatMessageTypeDefinition{Type: 1002, Name: "poll"}); err != nil {
+		t.Fatalf("RegisterChatMessageType() error = %v", err)
+	}
+	custom := ChatMessageBody{Text: "hi", Event: "member_joined", Items: []ChatMessageForwardItem{{SenderID: 3}}}
+	if err := validateSendChatMessageBody(1002, &custom); err != nil {
+		t.Fatalf("validateSendChatMessageBody() error = %v", err)
+	}
+	if custom.Event != "" || custom.Items != nil || custom.Text != "hi" {
+		t.Errorf("validateSendChatMessageBody() body = %+v, want without event and items", custom)
+	}
+
+	large := ChatMessageBody{Data: []byte(`"` + strings.Repeat("a", maxChatMessageCustomDataSize) + `"`)}
+	if err := validateSendChatMessageBody(1002, &large); err == nil {
+		t.Errorf("validateSendChatMessageBody() 超长的自定义数据应该返回错误")
+	}
+}
+
+func TestChatMediaHostAllowed(t *testing.T) {
+	hosts := []string{"cdn.example.com", ".static.example.org"}
+	tests := []struct {
+		name     string
+		hostname string
+		hosts    []string
+		want     bool
+	}{
+		{name: "未配置白名单", hostname: "any.com", hosts: nil, want: true},
+		{name: "完全匹配", hostname: "cdn.example.com", hosts: hosts, want: true},
+		{name: "子域名", hostname: "img.static.example.org", hosts: hosts, want: true},
+		{name: "大小写不敏感", hostname: "CDN.Example.com", hosts: hosts, want: true},
+		{name: "相似后缀", hostname: "evilcdn.example.com", hosts: hosts, want: false},
+		{name: "不在白名单", hostname: "example.com", hosts: hosts, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chatMediaHostAllowed(tt.hostname, tt.hosts); got != tt.want {
+				t.Errorf("chatMediaHostAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterChatMessageType(t *testing.T) {
+	if err := RegisterChatMessageType(ChatMessageTypeDefinition{Type: 1, Name: "text"}); err == nil {
+		t.Errorf("RegisterChatMessageType() 覆盖内置类型应该返回错误")
+	}
+
+	if err := RegisterChatMessageType(ChatMessageTypeDefinition{Type: 1001, Name: "vote"}); err != nil {
+		t.Fatalf("RegisterChatMessageType() error = %v", err)
+	}
+
+	if err := validateSendChatMessageBody(1001, &ChatMessageBody{}); err != nil {
+		t.Errorf("validateSendChatMessageBody() error = %v", err)
+	}
+}
+
+func TestChatMessageReactionsFromDatabase(t *testing.T) {
+	reactions := map[string][]int64{
+		"👍":  {1, 2, 3},
+		"😂":  {2},
+		"🎉":  {},
+		"❤️": {4},
+	}
+
+	got := chatMessageReactionsFromDatabase(reactions, 2)
+	want := []*ChatMessageReaction{
+		{Emoji: "👍", Count: 3, ReactedByMe: true},
+		{Emoji: "❤️", Count: 1, ReactedByMe: false},
+		{Emoji: "😂", Count: 1, ReactedByMe: true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("chatMessageReactionsFromDatabase() len = %d, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if *got[i] != *want[i] {
+			t.Errorf("chatMessageReactionsFromDatabase()[%d] = %+v, want %+v", i, *got[i], *want[i])
+		}
+	}
+}
+
+func TestValidReactionEmoji(t *testing.T) {
+	tests := []struct {
+		name  string
+		emoji string
+		want  bool
+	}{
+		{name: "单个表情", emoji: "👍", want: true},
+		{name: "带样式选择符的表情", emoji: "❤️", want: true},
+		{name: "带肤色的表情", emoji: "👍🏽", want: true},
+		{name: "组合表情", emoji: "👨‍👩‍👧", want: true},
+		{name: "国旗", emoji: "🇨🇳", want: true},
+		{name: "数字键帽", emoji: "1️⃣", want: true},
+		{name: "空字符串", emoji: "", want: false},
+		{name: "普通文字", emoji: "abc", want: false},
+		{name: "单独的数字", emoji: "1", want: false},
+		{name: "包含非法字符", emoji: "$set", want: false},
+		{name: "包含空字符", emoji: "👍\x00", want: false},
+		{name: "以肤色开头", emoji: "🏽👍", want: false},
+		{name: "以连接符结尾", emoji: "👨\u200D", want: false},
+		{name: "表情跟文字混合", emoji: "👍ok", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validReactionEmoji(tt.emoji); got != tt.want {
+				t.Errorf("validReactionEmoji(%q) = %v, want %v", tt.emoji, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatForwardable(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  database.ChatMessage
+		want bool
+	}{
+		{name: "正常消息", msg: database.ChatMessage{MessageID: 10, Type: 1, Status: 1}, want: true},
+		{name: "已撤回", msg: database.ChatMessage{MessageID: 10, Type: 1, Status: 3}, want: false},
+		{name: "已过期", msg: database.ChatMessage{MessageID: 10, Type: 1, Status: 4}, want: false},
+		{name: "阅后即焚", msg: database.ChatMessage{MessageID: 10, Type: 1, Status: 1, ExpireAt: 1}, want: false},
+		{name: "系统通知", msg: database.ChatMessage{MessageID: 10, Type: 9, Status: 1}, want: false},
+		{name: "已清空", msg: database.ChatMessage{MessageID: 5, Type: 1, Status: 1}, want: false},
+		{name: "已被自己删除", msg: database.ChatMessage{MessageID: 10, Type: 1, Status: 1, DeletedBy: []int64{2, 1}}, want: false},
+		{name: "被别人删除", msg: database.ChatMessage{MessageID: 10, Type: 1, Status: 1, DeletedBy: []int64{2}}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chatForwardable(&tt.msg, 1, 5); got != tt.want {
+				t.Errorf("chatForwardable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardSendChatMessageRequests(t *testing.T) {
+	messages := []*database.ChatMessage{
+		{MessageID: 1, SenderID: 2, Type: 1, Body: database.ChatMessageBody{Text: "a"}, CreatedAt: 100},
+		{MessageID: 2, SenderID: 3, Type: 1, Body: database.ChatMessageBody{Text: "b"}, CreatedAt: 200, ForwardFromID: 4},
+	}
+
+	reqs := forwardSendChatMessageRequests(&ForwardChatMessageRequest{}, messages)
+	if len(reqs) != 2 {
+		t.Fatalf("逐条转发 len = %d, want 2", len(reqs))
+	}
+	if reqs[0].forwardFromID != 2 || reqs[1].forwardFromID != 4 {
+		t.Errorf("逐条转发 forwardFromID = %d,%d, want 2,4", reqs[0].forwardFromID, reqs[1].forwardFromID)
+	}
+
+	reqs = forwardSendChatMessageRequests(&ForwardChatMessageRequest{Merge: true, Title: "聊天记录"}, messages)
+	if len(reqs) != 1 || reqs[0].Type != 11 || reqs[0].Body.Title != "聊天记录" {
+		t.Fatalf("合并转发 = %+v", reqs)
+	}
+	want := []ChatMessageForwardItem{
+		{SenderID: 2, Type: 1, Body: ChatMessageBody{Text: "a"}, CreatedAt: 100},
+		{SenderID: 3, Type: 1, Body: ChatMessageBody{Text: "b"}, CreatedAt: 200},
+	}
+	if !reflect.DeepEqual(reqs[0].Body.Items, want) {
+		t.Errorf("合并转发 items = %+v, want %+v", reqs[0].Body.Items, want)
+	}
+}
+
+func TestValidateForwardChatMessageRequest(t *testing.T) {
+	req := &ForwardChatMessageRequest{
+		MessageIDs: []int64{3, 1, 3},
+		Targets:    []ChatForwardTarget{{SessionType: 1, TargetID: 2}, {SessionType: 2, TargetID: 2}, {SessionType: 1, TargetID: 2}},
+		Title:      "  聊天记录 ",
+	}
+	if err := validateForwardChatMessageRequest(req); err != nil {
+		t.Fatalf("validateForwardChatMessageRequest() error = %v", err)
+	}
+	if !reflect.DeepEqual(req.MessageIDs, []int64{3, 1}) || len(req.Targets) != 2 || req.Title != "聊天记录" {
+		t.Errorf("validateForwardChatMessageRequest() = %+v", req)
+	}
+
+	invalid := []*ForwardChatMessageRequest{
+		{MessageIDs: []int64{1}, Targets: []ChatForwardTarget{{SessionType: 99, TargetID: 1}}},
+		{MessageIDs: []int64{0}, Targets: []ChatForwardTarget{{SessionType: 1, TargetID: 1}}},
+		{MessageIDs: []int64{1}},
+	}
+	for i, req := range invalid {
+		if err := validateForwardChatMessageRequest(req); err == nil {
+			t.Errorf("validateForwardChatMessageRequest() invalid[%d] 应该返回错误", i)
+		}
+	}
+}
+
+func TestDeleteChatMessageThreadValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *DeleteChatMessageRequest
+	}{
+		{
+			name: "话题ID为负数",
+			req:  &DeleteChatMessageRequest{TargetID: 1, SessionType: 1, MessageIDs: []int64{1}, ThreadID: -1},
+		},
+		{
+			name: "不能清空话题",
+			req:  &DeleteChatMessageRequest{TargetID: 1, SessionType: 1, Clear: true, ThreadID: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+			_, err := deleteChatMessageByRequest(ctx, tt.req)
+			if err == nil || err.Error() != MessageInvalidThreadID {
+				t.Errorf("deleteChatMessageByRequest() error = %v, want %v", err, MessageInvalidThreadID)
+			}
+		})
+	}
+}
+
+func TestChatOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		want     time.Duration
+	}{
+		{name: "第一次", attempts: 1, want: 2 * time.Second},
+		{name: "第二次", attempts: 2, want: 4 * time.Second},
+		{name: "第五次", attempts: 5, want: 32 * time.Second},
+		{name: "第八次", attempts: 8, want: 256 * time.Second},
+		{name: "达到上限", attempts: 9, want: 5 * time.Minute},
+		{name: "超过上限", attempts: 20, want: 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chatOutboxBackoff(tt.attempts); got != tt.want {
+				t.Errorf("chatOutboxBackoff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatRepairRange(t *testing.T) {
+	now := time.Date(2023, 10, 8, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		since   time.Time
+		wantEnd time.Time
+		wantOk  bool
+	}{
+		{name: "启动后第一次检查", since: now.Add(-time.Hour), wantEnd: now.Add(-time.Minute), wantOk: true},
+		{name: "上次检查之后有新的范围", since: now.Add(-2 * time.Minute), wantEnd: now.Add(-time.Minute), wantOk: true},
+		{name: "范围还在等待时间内", since: now.Add(-time.Minute), wantEnd: now.Add(-time.Minute), wantOk: false},
+		{name: "时钟回拨", since: now, wantEnd: now, wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, ok := chatRepairRange(tt.since, now)
+			if ok != tt.wantOk {
+				t.Fatalf("chatRepairRange() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !start.Equal(tt.since) || !end.Equal(tt.wantEnd) {
+				t.Errorf("chatRepairRange() = [%v, %v), want [%v, %v)", start, end, tt.since, tt.wantEnd)
+			}
+		})
+	}
+}
+
 func TestBenchmarkWebsocketApi(t *testing.T) {
 	//token, err := getToken()
 	//if err != nil {
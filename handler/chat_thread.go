@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/utils"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/26 15:40
+  @describe :
+*/
+
+// maxQuoteTextLength 回复快照中保留的最大文本长度
+const maxQuoteTextLength = 200
+
+// fillChatMessageReference 根据发送请求填充消息的话题跟回复信息
+// 发送到话题时,消息会改为写入话题房间,从而拥有独立的消息ID序列
+func fillChatMessageReference(ctx context.Context, req *SendChatMessageRequest, msg *database.ChatMessage) error {
+	if req.ThreadID > 0 {
+		root, err := getReferencedChatMessage(ctx, msg.RoomID, msg.SessionType, req.ThreadID)
+		if err != nil {
+			return err
+		}
+		if root == nil {
+			return NewResponseError(MessageInvalidThreadID)
+		}
+
+		msg.RoomID = utils.FormatThreadRoomID(msg.RoomID, root.MessageID)
+		msg.ThreadID = root.MessageID
+	}
+
+	if req.ReplyToMessageID > 0 {
+		replied, err := getReferencedChatMessage(ctx, msg.RoomID, msg.SessionType, req.ReplyToMessageID)
+		if err != nil {
+			return err
+		}
+		if replied == nil {
+			return NewResponseError(MessageInvalidReplyToMessageID)
+		}
+
+		msg.ReplyTo = &database.ChatMessageQuote{
+			RoomID:    replied.RoomID,
+			MessageID: replied.MessageID,
+			SenderID:  replied.SenderID,
+			Type:      replied.Type,
+			Body:      replied.Body,
+			CreatedAt: replied.CreatedAt,
+		}
+		msg.ReplyTo.Body.Text = utils.StringCut(replied.Body.Text, maxQuoteTextLength)
+		// 合并转发的消息快照可能很大,回复快照中不保留
+		msg.ReplyTo.Body.Items = nil
+	}
+	return nil
+}
+
+// getReferencedChatMessage 获取被引用的消息,消息不存在或者已撤回时返回nil
+func getReferencedChatMessage(ctx context.Context, roomID string, sessionType int, messageID int64) (*database.ChatMessage, error) {
+	messages, err := database.GetChatMessagesByIDs(roomID, sessionType, []int64{messageID})
+	if err != nil {
+		log.ErrorFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("room_id", roomID).Msg("获取被引用的消息失败")
+		return nil, errors.Wrap(err)
+	}
+
+	if len(messages) == 0 || messages[0].Status == database.ChatMessageStatusRollback || messages[0].Status == database.ChatMessageStatusExpired {
+		return nil, nil
+	}
+	return messages[0], nil
+}
@@ -2,6 +2,8 @@ package handler
 
 import (
 	"fmt"
+
+	"github.com/jerbe/jim/errors"
 )
 
 /**
@@ -39,6 +41,38 @@ var (
 
 	MessageInvalidLimit = "'limit'无效"
 
+	MessageInvalidDeviceID = "'device_id'无效"
+
+	MessageInvalidMessageID = "'message_id'无效"
+
+	MessageInvalidEvent = "'event'无效"
+
+	MessageInvalidReplyToMessageID = "'reply_to_message_id'无效"
+
+	MessageInvalidThreadID = "'thread_id'无效"
+
+	MessageInvalidMentions = "'mentions'无效"
+
+	MessageInvalidFile = "'file'无效"
+
+	MessageInvalidChecksum = "'checksum'无效"
+
+	MessageInvalidUploadID = "'upload_id'无效"
+
+	MessageInvalidChunkIndex = "'index'无效"
+
+	MessageInvalidKeyword = "'keyword'无效"
+
+	MessageInvalidOffset = "'offset'无效"
+
+	MessageInvalidSendAt = "'send_at'无效"
+
+	MessageInvalidTTL = "'ttl'无效"
+
+	MessageInvalidScheduleID = "'schedule_id'无效"
+
+	MessageSearchConditionRequired = "关键词,发送人跟消息类型至少需要填写一个"
+
 	MessageChatYourself = "不可与自己聊天"
 
 	MessageNotFriends = "您与对方不是好友关系"
@@ -78,9 +112,65 @@ var (
 	MessageForbidden = "没有权限"
 
 	MessageRollbackChatMessageFailure = "撤回聊天消息失败"
+
+	MessageEditChatMessageFailure = "编辑聊天消息失败"
+
+	MessageMentionAllForbidden = "只有群主跟管理员可以@所有人"
+
+	MessageTooFrequent = "操作太频繁,请稍后再试"
+
+	MessageMediaTooLarge = "文件大小超过限制"
+
+	MessageMediaTypeNotAllowed = "不支持的文件类型"
+
+	MessageMediaChecksumMismatch = "文件校验失败,请重新上传"
+
+	MessageMediaChunkSizeMismatch = "分片大小不正确"
+
+	MessageMediaUploadIncomplete = "文件分片未全部上传"
+
+	MessageMediaInvalidSignature = "下载地址无效或已过期"
+
+	MessageCancelChatScheduleFailure = "取消定时消息失败,消息不存在或正在发送"
+
+	MessageForwardChatMessageFailure = "部分消息不存在或不能转发"
+
+	MessageChatActionPending = "消息正在发送中,请稍后重试"
+
+	MessageChatActionConflict = "ActionID已经用于其他请求"
 )
 
 // MessageInvalidFormat 格式化参数无效错误
 func MessageInvalidFormat(val string) string {
 	return fmt.Sprintf("'%s'无效", val)
 }
+
+// ResponseError 可以直接返回给客户端的错误信息
+// 用于将业务逻辑从 *gin.Context 的响应中剥离出来,让HTTP跟websocket共用同一套校验逻辑
+type ResponseError struct {
+	// Status 状态码
+	Status int
+
+	// Message 返回给客户端的错误信息
+	Message string
+}
+
+// Error 实现error接口
+func (e *ResponseError) Error() string {
+	return e.Message
+}
+
+// NewResponseError 新建一个可以直接返回给客户端的错误
+func NewResponseError(message string) *ResponseError {
+	return &ResponseError{Status: StatusError, Message: message}
+}
+
+// responseErrorFrom 从错误中解析出需要返回给客户端的状态码跟错误信息
+// 如果不是 ResponseError 的错误,统一当作内部服务错误处理
+func responseErrorFrom(err error) (int, string) {
+	var rspErr *ResponseError
+	if errors.As(err, &rspErr) {
+		return rspErr.Status, rspErr.Message
+	}
+	return StatusError, MessageInternalServerError
+}
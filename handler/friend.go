@@ -3,7 +3,6 @@ package handler
 import (
 	"context"
 	"fmt"
-	"strconv"
 	"time"
 
 	"github.com/jerbe/jim/database"
@@ -635,8 +634,8 @@ func sayHelloFn(ctx *gin.Context, userID, targetID int64, now *time.Time) error
 		SessionType: database.ChatMessageSessionTypePrivate,
 		SenderID:    userID,
 		ReceiverID:  targetID,
-		SendStatus:  1,
-		ReadStatus:  0,
+		SendStatus:  database.ChatMessageSendStatusSent,
+		ReadStatus:  database.ChatMessageReadStatusUnread,
 		Status:      1,
 		CreatedAt:   now.UnixMilli(),
 		UpdatedAt:   now.UnixMilli(),
@@ -656,6 +655,9 @@ func sayHelloFn(ctx *gin.Context, userID, targetID int64, now *time.Time) error
 		return errors.Wrap(err)
 	}
 
+	markChatConversationRead(ctx, userID, msg)
+	incrChatUnreadCounts(ctx, msg, nil)
+
 	// 进行多服务器订阅推送
 	psData := fillSayHelloChatMessageForPublish(msg)
 
@@ -683,17 +685,8 @@ func fillSayHelloChatMessageForPublish(rsp *database.ChatMessage) *pubsub.ChatMe
 	msg.MessageID = rsp.MessageID
 	msg.CreatedAt = rsp.CreatedAt
 
-	msgBody := pubsub.NewChatMessageBody()
-	msgBody.Text = rsp.Body.Text
-	msgBody.Src = rsp.Body.Src
-	msgBody.Format = rsp.Body.Format
-	msgBody.Size = rsp.Body.Size
-	msgBody.Longitude = rsp.Body.Longitude
-	msgBody.Latitude = rsp.Body.Latitude
-	msgBody.Scale = rsp.Body.Scale
-	msgBody.LocationLabel = rsp.Body.LocationLabel
-
-	msg.Body = msgBody
+	body := chatMessageBodyFromDatabase(&rsp.Body)
+	msg.Body = fillChatMessageBodyForPublish(&body)
 	return msg
 }
 
@@ -750,14 +743,14 @@ func SubscribeFriendInviteHandler(ctx context.Context, payload *pubsub.Payload)
 
 	// 如果邀请记录是进行中,则直接发给目标
 	if fi.Status == database.UserRelationInviteStatusPending {
-		websocketManager.PushData(wsPayload, strconv.FormatInt(fi.TargetID, 10))
+		websocketManager.PushData(wsPayload, fi.TargetID)
 		return
 	}
 
 	// 如果邀请记录是拒绝,则直接发给用户
 	// 因为同意的时候是直接say hello了
 	if fi.Status == database.UserRelationInviteStatusReject {
-		websocketManager.PushData(wsPayload, strconv.FormatInt(fi.UserID, 10))
+		websocketManager.PushData(wsPayload, fi.UserID)
 		return
 	}
 }
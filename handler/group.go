@@ -171,6 +171,8 @@ func JoinGroupHandler(ctx *gin.Context) {
 		JSONError(ctx, StatusError, MessageInternalServerError)
 		return
 	}
+
+	notifyGroupMemberJoined(ctx, req.GroupID, currentUser.ID, []int64{currentUser.ID})
 	JSON(ctx)
 }
 
@@ -244,6 +246,15 @@ type UpdateGroupRequest struct {
 
 	// OwnerID 新群主
 	OwnerID *int64 `json:"owner_id,omitempty" example:"1"`
+
+	// Announcement 群公告, 必须为管理员以上级别; 每次修改都会保留历史版本, 空字符串表示清空公告
+	Announcement *string `json:"announcement,omitempty" maxLength:"2000" example:"本周六晚上八点聚餐"`
+
+	// PinMessageID 置顶一条群消息, 必须为管理员以上级别
+	PinMessageID *int64 `json:"pin_message_id,omitempty" example:"1"`
+
+	// UnpinMessageID 取消置顶一条群消息, 必须为管理员以上级别
+	UnpinMessageID *int64 `json:"unpin_message_id,omitempty" example:"1"`
 }
 
 // UpdateGroupHandler
@@ -271,7 +282,7 @@ func UpdateGroupHandler(ctx *gin.Context) {
 		return
 	}
 
-	if goutils.EqualAll(nil, req.Name, req.OwnerID, req.SpeakStatus) {
+	if goutils.EqualAll(nil, req.Name, req.OwnerID, req.SpeakStatus, req.Announcement, req.PinMessageID, req.UnpinMessageID) {
 		JSONError(ctx, StatusError, "更改的项未填写")
 		return
 	}
@@ -349,19 +360,83 @@ func UpdateGroupHandler(ctx *gin.Context) {
 		updateData.OwnerID = req.OwnerID
 	}
 
-	if updateData.OwnerID != nil {
-		err = database.UpdateGroupTx(req.GroupID, updateData)
-	} else {
-		err = database.UpdateGroup(req.GroupID, updateData)
+	// 群公告跟置顶消息都需要管理员以上级别
+	if !goutils.EqualAll(nil, req.Announcement, req.PinMessageID, req.UnpinMessageID) && member.Role == 0 {
+		JSONError(ctx, StatusError, "无权限修改群公告或置顶消息")
+		return
 	}
 
-	if err != nil {
-		if errors.Is(err, errors.NotChange) {
-			JSONError(ctx, StatusError, "未做任何改变")
+	if req.Announcement != nil && utils.StringLen(*req.Announcement) > database.GroupAnnouncementMaxLength {
+		JSONError(ctx, StatusError, fmt.Sprintf("群公告长度不能大于%d", database.GroupAnnouncementMaxLength))
+		return
+	}
+
+	if req.PinMessageID != nil && *req.PinMessageID <= 0 {
+		JSONError(ctx, StatusError, MessageInvalidFormat("pin_message_id"))
+		return
+	}
+
+	if req.UnpinMessageID != nil && *req.UnpinMessageID <= 0 {
+		JSONError(ctx, StatusError, MessageInvalidFormat("unpin_message_id"))
+		return
+	}
+
+	// 所有校验都在写入前完成,避免前面的修改已经保存后才因为后面的校验失败而返回错误
+	if !goutils.EqualAll(nil, req.PinMessageID, req.UnpinMessageID) {
+		if err = checkGroupPins(ctx, req.GroupID, req.PinMessageID, req.UnpinMessageID); err != nil {
+			JSONResponseError(ctx, err)
 			return
 		}
-		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", req.GroupID).Bool("has_owner", updateData.OwnerID != nil).Msg("更新群信息失败")
-		JSONError(ctx, StatusError, MessageInternalServerError)
+	}
+
+	// 置顶数量只在写入时才能最终确定,放在最前面写入
+	var changed bool
+	if req.UnpinMessageID != nil {
+		if err = unpinGroupMessage(ctx, req.GroupID, currentUser.ID, *req.UnpinMessageID); err != nil {
+			JSONResponseError(ctx, err)
+			return
+		}
+		changed = true
+	}
+
+	if req.PinMessageID != nil {
+		if err = pinGroupMessage(ctx, req.GroupID, currentUser.ID, *req.PinMessageID); err != nil {
+			JSONResponseError(ctx, err)
+			return
+		}
+		changed = true
+	}
+
+	if req.Announcement != nil {
+		published, err := publishGroupAnnouncement(ctx, req.GroupID, currentUser.ID, *req.Announcement)
+		if err != nil {
+			JSONResponseError(ctx, err)
+			return
+		}
+		changed = changed || published
+	}
+
+	if !goutils.EqualAll(nil, updateData.Name, updateData.OwnerID, updateData.SpeakStatus) {
+		if updateData.OwnerID != nil {
+			err = database.UpdateGroupTx(req.GroupID, updateData)
+		} else {
+			err = database.UpdateGroup(req.GroupID, updateData)
+		}
+
+		if err != nil && !errors.Is(err, errors.NotChange) {
+			log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", req.GroupID).Bool("has_owner", updateData.OwnerID != nil).Msg("更新群信息失败")
+			JSONError(ctx, StatusError, MessageInternalServerError)
+			return
+		}
+		changed = changed || err == nil
+
+		if updateData.Name != nil && *updateData.Name != group.Name {
+			notifyGroupRenamed(ctx, req.GroupID, currentUser.ID, *updateData.Name)
+		}
+	}
+
+	if !changed {
+		JSONError(ctx, StatusError, "未做任何改变")
 		return
 	}
 
@@ -512,6 +587,10 @@ func AddGroupMemberHandler(ctx *gin.Context) {
 		return
 	}
 
+	if cnt > 0 {
+		notifyGroupMemberJoined(ctx, req.GroupID, currentUser.ID, finalUserIDs)
+	}
+
 	rsp := &AddGroupMemberResponse{
 		Count: cnt,
 	}
@@ -0,0 +1,296 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/4 15:10
+  @describe :
+*/
+
+const (
+	// defaultGroupAnnouncementRevisionLimit 群公告历史版本默认返回的数量
+	defaultGroupAnnouncementRevisionLimit = 20
+
+	// maxGroupAnnouncementRevisionLimit 群公告历史版本最多返回的数量
+	maxGroupAnnouncementRevisionLimit = 100
+)
+
+// GetGroupInfoRequest 获取群信息请求参数
+// @Description 获取群信息请求参数
+type GetGroupInfoRequest struct {
+	// GroupID 群ID
+	GroupID int64 `form:"group_id" json:"group_id" binding:"required" example:"1098"`
+}
+
+// GroupPinInfo 群置顶消息
+// @Description 群置顶消息
+type GroupPinInfo struct {
+	// MessageID 被置顶的消息ID
+	MessageID int64 `json:"message_id" example:"1"`
+
+	// PinnerID 置顶人ID
+	PinnerID int64 `json:"pinner_id" example:"1"`
+
+	// PinnedAt 置顶时间,单位毫秒
+	PinnedAt int64 `json:"pinned_at" example:"1696000000000"`
+
+	// Message 被置顶的消息,消息被撤回后为空
+	Message *ChatMessage `json:"message,omitempty"`
+}
+
+// GroupAnnouncementInfo 群公告
+// @Description 群公告
+type GroupAnnouncementInfo struct {
+	// Content 公告内容
+	Content string `json:"content" example:"本周六晚上八点聚餐"`
+
+	// AuthorID 发布人ID
+	AuthorID int64 `json:"author_id" example:"1"`
+
+	// Revision 版本号,从1开始
+	Revision int `json:"revision" example:"3"`
+
+	// CreatedAt 发布时间,单位毫秒
+	CreatedAt int64 `json:"created_at" example:"1696000000000"`
+}
+
+// GetGroupInfoResponse 获取群信息返回参数
+// @Description 获取群信息返回参数
+type GetGroupInfoResponse struct {
+	// GroupID 群ID
+	GroupID int64 `json:"group_id" example:"1098"`
+
+	// Name 群名称
+	Name string `json:"name" example:"群聊1098"`
+
+	// OwnerID 群主ID
+	OwnerID int64 `json:"owner_id" example:"1"`
+
+	// MaxMember 群最大人数
+	MaxMember int `json:"max_member" example:"100"`
+
+	// MemberCount 群成员数量
+	MemberCount int64 `json:"member_count" example:"10"`
+
+	// SpeakStatus 发言状态; 0-禁言,1-可发言
+	SpeakStatus int `json:"speak_status" enums:"0,1" example:"1"`
+
+	// Announcement 当前群公告,没有公告或者公告被清空时为空
+	Announcement *GroupAnnouncementInfo `json:"announcement,omitempty"`
+
+	// Pins 置顶消息,最后置顶的排在最前面
+	Pins []*GroupPinInfo `json:"pins"`
+}
+
+// GetGroupInfoHandler
+// @Summary      获取群信息
+// @Description  获取群的基本信息,当前公告跟置顶消息,只有群成员可以获取
+// @Tags         群组
+// @Accept       json
+// @Produce      json
+// @Param        group_id    query      int  true  "群ID"
+// @Security 	 APIKeyHeader
+// @Success      200  {object}  Response{data=GetGroupInfoResponse}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/group/info [get]
+func GetGroupInfoHandler(ctx *gin.Context) {
+	req := new(GetGroupInfoRequest)
+	err := ctx.BindQuery(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	if req.GroupID <= 0 {
+		JSONError(ctx, StatusError, MessageInvalidGroupID)
+		return
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+
+	if !checkGroupMemberForInfo(ctx, req.GroupID, currentUser.ID) {
+		return
+	}
+
+	group, err := database.GetGroup(req.GroupID)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			JSONError(ctx, StatusError, "该群不存在")
+			return
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", req.GroupID).Msg("获取群信息失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+
+	if err = database.FillGroupExtras(group); err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", req.GroupID).Msg("获取群公告跟置顶消息失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+
+	memberCnt, err := database.GetGroupMemberCount(req.GroupID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", req.GroupID).Msg("获取群成员数量失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+
+	rsp := &GetGroupInfoResponse{
+		GroupID:     group.ID,
+		Name:        group.Name,
+		OwnerID:     group.OwnerID,
+		MaxMember:   group.MaxMember,
+		MemberCount: memberCnt,
+		SpeakStatus: group.SpeakStatus,
+		Pins:        make([]*GroupPinInfo, len(group.Pins)),
+	}
+
+	if group.Announcement != nil {
+		rsp.Announcement = groupAnnouncementInfoFromDatabase(group.Announcement)
+	}
+
+	messageIDs := make([]int64, len(group.Pins))
+	for i, pin := range group.Pins {
+		messageIDs[i] = pin.MessageID
+		rsp.Pins[i] = &GroupPinInfo{
+			MessageID: pin.MessageID,
+			PinnerID:  pin.PinnerID,
+			PinnedAt:  pin.CreatedAt.UnixMilli(),
+		}
+	}
+
+	if len(messageIDs) > 0 {
+		messages, err := database.GetChatMessagesByIDs(utils.FormatGroupRoomID(req.GroupID), database.ChatMessageSessionTypeGroup, messageIDs)
+		if err != nil && !errors.IsNoRecord(err) {
+			log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", req.GroupID).Ints64("message_ids", messageIDs).Msg("获取置顶消息失败")
+			JSONError(ctx, StatusError, MessageInternalServerError)
+			return
+		}
+
+		for _, msg := range messages {
+			if msg.Status == database.ChatMessageStatusRollback || msg.Status == database.ChatMessageStatusExpired {
+				continue
+			}
+			for _, pin := range rsp.Pins {
+				if pin.MessageID == msg.MessageID {
+					pin.Message = chatMessageFromDatabaseForUser(msg, currentUser.ID)
+				}
+			}
+		}
+	}
+
+	JSON(ctx, rsp)
+}
+
+// GetGroupAnnouncementRevisionsRequest 获取群公告历史版本请求参数
+// @Description 获取群公告历史版本请求参数
+type GetGroupAnnouncementRevisionsRequest struct {
+	// GroupID 群ID
+	GroupID int64 `form:"group_id" json:"group_id" binding:"required" example:"1098"`
+
+	// BeforeRevision 大于0时只返回该版本之前的版本,用于翻页
+	BeforeRevision int `form:"before_revision" json:"before_revision" example:"0"`
+
+	// Limit 返回数量,默认20,最大100
+	Limit int `form:"limit" json:"limit" example:"20"`
+}
+
+// GetGroupAnnouncementRevisionsHandler
+// @Summary      获取群公告历史版本
+// @Description  按版本号倒序返回群公告的所有版本,内容为空的版本表示当时清空了公告
+// @Tags         群组
+// @Accept       json
+// @Produce      json
+// @Param        group_id    query      int  true  "群ID"
+// @Param        before_revision    query      int  false  "大于0时只返回该版本之前的版本"
+// @Param        limit    query      int  false  "返回数量,默认20,最大100"
+// @Security 	 APIKeyHeader
+// @Success      200  {object}  Response{data=[]GroupAnnouncementInfo}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/group/announcement/revisions [get]
+func GetGroupAnnouncementRevisionsHandler(ctx *gin.Context) {
+	req := new(GetGroupAnnouncementRevisionsRequest)
+	err := ctx.BindQuery(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	if req.GroupID <= 0 {
+		JSONError(ctx, StatusError, MessageInvalidGroupID)
+		return
+	}
+
+	if req.BeforeRevision < 0 {
+		JSONError(ctx, StatusError, MessageInvalidFormat("before_revision"))
+		return
+	}
+
+	if req.Limit == 0 {
+		req.Limit = defaultGroupAnnouncementRevisionLimit
+	}
+	if req.Limit < 0 || req.Limit > maxGroupAnnouncementRevisionLimit {
+		JSONError(ctx, StatusError, MessageInvalidLimit)
+		return
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+
+	if !checkGroupMemberForInfo(ctx, req.GroupID, currentUser.ID) {
+		return
+	}
+
+	revisions, err := database.GetGroupAnnouncementRevisions(req.GroupID, req.BeforeRevision, req.Limit)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", req.GroupID).Msg("获取群公告历史版本失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+
+	rsp := make([]*GroupAnnouncementInfo, len(revisions))
+	for i, revision := range revisions {
+		rsp[i] = groupAnnouncementInfoFromDatabase(revision)
+	}
+	JSON(ctx, rsp)
+}
+
+// checkGroupMemberForInfo 检查当前用户是否是群成员,不是时直接写入错误响应并返回false
+func checkGroupMemberForInfo(ctx *gin.Context, groupID, userID int64) bool {
+	_, err := database.GetGroupMember(groupID, userID)
+	if err == nil {
+		return true
+	}
+
+	if errors.IsNoRecord(err) {
+		JSONError(ctx, StatusError, "您不是该群成员")
+		return false
+	}
+	log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", groupID).Int64("member_id", userID).Msg("获取群成员信息失败")
+	JSONError(ctx, StatusError, MessageInternalServerError)
+	return false
+}
+
+// groupAnnouncementInfoFromDatabase 将数据库中的群公告转换成返回数据
+func groupAnnouncementInfoFromDatabase(announcement *database.GroupAnnouncement) *GroupAnnouncementInfo {
+	return &GroupAnnouncementInfo{
+		Content:   announcement.Content,
+		AuthorID:  announcement.AuthorID,
+		Revision:  announcement.Revision,
+		CreatedAt: announcement.CreatedAt.UnixMilli(),
+	}
+}
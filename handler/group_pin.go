@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/pubsub"
+	"github.com/jerbe/jim/utils"
+	"github.com/jerbe/jim/websocket"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/4 14:05
+  @describe :
+*/
+
+// publishGroupAnnouncement 发布新版本的群公告,内容跟当前公告相同时不做改变
+// 调用前需要先校验公告长度
+func publishGroupAnnouncement(ctx *gin.Context, groupID, authorID int64, content string) (bool, error) {
+	current, err := database.GetGroupAnnouncement(groupID)
+	if err != nil && !errors.IsNoRecord(err) {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", groupID).Msg("获取群公告失败")
+		return false, errors.Wrap(err)
+	}
+
+	if (current == nil && content == "") || (current != nil && current.Content == content) {
+		return false, nil
+	}
+
+	err = database.AddGroupAnnouncement(&database.GroupAnnouncement{
+		GroupID:  groupID,
+		Content:  content,
+		AuthorID: authorID,
+	})
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", groupID).Msg("发布群公告失败")
+		return false, errors.Wrap(err)
+	}
+
+	notifyGroupAnnouncementUpdated(ctx, groupID, authorID, content)
+	return true, nil
+}
+
+// checkGroupPins 在写入前校验置顶跟取消置顶是否可以执行,同一个请求中先取消置顶再置顶
+func checkGroupPins(ctx *gin.Context, groupID int64, pinMessageID, unpinMessageID *int64) error {
+	pins, err := database.GetGroupPins(groupID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", groupID).Msg("获取群置顶消息失败")
+		return errors.Wrap(err)
+	}
+
+	pinned := make(map[int64]bool, len(pins))
+	for _, pin := range pins {
+		pinned[pin.MessageID] = true
+	}
+
+	if unpinMessageID != nil {
+		if !pinned[*unpinMessageID] {
+			return NewResponseError("该消息未置顶")
+		}
+		delete(pinned, *unpinMessageID)
+	}
+
+	if pinMessageID == nil {
+		return nil
+	}
+
+	if pinned[*pinMessageID] {
+		return NewResponseError("该消息已经置顶")
+	}
+	if len(pinned) >= database.GroupMaxPins {
+		return NewResponseError(fmt.Sprintf("置顶消息数量不能超过%d", database.GroupMaxPins))
+	}
+
+	messages, err := database.GetChatMessagesByIDs(utils.FormatGroupRoomID(groupID), database.ChatMessageSessionTypeGroup, []int64{*pinMessageID})
+	if err != nil && !errors.IsNoRecord(err) {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", groupID).Int64("message_id", *pinMessageID).Msg("获取群消息失败")
+		return errors.Wrap(err)
+	}
+	if len(messages) == 0 || messages[0].Status == database.ChatMessageStatusRollback || messages[0].Status == database.ChatMessageStatusExpired {
+		return NewResponseError(MessageNotFound)
+	}
+	return nil
+}
+
+// pinGroupMessage 置顶一条群消息,调用前需要先通过 checkGroupPins 校验
+func pinGroupMessage(ctx *gin.Context, groupID, operatorID, messageID int64) error {
+	err := database.AddGroupPin(&database.GroupPin{
+		GroupID:   groupID,
+		MessageID: messageID,
+		PinnerID:  operatorID,
+	})
+	if err != nil {
+		if errors.Is(err, errors.NotChange) {
+			return NewResponseError("该消息已经置顶")
+		}
+		if errors.Is(err, database.ErrGroupPinLimit) {
+			return NewResponseError(fmt.Sprintf("置顶消息数量不能超过%d", database.GroupMaxPins))
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", groupID).Int64("message_id", messageID).Msg("置顶群消息失败")
+		return errors.Wrap(err)
+	}
+
+	publishGroupPin(ctx, groupID, operatorID, messageID, pubsub.GroupPinActionPin)
+	return nil
+}
+
+// unpinGroupMessage 取消置顶一条群消息
+func unpinGroupMessage(ctx *gin.Context, groupID, operatorID, messageID int64) error {
+	err := database.RemoveGroupPin(groupID, messageID)
+	if err != nil {
+		if errors.Is(err, errors.NotChange) {
+			return NewResponseError("该消息未置顶")
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", groupID).Int64("message_id", messageID).Msg("取消置顶群消息失败")
+		return errors.Wrap(err)
+	}
+
+	publishGroupPin(ctx, groupID, operatorID, messageID, pubsub.GroupPinActionUnpin)
+	return nil
+}
+
+// publishGroupPin 推送置顶消息变更给所有群成员
+func publishGroupPin(ctx *gin.Context, groupID, operatorID, messageID int64, action string) {
+	memberIDs, err := database.GetGroupMemberIDs(groupID)
+	if err != nil {
+		log.WarnFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", groupID).Msg("获取群成员列表失败")
+		return
+	}
+
+	err = pubsub.PublishGroupPin(ctx, &pubsub.GroupPin{
+		GroupID:        groupID,
+		OperatorID:     operatorID,
+		MessageID:      messageID,
+		Action:         action,
+		CreatedAt:      time.Now().UnixMilli(),
+		PublishTargets: memberIDs,
+	})
+	if err != nil {
+		log.WarnFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", groupID).Str("action", action).Msg("推送群置顶消息变更失败")
+	}
+}
+
+// SubscribeGroupPinHandler 订阅群置顶消息变更
+func SubscribeGroupPinHandler(ctx context.Context, payload *pubsub.Payload) {
+	pin := new(pubsub.GroupPin)
+	err := payload.UnmarshalData(pin)
+	if err != nil {
+		log.Error().Err(err).Str("payload.channel", payload.Channel).Str("payload.type", payload.Type).Send()
+		return
+	}
+
+	targets, ok := chatPushTargets(database.ChatMessageSessionTypeGroup, 0, 0, pin.PublishTargets)
+	if !ok {
+		return
+	}
+
+	pin.PublishTargets = nil
+	websocketManager.PushData(websocket.Payload{Type: payload.Type, Data: pin}, targets...)
+}
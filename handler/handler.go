@@ -51,6 +51,13 @@ func JSONError(ctx *gin.Context, errorCode int, errorMsg string, obj ...any) {
 	ctx.JSON(http.StatusOK, Response{RequestID: getAndStoreRequestID(ctx), Status: errorCode, Error: errorMsg, Data: data})
 }
 
+// JSONResponseError 解析错误信息并返回JSON格式的错误数据
+// 非 ResponseError 类型的错误统一返回内部服务错误,避免暴露内部细节
+func JSONResponseError(ctx *gin.Context, err error, obj ...any) {
+	status, message := responseErrorFrom(err)
+	JSONError(ctx, status, message, obj...)
+}
+
 // JSONP 返回JSONP格式的数据
 func JSONP(ctx *gin.Context, obj ...any) {
 	var data any
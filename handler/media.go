@@ -0,0 +1,915 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jerbe/jim/config"
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/storage"
+	"github.com/jerbe/jim/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/30 11:00
+  @describe :
+*/
+
+const (
+	// defaultMediaMaxSize 未配置时单个文件的最大字节数
+	defaultMediaMaxSize = 100 << 20
+
+	// defaultMediaChunkSize 未配置时每个分片的字节数
+	defaultMediaChunkSize = 5 << 20
+
+	// defaultMediaUploadExpire 未配置时分片上传会话的有效期
+	defaultMediaUploadExpire = 24 * time.Hour
+
+	// defaultMediaURLExpire 未配置时下载地址的有效期
+	defaultMediaURLExpire = time.Hour
+
+	// mediaSniffSize 嗅探文件类型需要的字节数
+	mediaSniffSize = 512
+
+	// maxMediaNameLength 文件名的最大长度
+	maxMediaNameLength = 255
+)
+
+// mediaChecksumRegexp sha256的十六进制格式
+var mediaChecksumRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// defaultMediaAllowedTypes 未配置时允许上传的文件类型
+var defaultMediaAllowedTypes = []string{"image/", "audio/", "video/", "application/pdf", "application/zip", "text/plain"}
+
+// Media 媒体文件
+// @Description 媒体文件
+type Media struct {
+	// ID 媒体文件ID
+	ID string `json:"id" example:"6517a2c9e1b4a0d1c2f3e4a5"`
+
+	// Name 文件名
+	Name string `json:"name" example:"报告.pdf"`
+
+	// ContentType 嗅探出的文件类型
+	ContentType string `json:"content_type" example:"application/pdf"`
+
+	// Size 文件字节数
+	Size int64 `json:"size" example:"1024"`
+
+	// Checksum 文件内容的sha256
+	Checksum string `json:"checksum" example:"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"`
+
+	// URL 带签名的下载地址,可以直接作为消息主体的 src 使用
+	URL string `json:"url" example:"https://im.example.com/api/v1/media/file/6517a2c9e1b4a0d1c2f3e4a5?expires=1696000000&signature=abc"`
+
+	// ExpiresAt 下载地址的过期时间,单位秒
+	ExpiresAt int64 `json:"expires_at" example:"1696000000"`
+
+	// Width 宽度,单位像素,图片跟视频在后台提取完成后才有值
+	Width int `json:"width,omitempty" example:"1920"`
+
+	// Height 高度,单位像素
+	Height int `json:"height,omitempty" example:"1080"`
+
+	// Blurhash 模糊占位图的blurhash
+	Blurhash string `json:"blurhash,omitempty" example:"LEHV6nWB2yk8pyo0adR*.7kCMdnj"`
+
+	// Thumbnails 图片的缩略图,按尺寸从小到大排列
+	Thumbnails []ChatMessageThumbnail `json:"thumbnails,omitempty"`
+
+	// Poster 视频封面地址
+	Poster string `json:"poster,omitempty" example:"https://im.example.com/api/v1/media/file/6517a2c9e1b4a0d1c2f3e4a5/poster?expires=1696000000&signature=abc"`
+
+	// Duration 视频时长,单位毫秒
+	Duration int64 `json:"duration,omitempty" example:"12500"`
+}
+
+// UploadMediaHandler
+// @Summary      上传媒体文件
+// @Description  一次性上传小文件,大文件请使用分片上传。相同内容的文件只保存一份
+// @Tags         媒体
+// @Accept       multipart/form-data
+// @Produce      json
+// @Param        file    formData      file  true  "文件"
+// @Security 	 APIKeyHeader
+// @Success      200  {object}  Response{data=Media}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/media/upload [post]
+func UploadMediaHandler(ctx *gin.Context) {
+	maxSize := mediaMaxSize()
+	// 多留一些空间给multipart的边界跟其他字段
+	ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxSize+1<<20)
+
+	fh, err := ctx.FormFile("file")
+	if err != nil {
+		JSONError(ctx, StatusError, MessageInvalidFile)
+		return
+	}
+
+	if fh.Size > maxSize {
+		JSONError(ctx, StatusError, MessageMediaTooLarge)
+		return
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("打开上传文件失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	currentUser := LoginUserFromContext(ctx)
+	rsp, err := saveMedia(ctx, currentUser.ID, f, fh.Filename, fh.Size, "")
+	if err != nil {
+		JSONResponseError(ctx, err)
+		return
+	}
+	JSON(ctx, rsp)
+}
+
+// InitMediaUploadRequest 初始化分片上传请求参数
+// @Description 初始化分片上传请求参数
+type InitMediaUploadRequest struct {
+	// Name 文件名
+	Name string `json:"name" binding:"required" example:"报告.pdf"`
+
+	// Size 文件字节数
+	Size int64 `json:"size" binding:"required" example:"10485760"`
+
+	// Checksum 文件内容的sha256,小写十六进制
+	Checksum string `json:"checksum" binding:"required" example:"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"`
+}
+
+// MediaUploadStatus 分片上传状态
+// @Description 分片上传状态
+type MediaUploadStatus struct {
+	// UploadID 上传ID,相同用户上传相同文件时不变,可以用来断点续传
+	UploadID string `json:"upload_id,omitempty" example:"0f1e2d3c4b5a69788796a5b4c3d2e1f0"`
+
+	// ChunkSize 每个分片的字节数,最后一个分片可以小于该值
+	ChunkSize int64 `json:"chunk_size,omitempty" example:"5242880"`
+
+	// TotalChunks 分片数量
+	TotalChunks int `json:"total_chunks,omitempty" example:"2"`
+
+	// UploadedChunks 已经上传的分片序号,从0开始
+	UploadedChunks []int `json:"uploaded_chunks" example:"0"`
+
+	// Media 当前用户已经上传过相同的文件时直接返回,无需再上传
+	Media *Media `json:"media,omitempty"`
+}
+
+// InitMediaUploadHandler
+// @Summary      初始化分片上传
+// @Description  当前用户已经上传过相同内容的文件时直接返回文件,否则返回上传ID跟已经上传的分片,用于断点续传
+// @Tags         媒体
+// @Accept       json
+// @Produce      json
+// @Param        jsonRaw    body      InitMediaUploadRequest  true  "请求JSON数据体"
+// @Security 	 APIKeyHeader
+// @Success      200  {object}  Response{data=MediaUploadStatus}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/media/upload/init [post]
+func InitMediaUploadHandler(ctx *gin.Context) {
+	req := new(InitMediaUploadRequest)
+	err := ctx.BindJSON(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	req.Checksum = strings.ToLower(req.Checksum)
+	if !mediaChecksumRegexp.MatchString(req.Checksum) {
+		JSONError(ctx, StatusError, MessageInvalidChecksum)
+		return
+	}
+
+	if req.Size <= 0 {
+		JSONError(ctx, StatusError, MessageInvalidFormat("size"))
+		return
+	}
+
+	if req.Size > mediaMaxSize() {
+		JSONError(ctx, StatusError, MessageMediaTooLarge)
+		return
+	}
+
+	// 秒传,只返回当前用户自己上传过的文件;其他用户上传过的文件需要完整上传证明持有文件内容
+	currentUser := LoginUserFromContext(ctx)
+	media, err := database.GetUserMediaByChecksum(currentUser.ID, req.Checksum)
+	if err == nil && media.Size == req.Size {
+		JSON(ctx, &MediaUploadStatus{UploadedChunks: []int{}, Media: mediaFromDatabase(media)})
+		return
+	}
+	if err != nil && !errors.IsNoRecord(err) {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("checksum", req.Checksum).Msg("获取媒体文件失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+
+	chunkSize := mediaChunkSize()
+	upload, err := database.SetMediaUpload(&database.MediaUpload{
+		UploadID:    mediaUploadID(currentUser.ID, req.Checksum, req.Size),
+		UserID:      currentUser.ID,
+		Name:        utils.StringCut(req.Name, maxMediaNameLength),
+		Size:        req.Size,
+		Checksum:    req.Checksum,
+		ChunkSize:   chunkSize,
+		TotalChunks: int((req.Size + chunkSize - 1) / chunkSize),
+		CreatedAt:   time.Now().UnixMilli(),
+	}, mediaUploadExpire())
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("保存分片上传会话失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+
+	rsp, err := mediaUploadStatus(upload)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("upload_id", upload.UploadID).Msg("获取已上传分片失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+	JSON(ctx, rsp)
+}
+
+// UploadMediaChunkHandler
+// @Summary      上传分片
+// @Description  请求体为分片的原始数据,除最后一个分片外,大小必须等于 chunk_size
+// @Tags         媒体
+// @Accept       application/octet-stream
+// @Produce      json
+// @Param        upload_id    query      string  true  "上传ID"
+// @Param        index    query      int  true  "分片序号,从0开始"
+// @Security 	 APIKeyHeader
+// @Success      200  {object}  Response{data=MediaUploadStatus}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/media/upload/chunk [put]
+func UploadMediaChunkHandler(ctx *gin.Context) {
+	upload, ok := mediaUploadFromRequest(ctx, ctx.Query("upload_id"))
+	if !ok {
+		return
+	}
+
+	index, err := strconv.Atoi(ctx.Query("index"))
+	if err != nil || index < 0 || index >= upload.TotalChunks {
+		JSONError(ctx, StatusError, MessageInvalidChunkIndex)
+		return
+	}
+
+	size := upload.ChunkSize
+	if index == upload.TotalChunks-1 {
+		size = upload.Size - upload.ChunkSize*int64(index)
+	}
+
+	if ctx.Request.ContentLength != size {
+		JSONError(ctx, StatusError, MessageMediaChunkSizeMismatch)
+		return
+	}
+
+	body := http.MaxBytesReader(ctx.Writer, ctx.Request.Body, size)
+	err = storage.GlobStorage.Put(ctx, mediaChunkKey(upload.UploadID, index), body, size, "")
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("upload_id", upload.UploadID).Int("index", index).Msg("保存分片失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+
+	if err = database.AddMediaUploadChunk(upload.UploadID, index, mediaUploadExpire()); err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("upload_id", upload.UploadID).Int("index", index).Msg("记录已上传分片失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+
+	rsp, err := mediaUploadStatus(upload)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("upload_id", upload.UploadID).Msg("获取已上传分片失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+	JSON(ctx, rsp)
+}
+
+// GetMediaUploadStatusHandler
+// @Summary      获取分片上传状态
+// @Tags         媒体
+// @Accept       json
+// @Produce      json
+// @Param        upload_id    query      string  true  "上传ID"
+// @Security 	 APIKeyHeader
+// @Success      200  {object}  Response{data=MediaUploadStatus}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/media/upload/status [get]
+func GetMediaUploadStatusHandler(ctx *gin.Context) {
+	upload, ok := mediaUploadFromRequest(ctx, ctx.Query("upload_id"))
+	if !ok {
+		return
+	}
+
+	rsp, err := mediaUploadStatus(upload)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("upload_id", upload.UploadID).Msg("获取已上传分片失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+	JSON(ctx, rsp)
+}
+
+// CompleteMediaUploadRequest 完成分片上传请求参数
+// @Description 完成分片上传请求参数
+type CompleteMediaUploadRequest struct {
+	// UploadID 上传ID
+	UploadID string `json:"upload_id" binding:"required" example:"0f1e2d3c4b5a69788796a5b4c3d2e1f0"`
+}
+
+// CompleteMediaUploadHandler
+// @Summary      完成分片上传
+// @Description  合并所有分片并校验sha256,校验失败时需要重新上传
+// @Tags         媒体
+// @Accept       json
+// @Produce      json
+// @Param        jsonRaw    body      CompleteMediaUploadRequest  true  "请求JSON数据体"
+// @Security 	 APIKeyHeader
+// @Success      200  {object}  Response{data=Media}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/media/upload/complete [post]
+func CompleteMediaUploadHandler(ctx *gin.Context) {
+	req := new(CompleteMediaUploadRequest)
+	err := ctx.BindJSON(req)
+	if err != nil {
+		JSONError(ctx, StatusError, err.Error())
+		return
+	}
+
+	upload, ok := mediaUploadFromRequest(ctx, req.UploadID)
+	if !ok {
+		return
+	}
+
+	chunks, err := database.GetMediaUploadChunks(upload.UploadID)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("upload_id", upload.UploadID).Msg("获取已上传分片失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+
+	if len(chunks) != upload.TotalChunks {
+		JSONError(ctx, StatusError, MessageMediaUploadIncomplete)
+		return
+	}
+
+	r := &mediaChunkReader{ctx: ctx, upload: upload}
+	defer r.Close()
+
+	rsp, err := saveMedia(ctx, upload.UserID, r, upload.Name, upload.Size, upload.Checksum)
+	if err != nil {
+		// 内容校验失败时分片需要全部重新上传
+		var rspErr *ResponseError
+		if errors.As(err, &rspErr) {
+			removeMediaUpload(ctx, upload)
+		}
+		JSONResponseError(ctx, err)
+		return
+	}
+
+	removeMediaUpload(ctx, upload)
+	JSON(ctx, rsp)
+}
+
+// GetMediaURLHandler
+// @Summary      获取媒体文件下载地址
+// @Description  下载地址过期后通过该接口重新获取,只有上传人跟发送过该文件的会话中的成员可以获取
+// @Tags         媒体
+// @Accept       json
+// @Produce      json
+// @Param        id    query      string  true  "媒体文件ID"
+// @Security 	 APIKeyHeader
+// @Success      200  {object}  Response{data=Media}
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Failure      500  {object}  Response
+// @Router       /v1/media/url [get]
+func GetMediaURLHandler(ctx *gin.Context) {
+	media, err := database.GetMedia(ctx.Query("id"))
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			JSONError(ctx, StatusError, MessageNotFound)
+			return
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取媒体文件失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+	ok, err := mediaAccessible(ctx, currentUser.ID, media)
+	if err != nil {
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+
+	// 没有权限时跟不存在一样处理,不暴露文件是否存在
+	if !ok {
+		JSONError(ctx, StatusError, MessageNotFound)
+		return
+	}
+	JSON(ctx, mediaFromDatabase(media))
+}
+
+// MediaFileHandler
+// @Summary      下载媒体文件
+// @Description  通过带签名的地址下载,不需要登录。S3存储会跳转到存储服务的签名地址
+// @Tags         媒体
+// @Produce      octet-stream
+// @Param        id    path      string  true  "媒体文件ID"
+// @Param        expires    query      int  true  "过期时间"
+// @Param        signature    query      string  true  "签名"
+// @Success      200
+// @Success      302
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Router       /v1/media/file/{id} [get]
+func MediaFileHandler(ctx *gin.Context) {
+	mediaFileByVariant(ctx, "")
+}
+
+// MediaVariantFileHandler
+// @Summary      下载缩略图或者视频封面
+// @Description  通过带签名的地址下载,不需要登录。variant 为 thumb_{最长边像素} 或者 poster
+// @Tags         媒体
+// @Produce      jpeg
+// @Param        id    path      string  true  "媒体文件ID"
+// @Param        variant    path      string  true  "缩略图或者封面的标识"
+// @Param        expires    query      int  true  "过期时间"
+// @Param        signature    query      string  true  "签名"
+// @Success      200
+// @Success      302
+// @Failure      400  {object}  Response
+// @Failure      404  {object}  Response
+// @Router       /v1/media/file/{id}/{variant} [get]
+func MediaVariantFileHandler(ctx *gin.Context) {
+	mediaFileByVariant(ctx, ctx.Param("variant"))
+}
+
+// mediaFileByVariant 下载原文件,或者缩略图跟封面
+func mediaFileByVariant(ctx *gin.Context, variant string) {
+	id := ctx.Param("id")
+	expiresAt, err := strconv.ParseInt(ctx.Query("expires"), 10, 64)
+	if err != nil || !verifyMediaSignature(mediaResource(id, variant), expiresAt, ctx.Query("signature"), time.Now()) {
+		JSONError(ctx, StatusError, MessageMediaInvalidSignature)
+		return
+	}
+
+	media, err := database.GetMedia(id)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			JSONError(ctx, StatusError, MessageNotFound)
+			return
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("media_id", id).Msg("获取媒体文件失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+
+	key, contentType := media.Key, media.ContentType
+	if variant != "" {
+		var ok bool
+		if key, ok = mediaVariantKey(media, variant); !ok {
+			JSONError(ctx, StatusError, MessageNotFound)
+			return
+		}
+		contentType = "image/jpeg"
+	}
+
+	expires := time.Until(time.Unix(expiresAt, 0))
+	if presigner, ok := storage.GlobStorage.(storage.Presigner); ok {
+		u, err := presigner.PresignGet(ctx, key, expires)
+		if err != nil {
+			log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("media_id", id).Msg("生成存储下载地址失败")
+			JSONError(ctx, StatusError, MessageInternalServerError)
+			return
+		}
+		ctx.Redirect(http.StatusFound, u)
+		return
+	}
+
+	r, info, err := storage.GlobStorage.Get(ctx, key)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			JSONError(ctx, StatusError, MessageNotFound)
+			return
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("media_id", id).Msg("读取媒体文件失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return
+	}
+	defer r.Close()
+
+	headers := map[string]string{
+		"Cache-Control":          fmt.Sprintf("private, max-age=%d", int64(expires/time.Second)),
+		"X-Content-Type-Options": "nosniff",
+	}
+	// 下载地址不需要登录,除了图片、音频跟视频都作为附件下载,避免HTML之类的文件在本服务的域名下被浏览器执行
+	if !mediaInline(contentType) {
+		headers["Content-Disposition"] = mime.FormatMediaType("attachment", map[string]string{"filename": media.Name})
+	}
+	ctx.DataFromReader(http.StatusOK, info.Size, contentType, r, headers)
+}
+
+// mediaInline 判断文件类型是否可以在浏览器中直接打开
+// SVG 可以包含脚本,跟其他图片不同,只能作为附件下载
+func mediaInline(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	if strings.HasPrefix(contentType, "image/svg") {
+		return false
+	}
+	return strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "audio/") || strings.HasPrefix(contentType, "video/")
+}
+
+// saveMedia 保存媒体文件
+// 先写入临时文件,同时计算sha256跟嗅探文件类型。当前用户上传过相同内容的文件时直接返回,
+// 其他用户上传过时不再保存到存储中,只为当前用户添加记录
+// expectedChecksum 不为空时校验文件内容
+func saveMedia(ctx *gin.Context, userID int64, r io.Reader, name string, size int64, expectedChecksum string) (*Media, error) {
+	tmp, err := os.CreateTemp("", "jim-media-*")
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("创建临时文件失败")
+		return nil, errors.Wrap(err)
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	maxSize := mediaMaxSize()
+	h := sha256.New()
+	sniffer := new(mediaSniffer)
+	n, err := io.Copy(io.MultiWriter(tmp, h, sniffer), io.LimitReader(r, maxSize+1))
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("读取上传文件失败")
+		return nil, errors.Wrap(err)
+	}
+
+	if n > maxSize {
+		return nil, NewResponseError(MessageMediaTooLarge)
+	}
+
+	if n != size || n == 0 {
+		return nil, NewResponseError(MessageMediaChecksumMismatch)
+	}
+
+	checksum := hex.EncodeToString(h.Sum(nil))
+	if expectedChecksum != "" && checksum != expectedChecksum {
+		return nil, NewResponseError(MessageMediaChecksumMismatch)
+	}
+
+	media, err := database.GetUserMediaByChecksum(userID, checksum)
+	if err == nil {
+		return mediaFromDatabase(media), nil
+	}
+	if !errors.IsNoRecord(err) {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("checksum", checksum).Msg("获取媒体文件失败")
+		return nil, errors.Wrap(err)
+	}
+
+	contentType := http.DetectContentType(sniffer.buf)
+	if !mediaTypeAllowed(contentType, config.GlobConfig().Media.AllowedTypes) {
+		return nil, NewResponseError(MessageMediaTypeNotAllowed)
+	}
+
+	key := mediaKey(checksum)
+	media = &database.Media{
+		Checksum:    checksum,
+		Key:         key,
+		Name:        utils.StringCut(name, maxMediaNameLength),
+		ContentType: contentType,
+		Size:        n,
+		UploaderID:  userID,
+	}
+
+	// 相同内容的文件只保存一份,已经提取的元数据也一起复用
+	existing, err := database.GetMediaByChecksum(checksum)
+	if err == nil {
+		media.Metadata = existing.Metadata
+	} else if errors.IsNoRecord(err) {
+		if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+			return nil, errors.Wrap(err)
+		}
+
+		if err = storage.GlobStorage.Put(ctx, key, tmp, n, contentType); err != nil {
+			log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("key", key).Msg("保存媒体文件失败")
+			return nil, errors.Wrap(err)
+		}
+	} else {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("checksum", checksum).Msg("获取媒体文件失败")
+		return nil, errors.Wrap(err)
+	}
+
+	media, err = database.AddMedia(media)
+	if err != nil {
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("key", key).Msg("添加媒体文件记录失败")
+		return nil, errors.Wrap(err)
+	}
+
+	// 图片跟视频在后台提取元数据,不影响上传的响应时间
+	if media.Metadata == nil && mediaNeedMetadata(media.ContentType) {
+		enqueueMediaMetadataJob(ctx, &database.MediaMetadataJob{MediaID: media.ID.Hex()})
+	}
+	return mediaFromDatabase(media), nil
+}
+
+// mediaFromDatabase 将数据库的媒体文件转换成返回给客户端的媒体文件,并生成下载地址
+func mediaFromDatabase(media *database.Media) *Media {
+	id := media.ID.Hex()
+	expiresAt := time.Now().Add(mediaURLExpire()).Unix()
+	rsp := &Media{
+		ID:          id,
+		Name:        media.Name,
+		ContentType: media.ContentType,
+		Size:        media.Size,
+		Checksum:    media.Checksum,
+		URL:         mediaURL(id, expiresAt),
+		ExpiresAt:   expiresAt,
+	}
+
+	body := new(ChatMessageBody)
+	fillChatMessageMediaMetadata(body, media)
+	signChatMessageMediaVariants(body, id, expiresAt)
+	rsp.Width = body.Width
+	rsp.Height = body.Height
+	rsp.Blurhash = body.Blurhash
+	rsp.Thumbnails = body.Thumbnails
+	rsp.Poster = body.Poster
+	rsp.Duration = body.Duration
+	return rsp
+}
+
+// mediaAccessible 判断用户是否可以获取媒体文件
+// 上传人,以及发送过该文件的私聊双方,群成员跟世界频道中的用户可以获取
+func mediaAccessible(ctx context.Context, userID int64, media *database.Media) (bool, error) {
+	if media.UploaderID == userID {
+		return true, nil
+	}
+
+	id := media.ID.Hex()
+	ok, err := database.HasChatMessageMediaForUser(id, userID)
+	if err != nil {
+		log.ErrorFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("media_id", id).Msg("获取发送过媒体文件的消息失败")
+		return false, errors.Wrap(err)
+	}
+	if ok {
+		return true, nil
+	}
+
+	groupIDs, err := database.GetChatMessageMediaGroupIDs(id)
+	if err != nil {
+		log.ErrorFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("media_id", id).Msg("获取发送过媒体文件的群失败")
+		return false, errors.Wrap(err)
+	}
+
+	for _, groupID := range groupIDs {
+		_, err = database.GetGroupMember(groupID, userID)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.IsNoRecord(err) {
+			log.ErrorFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Int64("group_id", groupID).Msg("获取群成员失败")
+			return false, errors.Wrap(err)
+		}
+	}
+	return false, nil
+}
+
+// mediaUploadFromRequest 获取当前用户的分片上传会话,获取失败时直接响应客户端
+func mediaUploadFromRequest(ctx *gin.Context, uploadID string) (*database.MediaUpload, bool) {
+	if uploadID == "" {
+		JSONError(ctx, StatusError, MessageInvalidUploadID)
+		return nil, false
+	}
+
+	upload, err := database.GetMediaUpload(uploadID)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			JSONError(ctx, StatusError, MessageInvalidUploadID)
+			return nil, false
+		}
+		log.ErrorFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("upload_id", uploadID).Msg("获取分片上传会话失败")
+		JSONError(ctx, StatusError, MessageInternalServerError)
+		return nil, false
+	}
+
+	currentUser := LoginUserFromContext(ctx)
+	if upload.UserID != currentUser.ID {
+		JSONError(ctx, StatusError, MessageInvalidUploadID)
+		return nil, false
+	}
+	return upload, true
+}
+
+// mediaUploadStatus 获取分片上传状态
+func mediaUploadStatus(upload *database.MediaUpload) (*MediaUploadStatus, error) {
+	chunks, err := database.GetMediaUploadChunks(upload.UploadID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Ints(chunks)
+	return &MediaUploadStatus{
+		UploadID:       upload.UploadID,
+		ChunkSize:      upload.ChunkSize,
+		TotalChunks:    upload.TotalChunks,
+		UploadedChunks: chunks,
+	}, nil
+}
+
+// removeMediaUpload 删除分片上传会话跟已经上传的分片
+func removeMediaUpload(ctx *gin.Context, upload *database.MediaUpload) {
+	for i := 0; i < upload.TotalChunks; i++ {
+		if err := storage.GlobStorage.Delete(ctx, mediaChunkKey(upload.UploadID, i)); err != nil {
+			log.WarnFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("upload_id", upload.UploadID).Int("index", i).Msg("删除分片失败")
+		}
+	}
+
+	if err := database.DeleteMediaUpload(upload.UploadID); err != nil {
+		log.WarnFromGinContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("upload_id", upload.UploadID).Msg("删除分片上传会话失败")
+	}
+}
+
+// mediaChunkReader 按顺序读取所有分片
+type mediaChunkReader struct {
+	ctx     context.Context
+	upload  *database.MediaUpload
+	index   int
+	current io.ReadCloser
+}
+
+// Read 实现io.Reader接口,当前分片读完后打开下一个分片
+func (r *mediaChunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.index >= r.upload.TotalChunks {
+				return 0, io.EOF
+			}
+
+			rc, _, err := storage.GlobStorage.Get(r.ctx, mediaChunkKey(r.upload.UploadID, r.index))
+			if err != nil {
+				return 0, err
+			}
+			r.current = rc
+			r.index++
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Close 关闭正在读取的分片
+func (r *mediaChunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// mediaSniffer 保留前512个字节用于嗅探文件类型
+type mediaSniffer struct {
+	buf []byte
+}
+
+// Write 实现io.Writer接口
+func (s *mediaSniffer) Write(p []byte) (int, error) {
+	if n := mediaSniffSize - len(s.buf); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		s.buf = append(s.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// mediaTypeAllowed 判断文件类型是否允许上传,按前缀匹配,白名单为空时使用默认的白名单
+func mediaTypeAllowed(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		allowed = defaultMediaAllowedTypes
+	}
+
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range allowed {
+		if strings.HasPrefix(contentType, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaUploadID 生成上传ID,相同用户上传相同文件时不变,用于断点续传
+func mediaUploadID(userID int64, checksum string, size int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%s:%d", userID, checksum, size)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// mediaKey 媒体文件在存储中的键
+func mediaKey(checksum string) string {
+	return fmt.Sprintf("media/%s/%s", checksum[:2], checksum)
+}
+
+// mediaChunkKey 分片在存储中的键
+func mediaChunkKey(uploadID string, index int) string {
+	return fmt.Sprintf("uploads/%s/%d", uploadID, index)
+}
+
+// mediaURL 生成带签名的下载地址
+// resource 为媒体文件ID,或者缩略图跟封面的 ID/标识
+func mediaURL(resource string, expiresAt int64) string {
+	return fmt.Sprintf("%s%s%s?expires=%d&signature=%s",
+		strings.TrimSuffix(config.GlobConfig().Media.BaseURL, "/"), mediaFilePathPrefix, resource, expiresAt, mediaSignature(resource, expiresAt))
+}
+
+// mediaSignature 计算下载地址的签名
+func mediaSignature(resource string, expiresAt int64) string {
+	var mac hash.Hash
+	if key := config.GlobConfig().Media.SignKey; key != "" {
+		mac = hmac.New(sha256.New, []byte(key))
+	} else {
+		mac = hmac.New(sha256.New, []byte(config.GlobConfig().Main.JwtSigningKey))
+	}
+	mac.Write([]byte(fmt.Sprintf("%s:%d", resource, expiresAt)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyMediaSignature 校验下载地址的签名跟过期时间
+func verifyMediaSignature(resource string, expiresAt int64, signature string, now time.Time) bool {
+	if resource == "" || expiresAt < now.Unix() {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(mediaSignature(resource, expiresAt)))
+}
+
+// mediaMaxSize 单个文件的最大字节数
+func mediaMaxSize() int64 {
+	if size := config.GlobConfig().Media.MaxSize; size > 0 {
+		return size
+	}
+	return defaultMediaMaxSize
+}
+
+// mediaChunkSize 每个分片的字节数
+func mediaChunkSize() int64 {
+	if size := config.GlobConfig().Media.ChunkSize; size > 0 {
+		return size
+	}
+	return defaultMediaChunkSize
+}
+
+// mediaUploadExpire 分片上传会话的有效期
+func mediaUploadExpire() time.Duration {
+	if expire := config.GlobConfig().Media.UploadExpire; expire > 0 {
+		return expire
+	}
+	return defaultMediaUploadExpire
+}
+
+// mediaURLExpire 下载地址的有效期
+func mediaURLExpire() time.Duration {
+	if expire := config.GlobConfig().Media.URLExpire; expire > 0 {
+		return expire
+	}
+	return defaultMediaURLExpire
+}
@@ -0,0 +1,558 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jerbe/jim/config"
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/imaging"
+	"github.com/jerbe/jim/log"
+	"github.com/jerbe/jim/pubsub"
+	"github.com/jerbe/jim/storage"
+	"github.com/jerbe/jim/websocket"
+
+	goutils "github.com/jerbe/go-utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/2 16:30
+  @describe : 图片跟视频的元数据提取
+*/
+
+const (
+	// defaultMediaMaxPixels 未配置时允许解码的图片最大像素数
+	defaultMediaMaxPixels = 50000000
+
+	// defaultMediaWorkers 未配置时提取元数据的后台任务数量
+	defaultMediaWorkers = 2
+
+	// mediaWorkerPopTimeout 后台任务每次等待新任务的时间
+	mediaWorkerPopTimeout = 5 * time.Second
+
+	// mediaMetadataTimeout 单个文件提取元数据的超时时间
+	mediaMetadataTimeout = 2 * time.Minute
+
+	// mediaPosterVariant 视频封面的标识
+	mediaPosterVariant = "poster"
+
+	// mediaThumbnailVariantPrefix 缩略图标识的前缀,后面跟最长边像素
+	mediaThumbnailVariantPrefix = "thumb_"
+
+	// mediaFilePathPrefix 媒体文件下载地址的路径前缀
+	mediaFilePathPrefix = "/api/v1/media/file/"
+)
+
+// defaultMediaThumbnailSizes 未配置时生成的缩略图尺寸
+var defaultMediaThumbnailSizes = []int{160, 480, 960}
+
+// InitMediaWorker 启动提取媒体文件元数据的后台任务
+func InitMediaWorker() {
+	for i := 0; i < mediaWorkers(); i++ {
+		go runMediaWorker(context.Background())
+	}
+}
+
+// runMediaWorker 从队列中获取任务并提取元数据
+func runMediaWorker(ctx context.Context) {
+	defer func() {
+		if obj := recover(); obj != nil {
+			log.Error().Str("recover", fmt.Sprintf("%+v", obj)).Msg("媒体元数据提取任务异常")
+			go runMediaWorker(ctx)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		job, err := database.PopMediaMetadataJob(ctx, mediaWorkerPopTimeout)
+		if err != nil {
+			if errors.IsNoRecord(err) {
+				continue
+			}
+			log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Msg("获取媒体元数据提取任务失败")
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if err = processMediaMetadataJob(ctx, job); err != nil {
+			log.Error().Err(err).Str("err_format", fmt.Sprintf("%+v", err)).
+				Str("media_id", job.MediaID).
+				Str("room_id", job.RoomID).
+				Int64("message_id", job.MessageID).
+				Msg("处理媒体元数据提取任务失败")
+		}
+	}
+}
+
+// processMediaMetadataJob 提取媒体文件的元数据,任务中带有消息时把元数据补充到消息主体中
+func processMediaMetadataJob(ctx context.Context, job *database.MediaMetadataJob) error {
+	media, err := database.GetMedia(job.MediaID)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			return nil
+		}
+		return err
+	}
+
+	if media.Metadata == nil {
+		metadata, err := extractMediaMetadata(ctx, media)
+		if err != nil {
+			return err
+		}
+
+		if err = database.UpdateMediaMetadata(media.ID, metadata); err != nil {
+			return err
+		}
+		media.Metadata = metadata
+	}
+
+	if job.MessageID <= 0 || media.Metadata.Error != "" {
+		return nil
+	}
+
+	body := new(ChatMessageBody)
+	fillChatMessageMediaMetadata(body, media)
+	dbBody := chatMessageBodyToDatabase(body)
+	msg, err := database.UpdateChatMessageMedia(&database.UpdateChatMessageMediaFilter{
+		RoomID:      job.RoomID,
+		SessionType: job.SessionType,
+		MessageID:   job.MessageID,
+		MediaID:     job.MediaID,
+	}, &dbBody)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			// 消息已经被删除或者修改
+			return nil
+		}
+		return err
+	}
+
+	// 消息发送时还没有元数据,通知在线的客户端更新缩略图跟封面
+	return publishChatMessageMedia(ctx, msg)
+}
+
+// publishChatMessageMedia 推送补充了媒体元数据的消息主体
+func publishChatMessageMedia(ctx context.Context, msg *database.ChatMessage) error {
+	rsp := chatMessageFromDatabase(msg)
+	data := &pubsub.ChatMessageMedia{
+		SessionType: msg.SessionType,
+		SenderID:    msg.SenderID,
+		ReceiverID:  msg.ReceiverID,
+		MessageID:   msg.MessageID,
+		ThreadID:    msg.ThreadID,
+		Body:        fillChatMessageBodyForPublish(&rsp.Body),
+		UpdatedAt:   msg.UpdatedAt,
+	}
+
+	if msg.SessionType == database.ChatMessageSessionTypeGroup {
+		var err error
+		data.PublishTargets, err = database.GetGroupMemberIDs(msg.ReceiverID)
+		if err != nil && !errors.IsNoRecord(err) {
+			return errors.Wrap(err)
+		}
+	}
+	return errors.Wrap(pubsub.PublishChatMessageMedia(ctx, data))
+}
+
+// extractMediaMetadata 提取媒体文件的元数据
+// 文件内容无法解析时把原因记录在 Error 中,不再重试;读取存储失败时返回错误
+func extractMediaMetadata(ctx context.Context, media *database.Media) (*database.MediaMetadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, mediaMetadataTimeout)
+	defer cancel()
+
+	r, _, err := storage.GlobStorage.Get(ctx, media.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// ffmpeg需要可以随机读取的文件,先保存到临时文件
+	tmp, err := os.CreateTemp("", "jim-media-meta-*")
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	switch {
+	case strings.HasPrefix(media.ContentType, "image/"):
+		return extractImageMetadata(ctx, media, tmp)
+	case strings.HasPrefix(media.ContentType, "video/"):
+		return extractVideoMetadata(ctx, media, tmp)
+	default:
+		return &database.MediaMetadata{Error: "unsupported content type"}, nil
+	}
+}
+
+// extractImageMetadata 提取图片的尺寸跟blurhash,并生成比原图小的缩略图
+func extractImageMetadata(ctx context.Context, media *database.Media, f *os.File) (*database.MediaMetadata, error) {
+	img, err := imaging.Decode(f, mediaMaxPixels())
+	if err != nil {
+		return &database.MediaMetadata{Error: err.Error()}, nil
+	}
+
+	b := img.Bounds()
+	metadata := &database.MediaMetadata{Width: b.Dx(), Height: b.Dy()}
+	if metadata.Blurhash, err = imaging.Blurhash(img, imaging.BlurhashXComponents, imaging.BlurhashYComponents); err != nil {
+		return &database.MediaMetadata{Error: err.Error()}, nil
+	}
+
+	for _, size := range mediaThumbnailSizes() {
+		// 原图已经足够小时不需要更大的缩略图
+		if metadata.Width <= size && metadata.Height <= size {
+			break
+		}
+
+		key := mediaThumbnailKey(media.Checksum, size)
+		thumb := imaging.Resize(img, size)
+		if err = putMediaJPEG(ctx, key, thumb); err != nil {
+			return nil, err
+		}
+
+		tb := thumb.Bounds()
+		metadata.Thumbnails = append(metadata.Thumbnails, database.MediaThumbnail{
+			Size:   size,
+			Width:  tb.Dx(),
+			Height: tb.Dy(),
+			Key:    key,
+		})
+	}
+	return metadata, nil
+}
+
+// extractVideoMetadata 提取视频的时长,配置了ffmpeg时截取第一帧作为封面
+func extractVideoMetadata(ctx context.Context, media *database.Media, f *os.File) (*database.MediaMetadata, error) {
+	metadata := new(database.MediaMetadata)
+	if duration, err := imaging.MP4Duration(f, media.Size); err == nil {
+		metadata.Duration = duration.Milliseconds()
+	}
+
+	ffmpegPath, ok := mediaFFmpegPath()
+	if !ok {
+		if metadata.Duration == 0 {
+			metadata.Error = "ffmpeg not found"
+		}
+		return metadata, nil
+	}
+
+	img, duration, err := imaging.VideoPoster(ctx, ffmpegPath, f.Name())
+	if err != nil {
+		if metadata.Duration == 0 {
+			metadata.Error = err.Error()
+		}
+		return metadata, nil
+	}
+
+	if metadata.Duration == 0 {
+		metadata.Duration = duration.Milliseconds()
+	}
+
+	b := img.Bounds()
+	metadata.Width, metadata.Height = b.Dx(), b.Dy()
+	if metadata.Blurhash, err = imaging.Blurhash(img, imaging.BlurhashXComponents, imaging.BlurhashYComponents); err != nil {
+		return &database.MediaMetadata{Error: err.Error()}, nil
+	}
+
+	// 封面使用最大的缩略图尺寸
+	sizes := mediaThumbnailSizes()
+	key := mediaPosterKey(media.Checksum)
+	if err = putMediaJPEG(ctx, key, imaging.Resize(img, sizes[len(sizes)-1])); err != nil {
+		return nil, err
+	}
+	metadata.PosterKey = key
+	return metadata, nil
+}
+
+// putMediaJPEG 把图片编码成JPEG后保存到存储中
+func putMediaJPEG(ctx context.Context, key string, img image.Image) error {
+	buf := new(bytes.Buffer)
+	if err := imaging.EncodeJPEG(buf, img); err != nil {
+		return err
+	}
+	return storage.GlobStorage.Put(ctx, key, buf, int64(buf.Len()), "image/jpeg")
+}
+
+// enqueueMediaMetadataJob 添加元数据提取任务,失败时只记录日志
+func enqueueMediaMetadataJob(ctx context.Context, job *database.MediaMetadataJob) {
+	if err := database.PushMediaMetadataJob(job); err != nil {
+		log.WarnFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("media_id", job.MediaID).Msg("添加媒体元数据提取任务失败")
+	}
+}
+
+// fillChatMessageMedia 填充消息主体中的媒体文件信息
+// 客户端传入的元数据会被忽略;来源地址是本服务上传的文件时,只保存媒体文件ID,地址在读取消息时重新签名。
+// 图片跟视频的元数据已经提取完成的直接填充,还没有提取的返回 true,消息保存后需要添加提取任务
+func fillChatMessageMedia(ctx context.Context, userID int64, typ int, body *ChatMessageBody) (bool, error) {
+	body.MediaID, body.Width, body.Height, body.Blurhash = "", 0, 0, ""
+	body.Thumbnails, body.Poster, body.Duration = nil, "", 0
+
+	if !goutils.In(typ, database.ChatMessageTypePicture, database.ChatMessageTypeVoice, database.ChatMessageTypeVideo, database.ChatMessageTypeFile) {
+		return false, nil
+	}
+
+	id, ok := mediaIDFromSrc(body.Src)
+	if !ok {
+		return false, nil
+	}
+
+	media, err := database.GetMedia(id)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			return false, nil
+		}
+		log.ErrorFromContext(ctx).Err(err).Str("err_format", fmt.Sprintf("%+v", err)).Str("media_id", id).Msg("获取媒体文件失败")
+		return false, errors.Wrap(err)
+	}
+
+	// 签名不会过期,需要确认发送人现在还可以获取该文件
+	ok, err = mediaAccessible(ctx, userID, media)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, NewResponseError(MessageForbidden)
+	}
+	body.MediaID = id
+	body.Src = ""
+
+	if typ != database.ChatMessageTypePicture && typ != database.ChatMessageTypeVideo {
+		return false, nil
+	}
+
+	if media.Metadata == nil {
+		return true, nil
+	}
+
+	fillChatMessageMediaMetadata(body, media)
+	return false, nil
+}
+
+// fillChatMessageMediaMetadata 用媒体文件的元数据填充消息主体
+// 缩略图跟封面只填充标识,需要返回给客户端时再通过 signChatMessageMediaVariants 生成带签名的地址
+func fillChatMessageMediaMetadata(body *ChatMessageBody, media *database.Media) {
+	metadata := media.Metadata
+	if metadata == nil || metadata.Error != "" {
+		return
+	}
+
+	body.Width = metadata.Width
+	body.Height = metadata.Height
+	body.Blurhash = metadata.Blurhash
+	body.Duration = metadata.Duration
+	body.Thumbnails = nil
+	for _, thumb := range metadata.Thumbnails {
+		body.Thumbnails = append(body.Thumbnails, ChatMessageThumbnail{
+			Width:   thumb.Width,
+			Height:  thumb.Height,
+			variant: mediaThumbnailVariant(thumb.Size),
+		})
+	}
+
+	body.Poster, body.posterVariant = "", ""
+	if metadata.PosterKey != "" {
+		body.posterVariant = mediaPosterVariant
+	}
+}
+
+// signChatMessageMediaVariants 按标识生成缩略图跟封面的带签名地址
+func signChatMessageMediaVariants(body *ChatMessageBody, mediaID string, expiresAt int64) {
+	for i := range body.Thumbnails {
+		if variant := body.Thumbnails[i].variant; variant != "" {
+			body.Thumbnails[i].Src = mediaURL(mediaResource(mediaID, variant), expiresAt)
+		}
+	}
+
+	if body.posterVariant != "" {
+		body.Poster = mediaURL(mediaResource(mediaID, body.posterVariant), expiresAt)
+	}
+}
+
+// mediaVariantFromSrc 从本服务生成的缩略图或封面地址中解析标识,不是本服务的地址时返回空
+func mediaVariantFromSrc(src string) string {
+	if src == "" {
+		return ""
+	}
+
+	u, err := url.Parse(src)
+	if err != nil || !strings.HasPrefix(u.Path, mediaFilePathPrefix) {
+		return ""
+	}
+
+	parts := strings.Split(strings.TrimPrefix(u.Path, mediaFilePathPrefix), "/")
+	if len(parts) != 2 || !primitive.IsValidObjectID(parts[0]) {
+		return ""
+	}
+	return parts[1]
+}
+
+// mediaIDFromSrc 从本服务生成的下载地址中解析媒体文件ID
+// 只校验签名不校验过期时间,消息发送时地址可能刚好过期
+func mediaIDFromSrc(src string) (string, bool) {
+	u, err := url.Parse(src)
+	if err != nil || !strings.HasPrefix(u.Path, mediaFilePathPrefix) {
+		return "", false
+	}
+
+	id := strings.TrimPrefix(u.Path, mediaFilePathPrefix)
+	if !primitive.IsValidObjectID(id) {
+		return "", false
+	}
+
+	query := u.Query()
+	expiresAt, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || !verifyMediaSignature(id, expiresAt, query.Get("signature"), time.Unix(0, 0)) {
+		return "", false
+	}
+	return id, true
+}
+
+// mediaVariantKey 获取缩略图或者封面在存储中的键
+func mediaVariantKey(media *database.Media, variant string) (string, bool) {
+	if media.Metadata == nil {
+		return "", false
+	}
+
+	if variant == mediaPosterVariant {
+		return media.Metadata.PosterKey, media.Metadata.PosterKey != ""
+	}
+
+	for _, thumb := range media.Metadata.Thumbnails {
+		if variant == mediaThumbnailVariant(thumb.Size) {
+			return thumb.Key, true
+		}
+	}
+	return "", false
+}
+
+// mediaResource 下载地址签名的资源标识,原文件为媒体文件ID,缩略图跟封面为 ID/标识
+func mediaResource(id, variant string) string {
+	if variant == "" {
+		return id
+	}
+	return id + "/" + variant
+}
+
+// mediaThumbnailVariant 缩略图的标识
+func mediaThumbnailVariant(size int) string {
+	return mediaThumbnailVariantPrefix + strconv.Itoa(size)
+}
+
+// mediaThumbnailKey 缩略图在存储中的键
+func mediaThumbnailKey(checksum string, size int) string {
+	return fmt.Sprintf("thumbs/%s/%s_%d.jpg", checksum[:2], checksum, size)
+}
+
+// mediaPosterKey 视频封面在存储中的键
+func mediaPosterKey(checksum string) string {
+	return fmt.Sprintf("posters/%s/%s.jpg", checksum[:2], checksum)
+}
+
+// mediaNeedMetadata 判断文件类型是否需要提取元数据
+func mediaNeedMetadata(contentType string) bool {
+	return strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "video/")
+}
+
+// mediaThumbnailSizes 缩略图尺寸,从小到大排列
+func mediaThumbnailSizes() []int {
+	var sizes []int
+	for _, size := range config.GlobConfig().Media.ThumbnailSizes {
+		if size > 0 {
+			sizes = append(sizes, size)
+		}
+	}
+
+	if len(sizes) == 0 {
+		return defaultMediaThumbnailSizes
+	}
+
+	// 排序后去掉重复的尺寸
+	sort.Ints(sizes)
+	n := 1
+	for i := 1; i < len(sizes); i++ {
+		if sizes[i] != sizes[n-1] {
+			sizes[n] = sizes[i]
+			n++
+		}
+	}
+	return sizes[:n]
+}
+
+// mediaMaxPixels 允许解码的图片最大像素数
+func mediaMaxPixels() int64 {
+	if pixels := config.GlobConfig().Media.MaxPixels; pixels > 0 {
+		return pixels
+	}
+	return defaultMediaMaxPixels
+}
+
+// mediaFFmpegPath 获取ffmpeg路径,找不到时返回false
+func mediaFFmpegPath() (string, bool) {
+	name := config.GlobConfig().Media.FFmpegPath
+	if name == "" {
+		name = "ffmpeg"
+	}
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// mediaWorkers 提取元数据的后台任务数量
+func mediaWorkers() int {
+	if workers := config.GlobConfig().Media.Workers; workers > 0 {
+		return workers
+	}
+	return defaultMediaWorkers
+}
+
+// ========================================================================================
+// ============================ SUBSCRIBE HANDLER =========================================
+// ========================================================================================
+
+// SubscribeChatMessageMediaHandler 接收消息媒体元数据补充通知
+func SubscribeChatMessageMediaHandler(ctx context.Context, payload *pubsub.Payload) {
+	data := new(pubsub.ChatMessageMedia)
+	err := payload.UnmarshalData(data)
+	if err != nil {
+		log.Error().Err(err).Str("payload.channel", payload.Channel).Str("payload.type", payload.Type).Send()
+		return
+	}
+
+	targets, ok := chatPushTargets(data.SessionType, data.SenderID, data.ReceiverID, data.PublishTargets)
+	if !ok {
+		return
+	}
+
+	data.PublishTargets = nil
+	websocketManager.PushData(websocket.Payload{Type: payload.Type, Data: data}, targets...)
+}
@@ -0,0 +1,251 @@
+package handler
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jerbe/jim/database"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/30 15:20
+  @describe :
+*/
+
+func TestVerifyMediaSignature(t *testing.T) {
+	now := time.Unix(1696000000, 0)
+	expiresAt := now.Add(time.Hour).Unix()
+	signature := mediaSignature("abc", expiresAt)
+
+	tests := []struct {
+		name      string
+		id        string
+		expiresAt int64
+		signature string
+		want      bool
+	}{
+		{name: "正常", id: "abc", expiresAt: expiresAt, signature: signature, want: true},
+		{name: "已过期", id: "abc", expiresAt: now.Add(-time.Second).Unix(), signature: mediaSignature("abc", now.Add(-time.Second).Unix()), want: false},
+		{name: "篡改过期时间", id: "abc", expiresAt: expiresAt + 3600, signature: signature, want: false},
+		{name: "篡改ID", id: "abd", expiresAt: expiresAt, signature: signature, want: false},
+		{name: "空签名", id: "abc", expiresAt: expiresAt, signature: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyMediaSignature(tt.id, tt.expiresAt, tt.signature, now); got != tt.want {
+				t.Errorf("verifyMediaSignature() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMediaTypeAllowed(t *testing.T) {
+	allowed := []string{"image/", "application/pdf"}
+	tests := []struct {
+		name        string
+		contentType string
+		allowed     []string
+		want        bool
+	}{
+		{name: "未配置白名单时使用默认白名单", contentType: "image/png", allowed: nil, want: true},
+		{name: "默认白名单不允许HTML", contentType: "text/html; charset=utf-8", allowed: nil, want: false},
+		{name: "默认白名单不允许可执行文件", contentType: "application/x-msdownload", allowed: nil, want: false},
+		{name: "图片", contentType: "image/png", allowed: allowed, want: true},
+		{name: "PDF", contentType: "application/pdf", allowed: allowed, want: true},
+		{name: "可执行文件", contentType: "application/x-msdownload", allowed: allowed, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mediaTypeAllowed(tt.contentType, tt.allowed); got != tt.want {
+				t.Errorf("mediaTypeAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMediaInline(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		want        bool
+	}{
+		{name: "图片", contentType: "image/png", want: true},
+		{name: "视频", contentType: "video/mp4", want: true},
+		{name: "音频", contentType: "audio/mpeg", want: true},
+		{name: "SVG", contentType: "image/svg+xml", want: false},
+		{name: "HTML", contentType: "text/html; charset=utf-8", want: false},
+		{name: "PDF", contentType: "application/pdf", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mediaInline(tt.contentType); got != tt.want {
+				t.Errorf("mediaInline() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMediaSniffer(t *testing.T) {
+	s := new(mediaSniffer)
+	data := bytes.Repeat([]byte("a"), 300)
+	for i := 0; i < 3; i++ {
+		if n, err := s.Write(data); n != len(data) || err != nil {
+			t.Fatalf("Write() = %d, %v", n, err)
+		}
+	}
+
+	if len(s.buf) != mediaSniffSize {
+		t.Errorf("len(buf) = %d, want %d", len(s.buf), mediaSniffSize)
+	}
+}
+
+func TestMediaUploadID(t *testing.T) {
+	checksum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if mediaUploadID(1, checksum, 5) != mediaUploadID(1, checksum, 5) {
+		t.Errorf("mediaUploadID() 相同参数应该返回相同的上传ID")
+	}
+
+	if mediaUploadID(1, checksum, 5) == mediaUploadID(2, checksum, 5) {
+		t.Errorf("mediaUploadID() 不同用户应该返回不同的上传ID")
+	}
+}
+
+func TestMediaIDFromSrc(t *testing.T) {
+	id := "6517a2c9e1b4a0d1c2f3e4a5"
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	src := mediaURL(id, expiresAt)
+
+	tests := []struct {
+		name   string
+		src    string
+		wantID string
+		wantOK bool
+	}{
+		{name: "本服务的下载地址", src: src, wantID: id, wantOK: true},
+		{name: "已过期的下载地址", src: mediaURL(id, 1), wantID: id, wantOK: true},
+		{name: "篡改签名", src: src + "0", wantOK: false},
+		{name: "缩略图地址", src: mediaURL(mediaResource(id, mediaThumbnailVariant(160)), expiresAt), wantOK: false},
+		{name: "无效的ID", src: mediaURL("abc", expiresAt), wantOK: false},
+		{name: "外部地址", src: "https://www.baidu.com/logo.png", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotID, gotOK := mediaIDFromSrc(tt.src)
+			if gotID != tt.wantID || gotOK != tt.wantOK {
+				t.Errorf("mediaIDFromSrc() = %v, %v, want %v, %v", gotID, gotOK, tt.wantID, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestMediaVariantKey(t *testing.T) {
+	media := &database.Media{Metadata: &database.MediaMetadata{
+		Thumbnails: []database.MediaThumbnail{{Size: 160, Key: "thumbs/ab/abc_160.jpg"}},
+		PosterKey:  "posters/ab/abc.jpg",
+	}}
+
+	tests := []struct {
+		name    string
+		media   *database.Media
+		variant string
+		wantKey string
+		wantOK  bool
+	}{
+		{name: "缩略图", media: media, variant: "thumb_160", wantKey: "thumbs/ab/abc_160.jpg", wantOK: true},
+		{name: "封面", media: media, variant: "poster", wantKey: "posters/ab/abc.jpg", wantOK: true},
+		{name: "不存在的尺寸", media: media, variant: "thumb_480", wantOK: false},
+		{name: "还没有提取元数据", media: &database.Media{}, variant: "thumb_160", wantOK: false},
+		{name: "没有封面", media: &database.Media{Metadata: &database.MediaMetadata{}}, variant: "poster", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotKey, gotOK := mediaVariantKey(tt.media, tt.variant)
+			if gotKey != tt.wantKey || gotOK != tt.wantOK {
+				t.Errorf("mediaVariantKey() = %v, %v, want %v, %v", gotKey, gotOK, tt.wantKey, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFillChatMessageMedia(t *testing.T) {
+	// 客户端传入的元数据会被忽略,外部地址不需要提取元数据
+	body := &ChatMessageBody{
+		Src:        "https://www.baidu.com/logo.png",
+		MediaID:    "6517a2c9e1b4a0d1c2f3e4a5",
+		Width:      100,
+		Height:     100,
+		Blurhash:   "L00000fQfQfQfQfQfQfQfQfQfQfQ",
+		Thumbnails: []ChatMessageThumbnail{{Src: "https://evil.example.com/a.jpg"}},
+		Poster:     "https://evil.example.com/a.jpg",
+		Duration:   1000,
+	}
+	pending, err := fillChatMessageMedia(nil, 1, database.ChatMessageTypePicture, body)
+	if err != nil {
+		t.Fatalf("fillChatMessageMedia() error = %v", err)
+	}
+	if pending {
+		t.Errorf("fillChatMessageMedia() 外部地址不需要提取元数据")
+	}
+
+	want := ChatMessageBody{Src: "https://www.baidu.com/logo.png"}
+	if !reflect.DeepEqual(*body, want) {
+		t.Errorf("fillChatMessageMedia() body = %+v, want %+v", *body, want)
+	}
+}
+
+func TestMediaVariantFromSrc(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{name: "缩略图", src: "https://im.example.com/api/v1/media/file/6517a2c9e1b4a0d1c2f3e4a5/thumb_160?expires=1&signature=abc", want: "thumb_160"},
+		{name: "封面", src: "/api/v1/media/file/6517a2c9e1b4a0d1c2f3e4a5/poster?expires=1&signature=abc", want: "poster"},
+		{name: "原文件", src: "/api/v1/media/file/6517a2c9e1b4a0d1c2f3e4a5?expires=1&signature=abc", want: ""},
+		{name: "外部地址", src: "https://www.baidu.com/api/v1/media/file/abc/poster", want: ""},
+		{name: "空地址", src: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mediaVariantFromSrc(tt.src); got != tt.want {
+				t.Errorf("mediaVariantFromSrc() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatMessageBodyMediaVariants(t *testing.T) {
+	media := &database.Media{Metadata: &database.MediaMetadata{
+		Width:      1920,
+		Height:     1080,
+		Thumbnails: []database.MediaThumbnail{{Size: 160, Width: 160, Height: 90}},
+		PosterKey:  "posters/ab/abc.jpg",
+	}}
+
+	body := &ChatMessageBody{MediaID: "6517a2c9e1b4a0d1c2f3e4a5"}
+	fillChatMessageMediaMetadata(body, media)
+
+	// 保存时只有标识,没有会过期的地址
+	dbBody := chatMessageBodyToDatabase(body)
+	if dbBody.Thumbnails[0].Src != "" || dbBody.Thumbnails[0].Variant != "thumb_160" {
+		t.Errorf("chatMessageBodyToDatabase() thumbnails = %+v", dbBody.Thumbnails)
+	}
+	if dbBody.Poster != "" || dbBody.PosterVariant != "poster" {
+		t.Errorf("chatMessageBodyToDatabase() poster = %v, poster_variant = %v", dbBody.Poster, dbBody.PosterVariant)
+	}
+
+	// 读取时重新签名
+	rsp := chatMessageBodyFromDatabase(&dbBody)
+	if got := mediaVariantFromSrc(rsp.Thumbnails[0].Src); got != "thumb_160" {
+		t.Errorf("chatMessageBodyFromDatabase() thumbnail src = %v", rsp.Thumbnails[0].Src)
+	}
+	if got := mediaVariantFromSrc(rsp.Poster); got != "poster" {
+		t.Errorf("chatMessageBodyFromDatabase() poster = %v", rsp.Poster)
+	}
+	if id, ok := mediaIDFromSrc(rsp.Src); !ok || id != body.MediaID {
+		t.Errorf("chatMessageBodyFromDatabase() src = %v", rsp.Src)
+	}
+}
@@ -58,6 +58,10 @@ func InitRouter() *gin.Engine {
 	// WebSocket连接
 	rootRouter.GET("/api/v1/ws", WebsocketMiddleware(), WebsocketHandler)
 
+	// 媒体文件下载,通过地址中的签名校验,不需要登录
+	rootRouter.GET("/api/v1/media/file/:id", RequestLogMiddleware(), MediaFileHandler)
+	rootRouter.GET("/api/v1/media/file/:id/:variant", RequestLogMiddleware(), MediaVariantFileHandler)
+
 	apiGroup := rootRouter.Group("/api/v1", RateLimitMiddleware(goutils.NewLimiter(1000000, time.Second)), RequestLogMiddleware(), CheckAuthMiddleware())
 	{
 		// 个人画像
@@ -69,9 +73,35 @@ func InitRouter() *gin.Engine {
 		// 聊天
 		chat := apiGroup.Group("/chat")
 		chat.POST("/message/send", SendChatMessageHandler)
+		chat.POST("/message/forward", ForwardChatMessageHandler)
 		chat.POST("/message/rollback", RollbackChatMessageHandler)
 		chat.POST("/message/delete", DeleteChatMessageHandler)
 		chat.GET("/message/last", GetLastChatMessagesHandler)
+		chat.GET("/message/history", GetChatMessageHistoryHandler)
+		chat.GET("/message/search", SearchChatMessagesHandler)
+		chat.GET("/message/scheduled", GetScheduledChatMessagesHandler)
+		chat.POST("/message/scheduled/cancel", CancelScheduledChatMessageHandler)
+		chat.POST("/message/read", ReadChatMessageHandler)
+		chat.GET("/message/read_count", GetChatMessageReadCountHandler)
+		chat.POST("/message/reaction", ReactChatMessageHandler)
+		chat.POST("/message/edit", EditChatMessageHandler)
+		chat.GET("/message/revisions", GetChatMessageRevisionsHandler)
+		chat.GET("/sync", SyncChatHandler)
+		chat.POST("/sync/ack", AckChatSyncHandler)
+		chat.GET("/conversations", GetChatConversationsHandler)
+		chat.POST("/conversation/update", UpdateChatConversationHandler)
+		chat.POST("/event", SendChatEventHandler)
+	}
+
+	{
+		// 媒体
+		media := apiGroup.Group("/media")
+		media.POST("/upload", UploadMediaHandler)
+		media.POST("/upload/init", InitMediaUploadHandler)
+		media.PUT("/upload/chunk", UploadMediaChunkHandler)
+		media.GET("/upload/status", GetMediaUploadStatusHandler)
+		media.POST("/upload/complete", CompleteMediaUploadHandler)
+		media.GET("/url", GetMediaURLHandler)
 	}
 
 	{
@@ -90,7 +120,9 @@ func InitRouter() *gin.Engine {
 		group.POST("/create", CreateGroupHandler)
 		group.POST("/join", JoinGroupHandler)
 		group.POST("/leave", LeaveGroupHandler)
+		group.GET("/info", GetGroupInfoHandler)
 		group.POST("/update", UpdateGroupHandler)
+		group.GET("/announcement/revisions", GetGroupAnnouncementRevisionsHandler)
 
 		group.POST("/member/add", AddGroupMemberHandler)
 		group.POST("/member/update", UpdateGroupMemberHandler)
@@ -104,5 +136,15 @@ func InitRouter() *gin.Engine {
 func InitSubscribe() {
 	var subscriber = pubsub.NewSubscriber()
 	subscriber.Subscribe(pubsub.ChannelChatMessage, pubsub.PayloadTypeChatMessage, SubscribeChatMessageHandler)
+	subscriber.Subscribe(pubsub.ChannelChatMessage, pubsub.PayloadTypeChatReadReceipt, SubscribeChatReadReceiptHandler)
+	subscriber.Subscribe(pubsub.ChannelChatMessage, pubsub.PayloadTypeChatMessageRollback, SubscribeChatMessageRollbackHandler)
+	subscriber.Subscribe(pubsub.ChannelChatMessage, pubsub.PayloadTypeChatMessageEdit, SubscribeChatMessageEditHandler)
+	subscriber.Subscribe(pubsub.ChannelChatMessage, pubsub.PayloadTypeChatMessageReaction, SubscribeChatMessageReactionHandler)
+	subscriber.Subscribe(pubsub.ChannelChatMessage, pubsub.PayloadTypeChatMessageDeleted, SubscribeChatMessageDeletedHandler)
+	subscriber.Subscribe(pubsub.ChannelChatMessage, pubsub.PayloadTypeChatMessageExpired, SubscribeChatMessageExpiredHandler)
+	subscriber.Subscribe(pubsub.ChannelChatMessage, pubsub.PayloadTypeChatMessageMedia, SubscribeChatMessageMediaHandler)
 	subscriber.Subscribe(pubsub.ChannelNotify, pubsub.PayloadTypeFriendInvite, SubscribeFriendInviteHandler)
+	subscriber.Subscribe(pubsub.ChannelNotify, pubsub.PayloadTypeChatMention, SubscribeChatMentionHandler)
+	subscriber.Subscribe(pubsub.ChannelEphemeral, pubsub.PayloadTypeChatEvent, SubscribeChatEventHandler)
+	subscriber.Subscribe(pubsub.ChannelNotify, pubsub.PayloadTypeGroupPin, SubscribeGroupPinHandler)
 }
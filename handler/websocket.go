@@ -1,11 +1,16 @@
 package handler
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
+
+	"github.com/jerbe/jim/errors"
 	"github.com/jerbe/jim/log"
 	"github.com/jerbe/jim/websocket"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	gWebsocket "github.com/gorilla/websocket"
 )
 
@@ -17,16 +22,102 @@ import (
 
 // WebsocketMessageRequest websocket请求参数
 type WebsocketMessageRequest struct {
-	Action   string `json:"action"`
+	// Action 行为名称,例如: chat.send
+	Action string `json:"action"`
+
+	// ActionID 行为ID,由前端生成,返回时原样带回,用于前端关联请求跟返回
 	ActionID string `json:"action_id"`
-	Data     any    `json:"data"`
+
+	// Data 请求数据,具体结构由 Action 决定
+	Data json.RawMessage `json:"data"`
 }
 
 // WebsocketMessageResponse websocket返回数据
 type WebsocketMessageResponse struct {
-	Action   string `json:"action"`
+	// Action 行为名称,与请求一致
+	Action string `json:"action"`
+
+	// ActionID 行为ID,与请求一致
 	ActionID string `json:"action_id"`
-	Data     any    `json:"data"`
+
+	// Status 状态码,与HTTP返回的 Response.Status 一致
+	Status int `json:"status"`
+
+	// Error 错误信息
+	Error string `json:"error,omitempty"`
+
+	// Data 返回数据
+	Data any `json:"data,omitempty"`
+}
+
+const (
+	// WebsocketActionChatSend 发送聊天消息
+	WebsocketActionChatSend = "chat.send"
+
+	// WebsocketActionChatForward 转发聊天消息
+	WebsocketActionChatForward = "chat.forward"
+
+	// WebsocketActionChatRollback 撤回聊天消息
+	WebsocketActionChatRollback = "chat.rollback"
+
+	// WebsocketActionChatDelete 删除聊天消息,只对自己生效
+	WebsocketActionChatDelete = "chat.delete"
+
+	// WebsocketActionChatLast 获取最近的聊天消息
+	WebsocketActionChatLast = "chat.last"
+
+	// WebsocketActionChatHistory 分页获取历史聊天消息
+	WebsocketActionChatHistory = "chat.history"
+
+	// WebsocketActionChatSearch 搜索聊天消息
+	WebsocketActionChatSearch = "chat.search"
+
+	// WebsocketActionChatSync 同步离线期间的聊天消息
+	WebsocketActionChatSync = "chat.sync"
+
+	// WebsocketActionChatSyncAck 确认同步,推进设备的同步游标
+	WebsocketActionChatSyncAck = "chat.sync.ack"
+
+	// WebsocketActionChatRead 标记已读
+	WebsocketActionChatRead = "chat.read"
+
+	// WebsocketActionChatReadCount 获取消息已读人数
+	WebsocketActionChatReadCount = "chat.read_count"
+
+	// WebsocketActionChatEdit 编辑聊天消息
+	WebsocketActionChatEdit = "chat.edit"
+
+	// WebsocketActionChatReaction 添加或取消表情回应
+	WebsocketActionChatReaction = "chat.reaction"
+
+	// WebsocketActionChatEvent 发送正在输入等瞬时事件
+	WebsocketActionChatEvent = "chat.event"
+
+	// WebsocketActionPing 应用层心跳,用于无法收发控制帧的客户端(例如经过会过滤控制帧的代理)
+	WebsocketActionPing = "ping"
+)
+
+// websocketActionHandlerFunc websocket行为处理方法
+// ctx 为建立websocket连接时的上下文,可以从中获取当前登录用户
+type websocketActionHandlerFunc func(ctx *gin.Context, req *WebsocketMessageRequest) (any, error)
+
+// websocketActionHandlers websocket行为处理方法映射
+var websocketActionHandlers = map[string]websocketActionHandlerFunc{
+	WebsocketActionChatSend:      websocketChatSendAction,
+	WebsocketActionChatForward:   websocketChatForwardAction,
+	WebsocketActionChatRollback:  websocketChatRollbackAction,
+	WebsocketActionChatDelete:    websocketChatDeleteAction,
+	WebsocketActionChatLast:      websocketChatLastAction,
+	WebsocketActionChatHistory:   websocketChatHistoryAction,
+	WebsocketActionChatSearch:    websocketChatSearchAction,
+	WebsocketActionChatSync:      websocketChatSyncAction,
+	WebsocketActionChatSyncAck:   websocketChatSyncAckAction,
+	WebsocketActionChatRead:      websocketChatReadAction,
+	WebsocketActionChatReadCount: websocketChatReadCountAction,
+	WebsocketActionChatEdit:      websocketChatEditAction,
+	WebsocketActionChatReaction:  websocketChatReactionAction,
+	WebsocketActionChatEvent:     websocketChatEventAction,
+	WebsocketActionPing:          websocketPingAction,
 }
 
 var upgrader = &gWebsocket.Upgrader{}
@@ -43,25 +134,230 @@ func WebsocketHandler(ctx *gin.Context) {
 		return
 	}
 
-	defer func(conn *gWebsocket.Conn) {
-		websocketManager.RemoveConnect(fmt.Sprintf("%d", user.ID), conn)
-		err := conn.Close()
-		if err != nil {
+	// 连接统一使用用户ID(int64)作为key,推送时也必须使用int64类型的用户ID
+	client := websocketManager.AddConnect(user.ID, conn)
+
+	defer func() {
+		websocketManager.RemoveConnect(user.ID, client)
+		err := client.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
 			log.ErrorFromGinContext(ctx).Err(err).
 				Str("err_format", fmt.Sprintf("%+v", err)).
 				Int64("user_id", user.ID).
 				Str("remote", conn.RemoteAddr().String()).Msg("关闭websocket失败")
 		}
-	}(conn)
-
-	websocketManager.AddConnect(fmt.Sprintf("%d", user.ID), conn)
+	}()
 
+	// 读取超时,心跳跟空闲超时由client处理,失效的连接会使ReadMessage返回错误,从而退出循环并从管理器中移除
 	for {
-
-		_, _, err := conn.ReadMessage()
+		typ, message, err := client.ReadMessage()
 		if err != nil {
 			return
 		}
-		//go parseWSMessage(ctx, message)
+
+		if typ != gWebsocket.TextMessage {
+			continue
+		}
+
+		rsp := parseWSMessage(ctx, message)
+		data, err := json.Marshal(rsp)
+		if err != nil {
+			log.ErrorFromGinContext(ctx).Err(err).Str("action", rsp.Action).Msg("编码websocket返回数据失败")
+			continue
+		}
+
+		// 返回数据跟推送数据一样通过发送队列写出,保证同一连接只有一个写协程
+		if err = client.Send(data); err != nil {
+			log.WarnFromGinContext(ctx).Err(err).Str("action", rsp.Action).Int64("user_id", user.ID).Msg("websocket返回数据放入发送队列失败")
+		}
+	}
+}
+
+// parseWSMessage 解析websocket消息,并分发到对应的行为处理方法
+func parseWSMessage(ctx *gin.Context, message []byte) *WebsocketMessageResponse {
+	req := new(WebsocketMessageRequest)
+	if err := json.Unmarshal(message, req); err != nil {
+		return &WebsocketMessageResponse{Status: StatusError, Error: MessageInvalidParams}
+	}
+
+	rsp := &WebsocketMessageResponse{Action: req.Action, ActionID: req.ActionID, Status: StatusOK}
+
+	fn, ok := websocketActionHandlers[req.Action]
+	if !ok {
+		rsp.Status, rsp.Error = StatusError, MessageInvalidFormat("action")
+		return rsp
+	}
+
+	data, err := func() (data any, err error) {
+		defer func() {
+			if obj := recover(); obj != nil {
+				log.ErrorFromGinContext(ctx).Str("action", req.Action).Str("recover", fmt.Sprintf("%+v", obj)).Msg("websocket行为处理发生panic")
+				err = fmt.Errorf("%v", obj)
+			}
+		}()
+		return fn(ctx, req)
+	}()
+	if err != nil {
+		rsp.Status, rsp.Error = responseErrorFrom(err)
+		return rsp
+	}
+
+	rsp.Data = data
+	return rsp
+}
+
+// bindWebsocketData 解析websocket请求数据,并跟HTTP请求一样进行结构校验
+func bindWebsocketData(req *WebsocketMessageRequest, dest any) error {
+	if len(req.Data) == 0 {
+		return NewResponseError(MessageInvalidParams)
+	}
+
+	if err := json.Unmarshal(req.Data, dest); err != nil {
+		return NewResponseError(err.Error())
+	}
+
+	if err := binding.Validator.ValidateStruct(dest); err != nil {
+		return NewResponseError(err.Error())
+	}
+	return nil
+}
+
+// websocketChatSendAction 通过websocket发送聊天消息
+func websocketChatSendAction(ctx *gin.Context, req *WebsocketMessageRequest) (any, error) {
+	sendReq := new(SendChatMessageRequest)
+	if err := bindWebsocketData(req, sendReq); err != nil {
+		return nil, err
+	}
+
+	// 如果请求体里没有带上ActionID,则使用外层的ActionID
+	if sendReq.ActionID == "" {
+		sendReq.ActionID = req.ActionID
+	}
+	return sendChatMessageByRequest(ctx, sendReq)
+}
+
+// websocketChatForwardAction 通过websocket转发聊天消息
+func websocketChatForwardAction(ctx *gin.Context, req *WebsocketMessageRequest) (any, error) {
+	forwardReq := new(ForwardChatMessageRequest)
+	if err := bindWebsocketData(req, forwardReq); err != nil {
+		return nil, err
+	}
+
+	if forwardReq.ActionID == "" {
+		forwardReq.ActionID = req.ActionID
 	}
+	return forwardChatMessageByRequest(ctx, forwardReq)
+}
+
+// websocketChatRollbackAction 通过websocket撤回聊天消息
+func websocketChatRollbackAction(ctx *gin.Context, req *WebsocketMessageRequest) (any, error) {
+	rollbackReq := new(RollbackChatMessageRequest)
+	if err := bindWebsocketData(req, rollbackReq); err != nil {
+		return nil, err
+	}
+	return nil, rollbackChatMessageByRequest(ctx, rollbackReq)
+}
+
+// websocketChatDeleteAction 通过websocket删除聊天消息
+func websocketChatDeleteAction(ctx *gin.Context, req *WebsocketMessageRequest) (any, error) {
+	deleteReq := new(DeleteChatMessageRequest)
+	if err := bindWebsocketData(req, deleteReq); err != nil {
+		return nil, err
+	}
+	return deleteChatMessageByRequest(ctx, deleteReq)
+}
+
+// websocketChatLastAction 通过websocket获取最近的聊天消息
+func websocketChatLastAction(ctx *gin.Context, req *WebsocketMessageRequest) (any, error) {
+	lastReq := new(GetLastChatMessagesRequest)
+	if err := bindWebsocketData(req, lastReq); err != nil {
+		return nil, err
+	}
+	return getLastChatMessagesByRequest(ctx, lastReq)
+}
+
+// websocketChatHistoryAction 通过websocket分页获取历史聊天消息
+func websocketChatHistoryAction(ctx *gin.Context, req *WebsocketMessageRequest) (any, error) {
+	historyReq := new(GetChatMessageHistoryRequest)
+	if err := bindWebsocketData(req, historyReq); err != nil {
+		return nil, err
+	}
+	return getChatMessageHistoryByRequest(ctx, historyReq)
+}
+
+// websocketChatSearchAction 通过websocket搜索聊天消息
+func websocketChatSearchAction(ctx *gin.Context, req *WebsocketMessageRequest) (any, error) {
+	searchReq := new(SearchChatMessagesRequest)
+	if err := bindWebsocketData(req, searchReq); err != nil {
+		return nil, err
+	}
+	return searchChatMessagesByRequest(ctx, searchReq)
+}
+
+// websocketChatSyncAction 通过websocket同步离线期间的聊天消息
+func websocketChatSyncAction(ctx *gin.Context, req *WebsocketMessageRequest) (any, error) {
+	syncReq := new(SyncChatRequest)
+	if err := bindWebsocketData(req, syncReq); err != nil {
+		return nil, err
+	}
+	return syncChatByRequest(ctx, syncReq)
+}
+
+// websocketChatSyncAckAction 通过websocket确认同步
+func websocketChatSyncAckAction(ctx *gin.Context, req *WebsocketMessageRequest) (any, error) {
+	ackReq := new(AckChatSyncRequest)
+	if err := bindWebsocketData(req, ackReq); err != nil {
+		return nil, err
+	}
+	return nil, ackChatSyncByRequest(ctx, ackReq)
+}
+
+// websocketChatReadAction 通过websocket标记已读
+func websocketChatReadAction(ctx *gin.Context, req *WebsocketMessageRequest) (any, error) {
+	readReq := new(ReadChatMessageRequest)
+	if err := bindWebsocketData(req, readReq); err != nil {
+		return nil, err
+	}
+	return readChatMessageByRequest(ctx, readReq)
+}
+
+// websocketChatReadCountAction 通过websocket获取消息已读人数
+func websocketChatReadCountAction(ctx *gin.Context, req *WebsocketMessageRequest) (any, error) {
+	countReq := new(GetChatMessageReadCountRequest)
+	if err := bindWebsocketData(req, countReq); err != nil {
+		return nil, err
+	}
+	return getChatMessageReadCountByRequest(ctx, countReq)
+}
+
+// websocketChatEditAction 通过websocket编辑聊天消息
+func websocketChatEditAction(ctx *gin.Context, req *WebsocketMessageRequest) (any, error) {
+	editReq := new(EditChatMessageRequest)
+	if err := bindWebsocketData(req, editReq); err != nil {
+		return nil, err
+	}
+	return editChatMessageByRequest(ctx, editReq)
+}
+
+// websocketChatReactionAction 通过websocket添加或取消表情回应
+func websocketChatReactionAction(ctx *gin.Context, req *WebsocketMessageRequest) (any, error) {
+	reactReq := new(ReactChatMessageRequest)
+	if err := bindWebsocketData(req, reactReq); err != nil {
+		return nil, err
+	}
+	return reactChatMessageByRequest(ctx, reactReq)
+}
+
+// websocketChatEventAction 通过websocket发送聊天瞬时事件
+func websocketChatEventAction(ctx *gin.Context, req *WebsocketMessageRequest) (any, error) {
+	eventReq := new(SendChatEventRequest)
+	if err := bindWebsocketData(req, eventReq); err != nil {
+		return nil, err
+	}
+	return nil, sendChatEventByRequest(ctx, eventReq)
+}
+
+// websocketPingAction 应用层心跳,收到任何消息都会刷新连接的超时时间,这里只需要返回pong
+func websocketPingAction(ctx *gin.Context, req *WebsocketMessageRequest) (any, error) {
+	return "pong", nil
 }
@@ -0,0 +1,140 @@
+package imaging
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"github.com/jerbe/jim/errors"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/2 10:50
+  @describe : blurhash编码,算法参考 https://github.com/woltapp/blurhash
+*/
+
+const (
+	// BlurhashXComponents 默认的横向分量数
+	BlurhashXComponents = 4
+
+	// BlurhashYComponents 默认的纵向分量数
+	BlurhashYComponents = 3
+
+	// blurhashSampleSize 计算前先把图片缩小到该尺寸,结果差别不大但快很多
+	blurhashSampleSize = 64
+
+	base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// Blurhash 计算图片的blurhash,客户端可以在原图加载完成前用它渲染模糊的占位图
+// xComponents,yComponents 取值范围为1-9
+func Blurhash(img image.Image, xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", errors.Wrap(errors.ParamsInvalid)
+	}
+
+	b := img.Bounds()
+	if b.Dx() > blurhashSampleSize || b.Dy() > blurhashSampleSize {
+		img = Resize(img, blurhashSampleSize)
+		b = img.Bounds()
+	}
+
+	width, height := b.Dx(), b.Dy()
+	if width == 0 || height == 0 {
+		return "", errors.Wrap(errors.ParamsInvalid)
+	}
+
+	// 先把像素转换成线性色彩空间,避免每个分量重复计算
+	pixels := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			pixels[y*width+x] = [3]float64{
+				sRGBToLinear(int(r >> 8)),
+				sRGBToLinear(int(g >> 8)),
+				sRGBToLinear(int(bl >> 8)),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				cy := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := 0; x < width; x++ {
+					basis := normalisation * math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) * cy
+					p := pixels[y*width+x]
+					factor[0] += basis * p[0]
+					factor[1] += basis * p[1]
+					factor[2] += basis * p[2]
+				}
+			}
+
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	sb := new(strings.Builder)
+	encodeBase83(sb, (xComponents-1)+(yComponents-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMaximumValue := 0.0
+		for _, f := range ac {
+			actualMaximumValue = math.Max(actualMaximumValue, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMaximumValue := int(math.Max(0, math.Min(82, math.Floor(actualMaximumValue*166-0.5))))
+		maximumValue = float64(quantisedMaximumValue+1) / 166
+		encodeBase83(sb, quantisedMaximumValue, 1)
+	} else {
+		encodeBase83(sb, 0, 1)
+	}
+
+	encodeBase83(sb, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+	for _, f := range ac {
+		encodeBase83(sb, blurhashQuantiseAC(f[0], maximumValue)*19*19+blurhashQuantiseAC(f[1], maximumValue)*19+blurhashQuantiseAC(f[2], maximumValue), 2)
+	}
+	return sb.String(), nil
+}
+
+// blurhashQuantiseAC 量化交流分量
+func blurhashQuantiseAC(value, maximumValue float64) int {
+	v := value / maximumValue
+	return int(math.Max(0, math.Min(18, math.Floor(math.Copysign(math.Sqrt(math.Abs(v)), v)*9+9.5))))
+}
+
+// encodeBase83 将数值按 base83 编码成 length 个字符
+func encodeBase83(sb *strings.Builder, value, length int) {
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		sb.WriteByte(base83Chars[digit])
+	}
+}
+
+// sRGBToLinear sRGB色值转换成线性色值
+func sRGBToLinear(value int) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB 线性色值转换成sRGB色值
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
@@ -0,0 +1,90 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+
+	"github.com/jerbe/jim/errors"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/2 10:20
+  @describe : 图片解码,缩放跟编码
+*/
+
+// ThumbnailQuality 缩略图跟视频封面的JPEG质量
+const ThumbnailQuality = 80
+
+// ErrTooManyPixels 图片像素数超过限制
+var ErrTooManyPixels = errors.New("image has too many pixels")
+
+// Decode 解码图片,支持jpeg,png,gif,webp
+// maxPixels 大于0时先读取图片尺寸,超过限制时不解码,防止解压炸弹
+func Decode(r io.ReadSeeker, maxPixels int64) (image.Image, error) {
+	if maxPixels > 0 {
+		cfg, _, err := image.DecodeConfig(r)
+		if err != nil {
+			return nil, errors.Wrap(err)
+		}
+
+		if int64(cfg.Width)*int64(cfg.Height) > maxPixels {
+			return nil, errors.Wrap(ErrTooManyPixels)
+		}
+
+		if _, err = r.Seek(0, io.SeekStart); err != nil {
+			return nil, errors.Wrap(err)
+		}
+	}
+
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return img, nil
+}
+
+// FitSize 按比例缩小到最长边不超过 maxSide,不会放大
+func FitSize(width, height, maxSide int) (int, int) {
+	if width <= maxSide && height <= maxSide {
+		return width, height
+	}
+
+	if width >= height {
+		h := height * maxSide / width
+		if h < 1 {
+			h = 1
+		}
+		return maxSide, h
+	}
+
+	w := width * maxSide / height
+	if w < 1 {
+		w = 1
+	}
+	return w, maxSide
+}
+
+// Resize 按比例缩小图片到最长边不超过 maxSide
+// 透明部分会铺上白色背景,方便之后编码成JPEG
+func Resize(img image.Image, maxSide int) *image.RGBA {
+	b := img.Bounds()
+	w, h := FitSize(b.Dx(), b.Dy(), maxSide)
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+// EncodeJPEG 将图片编码成JPEG
+func EncodeJPEG(w io.Writer, img image.Image) error {
+	return errors.Wrap(jpeg.Encode(w, img, &jpeg.Options{Quality: ThumbnailQuality}))
+}
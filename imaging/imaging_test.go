@@ -0,0 +1,128 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/jerbe/jim/errors"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/2 14:10
+  @describe :
+*/
+
+// solidImage 生成纯色图片
+func solidImage(width, height int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestFitSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		maxSide       int
+		wantW, wantH  int
+	}{
+		{name: "小于最长边不放大", width: 100, height: 50, maxSide: 160, wantW: 100, wantH: 50},
+		{name: "横图", width: 1920, height: 1080, maxSide: 480, wantW: 480, wantH: 270},
+		{name: "竖图", width: 1080, height: 1920, maxSide: 480, wantW: 270, wantH: 480},
+		{name: "极窄的图片至少保留1像素", width: 10000, height: 1, maxSide: 160, wantW: 160, wantH: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h := FitSize(tt.width, tt.height, tt.maxSide)
+			if w != tt.wantW || h != tt.wantH {
+				t.Errorf("FitSize() = %d x %d, want %d x %d", w, h, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestResize(t *testing.T) {
+	// 透明图片缩放后铺上白色背景
+	img := Resize(image.NewNRGBA(image.Rect(0, 0, 400, 200)), 100)
+	if b := img.Bounds(); b.Dx() != 100 || b.Dy() != 50 {
+		t.Fatalf("Resize() bounds = %v", b)
+	}
+
+	if r, g, b, a := img.At(50, 25).RGBA(); r>>8 != 255 || g>>8 != 255 || b>>8 != 255 || a>>8 != 255 {
+		t.Errorf("Resize() 透明部分应该是白色, got %d,%d,%d,%d", r>>8, g>>8, b>>8, a>>8)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, solidImage(20, 10, color.Black)); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := Decode(bytes.NewReader(buf.Bytes()), 200)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 10 {
+		t.Errorf("Decode() bounds = %v", b)
+	}
+
+	if _, err = Decode(bytes.NewReader(buf.Bytes()), 199); !errors.Is(err, ErrTooManyPixels) {
+		t.Errorf("Decode() 超过像素限制时 error = %v, want %v", err, ErrTooManyPixels)
+	}
+
+	if _, err = Decode(strings.NewReader("not an image"), 0); err == nil {
+		t.Errorf("Decode() 不是图片时应该返回错误")
+	}
+}
+
+func TestBlurhash(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+	tests := []struct {
+		name    string
+		img     image.Image
+		x, y    int
+		wantLen int
+	}{
+		{name: "只有直流分量", img: solidImage(8, 8, red), x: 1, y: 1, wantLen: 6},
+		{name: "4x3分量", img: solidImage(32, 32, red), x: 4, y: 3, wantLen: 28},
+		{name: "大图先缩小", img: solidImage(500, 300, red), x: 4, y: 3, wantLen: 28},
+		{name: "9x9分量", img: solidImage(16, 16, red), x: 9, y: 9, wantLen: 166},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Blurhash(tt.img, tt.x, tt.y)
+			if err != nil {
+				t.Fatalf("Blurhash() error = %v", err)
+			}
+
+			// 长度为 1+1+4+2*(x*y-1),第一个字符是分量数,第3到6个字符是平均颜色
+			if len(got) != tt.wantLen {
+				t.Errorf("Blurhash() = %v, len = %d, want %d", got, len(got), tt.wantLen)
+			}
+			if sizeFlag := strings.IndexByte(base83Chars, got[0]); sizeFlag != (tt.x-1)+(tt.y-1)*9 {
+				t.Errorf("Blurhash() size flag = %d", sizeFlag)
+			}
+			if got[2:6] != "TI:j" {
+				t.Errorf("Blurhash() 平均颜色 = %v, want TI:j(#FF0000)", got[2:6])
+			}
+		})
+	}
+
+	if got, _ := Blurhash(solidImage(8, 8, red), 1, 1); got != "00TI:j" {
+		t.Errorf("Blurhash() = %v, want 00TI:j", got)
+	}
+
+	if _, err := Blurhash(solidImage(8, 8, red), 0, 10); err == nil {
+		t.Errorf("Blurhash() 分量数无效时应该返回错误")
+	}
+}
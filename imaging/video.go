@@ -0,0 +1,145 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jerbe/jim/errors"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/2 11:30
+  @describe : 视频封面跟时长
+*/
+
+// ffmpegDurationRegexp ffmpeg输出信息中的时长
+var ffmpegDurationRegexp = regexp.MustCompile(`Duration: (\d+):(\d{2}):(\d{2}(?:\.\d+)?)`)
+
+// VideoPoster 使用ffmpeg截取视频的第一帧作为封面,同时从输出信息中解析视频时长
+// 解析不到时长时返回的时长为0
+func VideoPoster(ctx context.Context, ffmpegPath, filename string) (image.Image, time.Duration, error) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-hide_banner", "-nostdin",
+		"-i", filename,
+		"-frames:v", "1",
+		"-f", "image2pipe", "-vcodec", "png", "-")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, 0, errors.New(err.Error() + ": " + lastLine(stderr.Bytes()))
+	}
+
+	img, _, err := image.Decode(stdout)
+	if err != nil {
+		return nil, 0, errors.Wrap(err)
+	}
+
+	duration, _ := parseFFmpegDuration(stderr.Bytes())
+	return img, duration, nil
+}
+
+// parseFFmpegDuration 从ffmpeg的输出信息中解析时长
+func parseFFmpegDuration(output []byte) (time.Duration, bool) {
+	m := ffmpegDurationRegexp.FindSubmatch(output)
+	if m == nil {
+		return 0, false
+	}
+
+	hours, _ := strconv.Atoi(string(m[1]))
+	minutes, _ := strconv.Atoi(string(m[2]))
+	seconds, _ := strconv.ParseFloat(string(m[3]), 64)
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)), true
+}
+
+// lastLine 获取输出信息的最后一行,ffmpeg的错误原因一般在最后一行
+func lastLine(output []byte) string {
+	output = bytes.TrimSpace(output)
+	if i := bytes.LastIndexByte(output, '\n'); i >= 0 {
+		output = output[i+1:]
+	}
+	return string(output)
+}
+
+// MP4Duration 从 moov/mvhd 中读取MP4跟MOV视频的时长,不需要ffmpeg
+func MP4Duration(r io.ReaderAt, size int64) (time.Duration, error) {
+	moov, moovSize, err := findMP4Box(r, 0, size, "moov")
+	if err != nil {
+		return 0, err
+	}
+
+	mvhd, mvhdSize, err := findMP4Box(r, moov, moovSize, "mvhd")
+	if err != nil {
+		return 0, err
+	}
+
+	// version(1) + flags(3),版本0的时间字段是32位,版本1的是64位
+	header := make([]byte, 32)
+	if mvhdSize < int64(len(header)) {
+		header = header[:mvhdSize]
+	}
+	if _, err = r.ReadAt(header, mvhd); err != nil {
+		return 0, errors.Wrap(err)
+	}
+
+	var timescale, duration uint64
+	switch {
+	case len(header) >= 32 && header[0] == 1:
+		timescale = uint64(binary.BigEndian.Uint32(header[20:24]))
+		duration = binary.BigEndian.Uint64(header[24:32])
+	case len(header) >= 20 && header[0] == 0:
+		timescale = uint64(binary.BigEndian.Uint32(header[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(header[16:20]))
+	default:
+		return 0, errors.Wrap(errors.ParamsInvalid)
+	}
+
+	if timescale == 0 {
+		return 0, errors.Wrap(errors.ParamsInvalid)
+	}
+	// 分开计算整数秒跟余数,避免乘法溢出
+	return time.Duration(duration/timescale)*time.Second + time.Duration(duration%timescale*uint64(time.Second)/timescale), nil
+}
+
+// findMP4Box 在 [offset, offset+size) 范围内查找指定类型的box,返回box内容的偏移量跟字节数
+func findMP4Box(r io.ReaderAt, offset, size int64, boxType string) (int64, int64, error) {
+	end := offset + size
+	header := make([]byte, 16)
+	for offset+8 <= end {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return 0, 0, errors.Wrap(err)
+		}
+
+		boxSize := int64(binary.BigEndian.Uint32(header[:4]))
+		headerSize := int64(8)
+		switch boxSize {
+		case 0:
+			// 一直到文件末尾
+			boxSize = end - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return 0, 0, errors.Wrap(err)
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+
+		if boxSize < headerSize || offset+boxSize > end {
+			break
+		}
+
+		if string(header[4:8]) == boxType {
+			return offset + headerSize, boxSize - headerSize, nil
+		}
+		offset += boxSize
+	}
+	return 0, 0, errors.Wrap(errors.NoRecords)
+}
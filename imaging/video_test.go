@@ -0,0 +1,81 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/2 14:40
+  @describe :
+*/
+
+// mp4Box 生成一个MP4 box
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	box := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(box, uint32(8+len(body)))
+	copy(box[4:], boxType)
+	return append(box, body...)
+}
+
+func TestMP4Duration(t *testing.T) {
+	// 版本0: version+flags(4) creation(4) modification(4) timescale(4) duration(4)
+	mvhd0 := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd0[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd0[16:], 12500)
+
+	// 版本1: version+flags(4) creation(8) modification(8) timescale(4) duration(8)
+	mvhd1 := make([]byte, 112)
+	mvhd1[0] = 1
+	binary.BigEndian.PutUint32(mvhd1[20:], 600)
+	binary.BigEndian.PutUint64(mvhd1[24:], 600*90)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "版本0", data: bytes.Join([][]byte{mp4Box("ftyp", []byte("isom")), mp4Box("moov", mp4Box("mvhd", mvhd0))}, nil), want: 12500 * time.Millisecond},
+		{name: "版本1", data: bytes.Join([][]byte{mp4Box("ftyp", []byte("isom")), mp4Box("mdat", make([]byte, 32)), mp4Box("moov", mp4Box("trak"), mp4Box("mvhd", mvhd1))}, nil), want: 90 * time.Second},
+		{name: "没有moov", data: mp4Box("ftyp", []byte("isom")), wantErr: true},
+		{name: "box大小超出文件", data: append([]byte{0, 0, 1, 0}, []byte("moov")...), wantErr: true},
+		{name: "mvhd太短", data: mp4Box("moov", mp4Box("mvhd", make([]byte, 8))), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MP4Duration(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MP4Duration() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("MP4Duration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFFmpegDuration(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   time.Duration
+		wantOK bool
+	}{
+		{name: "正常", output: "Input #0, mov,mp4,m4a,3gp,3g2,mj2, from 'a.mp4':\n  Duration: 00:01:02.50, start: 0.000000, bitrate: 1205 kb/s\n", want: 62500 * time.Millisecond, wantOK: true},
+		{name: "超过一小时", output: "  Duration: 01:00:00.00, start: 0.000000", want: time.Hour, wantOK: true},
+		{name: "没有时长", output: "  Duration: N/A, bitrate: N/A", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseFFmpegDuration([]byte(tt.output))
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("parseFFmpegDuration() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
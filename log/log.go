@@ -1,6 +1,7 @@
 package log
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -147,3 +148,23 @@ func FatalFromGinContext(ctx *gin.Context) *zerolog.Event {
 func PanicFromGinContext(ctx *gin.Context) *zerolog.Event {
 	return parseGinContextToLog(Panic(), ctx)
 }
+
+// parseContextToLog 是请求的上下文时带上请求信息,后台任务的上下文不带
+func parseContextToLog(evt *zerolog.Event, ctx context.Context) *zerolog.Event {
+	if ginCtx, ok := ctx.(*gin.Context); ok && ginCtx.Request != nil {
+		return parseGinContextToLog(evt, ginCtx)
+	}
+	return evt
+}
+
+func InfoFromContext(ctx context.Context) *zerolog.Event {
+	return parseContextToLog(Info(), ctx)
+}
+
+func WarnFromContext(ctx context.Context) *zerolog.Event {
+	return parseContextToLog(Warn(), ctx)
+}
+
+func ErrorFromContext(ctx context.Context) *zerolog.Event {
+	return parseContextToLog(Error(), ctx)
+}
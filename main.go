@@ -16,6 +16,9 @@ import (
 	"github.com/jerbe/jim/handler"
 	"github.com/jerbe/jim/log"
 	"github.com/jerbe/jim/pubsub"
+	"github.com/jerbe/jim/search"
+	"github.com/jerbe/jim/storage"
+	"github.com/jerbe/jim/websocket"
 )
 
 /**
@@ -33,6 +36,12 @@ func main() {
 	// 初始化订阅服务
 	handler.InitSubscribe()
 
+	// 初始化媒体元数据提取任务
+	handler.InitMediaWorker()
+	handler.InitChatScheduler()
+	handler.InitChatOutboxRelay()
+	handler.InitChatRepairJob()
+
 	// 初始化Http路由器
 	mainHttpRouter := handler.InitRouter()
 	mainHttpListenPort := fmt.Sprintf(":%d", config.GlobConfig().Http.MainListenPort)
@@ -106,8 +115,24 @@ func init() {
 	}
 	log.Info().Msg("推收模块('pubsub')初始完成")
 
+	// 配置websocket模块
+	err = websocket.Init(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("websocket模块('websocket')初始化失败")
+	}
+
 	// 配置数据库
 	if _, err = database.Init(cfg); err != nil {
 		log.Fatal().Err(err).Msg("数据模块('database')初始化失败")
 	}
+
+	// 配置文件存储
+	if err = storage.Init(cfg); err != nil {
+		log.Fatal().Err(err).Msg("存储模块('storage')初始化失败")
+	}
+
+	// 配置搜索
+	if err = search.Init(cfg); err != nil {
+		log.Fatal().Err(err).Msg("搜索模块('search')初始化失败")
+	}
 }
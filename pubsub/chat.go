@@ -2,6 +2,7 @@ package pubsub
 
 import (
 	"context"
+	"encoding/json"
 	"sync"
 )
 
@@ -33,6 +34,12 @@ func NewChatMessage() *ChatMessage {
 	msg.MessageID = 0
 	msg.CreatedAt = 0
 	msg.Body = nil
+	msg.ReplyTo = nil
+	msg.ThreadID = 0
+	msg.Mentions = nil
+	msg.MentionAll = false
+	msg.ExpireAt = 0
+	msg.ForwardFromID = 0
 	msg.PublishTargets = nil
 	return msg
 }
@@ -63,6 +70,24 @@ type ChatMessage struct {
 	// Body 消息体;
 	Body *ChatMessageBody `json:"body"`
 
+	// ReplyTo 回复的消息快照
+	ReplyTo *ChatMessageQuote `json:"reply_to,omitempty"`
+
+	// ThreadID 所属话题的根消息ID
+	ThreadID int64 `json:"thread_id,omitempty"`
+
+	// Mentions 被@的用户ID列表
+	Mentions []int64 `json:"mentions,omitempty"`
+
+	// MentionAll 是否@所有人
+	MentionAll bool `json:"mention_all,omitempty"`
+
+	// ExpireAt 过期时间,大于0时到期后消息会被清空
+	ExpireAt int64 `json:"expire_at,omitempty"`
+
+	// ForwardFromID 逐条转发时原消息的发送人ID
+	ForwardFromID int64 `json:"forward_from_id,omitempty"`
+
 	// PublishTargets 推送目标列表
 	// 为什么增加 PublishTargets 这个参数?
 	// 因为分布式中,会多个服务实例都订阅到该方法,将导致多个服务实例再去查询数据库,比方说群成员列表等,所以预先加入 PublishTargets .
@@ -70,19 +95,94 @@ type ChatMessage struct {
 	PublishTargets []int64 `json:"publish_targets,omitempty"`
 }
 
+// ChatMessageThumbnail 图片消息的缩略图
+type ChatMessageThumbnail struct {
+	// Src 缩略图地址
+	Src string `bson:"src" json:"src"`
+
+	// Width 宽度,单位像素
+	Width int `bson:"width" json:"width"`
+
+	// Height 高度,单位像素
+	Height int `bson:"height" json:"height"`
+}
+
 // ChatMessageBody 消息主体
 type ChatMessageBody struct {
-	// 文本信息。适用消息类型: 1
+	// 文本信息。适用消息类型: 1,9
 	Text string `bson:"text,omitempty" json:"text,omitempty"`
 
-	// 来源地址。通用字段，适用消息类型: 2,3,4
+	// 来源地址。通用字段，适用消息类型: 2,3,4,6,7
 	Src string `bson:"src,omitempty" json:"src,omitempty"`
 
-	// 文件格式。适用消息类型: 2,3,4
+	// 文件格式。适用消息类型: 2,3,4,7
 	Format string `bson:"format,omitempty" json:"format,omitempty"`
 
-	// 文件大小。适用消息类型: 2,3,4
-	Size string `bson:"size,omitempty" json:"size,omitempty"`
+	// 文件大小,单位字节。适用消息类型: 2,3,4,6
+	Size int64 `bson:"size,omitempty" json:"size,omitempty"`
+
+	// 媒体文件ID,来源地址是本服务上传的文件时由服务端填写。适用消息类型: 2,3,4,6
+	MediaID string `bson:"media_id,omitempty" json:"media_id,omitempty"`
+
+	// 宽度,单位像素,由服务端提取。适用消息类型: 2,4
+	Width int `bson:"width,omitempty" json:"width,omitempty"`
+
+	// 高度,单位像素,由服务端提取。适用消息类型: 2,4
+	Height int `bson:"height,omitempty" json:"height,omitempty"`
+
+	// 模糊占位图的blurhash,由服务端提取。适用消息类型: 2,4
+	Blurhash string `bson:"blurhash,omitempty" json:"blurhash,omitempty"`
+
+	// 缩略图,按尺寸从小到大排列,由服务端生成。适用消息类型: 2
+	Thumbnails []ChatMessageThumbnail `bson:"thumbnails,omitempty" json:"thumbnails,omitempty"`
+
+	// 视频封面地址,由服务端生成。适用消息类型: 4
+	Poster string `bson:"poster,omitempty" json:"poster,omitempty"`
+
+	// 时长,单位毫秒,由服务端提取。适用消息类型: 4
+	Duration int64 `bson:"duration,omitempty" json:"duration,omitempty"`
+
+	// 文件名称。适用消息类型: 6
+	Name string `bson:"name,omitempty" json:"name,omitempty"`
+
+	// 文件MIME类型。适用消息类型: 6
+	Mime string `bson:"mime,omitempty" json:"mime,omitempty"`
+
+	// 表情贴纸ID。适用消息类型: 7
+	StickerID string `bson:"sticker_id,omitempty" json:"sticker_id,omitempty"`
+
+	// 表情贴纸所属的表情包ID。适用消息类型: 7
+	PackID string `bson:"pack_id,omitempty" json:"pack_id,omitempty"`
+
+	// 卡片类型。适用消息类型: 8
+	CardType string `bson:"card_type,omitempty" json:"card_type,omitempty"`
+
+	// 卡片标题。适用消息类型: 8
+	Title string `bson:"title,omitempty" json:"title,omitempty"`
+
+	// 卡片描述。适用消息类型: 8
+	Description string `bson:"description,omitempty" json:"description,omitempty"`
+
+	// 链接地址。适用消息类型: 8
+	URL string `bson:"url,omitempty" json:"url,omitempty"`
+
+	// 名片对应的用户ID或者群ID。适用消息类型: 8
+	TargetID int64 `bson:"target_id,omitempty" json:"target_id,omitempty"`
+
+	// 系统通知事件。适用消息类型: 9
+	Event string `bson:"event,omitempty" json:"event,omitempty"`
+
+	// 触发系统通知的用户ID。适用消息类型: 9
+	OperatorID int64 `bson:"operator_id,omitempty" json:"operator_id,omitempty"`
+
+	// 系统通知涉及的用户ID列表。适用消息类型: 9
+	UserIDs []int64 `bson:"user_ids,omitempty" json:"user_ids,omitempty"`
+
+	// 自定义消息的应用类型标识。适用消息类型: 10
+	CustomType string `bson:"custom_type,omitempty" json:"custom_type,omitempty"`
+
+	// 自定义消息的JSON数据。适用消息类型: 10
+	Data json.RawMessage `bson:"data,omitempty" json:"data,omitempty"`
 
 	// 位置信息-经度。 适用消息类型: 5
 	Longitude string `bson:"longitude,omitempty" json:"longitude,omitempty"`
@@ -95,18 +195,47 @@ type ChatMessageBody struct {
 
 	// 位置信息标签。适用消息类型: 5
 	LocationLabel string `bson:"location_label,omitempty" json:"location_label,omitempty"`
+
+	// 合并转发的消息快照。适用消息类型: 11
+	Items []ChatMessageForwardItem `bson:"items,omitempty" json:"items,omitempty"`
+}
+
+// ChatMessageForwardItem 合并转发中的一条消息快照
+type ChatMessageForwardItem struct {
+	// SenderID 原消息的发送人ID
+	SenderID int64 `json:"sender_id"`
+
+	// Type 原消息的类型
+	Type int `json:"type"`
+
+	// Body 原消息的主体
+	Body ChatMessageBody `json:"body"`
+
+	// CreatedAt 原消息的发送时间
+	CreatedAt int64 `json:"created_at"`
+}
+
+// ChatMessageQuote 被回复消息的快照
+type ChatMessageQuote struct {
+	// MessageID 被回复的消息ID
+	MessageID int64 `json:"message_id"`
+
+	// SenderID 被回复消息的发送人ID
+	SenderID int64 `json:"sender_id"`
+
+	// Type 被回复消息的类型
+	Type int `json:"type"`
+
+	// Body 被回复消息的主体
+	Body *ChatMessageBody `json:"body"`
+
+	// CreatedAt 被回复消息的发送时间
+	CreatedAt int64 `json:"created_at"`
 }
 
 func NewChatMessageBody() *ChatMessageBody {
 	body := chatMessageBodyPool.Get().(*ChatMessageBody)
-	body.Text = ""
-	body.Src = ""
-	body.Format = ""
-	body.Size = ""
-	body.Longitude = ""
-	body.Latitude = ""
-	body.Scale = 0
-	body.LocationLabel = ""
+	*body = ChatMessageBody{}
 	return body
 }
 
@@ -116,3 +245,225 @@ func PublishChatMessage(ctx context.Context, data *ChatMessage) error {
 	chatMessagePool.Put(data)
 	return err
 }
+
+// ChatReadReceipt 订阅传输用的已读回执
+type ChatReadReceipt struct {
+	// SessionType 会话类型; 1:私聊
+	SessionType int `json:"session_type"`
+
+	// ReaderID 阅读人ID
+	ReaderID int64 `json:"reader_id"`
+
+	// TargetID 消息发送人ID
+	TargetID int64 `json:"target_id"`
+
+	// MessageID 已读到的消息ID
+	MessageID int64 `json:"message_id"`
+
+	// ReadAt 阅读时间
+	ReadAt int64 `json:"read_at"`
+}
+
+// PublishChatReadReceipt 发布已读回执到其他服务器上
+func PublishChatReadReceipt(ctx context.Context, data *ChatReadReceipt) error {
+	return PublishWithPayload(ctx, ChannelChatMessage, PayloadTypeChatReadReceipt, data)
+}
+
+// ChatMessageRollback 订阅传输用的消息撤回通知
+type ChatMessageRollback struct {
+	// SessionType 会话类型; 1:私聊, 2:群聊
+	SessionType int `json:"session_type"`
+
+	// SenderID 消息发送人ID
+	SenderID int64 `json:"sender_id"`
+
+	// ReceiverID 接收人; 私聊为对方用户ID,群聊为群ID
+	ReceiverID int64 `json:"receiver_id"`
+
+	// MessageID 被撤回的消息ID
+	MessageID int64 `json:"message_id"`
+
+	// ThreadID 被撤回消息所在话题的根消息ID
+	ThreadID int64 `json:"thread_id,omitempty"`
+
+	// OperatorID 撤回人ID,群主或管理员撤回他人消息时与发送人不同
+	OperatorID int64 `json:"operator_id"`
+
+	// RollbackAt 撤回时间
+	RollbackAt int64 `json:"rollback_at"`
+
+	// PublishTargets 推送目标列表,群聊时预先填入群成员ID
+	PublishTargets []int64 `json:"publish_targets,omitempty"`
+}
+
+// PublishChatMessageRollback 发布消息撤回通知到其他服务器上
+func PublishChatMessageRollback(ctx context.Context, data *ChatMessageRollback) error {
+	return PublishWithPayload(ctx, ChannelChatMessage, PayloadTypeChatMessageRollback, data)
+}
+
+// ChatMessageExpired 订阅传输用的阅后即焚消息过期通知
+type ChatMessageExpired struct {
+	// SessionType 会话类型; 1:私聊, 2:群聊, 99:世界频道
+	SessionType int `json:"session_type"`
+
+	// SenderID 消息发送人ID
+	SenderID int64 `json:"sender_id"`
+
+	// ReceiverID 接收人; 私聊为对方用户ID,群聊为群ID,世界频道为世界频道ID
+	ReceiverID int64 `json:"receiver_id"`
+
+	// MessageID 过期的消息ID
+	MessageID int64 `json:"message_id"`
+
+	// ThreadID 过期消息所在话题的根消息ID
+	ThreadID int64 `json:"thread_id,omitempty"`
+
+	// ExpiredAt 过期时间
+	ExpiredAt int64 `json:"expired_at"`
+
+	// PublishTargets 推送目标列表,群聊时预先填入群成员ID
+	PublishTargets []int64 `json:"publish_targets,omitempty"`
+}
+
+// PublishChatMessageExpired 发布阅后即焚消息过期通知到其他服务器上
+func PublishChatMessageExpired(ctx context.Context, data *ChatMessageExpired) error {
+	return PublishWithPayload(ctx, ChannelChatMessage, PayloadTypeChatMessageExpired, data)
+}
+
+// ChatMessageEdit 订阅传输用的消息编辑通知
+type ChatMessageEdit struct {
+	// SessionType 会话类型; 1:私聊, 2:群聊, 99:世界频道
+	SessionType int `json:"session_type"`
+
+	// SenderID 消息发送人ID
+	SenderID int64 `json:"sender_id"`
+
+	// ReceiverID 接收人; 私聊为对方用户ID,群聊为群ID,世界频道为世界频道ID
+	ReceiverID int64 `json:"receiver_id"`
+
+	// MessageID 被编辑的消息ID
+	MessageID int64 `json:"message_id"`
+
+	// ThreadID 被编辑消息所在话题的根消息ID
+	ThreadID int64 `json:"thread_id,omitempty"`
+
+	// Body 编辑后的消息主体
+	Body *ChatMessageBody `json:"body"`
+
+	// EditedAt 编辑时间
+	EditedAt int64 `json:"edited_at"`
+
+	// PublishTargets 推送目标列表,群聊时预先填入群成员ID
+	PublishTargets []int64 `json:"publish_targets,omitempty"`
+}
+
+// PublishChatMessageEdit 发布消息编辑通知到其他服务器上
+func PublishChatMessageEdit(ctx context.Context, data *ChatMessageEdit) error {
+	return PublishWithPayload(ctx, ChannelChatMessage, PayloadTypeChatMessageEdit, data)
+}
+
+// ChatMessageMedia 订阅传输用的消息媒体元数据补充通知
+type ChatMessageMedia struct {
+	// SessionType 会话类型; 1:私聊, 2:群聊, 99:世界频道
+	SessionType int `json:"session_type"`
+
+	// SenderID 消息发送人ID
+	SenderID int64 `json:"sender_id"`
+
+	// ReceiverID 接收人; 私聊为对方用户ID,群聊为群ID,世界频道为世界频道ID
+	ReceiverID int64 `json:"receiver_id"`
+
+	// MessageID 补充了元数据的消息ID
+	MessageID int64 `json:"message_id"`
+
+	// ThreadID 消息所在话题的根消息ID
+	ThreadID int64 `json:"thread_id,omitempty"`
+
+	// Body 补充了宽高,缩略图跟封面的消息主体
+	Body *ChatMessageBody `json:"body"`
+
+	// UpdatedAt 更新时间
+	UpdatedAt int64 `json:"updated_at"`
+
+	// PublishTargets 推送目标列表,群聊时预先填入群成员ID
+	PublishTargets []int64 `json:"publish_targets,omitempty"`
+}
+
+// PublishChatMessageMedia 发布消息媒体元数据补充通知到其他服务器上
+func PublishChatMessageMedia(ctx context.Context, data *ChatMessageMedia) error {
+	return PublishWithPayload(ctx, ChannelChatMessage, PayloadTypeChatMessageMedia, data)
+}
+
+// ChatMessageReaction 订阅传输用的表情回应变更
+type ChatMessageReaction struct {
+	// SessionType 会话类型; 1:私聊, 2:群聊, 99:世界频道
+	SessionType int `json:"session_type"`
+
+	// ReactorID 回应人ID
+	ReactorID int64 `json:"reactor_id"`
+
+	// ReceiverID 接收人; 私聊为对方用户ID,群聊为群ID,世界频道为世界频道ID
+	ReceiverID int64 `json:"receiver_id"`
+
+	// MessageID 被回应的消息ID
+	MessageID int64 `json:"message_id"`
+
+	// ThreadID 被回应消息所在话题的根消息ID
+	ThreadID int64 `json:"thread_id,omitempty"`
+
+	// Emoji 表情
+	Emoji string `json:"emoji"`
+
+	// Action 变更类型; add-添加,remove-取消
+	Action string `json:"action"`
+
+	// Count 变更后该表情的回应人数
+	Count int `json:"count"`
+
+	// ReactedAt 变更时间
+	ReactedAt int64 `json:"reacted_at"`
+
+	// PublishTargets 推送目标列表,群聊时预先填入群成员ID
+	PublishTargets []int64 `json:"publish_targets,omitempty"`
+}
+
+// PublishChatMessageReaction 发布表情回应变更到其他服务器上
+func PublishChatMessageReaction(ctx context.Context, data *ChatMessageReaction) error {
+	return PublishWithPayload(ctx, ChannelChatMessage, PayloadTypeChatMessageReaction, data)
+}
+
+// ChatMessageDeleted 订阅传输用的消息删除通知
+// 删除只对删除人生效,所以只推送给删除人的所有设备
+type ChatMessageDeleted struct {
+	// UserID 删除人ID
+	UserID int64 `json:"user_id"`
+
+	// SessionType 会话类型; 1:私聊, 2:群聊, 99:世界频道
+	SessionType int `json:"session_type"`
+
+	// TargetID 目标ID; 朋友ID/群ID/世界频道ID
+	TargetID int64 `json:"target_id"`
+
+	// ThreadID 被删除消息所在话题的根消息ID
+	ThreadID int64 `json:"thread_id,omitempty"`
+
+	// MessageIDs 被删除的消息ID列表
+	MessageIDs []int64 `json:"message_ids,omitempty"`
+
+	// StartMessageID 按范围删除时的起始消息ID
+	StartMessageID int64 `json:"start_message_id,omitempty"`
+
+	// EndMessageID 按范围删除时的结束消息ID
+	EndMessageID int64 `json:"end_message_id,omitempty"`
+
+	// ClearedMessageID 清空会话时的最后消息ID
+	ClearedMessageID int64 `json:"cleared_message_id,omitempty"`
+
+	// DeletedAt 删除时间
+	DeletedAt int64 `json:"deleted_at"`
+}
+
+// PublishChatMessageDeleted 发布消息删除通知到其他服务器上
+func PublishChatMessageDeleted(ctx context.Context, data *ChatMessageDeleted) error {
+	return PublishWithPayload(ctx, ChannelChatMessage, PayloadTypeChatMessageDeleted, data)
+}
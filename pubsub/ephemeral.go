@@ -0,0 +1,47 @@
+package pubsub
+
+import "context"
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/25 10:20
+  @describe :
+*/
+
+const (
+	// ChatEventTyping 正在输入
+	ChatEventTyping = "typing"
+
+	// ChatEventRecording 正在录音
+	ChatEventRecording = "recording"
+
+	// ChatEventStopped 停止输入/录音
+	ChatEventStopped = "stopped"
+)
+
+// ChatEvent 订阅传输用的聊天瞬时事件
+// 瞬时事件只在线推送,不会写入数据库,离线的用户不会收到
+type ChatEvent struct {
+	// Event 事件类型; typing-正在输入,recording-正在录音,stopped-停止
+	Event string `json:"event"`
+
+	// SessionType 会话类型; 1:私聊, 2:群聊
+	SessionType int `json:"session_type"`
+
+	// SenderID 发送人ID
+	SenderID int64 `json:"sender_id"`
+
+	// ReceiverID 接收人; 私聊为对方用户ID,群聊为群ID
+	ReceiverID int64 `json:"receiver_id"`
+
+	// CreatedAt 创建时间
+	CreatedAt int64 `json:"created_at"`
+
+	// PublishTargets 推送目标列表,群聊时预先填入群成员ID,避免每个订阅的服务实例都去查询数据库
+	PublishTargets []int64 `json:"publish_targets,omitempty"`
+}
+
+// PublishChatEvent 发布聊天瞬时事件到其他服务器上
+func PublishChatEvent(ctx context.Context, data *ChatEvent) error {
+	return PublishWithPayload(ctx, ChannelEphemeral, PayloadTypeChatEvent, data)
+}
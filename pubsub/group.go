@@ -0,0 +1,43 @@
+package pubsub
+
+import "context"
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/4 11:30
+  @describe :
+*/
+
+const (
+	// GroupPinActionPin 置顶
+	GroupPinActionPin = "pin"
+
+	// GroupPinActionUnpin 取消置顶
+	GroupPinActionUnpin = "unpin"
+)
+
+// GroupPin 订阅传输用的群置顶消息变更
+type GroupPin struct {
+	// GroupID 群ID
+	GroupID int64 `json:"group_id"`
+
+	// OperatorID 操作人ID
+	OperatorID int64 `json:"operator_id"`
+
+	// MessageID 被置顶或取消置顶的消息ID
+	MessageID int64 `json:"message_id"`
+
+	// Action 变更类型; pin-置顶,unpin-取消置顶
+	Action string `json:"action"`
+
+	// CreatedAt 变更时间
+	CreatedAt int64 `json:"created_at"`
+
+	// PublishTargets 推送目标列表,预先填入群成员ID
+	PublishTargets []int64 `json:"publish_targets,omitempty"`
+}
+
+// PublishGroupPin 发布群置顶消息变更到其他服务器上
+func PublishGroupPin(ctx context.Context, data *GroupPin) error {
+	return PublishNotifyMessage(ctx, PayloadTypeGroupPin, data)
+}
@@ -22,6 +22,9 @@ const (
 
 	// ChannelNotify 提送通道推送消息
 	ChannelNotify = "notify"
+
+	// ChannelEphemeral 推送通道瞬时事件,例如正在输入,不做任何持久化
+	ChannelEphemeral = "ephemeral"
 )
 
 const (
@@ -30,6 +33,36 @@ const (
 
 	// PayloadTypeFriendInvite 好友邀请
 	PayloadTypeFriendInvite = "friend_invite"
+
+	// PayloadTypeChatReadReceipt 聊天消息已读回执
+	PayloadTypeChatReadReceipt = "read_receipt"
+
+	// PayloadTypeChatMessageRollback 聊天消息已被撤回
+	PayloadTypeChatMessageRollback = "chat_message_rollback"
+
+	// PayloadTypeChatMessageExpired 阅后即焚的聊天消息已过期
+	PayloadTypeChatMessageExpired = "chat_message_expired"
+
+	// PayloadTypeChatMessageEdit 聊天消息已被编辑
+	PayloadTypeChatMessageEdit = "chat_message_edit"
+
+	// PayloadTypeChatMessageMedia 聊天消息补充了媒体元数据
+	PayloadTypeChatMessageMedia = "chat_message_media"
+
+	// PayloadTypeChatMessageReaction 聊天消息表情回应变更
+	PayloadTypeChatMessageReaction = "chat_message_reaction"
+
+	// PayloadTypeChatMessageDeleted 聊天消息已被用户删除
+	PayloadTypeChatMessageDeleted = "chat_message_deleted"
+
+	// PayloadTypeChatMention 聊天消息中@了用户
+	PayloadTypeChatMention = "mention"
+
+	// PayloadTypeChatEvent 聊天瞬时事件
+	PayloadTypeChatEvent = "chat_event"
+
+	// PayloadTypeGroupPin 群置顶消息变更
+	PayloadTypeGroupPin = "group_pin"
 )
 
 func Init(cfg config.Config) error {
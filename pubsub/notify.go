@@ -19,6 +19,38 @@ func PublishNotifyMessage(ctx context.Context, typ string, data any) error {
 	return PublishWithPayload(ctx, ChannelNotify, typ, data)
 }
 
+// ChatMention 订阅传输用的@通知
+type ChatMention struct {
+	// SessionType 会话类型; 目前只有 2:群聊
+	SessionType int `json:"session_type"`
+
+	// SenderID 发送人ID
+	SenderID int64 `json:"sender_id"`
+
+	// ReceiverID 接收人; 群聊为群ID
+	ReceiverID int64 `json:"receiver_id"`
+
+	// MessageID 消息ID
+	MessageID int64 `json:"message_id"`
+
+	// ThreadID 消息所在话题的根消息ID
+	ThreadID int64 `json:"thread_id,omitempty"`
+
+	// MentionAll 是否@所有人
+	MentionAll bool `json:"mention_all,omitempty"`
+
+	// CreatedAt 消息发送时间
+	CreatedAt int64 `json:"created_at"`
+
+	// PublishTargets 被@的用户ID列表
+	PublishTargets []int64 `json:"publish_targets,omitempty"`
+}
+
+// PublishChatMention 发布@通知到其他服务器上
+func PublishChatMention(ctx context.Context, data *ChatMention) error {
+	return PublishNotifyMessage(ctx, PayloadTypeChatMention, data)
+}
+
 // notifyMessageHandler 接收通知消息
 func notifyMessageHandler(ctx context.Context, msg *redis.Message) {
 	payload := &Payload{}
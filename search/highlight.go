@@ -0,0 +1,176 @@
+package search
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/jerbe/jim/database"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/3 10:40
+  @describe : 关键词高亮
+*/
+
+const (
+	// snippetContext 片段中保留的第一个关键词之前的字符数
+	snippetContext = 20
+
+	// snippetLength 片段的最大字符数,不包含省略号
+	snippetLength = 80
+
+	// snippetEllipsis 片段被截断时使用的省略号
+	snippetEllipsis = "…"
+)
+
+// Terms 把关键词按空白拆分,去掉双引号跟重复的关键词
+func Terms(keyword string) []string {
+	var terms []string
+	seen := make(map[string]struct{})
+	for _, term := range strings.Fields(strings.ReplaceAll(keyword, `"`, " ")) {
+		lower := strings.ToLower(term)
+		if _, ok := seen[lower]; ok {
+			continue
+		}
+		seen[lower] = struct{}{}
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// Highlights 在消息主体的文本字段中查找关键词,返回命中的片段
+func Highlights(body *database.ChatMessageBody, terms []string) []Highlight {
+	if len(terms) == 0 {
+		return nil
+	}
+
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{name: "text", value: body.Text},
+		{name: "name", value: body.Name},
+		{name: "title", value: body.Title},
+		{name: "description", value: body.Description},
+	}
+
+	var highlights []Highlight
+	for _, field := range fields {
+		if h, ok := highlightText(field.name, field.value, terms); ok {
+			highlights = append(highlights, h)
+		}
+	}
+	return highlights
+}
+
+// highlightText 查找关键词在文本中的位置,并截取第一个关键词附近的片段
+func highlightText(field, text string, terms []string) (Highlight, bool) {
+	if text == "" {
+		return Highlight{}, false
+	}
+
+	runes := []rune(text)
+	lower := lowerRunes(runes)
+	var ranges [][2]int
+	for _, term := range terms {
+		t := lowerRunes([]rune(term))
+		for i := 0; i+len(t) <= len(lower); {
+			if runesEqual(lower[i:i+len(t)], t) {
+				ranges = append(ranges, [2]int{i, i + len(t)})
+				i += len(t)
+				continue
+			}
+			i++
+		}
+	}
+
+	if len(ranges) == 0 {
+		return Highlight{}, false
+	}
+	ranges = mergeRanges(ranges)
+
+	start := ranges[0][0] - snippetContext
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetLength
+	if end < ranges[0][1] {
+		end = ranges[0][1]
+	}
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	h := Highlight{Field: field}
+	offset := -start
+	if start > 0 {
+		h.Snippet = snippetEllipsis
+		offset += len([]rune(snippetEllipsis))
+	}
+	h.Snippet += string(runes[start:end])
+	if end < len(runes) {
+		h.Snippet += snippetEllipsis
+	}
+
+	for _, r := range ranges {
+		if r[0] < start || r[1] > end {
+			continue
+		}
+		h.Ranges = append(h.Ranges, [2]int{r[0] + offset, r[1] + offset})
+	}
+	return h, true
+}
+
+// mergeRanges 排序并合并重叠的位置
+func mergeRanges(ranges [][2]int) [][2]int {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i][0] < ranges[j][0]
+	})
+
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] <= last[1] {
+			if r[1] > last[1] {
+				last[1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// lowerRunes 逐个字符转换成小写,保证转换前后的位置一致
+func lowerRunes(runes []rune) []rune {
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	return lower
+}
+
+// runesEqual 比较两个字符切片是否相同
+func runesEqual(a, b []rune) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hasCJK 是否包含中日韩文字,MongoDB的文本索引不能对这些文字分词
+func hasCJK(s string) bool {
+	for _, r := range s {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/3 15:20
+  @describe :
+*/
+
+func TestTerms(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyword string
+		want    []string
+	}{
+		{name: "空关键词", keyword: "  ", want: nil},
+		{name: "多个关键词", keyword: "周末  聚餐", want: []string{"周末", "聚餐"}},
+		{name: "去掉双引号", keyword: `"hello world"`, want: []string{"hello", "world"}},
+		{name: "忽略大小写去重", keyword: "Go go GO", want: []string{"Go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Terms(tt.keyword); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Terms() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHighlightText(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		terms  []string
+		want   Highlight
+		wantOk bool
+	}{
+		{
+			name:   "没有命中",
+			text:   "hello",
+			terms:  []string{"world"},
+			wantOk: false,
+		},
+		{
+			name:   "中文按字符计算位置",
+			text:   "这个周末一起去聚餐吧",
+			terms:  []string{"周末", "聚餐"},
+			want:   Highlight{Field: "text", Snippet: "这个周末一起去聚餐吧", Ranges: [][2]int{{2, 4}, {7, 9}}},
+			wantOk: true,
+		},
+		{
+			name:   "忽略大小写并合并重叠位置",
+			text:   "Hello HELLO",
+			terms:  []string{"hello", "llo h"},
+			want:   Highlight{Field: "text", Snippet: "Hello HELLO", Ranges: [][2]int{{0, 11}}},
+			wantOk: true,
+		},
+		{
+			name:   "长文本截取片段",
+			text:   "0123456789012345678901234567890123456789keyword0123456789012345678901234567890123456789",
+			terms:  []string{"keyword"},
+			want:   Highlight{Field: "text", Snippet: "…01234567890123456789keyword0123456789012345678901234567890123456789", Ranges: [][2]int{{21, 28}}},
+			wantOk: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := highlightText("text", tt.text, tt.terms)
+			if ok != tt.wantOk {
+				t.Fatalf("highlightText() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("highlightText() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package search
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/3 11:20
+  @describe : 基于MongoDB文本索引的搜索
+*/
+
+const (
+	// mongoTextIndexName 消息集合的文本索引名称
+	mongoTextIndexName = "chat_message_text"
+
+	// mongoDefaultLimit 未设置返回数量时的默认值
+	mongoDefaultLimit = 20
+)
+
+// mongoTextFields 参与搜索的字段
+var mongoTextFields = []string{"body.text", "body.name", "body.title", "body.description"}
+
+// Mongo 基于MongoDB文本索引的搜索
+// 文本索引按空白跟标点分词,无法对中日韩文字分词,关键词包含这些文字时改用正则匹配
+type Mongo struct {
+	coll *mongo.Collection
+}
+
+// NewMongo 新建MongoDB搜索,并创建消息集合的文本索引
+func NewMongo(db *mongo.Database) (*Mongo, error) {
+	coll := db.Collection(database.CollectionMessage)
+
+	keys := bson.D{}
+	for _, field := range mongoTextFields {
+		keys = append(keys, bson.E{Key: field, Value: "text"})
+	}
+
+	// 不使用词干提取,中英文混排时结果更符合预期
+	_, err := coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: keys,
+		Options: options.Index().
+			SetName(mongoTextIndexName).
+			SetDefaultLanguage("none").
+			SetWeights(bson.D{{Key: "body.text", Value: 10}, {Key: "body.name", Value: 5}, {Key: "body.title", Value: 5}, {Key: "body.description", Value: 1}}),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return &Mongo{coll: coll}, nil
+}
+
+// SearchChatMessages 实现 Searcher 接口
+func (m *Mongo) SearchChatMessages(ctx context.Context, q *Query) ([]*Hit, error) {
+	if len(q.Rooms) == 0 {
+		return []*Hit{}, nil
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = mongoDefaultLimit
+	}
+
+	filter, terms := mongoSearchFilter(q)
+	findOpts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64(q.Offset)).
+		SetLimit(int64(limit))
+
+	rs, err := m.coll.Find(ctx, filter, findOpts)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	defer rs.Close(ctx)
+
+	hits := make([]*Hit, 0, limit)
+	for rs.Next(ctx) {
+		msg := new(database.ChatMessage)
+		if err = rs.Decode(msg); err != nil {
+			return nil, errors.Wrap(err)
+		}
+		hits = append(hits, &Hit{Message: msg, Highlights: Highlights(&msg.Body, terms)})
+	}
+	if err = rs.Err(); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return hits, nil
+}
+
+// mongoSearchFilter 根据搜索条件生成查询条件,同时返回用于高亮的关键词
+func mongoSearchFilter(q *Query) (bson.M, []string) {
+	filter := bson.M{
+		"status": bson.M{"$nin": bson.A{database.ChatMessageStatusRollback, database.ChatMessageStatusExpired}},
+	}
+
+	if q.UserID > 0 {
+		filter["deleted_by"] = bson.M{"$ne": q.UserID}
+	}
+
+	// 清空过的房间需要单独限制消息ID,其余房间合并成一个 $in 条件
+	var roomIDs bson.A
+	var rooms bson.A
+	for _, room := range q.Rooms {
+		threads := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(room.RoomID) + "_thread_"}
+		if room.ClearedMessageID > 0 {
+			rooms = append(rooms, bson.M{"room_id": room.RoomID, "message_id": bson.M{"$gt": room.ClearedMessageID}})
+			roomIDs = append(roomIDs, threads)
+			continue
+		}
+		roomIDs = append(roomIDs, room.RoomID, threads)
+	}
+	rooms = append(rooms, bson.M{"room_id": bson.M{"$in": roomIDs}})
+	filter["$or"] = rooms
+
+	if q.SenderID > 0 {
+		filter["sender_id"] = q.SenderID
+	}
+
+	if q.Type > 0 {
+		filter["type"] = q.Type
+	}
+
+	if q.StartTime > 0 || q.EndTime > 0 {
+		createdAt := bson.M{}
+		if q.StartTime > 0 {
+			createdAt["$gte"] = q.StartTime
+		}
+		if q.EndTime > 0 {
+			createdAt["$lt"] = q.EndTime
+		}
+		filter["created_at"] = createdAt
+	}
+
+	terms := Terms(q.Keyword)
+	if len(terms) == 0 {
+		return filter, nil
+	}
+
+	if !hasCJK(q.Keyword) {
+		// 每个关键词都用双引号包起来,表示全部需要命中,同时避免 - 被当成排除
+		phrases := make([]string, len(terms))
+		for i, term := range terms {
+			phrases[i] = `"` + term + `"`
+		}
+		filter["$text"] = bson.M{"$search": strings.Join(phrases, " ")}
+		return filter, terms
+	}
+
+	and := make(bson.A, 0, len(terms))
+	for _, term := range terms {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(term), Options: "i"}
+		fields := make(bson.A, len(mongoTextFields))
+		for i, field := range mongoTextFields {
+			fields[i] = bson.M{field: pattern}
+		}
+		and = append(and, bson.M{"$or": fields})
+	}
+	filter["$and"] = and
+	return filter, terms
+}
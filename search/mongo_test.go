@@ -0,0 +1,77 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/3 15:40
+  @describe :
+*/
+
+func TestMongoSearchFilter(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     *Query
+		wantKey   string
+		wantValue any
+		wantTerms []string
+	}{
+		{
+			name:    "清空过的房间单独限制消息ID",
+			query:   &Query{Rooms: []Room{{RoomID: "a", ClearedMessageID: 10}, {RoomID: "b"}}},
+			wantKey: "$or",
+			wantValue: bson.A{
+				bson.M{"room_id": "a", "message_id": bson.M{"$gt": int64(10)}},
+				bson.M{"room_id": bson.M{"$in": bson.A{
+					primitive.Regex{Pattern: "^a_thread_"},
+					"b",
+					primitive.Regex{Pattern: "^b_thread_"},
+				}}},
+			},
+		},
+		{
+			name:      "英文关键词使用文本索引",
+			query:     &Query{Keyword: "hello -world"},
+			wantKey:   "$text",
+			wantValue: bson.M{"$search": `"hello" "-world"`},
+			wantTerms: []string{"hello", "-world"},
+		},
+		{
+			name:      "时间范围",
+			query:     &Query{Keyword: "", StartTime: 1, EndTime: 2},
+			wantKey:   "created_at",
+			wantValue: bson.M{"$gte": int64(1), "$lt": int64(2)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, terms := mongoSearchFilter(tt.query)
+			if !reflect.DeepEqual(filter[tt.wantKey], tt.wantValue) {
+				t.Errorf("mongoSearchFilter()[%s] = %v, want %v", tt.wantKey, filter[tt.wantKey], tt.wantValue)
+			}
+			if !reflect.DeepEqual(terms, tt.wantTerms) {
+				t.Errorf("mongoSearchFilter() terms = %v, want %v", terms, tt.wantTerms)
+			}
+		})
+	}
+}
+
+func TestMongoSearchFilterCJK(t *testing.T) {
+	filter, terms := mongoSearchFilter(&Query{Keyword: "周末 聚餐"})
+	if _, ok := filter["$text"]; ok {
+		t.Errorf("mongoSearchFilter() should not use $text for CJK keyword")
+	}
+	and, ok := filter["$and"].(bson.A)
+	if !ok || len(and) != 2 {
+		t.Fatalf("mongoSearchFilter()[$and] = %v, want 2 conditions", filter["$and"])
+	}
+	if !reflect.DeepEqual(terms, []string{"周末", "聚餐"}) {
+		t.Errorf("mongoSearchFilter() terms = %v", terms)
+	}
+}
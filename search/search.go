@@ -0,0 +1,113 @@
+package search
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jerbe/jim/config"
+	"github.com/jerbe/jim/database"
+	"github.com/jerbe/jim/errors"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/3 10:05
+  @describe : 聊天记录搜索
+*/
+
+const (
+	// DriverMongo 使用MongoDB的文本索引
+	DriverMongo = "mongo"
+)
+
+// Room 可以搜索的房间
+type Room struct {
+	// RoomID 房间ID,该房间下的话题消息也会被搜索
+	RoomID string
+
+	// SessionType 会话类型
+	SessionType int
+
+	// ClearedMessageID 用户清空会话时的最后消息ID,只搜索该消息之后的消息,不影响话题消息
+	ClearedMessageID int64
+}
+
+// Query 搜索条件
+// Keyword,SenderID,Type 至少需要设置一个
+type Query struct {
+	// UserID 搜索的用户ID,该用户删除过的消息不会被搜索到
+	UserID int64
+
+	// Rooms 可以搜索的房间,调用方需要先做好权限过滤
+	Rooms []Room
+
+	// Keyword 关键词,多个关键词用空格分隔,需要全部命中
+	Keyword string
+
+	// SenderID 大于0时只搜索该用户发送的消息
+	SenderID int64
+
+	// Type 大于0时只搜索该类型的消息
+	Type int
+
+	// StartTime 大于0时只搜索该时间(毫秒)之后发送的消息,包含该时间
+	StartTime int64
+
+	// EndTime 大于0时只搜索该时间(毫秒)之前发送的消息,不包含该时间
+	EndTime int64
+
+	// Offset 跳过的数量
+	Offset int
+
+	// Limit 返回的数量
+	Limit int
+}
+
+// Highlight 命中关键词的片段
+type Highlight struct {
+	// Field 命中的字段,例如 text,name,title,description
+	Field string
+
+	// Snippet 包含关键词的片段,过长的内容会被截断
+	Snippet string
+
+	// Ranges 关键词在片段中的位置,按字符(rune)计算,每项为 [开始,结束)
+	Ranges [][2]int
+}
+
+// Hit 搜索结果
+type Hit struct {
+	// Message 命中的消息
+	Message *database.ChatMessage
+
+	// Highlights 命中关键词的片段,没有关键词时为空
+	Highlights []Highlight
+}
+
+// Searcher 聊天记录搜索接口
+type Searcher interface {
+	// SearchChatMessages 搜索聊天消息,按发送时间倒序返回
+	SearchChatMessages(ctx context.Context, q *Query) ([]*Hit, error)
+}
+
+// GlobSearcher 全局使用的搜索
+var GlobSearcher Searcher
+
+// Init 根据配置初始化全局搜索,需要在数据库初始化之后调用
+func Init(cfg config.Config) error {
+	s, err := New(cfg.Search)
+	if err != nil {
+		return err
+	}
+	GlobSearcher = s
+	return nil
+}
+
+// New 根据配置新建搜索
+func New(cfg config.Search) (Searcher, error) {
+	switch strings.ToLower(cfg.Driver) {
+	case "", DriverMongo:
+		return NewMongo(database.GlobDB.Mongo.Database(database.DatabaseMongodbIM))
+	}
+	return nil, errors.New("search.driver 只支持mongo")
+}
@@ -1,6 +1,22 @@
 SET NAMES utf8mb4;
 SET FOREIGN_KEY_CHECKS = 0;
 
+-- ----------------------------
+-- Table structure for group_announcement
+-- ----------------------------
+DROP TABLE IF EXISTS `group_announcement`;
+CREATE TABLE `group_announcement` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `group_id` int(10) unsigned NOT NULL DEFAULT 0 COMMENT '群ID编号',
+  `content` text NOT NULL COMMENT '公告内容,为空表示清空公告',
+  `author_id` int(10) unsigned NOT NULL DEFAULT 0 COMMENT '发布人ID',
+  `revision` int(10) unsigned NOT NULL DEFAULT 1 COMMENT '版本号,每次发布加1,最大的为当前公告',
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp() COMMENT '发布时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `revision_uidx` (`group_id`,`revision`) USING BTREE COMMENT '群ID加版本号唯一索引',
+  CONSTRAINT `fk_announcement_group_id` FOREIGN KEY (`group_id`) REFERENCES `groups` (`id`)
+) ENGINE=InnoDB AUTO_INCREMENT=0 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
 -- ----------------------------
 -- Table structure for group_member
 -- ----------------------------
@@ -22,6 +38,21 @@ CREATE TABLE `group_member` (
   CONSTRAINT `fk_user_id` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`)
 ) ENGINE=InnoDB AUTO_INCREMENT=0 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
 
+-- ----------------------------
+-- Table structure for group_pin
+-- ----------------------------
+DROP TABLE IF EXISTS `group_pin`;
+CREATE TABLE `group_pin` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `group_id` int(10) unsigned NOT NULL DEFAULT 0 COMMENT '群ID编号',
+  `message_id` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '被置顶的消息ID',
+  `pinner_id` int(10) unsigned NOT NULL DEFAULT 0 COMMENT '置顶人ID',
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp() COMMENT '置顶时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `message_uidx` (`group_id`,`message_id`) USING BTREE COMMENT '同一条消息只能置顶一次',
+  CONSTRAINT `fk_pin_group_id` FOREIGN KEY (`group_id`) REFERENCES `groups` (`id`)
+) ENGINE=InnoDB AUTO_INCREMENT=0 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
 -- ----------------------------
 -- Table structure for groups
 -- ----------------------------
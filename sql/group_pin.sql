@@ -0,0 +1,19 @@
+SET NAMES utf8mb4;
+SET FOREIGN_KEY_CHECKS = 0;
+
+-- ----------------------------
+-- Table structure for group_pin
+-- ----------------------------
+DROP TABLE IF EXISTS `group_pin`;
+CREATE TABLE `group_pin` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `group_id` int(10) unsigned NOT NULL DEFAULT 0 COMMENT '群ID编号',
+  `message_id` bigint(20) unsigned NOT NULL DEFAULT 0 COMMENT '被置顶的消息ID',
+  `pinner_id` int(10) unsigned NOT NULL DEFAULT 0 COMMENT '置顶人ID',
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp() COMMENT '置顶时间',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `message_uidx` (`group_id`,`message_id`) USING BTREE COMMENT '同一条消息只能置顶一次',
+  CONSTRAINT `fk_pin_group_id` FOREIGN KEY (`group_id`) REFERENCES `groups` (`id`)
+) ENGINE=InnoDB AUTO_INCREMENT=0 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+SET FOREIGN_KEY_CHECKS = 1;
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jerbe/jim/errors"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/29 15:40
+  @describe :
+*/
+
+// defaultLocalRoot 未配置根目录时使用的目录
+const defaultLocalRoot = "./data/storage"
+
+// Local 本地文件系统存储
+type Local struct {
+	root string
+}
+
+// NewLocal 新建本地文件系统存储,根目录不存在时自动创建
+func NewLocal(root string) (*Local, error) {
+	if root == "" {
+		root = defaultLocalRoot
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	if err = os.MkdirAll(root, 0o755); err != nil {
+		return nil, errors.Wrap(err)
+	}
+	return &Local{root: root}, nil
+}
+
+// path 获取对象对应的文件路径
+func (l *Local) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", errors.Wrap(errors.ParamsInvalid)
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// Put 保存对象,先写入临时文件再重命名,避免读到写了一半的文件
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	filename, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return errors.Wrap(err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(filename), ".upload-*")
+	if err != nil {
+		return errors.Wrap(err)
+	}
+	defer os.Remove(f.Name())
+
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err)
+	}
+
+	if size >= 0 && n != size {
+		return errors.New("写入的字节数跟对象大小不一致")
+	}
+	return errors.Wrap(os.Rename(f.Name(), filename))
+}
+
+// Get 读取对象
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	filename, err := l.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, localError(err)
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrap(err)
+	}
+	return f, &ObjectInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// Stat 获取对象信息
+func (l *Local) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	filename, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return nil, localError(err)
+	}
+	return &ObjectInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// Delete 删除对象
+func (l *Local) Delete(ctx context.Context, key string) error {
+	filename, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err)
+	}
+	return nil
+}
+
+// localError 将文件不存在的错误转换成 errors.NoRecords
+func localError(err error) error {
+	if os.IsNotExist(err) {
+		return errors.Wrap(errors.NoRecords)
+	}
+	return errors.Wrap(err)
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jerbe/jim/errors"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/29 17:45
+  @describe :
+*/
+
+func TestLocal(t *testing.T) {
+	ctx := context.Background()
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocal() error = %v", err)
+	}
+
+	key := "media/ab/abcdef"
+	if err = l.Put(ctx, key, strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	if err = l.Put(ctx, key, strings.NewReader("hello"), 6, "text/plain"); err == nil {
+		t.Errorf("Put() 大小不一致时应该返回错误")
+	}
+
+	r, info, err := l.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "hello" || info.Size != 5 {
+		t.Errorf("Get() = %s, size %d", data, info.Size)
+	}
+
+	if err = l.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	if _, err = l.Stat(ctx, key); !errors.IsNoRecord(err) {
+		t.Errorf("Stat() 删除后 error = %v, want NoRecords", err)
+	}
+
+	if err = l.Delete(ctx, key); err != nil {
+		t.Errorf("Delete() 不存在的对象 error = %v", err)
+	}
+}
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want bool
+	}{
+		{name: "正常", key: "media/ab/abc", want: true},
+		{name: "空", key: "", want: false},
+		{name: "绝对路径", key: "/etc/passwd", want: false},
+		{name: "上级目录", key: "media/../../etc/passwd", want: false},
+		{name: "空的段", key: "media//abc", want: false},
+		{name: "反斜杠", key: "media\\abc", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validKey(tt.key); got != tt.want {
+				t.Errorf("validKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
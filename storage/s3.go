@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jerbe/jim/config"
+	"github.com/jerbe/jim/errors"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/29 16:50
+  @describe :
+*/
+
+// S3 兼容S3协议的对象存储,使用SigV4签名,不依赖官方SDK
+type S3 struct {
+	endpoint  *url.URL
+	bucket    string
+	pathStyle bool
+	signer    *sigV4Signer
+	client    *http.Client
+}
+
+// NewS3 新建S3存储
+func NewS3(cfg config.S3Storage) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" || cfg.Region == "" {
+		return nil, errors.New("storage.s3 的endpoint/bucket/region不能为空")
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, errors.New("storage.s3.endpoint 无效")
+	}
+
+	return &S3{
+		endpoint:  endpoint,
+		bucket:    cfg.Bucket,
+		pathStyle: cfg.PathStyle,
+		signer: &sigV4Signer{
+			accessKeyID:     cfg.AccessKeyID,
+			secretAccessKey: cfg.SecretAccessKey,
+			region:          cfg.Region,
+			service:         "s3",
+		},
+		client: &http.Client{Timeout: time.Minute * 10},
+	}, nil
+}
+
+// objectURL 获取对象的地址
+func (s *S3) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		path += "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = path + "/" + key
+	u.RawPath = sigV4Escape(u.Path, false)
+	u.RawQuery = ""
+	return &u
+}
+
+// do 签名并发送请求
+func (s *S3) do(ctx context.Context, method, key string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	if !validKey(key) {
+		return nil, errors.Wrap(errors.ParamsInvalid)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key).String(), body)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	payloadHash := sigV4EmptyPayloadHash
+	if body != nil {
+		req.ContentLength = size
+		payloadHash = sigV4UnsignedPayload
+	}
+	s.signer.sign(req, payloadHash, time.Now())
+
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+
+	if rsp.StatusCode == http.StatusNotFound {
+		rsp.Body.Close()
+		return nil, errors.Wrap(errors.NoRecords)
+	}
+
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		defer rsp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(rsp.Body, 512))
+		return nil, errors.New(fmt.Sprintf("s3 %s %s 失败: %d %s", method, key, rsp.StatusCode, msg))
+	}
+	return rsp, nil
+}
+
+// Put 保存对象
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if size < 0 {
+		return errors.New("s3 上传对象必须指定大小")
+	}
+
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	rsp, err := s.do(ctx, http.MethodPut, key, r, size, header)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(rsp.Body.Close())
+}
+
+// Get 读取对象
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	rsp, err := s.do(ctx, http.MethodGet, key, nil, 0, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rsp.Body, s3ObjectInfo(key, rsp), nil
+}
+
+// Stat 获取对象信息
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	rsp, err := s.do(ctx, http.MethodHead, key, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body.Close()
+	return s3ObjectInfo(key, rsp), nil
+}
+
+// Delete 删除对象
+func (s *S3) Delete(ctx context.Context, key string) error {
+	rsp, err := s.do(ctx, http.MethodDelete, key, nil, 0, nil)
+	if err != nil {
+		if errors.IsNoRecord(err) {
+			return nil
+		}
+		return err
+	}
+	return errors.Wrap(rsp.Body.Close())
+}
+
+// PresignGet 生成带签名的下载地址
+func (s *S3) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if !validKey(key) {
+		return "", errors.Wrap(errors.ParamsInvalid)
+	}
+	return s.signer.presign(http.MethodGet, s.objectURL(key), expires, time.Now()), nil
+}
+
+// s3ObjectInfo 从响应头中解析对象信息
+func s3ObjectInfo(key string, rsp *http.Response) *ObjectInfo {
+	info := &ObjectInfo{Key: key, ContentType: rsp.Header.Get("Content-Type")}
+	info.Size, _ = strconv.ParseInt(rsp.Header.Get("Content-Length"), 10, 64)
+	info.ModTime, _ = http.ParseTime(rsp.Header.Get("Last-Modified"))
+	return info
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jerbe/jim/config"
+	"github.com/jerbe/jim/errors"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/29 15:20
+  @describe :
+*/
+
+const (
+	// DriverLocal 本地文件系统
+	DriverLocal = "local"
+
+	// DriverS3 兼容S3协议的对象存储
+	DriverS3 = "s3"
+)
+
+// ObjectInfo 存储对象信息
+type ObjectInfo struct {
+	// Key 对象的键
+	Key string
+
+	// Size 对象的字节数
+	Size int64
+
+	// ContentType 对象的类型,本地存储不记录该值
+	ContentType string
+
+	// ModTime 最后修改时间
+	ModTime time.Time
+}
+
+// Storage 文件存储接口
+// 对象不存在时返回的错误可以用 errors.IsNoRecord 判断
+type Storage interface {
+	// Put 保存对象,已经存在时覆盖
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+
+	// Get 读取对象,使用完后需要关闭返回的 io.ReadCloser
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+
+	// Stat 获取对象信息
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+
+	// Delete 删除对象,对象不存在时不返回错误
+	Delete(ctx context.Context, key string) error
+}
+
+// Presigner 可以直接生成带签名的下载地址的存储
+// 实现了该接口的存储,下载时直接跳转到存储服务,不再经过本服务中转
+type Presigner interface {
+	// PresignGet 生成有效期为 expires 的下载地址
+	PresignGet(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+// GlobStorage 全局使用的存储
+var GlobStorage Storage
+
+// Init 根据配置初始化全局存储
+func Init(cfg config.Config) error {
+	s, err := New(cfg.Storage)
+	if err != nil {
+		return err
+	}
+	GlobStorage = s
+	return nil
+}
+
+// New 根据配置新建存储
+func New(cfg config.Storage) (Storage, error) {
+	switch strings.ToLower(cfg.Driver) {
+	case "", DriverLocal:
+		return NewLocal(cfg.Local.Root)
+	case DriverS3:
+		return NewS3(cfg.S3)
+	}
+	return nil, errors.New("storage.driver 只支持local/s3")
+}
+
+// validKey 检测对象的键是否合法,不允许出现上级目录跟绝对路径
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
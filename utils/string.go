@@ -2,6 +2,9 @@ package utils
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+
 	goutils "github.com/jerbe/go-utils"
 
 	"github.com/google/uuid"
@@ -32,6 +35,27 @@ func FormatWorldRoomID(worldID int64) string {
 	return fmt.Sprintf("world_%04x", worldID)
 }
 
+// FormatThreadRoomID 格式化话题聊天室房间号
+// 话题使用独立的房间号,从而拥有独立的消息ID序列
+func FormatThreadRoomID(roomID string, rootMessageID int64) string {
+	return fmt.Sprintf("%s_thread_%x", roomID, rootMessageID)
+}
+
+// ParseThreadRoomID 解析话题聊天室房间号,返回所属的房间号跟根消息ID
+// 不是话题房间号时 ok 为 false
+func ParseThreadRoomID(threadRoomID string) (roomID string, rootMessageID int64, ok bool) {
+	idx := strings.LastIndex(threadRoomID, "_thread_")
+	if idx <= 0 {
+		return "", 0, false
+	}
+
+	rootMessageID, err := strconv.ParseInt(threadRoomID[idx+len("_thread_"):], 16, 64)
+	if err != nil || rootMessageID <= 0 {
+		return "", 0, false
+	}
+	return threadRoomID[:idx], rootMessageID, true
+}
+
 // StringCut 裁剪字符串
 func StringCut(data string, limit int) string {
 	return goutils.StringTrim(data, 0, limit)
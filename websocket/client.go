@@ -0,0 +1,375 @@
+package websocket
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jerbe/jim/errors"
+	"github.com/jerbe/jim/log"
+
+	"github.com/gorilla/websocket"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/20 10:12
+  @describe :
+*/
+
+// OverflowPolicy 发送队列已满时的处理策略
+type OverflowPolicy int
+
+const (
+	// OverflowPolicyDropOldest 丢弃队列中最旧的一条消息,再把新消息放入队列
+	OverflowPolicyDropOldest OverflowPolicy = iota
+
+	// OverflowPolicyDisconnect 直接断开该连接,让客户端重连后自行补齐消息
+	OverflowPolicyDisconnect
+
+	// OverflowPolicyBlock 阻塞等待队列有空位,超时后丢弃新消息
+	OverflowPolicyBlock
+)
+
+// ParseOverflowPolicy 将配置中的字符串解析成处理策略,无法识别的统一使用 OverflowPolicyDropOldest
+func ParseOverflowPolicy(val string) OverflowPolicy {
+	switch val {
+	case "disconnect":
+		return OverflowPolicyDisconnect
+	case "block":
+		return OverflowPolicyBlock
+	default:
+		return OverflowPolicyDropOldest
+	}
+}
+
+var (
+	// ErrClientClosed 客户端已关闭
+	ErrClientClosed = errors.New("websocket client closed")
+
+	// ErrSendQueueFull 发送队列已满
+	ErrSendQueueFull = errors.New("websocket send queue full")
+)
+
+// ClientOptions 客户端配置
+type ClientOptions struct {
+	// QueueSize 发送队列长度
+	QueueSize int
+
+	// OverflowPolicy 发送队列已满时的处理策略
+	OverflowPolicy OverflowPolicy
+
+	// BlockTimeout OverflowPolicyBlock 策略下的最长等待时间
+	BlockTimeout time.Duration
+
+	// WriteTimeout 单条消息写入连接的超时时间
+	WriteTimeout time.Duration
+
+	// PingInterval 服务端发送ping控制帧的间隔,小于等于0时不发送
+	PingInterval time.Duration
+
+	// PongWait 读取超时时间,在该时间内没有收到任何数据(包括pong控制帧)则认为连接已失效,小于等于0时不限制
+	// 必须大于 PingInterval
+	PongWait time.Duration
+
+	// MaxMessageSize 客户端单条消息的最大字节数,小于等于0时不限制
+	MaxMessageSize int64
+
+	// IdleTimeout 空闲超时时间,在该时间内没有收到任何业务消息(包括应用层ping)则断开连接,小于等于0时不限制
+	IdleTimeout time.Duration
+}
+
+// NewClientOptions 新建一个默认的客户端配置
+func NewClientOptions() *ClientOptions {
+	return &ClientOptions{
+		QueueSize:      256,
+		OverflowPolicy: OverflowPolicyDropOldest,
+		BlockTimeout:   time.Millisecond * 100,
+		WriteTimeout:   time.Second * 10,
+		PingInterval:   time.Second * 30,
+		PongWait:       time.Second * 60,
+		MaxMessageSize: 64 * 1024,
+	}
+}
+
+// Client 对 websocket 连接的封装
+// 因为 gorilla/websocket 不允许并发写,所以每个连接只有一个写协程,
+// 其他协程通过 Send 把消息放进有界的发送队列,由写协程统一写出
+type Client struct {
+	conn *websocket.Conn
+	opts *ClientOptions
+
+	// send 发送队列
+	send chan []byte
+
+	// done 关闭信号
+	done chan struct{}
+
+	// enqueueMux 保证 OverflowPolicyDropOldest 策略下出队跟入队的原子性
+	enqueueMux sync.Mutex
+
+	// lastActive 最后一次收到业务消息的时间(UnixNano)
+	lastActive int64
+
+	// reaped 是否已经因为心跳超时或空闲超时被回收,避免重复计数
+	reaped int32
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewClient 新建一个客户端,并启动写协程
+func NewClient(conn *websocket.Conn, opts *ClientOptions) *Client {
+	if opts == nil {
+		opts = NewClientOptions()
+	}
+
+	queueSize := opts.QueueSize
+	if queueSize <= 0 {
+		queueSize = NewClientOptions().QueueSize
+	}
+
+	c := &Client{
+		conn: conn,
+		opts: opts,
+		send: make(chan []byte, queueSize),
+		done: make(chan struct{}),
+	}
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+
+	if opts.MaxMessageSize > 0 {
+		conn.SetReadLimit(opts.MaxMessageSize)
+	}
+	c.extendReadDeadline()
+
+	// 收到pong控制帧只说明连接还活着,只延长读取超时,不刷新空闲时间
+	conn.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		return nil
+	})
+
+	go c.writePump()
+	return c
+}
+
+// extendReadDeadline 延长读取超时时间,只允许在读协程中调用
+func (c *Client) extendReadDeadline() {
+	if c.opts.PongWait > 0 {
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.opts.PongWait))
+	}
+}
+
+// ReadMessage 读取一条客户端消息,同一连接只允许一个读协程调用
+// 收到消息会刷新读取超时跟空闲时间,读取超时导致的失败会被记录为回收
+func (c *Client) ReadMessage() (messageType int, p []byte, err error) {
+	messageType, p, err = c.conn.ReadMessage()
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			c.reap("读取超时")
+		}
+		return
+	}
+
+	c.extendReadDeadline()
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	return
+}
+
+// IdleDuration 距离最后一次收到业务消息的时间
+func (c *Client) IdleDuration() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+}
+
+// reap 回收已失效的连接
+func (c *Client) reap(reason string) {
+	if !atomic.CompareAndSwapInt32(&c.reaped, 0, 1) {
+		return
+	}
+	metricReapedClients.Add(1)
+	log.Info().Str("function", "Client.reap").Str("remote_addr", c.conn.RemoteAddr().String()).Str("reason", reason).Msg("回收失效的websocket连接")
+	_ = c.Close()
+}
+
+// tickInterval 写协程定时任务的间隔,用于发送ping跟检查空闲超时
+func (c *Client) tickInterval() time.Duration {
+	interval := c.opts.PingInterval
+	if c.opts.IdleTimeout > 0 && (interval <= 0 || c.opts.IdleTimeout/2 < interval) {
+		interval = c.opts.IdleTimeout / 2
+	}
+	return interval
+}
+
+// Conn 获取原始的 websocket 连接,读取请使用 Client.ReadMessage
+func (c *Client) Conn() *websocket.Conn {
+	return c.conn
+}
+
+// Done 客户端关闭时,该通道会被关闭
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// QueueLen 当前发送队列中待发送的消息数量
+func (c *Client) QueueLen() int {
+	return len(c.send)
+}
+
+// trySend 尝试不等待地把消息放入发送队列,队列已满时返回 false
+func (c *Client) trySend(msg []byte) (bool, error) {
+	select {
+	case <-c.done:
+		return false, ErrClientClosed
+	default:
+	}
+
+	select {
+	case c.send <- msg:
+		return true, c.enqueued()
+	default:
+		return false, nil
+	}
+}
+
+// enqueued 消息放入发送队列后调用,增加队列深度
+// 放入时连接可能刚好关闭,写协程已经清空过队列,这时由放入方再清空一次,避免关闭后的消息一直计入队列深度
+func (c *Client) enqueued() error {
+	metricQueueDepth.Add(1)
+	select {
+	case <-c.done:
+		c.drainQueue()
+		return ErrClientClosed
+	default:
+		return nil
+	}
+}
+
+// drainQueue 清空发送队列中剩余的消息,每条消息只会被取出一次,不会重复扣减队列深度
+func (c *Client) drainQueue() {
+	for {
+		select {
+		case <-c.send:
+			metricQueueDepth.Add(-1)
+		default:
+			return
+		}
+	}
+}
+
+// Send 把消息放入发送队列,队列满时按照 ClientOptions.OverflowPolicy 处理
+func (c *Client) Send(msg []byte) error {
+	// 大部分情况下队列都不会满,直接放入即可
+	if ok, err := c.trySend(msg); ok || err != nil {
+		return err
+	}
+	return c.sendOverflow(msg)
+}
+
+// sendOverflow 发送队列已满时按照 ClientOptions.OverflowPolicy 处理
+func (c *Client) sendOverflow(msg []byte) error {
+	switch c.opts.OverflowPolicy {
+	case OverflowPolicyDisconnect:
+		metricDisconnectedClients.Add(1)
+		log.Warn().Str("function", "Client.Send").Str("remote_addr", c.conn.RemoteAddr().String()).Msg("发送队列已满,断开连接")
+		_ = c.Close()
+		return ErrSendQueueFull
+
+	case OverflowPolicyBlock:
+		timer := time.NewTimer(c.opts.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case c.send <- msg:
+			return c.enqueued()
+		case <-c.done:
+			return ErrClientClosed
+		case <-timer.C:
+			metricDroppedMessages.Add(1)
+			return ErrSendQueueFull
+		}
+
+	default:
+		c.enqueueMux.Lock()
+		defer c.enqueueMux.Unlock()
+		for {
+			select {
+			case c.send <- msg:
+				return c.enqueued()
+			case <-c.done:
+				return ErrClientClosed
+			default:
+			}
+
+			// 丢弃最旧的一条消息后再尝试放入
+			select {
+			case <-c.send:
+				metricQueueDepth.Add(-1)
+				metricDroppedMessages.Add(1)
+			default:
+			}
+		}
+	}
+}
+
+// writePump 写协程,每个连接只有一个,保证不会并发写
+func (c *Client) writePump() {
+	defer func() {
+		if obj := recover(); obj != nil {
+			log.Error().Str("function", "Client.writePump").Any("panic", obj).Str("remote_addr", c.conn.RemoteAddr().String()).Msg("推送消息到客户端发生panic")
+		}
+		_ = c.Close()
+	}()
+
+	var tick <-chan time.Time
+	if interval := c.tickInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-tick:
+			if c.opts.IdleTimeout > 0 && c.IdleDuration() > c.opts.IdleTimeout {
+				c.reap("空闲超时")
+				return
+			}
+
+			if c.opts.PingInterval <= 0 {
+				continue
+			}
+			if c.opts.WriteTimeout > 0 {
+				_ = c.conn.SetWriteDeadline(time.Now().Add(c.opts.WriteTimeout))
+			}
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				metricWriteErrors.Add(1)
+				log.Error().Err(err).Str("function", "Client.writePump").Str("remote_addr", c.conn.RemoteAddr().String()).Msg("发送ping到客户端发生错误")
+				return
+			}
+		case msg := <-c.send:
+			metricQueueDepth.Add(-1)
+			if c.opts.WriteTimeout > 0 {
+				_ = c.conn.SetWriteDeadline(time.Now().Add(c.opts.WriteTimeout))
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				metricWriteErrors.Add(1)
+				log.Error().Err(err).Str("function", "Client.writePump").Str("remote_addr", c.conn.RemoteAddr().String()).Msg("推送消息到客户端发生错误")
+				return
+			}
+		}
+	}
+}
+
+// Close 关闭客户端以及底层连接,可以重复调用
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.closeErr = c.conn.Close()
+
+		// 清空剩余的消息,保证队列深度指标准确
+		c.drainQueue()
+	})
+	return c.closeErr
+}
@@ -0,0 +1,206 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/20 14:31
+  @describe :
+*/
+
+// newTestConn 新建一个测试用的websocket连接
+func newTestConn(t *testing.T) *websocket.Conn {
+	upgrader := websocket.Upgrader{}
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(svr.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(svr.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// newTestClient 新建一个没有启动写协程的客户端,方便观察发送队列
+func newTestClient(t *testing.T, opts *ClientOptions) *Client {
+	return &Client{
+		conn: newTestConn(t),
+		opts: opts,
+		send: make(chan []byte, opts.QueueSize),
+		done: make(chan struct{}),
+	}
+}
+
+func TestClientSend(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    OverflowPolicy
+		wantErr   error
+		wantQueue []string
+		wantClose bool
+	}{
+		{
+			name:      "丢弃最旧的消息",
+			policy:    OverflowPolicyDropOldest,
+			wantErr:   nil,
+			wantQueue: []string{"2", "3"},
+		},
+		{
+			name:      "断开连接",
+			policy:    OverflowPolicyDisconnect,
+			wantErr:   ErrSendQueueFull,
+			wantQueue: nil,
+			wantClose: true,
+		},
+		{
+			name:      "阻塞超时",
+			policy:    OverflowPolicyBlock,
+			wantErr:   ErrSendQueueFull,
+			wantQueue: []string{"1", "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, &ClientOptions{QueueSize: 2, OverflowPolicy: tt.policy, BlockTimeout: time.Millisecond})
+			defer c.Close()
+
+			for _, msg := range []string{"1", "2"} {
+				if err := c.Send([]byte(msg)); err != nil {
+					t.Fatalf("Send() error = %v", err)
+				}
+			}
+
+			if err := c.Send([]byte("3")); err != tt.wantErr {
+				t.Errorf("Send() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var got []string
+			for len(c.send) > 0 {
+				got = append(got, string(<-c.send))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.wantQueue, ",") {
+				t.Errorf("queue = %v, want %v", got, tt.wantQueue)
+			}
+
+			select {
+			case <-c.Done():
+				if !tt.wantClose {
+					t.Errorf("client closed, want open")
+				}
+			default:
+				if tt.wantClose {
+					t.Errorf("client open, want closed")
+				}
+			}
+		})
+	}
+}
+
+func TestClientSendAfterClose(t *testing.T) {
+	c := NewClient(newTestConn(t), nil)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send([]byte("1")); err != ErrClientClosed {
+		t.Errorf("Send() error = %v, wantErr %v", err, ErrClientClosed)
+	}
+}
+
+func TestClientCloseQueueDepth(t *testing.T) {
+	c := newTestClient(t, &ClientOptions{QueueSize: 2})
+	before := metricQueueDepth.Value()
+	for _, msg := range []string{"1", "2"} {
+		if err := c.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+	if got := metricQueueDepth.Value() - before; got != 2 {
+		t.Errorf("queue depth after Send() = %v, want 2", got)
+	}
+
+	// 关闭时队列中剩余的消息不会再发送,需要从队列深度中减去
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := metricQueueDepth.Value() - before; got != 0 {
+		t.Errorf("queue depth after Close() = %v, want 0", got)
+	}
+	if c.QueueLen() != 0 {
+		t.Errorf("QueueLen() after Close() = %v, want 0", c.QueueLen())
+	}
+}
+
+func TestClientReap(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *ClientOptions
+	}{
+		{
+			name: "读取超时",
+			opts: &ClientOptions{QueueSize: 1, PongWait: time.Millisecond * 50},
+		},
+		{
+			name: "空闲超时",
+			opts: &ClientOptions{QueueSize: 1, IdleTimeout: time.Millisecond * 50},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := metricReapedClients.Value()
+
+			c := NewClient(newTestConn(t), tt.opts)
+			defer c.Close()
+
+			if _, _, err := c.ReadMessage(); err == nil {
+				t.Fatalf("ReadMessage() error = nil, want error")
+			}
+
+			select {
+			case <-c.Done():
+			case <-time.After(time.Second):
+				t.Fatalf("client open, want closed")
+			}
+
+			if got := metricReapedClients.Value() - before; got != 1 {
+				t.Errorf("reaped_clients = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestClientPing(t *testing.T) {
+	// 对端正常读取时会自动回复pong,连接不应该因为读取超时被回收
+	c := NewClient(newTestConn(t), &ClientOptions{QueueSize: 1, PingInterval: time.Millisecond * 20, PongWait: time.Millisecond * 100})
+	defer c.Close()
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadMessage()
+		readErr <- err
+	}()
+
+	select {
+	case err := <-readErr:
+		t.Fatalf("ReadMessage() error = %v, want still alive", err)
+	case <-time.After(time.Millisecond * 300):
+	}
+}
@@ -0,0 +1,58 @@
+package websocket
+
+import (
+	"github.com/jerbe/jim/config"
+	"github.com/jerbe/jim/errors"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/20 11:05
+  @describe :
+*/
+
+// Init 根据配置初始化默认管理器
+func Init(cfg config.Config) error {
+	wsCfg := cfg.Websocket
+	opts := NewClientOptions()
+
+	if wsCfg.SendQueueSize > 0 {
+		opts.QueueSize = wsCfg.SendQueueSize
+	}
+
+	if wsCfg.OverflowPolicy != "" {
+		opts.OverflowPolicy = ParseOverflowPolicy(wsCfg.OverflowPolicy)
+	}
+
+	if wsCfg.BlockTimeout > 0 {
+		opts.BlockTimeout = wsCfg.BlockTimeout
+	}
+
+	if wsCfg.WriteTimeout > 0 {
+		opts.WriteTimeout = wsCfg.WriteTimeout
+	}
+
+	if wsCfg.PingInterval > 0 {
+		opts.PingInterval = wsCfg.PingInterval
+	}
+
+	if wsCfg.PongWait > 0 {
+		opts.PongWait = wsCfg.PongWait
+	}
+
+	// pong等待时间必须大于ping间隔,否则正常的连接也会被回收
+	if opts.PingInterval > 0 && opts.PongWait > 0 && opts.PongWait <= opts.PingInterval {
+		return errors.New("websocket.pong_wait must be greater than websocket.ping_interval")
+	}
+
+	if wsCfg.MaxMessageSize > 0 {
+		opts.MaxMessageSize = wsCfg.MaxMessageSize
+	}
+
+	if wsCfg.IdleTimeout > 0 {
+		opts.IdleTimeout = wsCfg.IdleTimeout
+	}
+
+	DefaultManager.SetClientOptions(opts)
+	return nil
+}
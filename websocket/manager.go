@@ -7,6 +7,7 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/jerbe/jim/errors"
 	"github.com/jerbe/jim/log"
 
 	"github.com/gorilla/websocket"
@@ -22,7 +23,7 @@ type Key interface {
 	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~string
 }
 
-type mCA map[*websocket.Conn]any
+type mCA map[*Client]any
 
 type mSmCA map[any]mCA
 
@@ -32,6 +33,9 @@ type Manager struct {
 	rwMux   *sync.RWMutex
 	keyCnt  uint64
 	connCnt uint64
+
+	// clientOpts 新建客户端时使用的配置
+	clientOpts *ClientOptions
 }
 
 // shardCount 分片数量
@@ -101,109 +105,115 @@ func simpleLoadBalancingIndex(key any) int {
 	return id % shardCount
 }
 
-// AddConnect 添加一条网络连接
-func (wm *Manager) AddConnect(key any, conn *websocket.Conn) {
+// AddConnect 添加一条网络连接,返回封装后的客户端
+// 后续所有往该连接写入的数据都必须通过 Client.Send 进行
+func (wm *Manager) AddConnect(key any, conn *websocket.Conn) *Client {
 	wm.rwMux.Lock()
 	defer wm.rwMux.Unlock()
 
+	client := NewClient(conn, wm.clientOpts)
+
 	i := simpleLoadBalancingIndex(key)
 	s, ok := wm.sm[i][key]
 	if ok {
-		s[conn] = struct{}{}
+		s[client] = struct{}{}
 	} else {
 		atomic.AddUint64(&wm.keyCnt, 1)
 		s = mCA{
-			conn: struct{}{},
+			client: struct{}{},
 		}
 		wm.sm[i][key] = s
 	}
 
 	atomic.AddUint64(&wm.connCnt, 1)
+	return client
 }
 
 // RemoveConnect 删除一条网络连接
-func (wm *Manager) RemoveConnect(key string, conn *websocket.Conn) {
+func (wm *Manager) RemoveConnect(key any, client *Client) {
 	wm.rwMux.Lock()
 	defer wm.rwMux.Unlock()
 	i := simpleLoadBalancingIndex(key)
 	s, ok := wm.sm[i][key]
-	if ok {
-		atomic.StoreUint64(&wm.connCnt, atomic.LoadUint64(&wm.connCnt)-1)
-		delete(s, conn)
-		if len(s) == 0 {
-			atomic.StoreUint64(&wm.keyCnt, atomic.LoadUint64(&wm.keyCnt)-1)
-			delete(wm.sm[i], key)
-		}
+	if !ok {
+		return
+	}
+
+	if _, ok = s[client]; !ok {
+		return
+	}
+
+	atomic.AddUint64(&wm.connCnt, ^uint64(0))
+	delete(s, client)
+	if len(s) == 0 {
+		atomic.AddUint64(&wm.keyCnt, ^uint64(0))
+		delete(wm.sm[i], key)
 	}
 }
 
-// PushMessage 推送消息到网络连接上
-func (wm *Manager) PushMessage(msg []byte, keys ...any) {
+// clients 获取需要推送的客户端列表,未设置keys时获取所有客户端
+func (wm *Manager) clients(keys ...any) []*Client {
 	wm.rwMux.RLock()
 	defer wm.rwMux.RUnlock()
 
-	writeMessage := func(conn *websocket.Conn) {
-		defer func() {
-			if obj := recover(); obj != nil {
-				log.Error().Str("function", "Manager.PushMessage.writeMessage").Any("panic", obj).Str("remote_addr", conn.RemoteAddr().String()).Msg("推送消息到客户端发生panic")
+	var clients []*Client
+	if len(keys) > 0 {
+		for j := 0; j < len(keys); j++ {
+			key := keys[j]
+			idx := simpleLoadBalancingIndex(key)
+			for client := range wm.sm[idx][key] {
+				clients = append(clients, client)
 			}
-		}()
-
-		err := conn.WriteMessage(websocket.TextMessage, msg)
-		if err != nil {
-			log.Error().Err(err).Str("function", "Manager.PushMessage.writeMessage").Str("remote_addr", conn.RemoteAddr().String()).Msg("推送消息到客户端发生错误")
-			return
 		}
+		return clients
 	}
 
-	// 设置了IDS
-	if len(keys) > 0 {
-		const step = 200
-		steps := len(keys) / step
-		mod := len(keys) % step
-		if mod > 0 {
-			steps++
-		}
-
-		writeFun := func(ks []any) {
-			for j := 0; j < len(ks); j++ {
-				key := ks[j]
-				idx := simpleLoadBalancingIndex(key)
-				mca, ok := wm.sm[idx][key]
-				if ok {
-					for conn, _ := range mca {
-						go writeMessage(conn)
-					}
-				}
+	clients = make([]*Client, 0, atomic.LoadUint64(&wm.connCnt))
+	for _, msmca := range wm.sm {
+		for _, mca := range msmca {
+			for client := range mca {
+				clients = append(clients, client)
 			}
 		}
+	}
+	return clients
+}
 
-		// 预先消耗余数
-		writeFun(keys[0:mod])
+// PushMessage 推送消息到网络连接上
+// 消息只会放入各个客户端的发送队列,由各自的写协程写出,不会阻塞在慢连接上
+// OverflowPolicyBlock 策略下队列已满的客户端并发等待,一次推送最多等待一个 BlockTimeout
+func (wm *Manager) PushMessage(msg []byte, keys ...any) {
+	// 先复制出客户端列表再释放锁,防止 OverflowPolicyBlock 策略下长时间占用锁
+	clients := wm.clients(keys...)
+
+	var wg sync.WaitGroup
+	for i := 0; i < len(clients); i++ {
+		client := clients[i]
+		ok, err := client.trySend(msg)
+		if ok || err != nil {
+			logPushMessageError(client, err)
+			continue
+		}
 
-		// 这步很重要
-		steps--
-		// 再消耗剩余的倍数
-		for i := 0; i < steps; i++ {
-			start := i + mod
-			end := (i+1)*steps + mod
-			writeFun(keys[start:end])
+		if client.opts.OverflowPolicy != OverflowPolicyBlock {
+			logPushMessageError(client, client.sendOverflow(msg))
+			continue
 		}
 
-		return
+		// 等待全部放入后再返回,保证同一个客户端的消息顺序跟推送顺序一致
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logPushMessageError(client, client.sendOverflow(msg))
+		}()
 	}
+	wg.Wait()
+}
 
-	// 未设置ids
-	if l := len(keys); l == 0 {
-		for _, msmca := range wm.sm {
-			go func(msmca mSmCA) {
-				for _, mca := range msmca {
-					for conn, _ := range mca {
-						go writeMessage(conn)
-					}
-				}
-			}(msmca)
-		}
+// logPushMessageError 记录放入客户端发送队列失败的原因,连接已经关闭的不用记录
+func logPushMessageError(client *Client, err error) {
+	if err != nil && !errors.Is(err, ErrClientClosed) {
+		log.Warn().Err(err).Str("function", "Manager.PushMessage").Str("remote_addr", client.Conn().RemoteAddr().String()).Msg("推送消息到客户端发送队列失败")
 	}
 }
 
@@ -232,12 +242,29 @@ func (wm *Manager) PushData(data any, keys ...any) {
 
 // KeysCount 获取所有键数量
 func (wm *Manager) KeysCount() uint64 {
-	return wm.keyCnt
+	return atomic.LoadUint64(&wm.keyCnt)
 }
 
 // ConnectCount 所以网络连接数量
 func (wm *Manager) ConnectCount() uint64 {
-	return wm.connCnt
+	return atomic.LoadUint64(&wm.connCnt)
+}
+
+// QueueDepth 所有客户端发送队列中待发送的消息总数
+func (wm *Manager) QueueDepth() int {
+	clients := wm.clients()
+	var depth int
+	for i := 0; i < len(clients); i++ {
+		depth += clients[i].QueueLen()
+	}
+	return depth
+}
+
+// SetClientOptions 设置新建客户端时使用的配置,只对之后新建立的连接生效
+func (wm *Manager) SetClientOptions(opts *ClientOptions) {
+	wm.rwMux.Lock()
+	defer wm.rwMux.Unlock()
+	wm.clientOpts = opts
 }
 
 func NewManager() *Manager {
@@ -249,7 +276,8 @@ func NewManager() *Manager {
 			}
 			return slice
 		}(),
-		rwMux: new(sync.RWMutex),
+		rwMux:      new(sync.RWMutex),
+		clientOpts: NewClientOptions(),
 	}
 }
 
@@ -0,0 +1,40 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/10/9 11:05
+  @describe :
+*/
+
+func TestManagerPushMessageBlock(t *testing.T) {
+	opts := &ClientOptions{QueueSize: 1, OverflowPolicy: OverflowPolicyBlock, BlockTimeout: 200 * time.Millisecond}
+	wm := NewManager()
+
+	// 两个队列已满的慢连接跟一个正常连接
+	slow1, slow2, fast := newTestClient(t, opts), newTestClient(t, opts), newTestClient(t, opts)
+	slow1.send <- []byte("0")
+	slow2.send <- []byte("0")
+	wm.sm[simpleLoadBalancingIndex(1)][1] = mCA{slow1: struct{}{}, slow2: struct{}{}, fast: struct{}{}}
+
+	start := time.Now()
+	wm.PushMessage([]byte("1"), 1)
+	elapsed := time.Since(start)
+
+	// 慢连接并发等待,总耗时不会是 BlockTimeout 的倍数
+	if elapsed >= 2*opts.BlockTimeout {
+		t.Errorf("PushMessage() elapsed = %v, want < %v", elapsed, 2*opts.BlockTimeout)
+	}
+	if got := string(<-fast.send); got != "1" {
+		t.Errorf("PushMessage() fast client got = %v, want 1", got)
+	}
+	for _, c := range []*Client{slow1, slow2} {
+		if c.QueueLen() != 1 {
+			t.Errorf("PushMessage() slow client queue = %v, want 1", c.QueueLen())
+		}
+	}
+}
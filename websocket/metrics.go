@@ -0,0 +1,41 @@
+package websocket
+
+import (
+	"expvar"
+)
+
+/**
+  @author : Jerbe - The porter from Earth
+  @time : 2023/9/20 10:48
+  @describe :
+*/
+
+// 指标通过 expvar 暴露,在 pprof 服务的 `/debug/vars` 下可以查看
+var (
+	metrics = expvar.NewMap("websocket")
+
+	// metricQueueDepth 所有连接发送队列中待发送的消息总数
+	metricQueueDepth = new(expvar.Int)
+
+	// metricDroppedMessages 因发送队列已满而被丢弃的消息数量
+	metricDroppedMessages = new(expvar.Int)
+
+	// metricDisconnectedClients 因发送队列已满而被断开的连接数量
+	metricDisconnectedClients = new(expvar.Int)
+
+	// metricWriteErrors 写入连接失败的次数
+	metricWriteErrors = new(expvar.Int)
+
+	// metricReapedClients 因心跳超时或空闲超时被回收的连接数量
+	metricReapedClients = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("queue_depth", metricQueueDepth)
+	metrics.Set("dropped_messages", metricDroppedMessages)
+	metrics.Set("disconnected_clients", metricDisconnectedClients)
+	metrics.Set("write_errors", metricWriteErrors)
+	metrics.Set("reaped_clients", metricReapedClients)
+	metrics.Set("connect_count", expvar.Func(func() any { return DefaultManager.ConnectCount() }))
+	metrics.Set("keys_count", expvar.Func(func() any { return DefaultManager.KeysCount() }))
+}